@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/deepfence/PacketStreamer/pkg/plugins/archive"
+)
+
+var (
+	findRoot   string
+	findPlugin string
+	findSensor string
+	findFrom   string
+	findTo     string
+	findJSON   bool
+)
+
+var archiveFindCmd = &cobra.Command{
+	Use:   "archive-find [flags]",
+	Short: "List the files of the archive plugin by time range",
+	Long: `List the files written by the archive plugin with packets between --from
+and --to, oldest first, using their side-car indexes. The root of the archive
+is taken from an archive plugin of the --config file, unless --root is set.
+Timestamps are in RFC 3339, and either end of the range can be left open.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := findRoot
+		if root == "" {
+			if cfg == nil {
+				log.Fatalf("No archive configured, use --root or an archive plugin of --config")
+			}
+			for _, plugin := range cfg.Output.Plugins {
+				if plugin.Type != "archive" || (findPlugin != "" && plugin.Name != findPlugin) {
+					continue
+				}
+				var archiveConfig archive.Config
+				if err := plugin.Decode(&archiveConfig); err != nil {
+					log.Fatalf("Invalid archive plugin configuration: %v", err)
+				}
+				root = archiveConfig.Root
+				break
+			}
+			if root == "" {
+				log.Fatalf("No archive plugin in the configuration, use --root")
+			}
+		}
+
+		from, err := parseFindTime(findFrom)
+		if err != nil {
+			log.Fatalf("Invalid --from: %v", err)
+		}
+		to, err := parseFindTime(findTo)
+		if err != nil {
+			log.Fatalf("Invalid --to: %v", err)
+		}
+
+		entries, err := archive.Find(root, findSensor, from, to)
+		if err != nil {
+			log.Fatalf("Failed to search the archive: %v", err)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			if !findJSON {
+				fmt.Println(entry.Path)
+				continue
+			}
+			line := struct {
+				Path string `json:"path"`
+				archive.Entry
+			}{entry.Path, entry}
+			if err := encoder.Encode(line); err != nil {
+				log.Fatalf("Failed to write the entries: %v", err)
+			}
+		}
+	},
+}
+
+func parseFindTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func init() {
+	archiveFindCmd.Flags().StringVar(&findRoot, "root", "", "root directory of the archive, overriding the configuration")
+	archiveFindCmd.Flags().StringVar(&findPlugin, "plugin", "", "name of the archive plugin of the configuration to take the root from")
+	archiveFindCmd.Flags().StringVar(&findSensor, "sensor", "", "ID of the sensor whose files to list, all sensors when empty")
+	archiveFindCmd.Flags().StringVar(&findFrom, "from", "", "start of the time range, in RFC 3339")
+	archiveFindCmd.Flags().StringVar(&findTo, "to", "", "end of the time range, in RFC 3339")
+	archiveFindCmd.Flags().BoolVar(&findJSON, "json", false, "print the index of every file as a JSON line, instead of its path")
+	rootCmd.AddCommand(archiveFindCmd)
+}
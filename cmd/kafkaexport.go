@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/deepfence/PacketStreamer/pkg/plugins/kafka"
+)
+
+const defaultExportSnapLen = 65535
+
+var (
+	exportBrokers     string
+	exportTopic       string
+	exportGroup       string
+	exportPlugin      string
+	exportOutputDir   string
+	exportStdout      bool
+	exportIdleTimeout time.Duration
+)
+
+var kafkaExportCmd = &cobra.Command{
+	Use:   "kafka-export [flags]",
+	Short: "Rebuild pcap files from the messages of the Kafka plugin",
+	Long: `Consume the messages produced by the Kafka plugin in file mode, put the
+chunks of every file back together and write them as pcap files to a directory,
+or as a single pcap stream to the standard output. The brokers, topic, TLS and
+SASL settings are taken from a kafka plugin of the --config file, and can be
+overridden with flags. Files with missing chunks are written up to the first
+missing one, and reported.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if (exportOutputDir == "") == !exportStdout {
+			log.Fatalf("Exactly one of --output-dir and --stdout has to be set")
+		}
+
+		var kafkaConfig kafka.Config
+		snapLen := defaultExportSnapLen
+		if cfg != nil {
+			snapLen = cfg.InputPacketLen
+			found := false
+			for _, plugin := range cfg.Output.Plugins {
+				if plugin.Type != "kafka" || (exportPlugin != "" && plugin.Name != exportPlugin) {
+					continue
+				}
+				if err := plugin.Decode(&kafkaConfig); err != nil {
+					log.Fatalf("Invalid kafka plugin configuration: %v", err)
+				}
+				found = true
+				break
+			}
+			if !found && exportPlugin != "" {
+				log.Fatalf("No kafka plugin %s in the configuration", exportPlugin)
+			}
+		} else if exportPlugin != "" {
+			log.Fatalf("Configuration file not provided")
+		}
+		if exportBrokers != "" {
+			kafkaConfig.Brokers = exportBrokers
+		}
+		if exportTopic != "" {
+			kafkaConfig.Topic = &exportTopic
+		}
+		if kafkaConfig.Brokers == "" {
+			log.Fatalf("No brokers configured, use --brokers or a kafka plugin of --config")
+		}
+
+		var sink kafka.ExportSink
+		if exportStdout {
+			sink = kafka.NewStreamSink(os.Stdout, snapLen)
+		} else {
+			var err error
+			sink, err = kafka.NewDirSink(exportOutputDir, snapLen)
+			if err != nil {
+				log.Fatalf("Failed to open output: %v", err)
+			}
+		}
+
+		reader, err := kafka.NewReader(kafkaConfig, exportGroup)
+		if err != nil {
+			log.Fatalf("Invalid kafka configuration: %v", err)
+		}
+		defer reader.Close()
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-sigs
+			cancel()
+		}()
+
+		exporter := kafka.NewExporter(sink)
+		exporter.IdleTimeout = exportIdleTimeout
+		err = exporter.Run(ctx, reader)
+
+		incomplete, packets := 0, 0
+		for _, f := range exporter.Files {
+			packets += f.Packets
+			if !f.Complete {
+				incomplete++
+				log.Printf("File %s is incomplete (%d messages, %d packets): %v\n", f.Key, f.Messages, f.Packets, f.Err)
+			}
+		}
+		log.Printf("Exported %d files (%d incomplete) with %d packets, skipped %d messages of other modes and %d duplicates\n",
+			len(exporter.Files), incomplete, packets, exporter.Skipped, exporter.Duplicates)
+		if err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+	},
+}
+
+func init() {
+	kafkaExportCmd.Flags().StringVar(&exportBrokers, "brokers", "", "comma separated list of brokers, overriding the configuration")
+	kafkaExportCmd.Flags().StringVar(&exportTopic, "topic", "", "topic to consume, overriding the configuration")
+	kafkaExportCmd.Flags().StringVar(&exportGroup, "group", "packetstreamer-export", "consumer group, which keeps track of the exported messages")
+	kafkaExportCmd.Flags().StringVar(&exportPlugin, "plugin", "", "name of the kafka plugin of the configuration to take the settings from")
+	kafkaExportCmd.Flags().StringVarP(&exportOutputDir, "output-dir", "o", "", "directory to write a pcap file per exported file to")
+	kafkaExportCmd.Flags().BoolVar(&exportStdout, "stdout", false, "write the packets of all the files as a pcap stream to the standard output")
+	kafkaExportCmd.Flags().DurationVar(&exportIdleTimeout, "idle-timeout", 0, "stop once no message comes for that long, 0 to run until interrupted")
+	rootCmd.AddCommand(kafkaExportCmd)
+}
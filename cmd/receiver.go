@@ -19,24 +19,27 @@ var receiverCmd = &cobra.Command{
 	Long: `Receiver (server) which retrieves packets from sensors (clients) via
 TCP and is able to store them (i.e. output to file) or pass them further.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		requireConfig()
 		if err := config.ValidateReceiverConfig(cfg); err != nil {
 			log.Fatalf("Invalid configuration: %v", err)
 		}
 
-		proto := "tcp"
-		if err := streamer.InitOutput(cfg, proto); err != nil {
-			log.Fatalf("Failed to connect: %v", err)
-		}
-
 		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 		ctx, cancel := context.WithCancel(context.Background())
 
+		proto := "tcp"
+		outputs, err := streamer.NewOutputs(ctx, cfg, proto)
+		if err != nil {
+			log.Fatalf("Failed to open outputs: %v", err)
+		}
+
 		log.Println("Start receiving")
-		streamer.StartReceiver(ctx, cfg, proto)
+		done := streamer.StartReceiver(ctx, cfg, outputs, proto)
 		log.Println("Now waiting in main")
 		<-sigs
 		cancel()
+		waitForFlush(sigs, done)
 	},
 }
 
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/replay"
+)
+
+var (
+	replayInterface string
+	replayOutput    string
+	replaySpeed     string
+	replayLoops     int
+	replayRate      float64
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay [flags] file...",
+	Short: "Replay captured packets onto an interface or to a pcap consumer",
+	Long: `Replay packets from pcap or pcapng files, or from streams recorded from
+sensors, either by injecting them onto a network interface or by streaming them
+as pcap to a TCP or UNIX socket, a named pipe or a file. Use "-" to read from
+the standard input.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if (replayInterface == "") == (replayOutput == "") {
+			log.Fatalf("Exactly one of --interface and --output has to be set")
+		}
+		speed, err := config.ParseSpeed(replaySpeed)
+		if err != nil {
+			log.Fatalf("Invalid speed: %v", err)
+		}
+		if replayRate < 0 {
+			log.Fatalf("Invalid rate %v", replayRate)
+		}
+		if replayLoops < 0 {
+			log.Fatalf("Invalid number of loops %d", replayLoops)
+		}
+
+		var sink replay.Sink
+		if replayInterface != "" {
+			sink, err = replay.NewInterfaceSink(replayInterface)
+		} else {
+			sink, err = replay.NewPcapSink(replayOutput)
+		}
+		if err != nil {
+			log.Fatalf("Failed to open output: %v", err)
+		}
+		defer sink.Close()
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-sigs
+			cancel()
+		}()
+
+		stats, err := replay.Replay(ctx, args, sink, replay.Options{Speed: speed, Rate: replayRate, Loops: replayLoops})
+		log.Printf("Replayed %d packets (%d bytes) in %d loops, skipped %d packets\n",
+			stats.Packets, stats.Bytes, stats.Loops, stats.Skipped)
+		if err != nil && ctx.Err() == nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+	},
+}
+
+func init() {
+	replayCmd.Flags().StringVarP(&replayInterface, "interface", "i", "", "interface to inject the packets onto")
+	replayCmd.Flags().StringVarP(&replayOutput, "output", "o", "", "pcap consumer: tcp://host:port, unix:///path or a path to a named pipe or file")
+	replayCmd.Flags().StringVar(&replaySpeed, "speed", "original", "original, max or a multiple of the original speed, e.g. 2x")
+	replayCmd.Flags().Float64Var(&replayRate, "rate", 0, "maximum number of packets per second, 0 for no limit")
+	replayCmd.Flags().IntVar(&replayLoops, "loop", 1, "number of times to replay the files, 0 to loop forever")
+	rootCmd.AddCommand(replayCmd)
+}
@@ -7,6 +7,12 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/deepfence/PacketStreamer/pkg/config"
+
+	// Register the built-in plugins.
+	_ "github.com/deepfence/PacketStreamer/pkg/plugins/archive"
+	_ "github.com/deepfence/PacketStreamer/pkg/plugins/http"
+	_ "github.com/deepfence/PacketStreamer/pkg/plugins/kafka"
+	_ "github.com/deepfence/PacketStreamer/pkg/plugins/s3"
 )
 
 var (
@@ -38,8 +44,9 @@ func init() {
 }
 
 func initConfig() {
+	// commands which need the configuration check it with requireConfig
 	if cfgFile == "" {
-		log.Fatalf("Configuration file not provided")
+		return
 	}
 
 	var err error
@@ -48,3 +55,20 @@ func initConfig() {
 		log.Fatalf("Could not retrieve configuration: %v", err)
 	}
 }
+
+func requireConfig() {
+	if cfg == nil {
+		log.Fatalf("Configuration file not provided")
+	}
+}
+
+// waitForFlush waits until the outputs and plugins were flushed and closed,
+// unless another signal asks to stop right away.
+func waitForFlush(sigs <-chan os.Signal, done <-chan struct{}) {
+	log.Println("Stopping, flushing the outputs and plugins")
+	select {
+	case <-done:
+	case <-sigs:
+		log.Println("Stopping without flushing")
+	}
+}
@@ -19,24 +19,31 @@ var sensorCmd = &cobra.Command{
 	Long: `Sensor which broadcasts locally captured packets to another server
 (receiver).`,
 	Run: func(cmd *cobra.Command, args []string) {
+		requireConfig()
 		if err := config.ValidateSensorConfig(cfg); err != nil {
 			log.Fatalf("Invalid configuration: %v", err)
 		}
 
-		proto := "tcp"
-		if err := streamer.InitOutput(cfg, proto); err != nil {
-			log.Fatalf("Failed to connect: %v", err)
-		}
-
 		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 		ctx, cancel := context.WithCancel(context.Background())
 
+		proto := "tcp"
+		outputs, err := streamer.NewOutputs(ctx, cfg, proto)
+		if err != nil {
+			log.Fatalf("Failed to open outputs: %v", err)
+		}
+
 		log.Println("Start sending")
-		streamer.StartSensor(ctx, cfg)
+		done := streamer.StartSensor(ctx, cfg, outputs)
 		log.Println("Now waiting in main")
-		<-sigs
-		cancel()
+		select {
+		case <-sigs:
+			cancel()
+			waitForFlush(sigs, done)
+		case <-done:
+			cancel()
+		}
 	},
 }
 
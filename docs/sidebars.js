@@ -49,7 +49,11 @@ const sidebars = {
       },
       items: [
         'packetstreamer/extra/s3',
+        'packetstreamer/extra/kafka',
+        'packetstreamer/extra/http',
+        'packetstreamer/extra/archive',
         'packetstreamer/extra/suricata',
+        'packetstreamer/extra/replay',
       ]
     }
   ]
@@ -0,0 +1,257 @@
+package batch
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// RecordHeaderLen is the length of the pcap record header preceding every
+	// packet in a batch.
+	RecordHeaderLen = 16
+)
+
+// ErrTruncatedRecord is returned for pcap records cut short.
+var ErrTruncatedRecord = errors.New("truncated pcap record")
+
+// Codec is the encoding of the data in a batch.
+type Codec int
+
+const (
+	// CodecNone means that the batch contains plain pcap records.
+	CodecNone Codec = iota
+	// CodecS2 means that the batch contains S2-compressed pcap records.
+	CodecS2
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecS2:
+		return "s2"
+	default:
+		return "unknown"
+	}
+}
+
+// Metadata describes the packets in a batch.
+type Metadata struct {
+	SensorID       string
+	Interface      string
+	LinkType       layers.LinkType
+	FirstTimestamp time.Time
+	LastTimestamp  time.Time
+	PacketCount    int
+	Codec          Codec
+	// Filter is the BPF filter the packets were captured with, when they were
+	// captured from a single interface by this process.
+	Filter string
+}
+
+// PcapLinkType returns the link type of the pcap header of the packets.
+// Batches which don't tell carry Ethernet packets.
+func (m Metadata) PcapLinkType() layers.LinkType {
+	if m.LinkType == layers.LinkTypeNull {
+		return layers.LinkTypeEthernet
+	}
+	return m.LinkType
+}
+
+// Merge adds the packets described by o to the ones of m.
+func (m *Metadata) Merge(o Metadata) {
+	if o.PacketCount == 0 {
+		return
+	}
+	if m.PacketCount == 0 || o.FirstTimestamp.Before(m.FirstTimestamp) {
+		m.FirstTimestamp = o.FirstTimestamp
+	}
+	if o.LastTimestamp.After(m.LastTimestamp) {
+		m.LastTimestamp = o.LastTimestamp
+	}
+	m.PacketCount += o.PacketCount
+}
+
+// Batch is a chunk of packet data, together with its metadata. Batches come
+// from a Pool and are reference counted, so the same batch can be handed over
+// to multiple consumers without copying. Every consumer which gets a batch
+// has to Release it once it's done with it.
+type Batch struct {
+	Metadata
+	Data []byte
+	// Source is the compressed batch this batch was decoded from, kept so
+	// that it can be forwarded without compressing it again. The batch holds
+	// a reference to its source, which is released along with the batch.
+	Source *Batch
+
+	refs int32
+	pool *Pool
+}
+
+// AppendPacket appends a single packet to the batch as a pcap record, and
+// updates the metadata accordingly.
+func (b *Batch) AppendPacket(ci gopacket.CaptureInfo, data []byte) {
+	var hdr [RecordHeaderLen]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(ci.Timestamp.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(ci.Timestamp.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(ci.Length))
+	b.Data = append(b.Data, hdr[:]...)
+	b.Data = append(b.Data, data...)
+
+	if b.PacketCount == 0 || ci.Timestamp.Before(b.FirstTimestamp) {
+		b.FirstTimestamp = ci.Timestamp
+	}
+	if ci.Timestamp.After(b.LastTimestamp) {
+		b.LastTimestamp = ci.Timestamp
+	}
+	b.PacketCount++
+}
+
+// ScanPackets walks through the pcap records of an uncompressed batch and
+// recomputes the packet count and timestamps. It's meant for batches whose
+// metadata got lost on the way, e.g. the ones received from sensors.
+func (b *Batch) ScanPackets() {
+	b.PacketCount = 0
+	b.FirstTimestamp = time.Time{}
+	b.LastTimestamp = time.Time{}
+
+	for offset := 0; offset+RecordHeaderLen <= len(b.Data); {
+		sec := binary.LittleEndian.Uint32(b.Data[offset : offset+4])
+		usec := binary.LittleEndian.Uint32(b.Data[offset+4 : offset+8])
+		capLen := binary.LittleEndian.Uint32(b.Data[offset+8 : offset+12])
+		ts := time.Unix(int64(sec), int64(usec)*1000)
+
+		if b.PacketCount == 0 || ts.Before(b.FirstTimestamp) {
+			b.FirstTimestamp = ts
+		}
+		if ts.After(b.LastTimestamp) {
+			b.LastTimestamp = ts
+		}
+		b.PacketCount++
+		offset += RecordHeaderLen + int(capLen)
+	}
+}
+
+// NextRecord parses the first of the pcap records, and returns its packet
+// along with the records following it.
+func NextRecord(records []byte) (gopacket.CaptureInfo, []byte, []byte, error) {
+	if len(records) < RecordHeaderLen {
+		return gopacket.CaptureInfo{}, nil, nil, ErrTruncatedRecord
+	}
+	var ci gopacket.CaptureInfo
+	ci.Timestamp = time.Unix(int64(binary.LittleEndian.Uint32(records[0:4])),
+		int64(binary.LittleEndian.Uint32(records[4:8]))*int64(time.Microsecond)).UTC()
+	ci.CaptureLength = int(binary.LittleEndian.Uint32(records[8:12]))
+	ci.Length = int(binary.LittleEndian.Uint32(records[12:16]))
+	end := RecordHeaderLen + ci.CaptureLength
+	if len(records) < end {
+		return gopacket.CaptureInfo{}, nil, nil, ErrTruncatedRecord
+	}
+	return ci, records[RecordHeaderLen:end], records[end:], nil
+}
+
+// Retain increments the reference count of the batch, for handing it over to
+// another consumer. It returns the batch itself for convenience.
+func (b *Batch) Retain() *Batch {
+	atomic.AddInt32(&b.refs, 1)
+	return b
+}
+
+// Release decrements the reference count of the batch. The last Release
+// returns the batch to its pool, after which it must not be used anymore.
+func (b *Batch) Release() {
+	refs := atomic.AddInt32(&b.refs, -1)
+	if refs > 0 {
+		return
+	}
+	if refs < 0 {
+		panic("batch: Release called on a released batch")
+	}
+	if b.Source != nil {
+		b.Source.Release()
+		b.Source = nil
+	}
+	if b.pool != nil {
+		b.pool.put(b)
+	}
+}
+
+// Pool is a pool of batches whose buffers have the same capacity.
+type Pool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewPool creates a pool of batches with buffers of the given capacity.
+func NewPool(size int) *Pool {
+	p := &Pool{size: size}
+	p.pool.New = func() interface{} {
+		return &Batch{
+			Data: make([]byte, 0, size),
+			pool: p,
+		}
+	}
+	return p
+}
+
+// Get returns an empty batch with a single reference.
+func (p *Pool) Get() *Batch {
+	b := p.pool.Get().(*Batch)
+	b.refs = 1
+	return b
+}
+
+func (p *Pool) put(b *Batch) {
+	// Don't keep the buffers which grew too much, so a single huge batch
+	// doesn't pin memory forever.
+	if cap(b.Data) > 2*p.size {
+		return
+	}
+	b.Metadata = Metadata{}
+	b.Data = b.Data[:0]
+	p.pool.Put(b)
+}
+
+// BufferPool is a pool of byte buffers with the same capacity, meant for
+// short-lived copies of single packets.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBufferPool creates a pool of buffers with the given capacity.
+func NewBufferPool(size int) *BufferPool {
+	p := &BufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// Get returns a buffer of length n. Buffers larger than the capacity of the
+// pool are allocated, and not pooled once they are put back.
+func (p *BufferPool) Get(n int) *[]byte {
+	if n > p.size {
+		buf := make([]byte, n)
+		return &buf
+	}
+	buf := p.pool.Get().(*[]byte)
+	*buf = (*buf)[:n]
+	return buf
+}
+
+// Put returns the buffer to the pool.
+func (p *BufferPool) Put(buf *[]byte) {
+	if cap(*buf) != p.size {
+		return
+	}
+	p.pool.Put(buf)
+}
@@ -0,0 +1,177 @@
+package batch
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestAppendPacket(t *testing.T) {
+	first := time.Unix(1650000000, 123000)
+	last := first.Add(time.Second)
+	packets := []struct {
+		ci   gopacket.CaptureInfo
+		data []byte
+	}{
+		{
+			ci:   gopacket.CaptureInfo{Timestamp: first, CaptureLength: 3, Length: 3},
+			data: []byte{0x1, 0x2, 0x3},
+		},
+		{
+			ci:   gopacket.CaptureInfo{Timestamp: last, CaptureLength: 2, Length: 60},
+			data: []byte{0x4, 0x5},
+		},
+	}
+
+	pool := NewPool(64)
+	b := pool.Get()
+	defer b.Release()
+	for _, p := range packets {
+		b.AppendPacket(p.ci, p.data)
+	}
+
+	if b.PacketCount != 2 || !b.FirstTimestamp.Equal(first) || !b.LastTimestamp.Equal(last) {
+		t.Errorf("unexpected metadata: %+v", b.Metadata)
+	}
+
+	// The records should be readable as a regular pcap file.
+	var pcapFile bytes.Buffer
+	if err := pcapgo.NewWriter(&pcapFile).WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pcapFile.Write(b.Data)
+	reader, err := pcapgo.NewReader(&pcapFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, p := range packets {
+		data, ci, err := reader.ReadPacketData()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !bytes.Equal(data, p.data) || ci.Length != p.ci.Length || !ci.Timestamp.Equal(p.ci.Timestamp) {
+			t.Errorf("expected packet %v %+v, got %v %+v", p.data, p.ci, data, ci)
+		}
+	}
+
+	scanned := &Batch{Data: b.Data}
+	scanned.ScanPackets()
+	if scanned.PacketCount != 2 || !scanned.FirstTimestamp.Equal(first) || !scanned.LastTimestamp.Equal(last) {
+		t.Errorf("unexpected scanned metadata: %+v", scanned.Metadata)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	first := time.Unix(1650000000, 0)
+	m := Metadata{SensorID: "sensor"}
+	m.Merge(Metadata{FirstTimestamp: first.Add(time.Second), LastTimestamp: first.Add(2 * time.Second), PacketCount: 2})
+	m.Merge(Metadata{})
+	m.Merge(Metadata{FirstTimestamp: first, LastTimestamp: first, PacketCount: 1})
+	if m.SensorID != "sensor" || m.PacketCount != 3 || !m.FirstTimestamp.Equal(first) || !m.LastTimestamp.Equal(first.Add(2*time.Second)) {
+		t.Errorf("unexpected merged metadata %+v", m)
+	}
+}
+
+func TestNextRecord(t *testing.T) {
+	ts := time.Unix(1650000000, 123000).UTC()
+	b := &Batch{}
+	b.AppendPacket(gopacket.CaptureInfo{Timestamp: ts, CaptureLength: 3, Length: 60}, []byte{0x1, 0x2, 0x3})
+	b.AppendPacket(gopacket.CaptureInfo{Timestamp: ts, CaptureLength: 1, Length: 1}, []byte{0x4})
+
+	ci, data, rest, err := NextRecord(b.Data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(data, []byte{0x1, 0x2, 0x3}) || ci.Length != 60 || !ci.Timestamp.Equal(ts) {
+		t.Errorf("unexpected packet %v %+v", data, ci)
+	}
+	if _, data, rest, err = NextRecord(rest); err != nil || !bytes.Equal(data, []byte{0x4}) || len(rest) != 0 {
+		t.Errorf("unexpected last packet %v, %d bytes left, error %v", data, len(rest), err)
+	}
+
+	for _, truncated := range [][]byte{b.Data[:RecordHeaderLen-1], b.Data[:RecordHeaderLen+2]} {
+		if _, _, _, err := NextRecord(truncated); err != ErrTruncatedRecord {
+			t.Errorf("expected ErrTruncatedRecord, got %v", err)
+		}
+	}
+}
+
+func TestRelease(t *testing.T) {
+	pool := NewPool(64)
+	b := pool.Get()
+	b.SensorID = "sensor"
+	b.Data = append(b.Data, 0x1)
+
+	b.Retain()
+	b.Release()
+	if b.SensorID != "sensor" || len(b.Data) != 1 {
+		t.Fatal("batch was reset while still referenced")
+	}
+	b.Release()
+	if b.SensorID != "" || len(b.Data) != 0 {
+		t.Error("batch was not reset after the last release")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic when releasing a released batch")
+		}
+	}()
+	b.Release()
+}
+
+func TestReleaseSource(t *testing.T) {
+	pool := NewPool(64)
+	source := pool.Get()
+	source.Codec = CodecS2
+	b := pool.Get()
+	b.Source = source
+
+	source.Retain()
+	b.Release()
+	if b.Source != nil {
+		t.Error("source was not detached from the released batch")
+	}
+	if source.Codec != CodecS2 {
+		t.Fatal("source was reset while still referenced")
+	}
+	source.Release()
+	if source.Codec != CodecNone {
+		t.Error("source was not reset after the last release")
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	pool := NewBufferPool(16)
+
+	small := pool.Get(8)
+	if len(*small) != 8 || cap(*small) != 16 {
+		t.Errorf("expected a pooled buffer of length 8, got length %d and capacity %d", len(*small), cap(*small))
+	}
+	pool.Put(small)
+
+	large := pool.Get(32)
+	if len(*large) != 32 {
+		t.Errorf("expected a buffer of length 32, got %d", len(*large))
+	}
+	pool.Put(large)
+}
+
+func TestPcapLinkType(t *testing.T) {
+	for _, tt := range []struct {
+		linkType layers.LinkType
+		expected layers.LinkType
+	}{
+		{layers.LinkTypeNull, layers.LinkTypeEthernet},
+		{layers.LinkTypeEthernet, layers.LinkTypeEthernet},
+		{layers.LinkTypeLinuxSLL, layers.LinkTypeLinuxSLL},
+	} {
+		if got := (Metadata{LinkType: tt.linkType}).PcapLinkType(); got != tt.expected {
+			t.Errorf("expected %v for %v, got %v", tt.expected, tt.linkType, got)
+		}
+	}
+}
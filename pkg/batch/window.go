@@ -0,0 +1,67 @@
+package batch
+
+import "time"
+
+// Windows cut packets on time boundaries aligned to Interval, by their
+// timestamps. A window is over Delay after its end, so that the packets
+// gathered at the time get in.
+type Windows struct {
+	Interval time.Duration
+	Delay    time.Duration
+}
+
+// Split calls fn with the pcap records of every time window, in order,
+// along with the start of the window and the metadata of its records. It
+// stops at the first error.
+func (w Windows) Split(m Metadata, records []byte, fn func(window time.Time, m Metadata, records []byte) error) error {
+	for len(records) > 0 {
+		window, wm, n := w.next(m, records)
+		if err := fn(window, wm, records[:n]); err != nil {
+			return err
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+// next returns the time window of the first of the records, along with the
+// metadata and the length of the records in the same window.
+func (w Windows) next(metadata Metadata, records []byte) (time.Time, Metadata, int) {
+	var window time.Time
+	m := metadata
+	m.PacketCount = 0
+	n := 0
+	for n < len(records) {
+		ci, _, rest, err := NextRecord(records[n:])
+		if err != nil {
+			// the garbage goes along with the previous records
+			return window, m, len(records)
+		}
+		packetWindow := ci.Timestamp.Truncate(w.Interval)
+		if m.PacketCount == 0 {
+			window = packetWindow
+			m.FirstTimestamp, m.LastTimestamp = ci.Timestamp, ci.Timestamp
+		} else if !packetWindow.Equal(window) {
+			break
+		}
+		if ci.Timestamp.Before(m.FirstTimestamp) {
+			m.FirstTimestamp = ci.Timestamp
+		}
+		if ci.Timestamp.After(m.LastTimestamp) {
+			m.LastTimestamp = ci.Timestamp
+		}
+		m.PacketCount++
+		n = len(records) - len(rest)
+	}
+	return window, m, n
+}
+
+// Over tells whether the window starting at window is over at now.
+func (w Windows) Over(window, now time.Time) bool {
+	return !now.Before(window.Add(w.Interval + w.Delay))
+}
+
+// UntilOver returns the time until the window of now is over.
+func (w Windows) UntilOver(now time.Time) time.Duration {
+	return now.Truncate(w.Interval).Add(w.Interval + w.Delay).Sub(now)
+}
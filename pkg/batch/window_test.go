@@ -0,0 +1,76 @@
+package batch
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+func TestWindowsSplit(t *testing.T) {
+	start := time.Date(2024, 5, 3, 12, 59, 0, 0, time.UTC)
+	b := &Batch{Metadata: Metadata{SensorID: "sensor", Interface: "eth0"}}
+	// 12:59:00, 12:59:30, 13:00:00, 12:59:59 and 13:00:30
+	for _, offset := range []time.Duration{0, 30 * time.Second, time.Minute, 59 * time.Second, 90 * time.Second} {
+		b.AppendPacket(gopacket.CaptureInfo{Timestamp: start.Add(offset), CaptureLength: 1, Length: 1}, []byte{0x1})
+	}
+
+	type split struct {
+		window, first, last time.Time
+		packets, bytes      int
+	}
+	var got []split
+	windows := Windows{Interval: time.Minute, Delay: 10 * time.Second}
+	err := windows.Split(b.Metadata, b.Data, func(window time.Time, m Metadata, records []byte) error {
+		if m.SensorID != "sensor" || m.Interface != "eth0" {
+			t.Errorf("unexpected metadata %+v", m)
+		}
+		got = append(got, split{window, m.FirstTimestamp, m.LastTimestamp, m.PacketCount, len(records)})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// packets going back in time start a new split
+	record := RecordHeaderLen + 1
+	expected := []split{
+		{start, start, start.Add(30 * time.Second), 2, 2 * record},
+		{start.Add(time.Minute), start.Add(time.Minute), start.Add(time.Minute), 1, record},
+		{start, start.Add(59 * time.Second), start.Add(59 * time.Second), 1, record},
+		{start.Add(time.Minute), start.Add(90 * time.Second), start.Add(90 * time.Second), 1, record},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d splits, got %+v", len(expected), got)
+	}
+	for i := range expected {
+		e, g := expected[i], got[i]
+		if !g.window.Equal(e.window) || !g.first.Equal(e.first) || !g.last.Equal(e.last) || g.packets != e.packets || g.bytes != e.bytes {
+			t.Errorf("expected split %d to be %+v, got %+v", i, e, g)
+		}
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	err = windows.Split(b.Metadata, b.Data, func(time.Time, Metadata, []byte) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Errorf("expected to stop at the first error, got %v after %d calls", err, calls)
+	}
+}
+
+func TestWindowsOver(t *testing.T) {
+	windows := Windows{Interval: time.Minute, Delay: 10 * time.Second}
+	window := time.Date(2024, 5, 3, 12, 59, 0, 0, time.UTC)
+	if windows.Over(window, window.Add(70*time.Second-time.Nanosecond)) {
+		t.Error("expected the window to be open until 10s after its end")
+	}
+	if !windows.Over(window, window.Add(70*time.Second)) {
+		t.Error("expected the window to be over 10s after its end")
+	}
+	if until := windows.UntilOver(window.Add(15 * time.Second)); until != 55*time.Second {
+		t.Errorf("expected the window to be over in 55s, got %v", until)
+	}
+}
@@ -0,0 +1,234 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inhies/go-bytesize"
+)
+
+type CaptureBackend int
+
+const (
+	PcapBackend CaptureBackend = iota
+	AFPacketBackend
+	FileBackend
+)
+
+type FanoutType int
+
+const (
+	FanoutHash FanoutType = iota
+	FanoutLoadBalance
+	FanoutCPU
+	FanoutRollover
+	FanoutRandom
+	FanoutQueueMapping
+)
+
+const (
+	defaultRingSize       = 64 * bytesize.MB
+	defaultBlockSize      = 1 * bytesize.MB
+	defaultCaptureTimeout = 5 * time.Second
+	defaultPollInterval   = 5 * time.Second
+)
+
+type RawFanoutConfig struct {
+	Group   uint16
+	Type    string
+	Sockets *int `yaml:"sockets,omitempty"`
+}
+
+type RawFileCaptureConfig struct {
+	Paths        []string
+	Watch        bool
+	PollInterval *string `yaml:"pollInterval,omitempty"`
+	Speed        *string `yaml:"speed,omitempty"`
+}
+
+type RawCaptureConfig struct {
+	Backend   string
+	RingSize  *string               `yaml:"ringSize,omitempty"`
+	BlockSize *string               `yaml:"blockSize,omitempty"`
+	Timeout   *string               `yaml:"timeout,omitempty"`
+	Fanout    *RawFanoutConfig      `yaml:"fanout,omitempty"`
+	File      *RawFileCaptureConfig `yaml:"file,omitempty"`
+}
+
+// FanoutConfig makes several AF_PACKET sockets share the packets of an
+// interface. The sockets can belong to one sensor (Sockets) or to several
+// sensors using the same Group.
+type FanoutConfig struct {
+	Group   uint16
+	Type    FanoutType
+	Sockets int
+}
+
+// FileCaptureConfig makes the sensor read packets from pcap and pcapng files
+// instead of live interfaces. Paths can point to files or directories, which
+// are polled for new files in the watch mode. Speed is the multiple of the
+// original speed of the capture to replay the packets at, 0 means as fast as
+// possible.
+type FileCaptureConfig struct {
+	Paths        []string
+	Watch        bool
+	PollInterval time.Duration
+	Speed        float64
+}
+
+type CaptureConfig struct {
+	Backend   CaptureBackend
+	RingSize  int
+	BlockSize int
+	Timeout   time.Duration
+	Fanout    *FanoutConfig
+	File      *FileCaptureConfig
+}
+
+func newCaptureConfig(rawConfig *RawCaptureConfig) (CaptureConfig, error) {
+	captureConfig := CaptureConfig{
+		Backend:   PcapBackend,
+		RingSize:  int(defaultRingSize),
+		BlockSize: int(defaultBlockSize),
+		Timeout:   defaultCaptureTimeout,
+	}
+	if rawConfig == nil {
+		return captureConfig, nil
+	}
+
+	switch rawConfig.Backend {
+	case "pcap", "":
+		captureConfig.Backend = PcapBackend
+	case "afpacket":
+		captureConfig.Backend = AFPacketBackend
+	case "file":
+		captureConfig.Backend = FileBackend
+	default:
+		return CaptureConfig{}, fmt.Errorf("invalid capture backend \"%s\"", rawConfig.Backend)
+	}
+
+	if rawConfig.RingSize != nil {
+		ringSize, err := bytesize.Parse(*rawConfig.RingSize)
+		if err != nil {
+			return CaptureConfig{}, fmt.Errorf("could not parse the ringSize field %s: %w", *rawConfig.RingSize, err)
+		}
+		captureConfig.RingSize = int(ringSize)
+	}
+
+	if rawConfig.BlockSize != nil {
+		blockSize, err := bytesize.Parse(*rawConfig.BlockSize)
+		if err != nil {
+			return CaptureConfig{}, fmt.Errorf("could not parse the blockSize field %s: %w", *rawConfig.BlockSize, err)
+		}
+		captureConfig.BlockSize = int(blockSize)
+	}
+	if captureConfig.BlockSize <= 0 || captureConfig.RingSize < captureConfig.BlockSize {
+		return CaptureConfig{}, fmt.Errorf("ringSize %d must be at least one block of blockSize %d",
+			captureConfig.RingSize, captureConfig.BlockSize)
+	}
+
+	if rawConfig.Timeout != nil {
+		timeout, err := time.ParseDuration(*rawConfig.Timeout)
+		if err != nil {
+			return CaptureConfig{}, fmt.Errorf("could not parse the timeout field %s: %w", *rawConfig.Timeout, err)
+		}
+		captureConfig.Timeout = timeout
+	}
+
+	if rawConfig.Fanout != nil {
+		if captureConfig.Backend != AFPacketBackend {
+			return CaptureConfig{}, fmt.Errorf("fanout is only supported by the afpacket capture backend")
+		}
+
+		fanout := &FanoutConfig{
+			Group:   rawConfig.Fanout.Group,
+			Sockets: 1,
+		}
+		switch rawConfig.Fanout.Type {
+		case "hash", "":
+			fanout.Type = FanoutHash
+		case "lb":
+			fanout.Type = FanoutLoadBalance
+		case "cpu":
+			fanout.Type = FanoutCPU
+		case "rollover":
+			fanout.Type = FanoutRollover
+		case "random":
+			fanout.Type = FanoutRandom
+		case "qm":
+			fanout.Type = FanoutQueueMapping
+		default:
+			return CaptureConfig{}, fmt.Errorf("invalid fanout type \"%s\"", rawConfig.Fanout.Type)
+		}
+		if rawConfig.Fanout.Sockets != nil {
+			if *rawConfig.Fanout.Sockets < 1 {
+				return CaptureConfig{}, fmt.Errorf("invalid number of fanout sockets %d", *rawConfig.Fanout.Sockets)
+			}
+			fanout.Sockets = *rawConfig.Fanout.Sockets
+		}
+		captureConfig.Fanout = fanout
+	}
+
+	if captureConfig.Backend == FileBackend {
+		fileConfig, err := newFileCaptureConfig(rawConfig.File)
+		if err != nil {
+			return CaptureConfig{}, err
+		}
+		captureConfig.File = fileConfig
+	} else if rawConfig.File != nil {
+		return CaptureConfig{}, fmt.Errorf("file options are only supported by the file capture backend")
+	}
+
+	return captureConfig, nil
+}
+
+func newFileCaptureConfig(rawConfig *RawFileCaptureConfig) (*FileCaptureConfig, error) {
+	if rawConfig == nil || len(rawConfig.Paths) == 0 {
+		return nil, fmt.Errorf("no paths configured for the file capture backend")
+	}
+
+	fileConfig := &FileCaptureConfig{
+		Paths:        rawConfig.Paths,
+		Watch:        rawConfig.Watch,
+		PollInterval: defaultPollInterval,
+	}
+
+	if rawConfig.PollInterval != nil {
+		pollInterval, err := time.ParseDuration(*rawConfig.PollInterval)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse the pollInterval field %s: %w", *rawConfig.PollInterval, err)
+		}
+		if pollInterval <= 0 {
+			return nil, fmt.Errorf("invalid pollInterval %s", *rawConfig.PollInterval)
+		}
+		fileConfig.PollInterval = pollInterval
+	}
+
+	if rawConfig.Speed != nil {
+		speed, err := ParseSpeed(*rawConfig.Speed)
+		if err != nil {
+			return nil, err
+		}
+		fileConfig.Speed = speed
+	}
+
+	return fileConfig, nil
+}
+
+// ParseSpeed parses a replay speed: "original", "max" or a multiple of the
+// original speed like "2x" or "0.5". The returned multiplier is 0 for "max".
+func ParseSpeed(s string) (float64, error) {
+	switch s {
+	case "max":
+		return 0, nil
+	case "original":
+		return 1, nil
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("invalid speed \"%s\", expected original, max or a multiplier like 2x", s)
+	}
+	return speed, nil
+}
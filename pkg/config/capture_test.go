@@ -0,0 +1,182 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestNewCaptureConfig(t *testing.T) {
+	for _, tt := range []struct {
+		TestName string
+		Input    string
+		Expected CaptureConfig
+	}{
+		{
+			TestName: "defaults",
+			Input:    `{}`,
+			Expected: CaptureConfig{
+				Backend:   PcapBackend,
+				RingSize:  64 * 1024 * 1024,
+				BlockSize: 1024 * 1024,
+				Timeout:   5 * time.Second,
+			},
+		},
+		{
+			TestName: "afpacket with fanout",
+			Input: `
+backend: afpacket
+ringSize: 16MB
+blockSize: 512KB
+timeout: 100ms
+fanout:
+  group: 42
+  type: lb
+  sockets: 4
+`,
+			Expected: CaptureConfig{
+				Backend:   AFPacketBackend,
+				RingSize:  16 * 1024 * 1024,
+				BlockSize: 512 * 1024,
+				Timeout:   100 * time.Millisecond,
+				Fanout:    &FanoutConfig{Group: 42, Type: FanoutLoadBalance, Sockets: 4},
+			},
+		},
+		{
+			TestName: "fanout with the default type and sockets",
+			Input: `
+backend: afpacket
+fanout:
+  group: 1
+`,
+			Expected: CaptureConfig{
+				Backend:   AFPacketBackend,
+				RingSize:  64 * 1024 * 1024,
+				BlockSize: 1024 * 1024,
+				Timeout:   5 * time.Second,
+				Fanout:    &FanoutConfig{Group: 1, Type: FanoutHash, Sockets: 1},
+			},
+		},
+		{
+			TestName: "files at a multiple of the original speed",
+			Input: `
+backend: file
+file:
+  paths: [/var/pcap]
+  watch: true
+  pollInterval: 1m
+  speed: 2.5x
+`,
+			Expected: CaptureConfig{
+				Backend:   FileBackend,
+				RingSize:  64 * 1024 * 1024,
+				BlockSize: 1024 * 1024,
+				Timeout:   5 * time.Second,
+				File: &FileCaptureConfig{
+					Paths:        []string{"/var/pcap"},
+					Watch:        true,
+					PollInterval: time.Minute,
+					Speed:        2.5,
+				},
+			},
+		},
+		{
+			TestName: "files at the original speed",
+			Input: `
+backend: file
+file:
+  paths: [a.pcap, b.pcapng]
+  speed: original
+`,
+			Expected: CaptureConfig{
+				Backend:   FileBackend,
+				RingSize:  64 * 1024 * 1024,
+				BlockSize: 1024 * 1024,
+				Timeout:   5 * time.Second,
+				File: &FileCaptureConfig{
+					Paths:        []string{"a.pcap", "b.pcapng"},
+					PollInterval: 5 * time.Second,
+					Speed:        1,
+				},
+			},
+		},
+	} {
+		t.Run(tt.TestName, func(t *testing.T) {
+			var rawConfig RawCaptureConfig
+			if err := yaml.Unmarshal([]byte(tt.Input), &rawConfig); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			captureConfig, err := newCaptureConfig(&rawConfig)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(captureConfig, tt.Expected) {
+				t.Errorf("expected %+v, got %+v", tt.Expected, captureConfig)
+			}
+		})
+	}
+}
+
+func TestNewCaptureConfigInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		TestName string
+		Input    string
+	}{
+		{TestName: "unknown backend", Input: `backend: dpdk`},
+		{TestName: "invalid ring size", Input: `ringSize: lots`},
+		{TestName: "ring smaller than a block", Input: `{ringSize: 1MB, blockSize: 2MB}`},
+		{TestName: "invalid timeout", Input: `timeout: 5`},
+		{TestName: "fanout with pcap", Input: `{fanout: {group: 1}}`},
+		{TestName: "unknown fanout type", Input: `{backend: afpacket, fanout: {group: 1, type: ebpf}}`},
+		{TestName: "no fanout sockets", Input: `{backend: afpacket, fanout: {group: 1, sockets: 0}}`},
+		{TestName: "file backend without paths", Input: `backend: file`},
+		{TestName: "file options with pcap", Input: `{file: {paths: [a.pcap]}}`},
+		{TestName: "invalid speed", Input: `{backend: file, file: {paths: [a.pcap], speed: fast}}`},
+		{TestName: "negative speed", Input: `{backend: file, file: {paths: [a.pcap], speed: -2x}}`},
+		{TestName: "invalid poll interval", Input: `{backend: file, file: {paths: [a.pcap], pollInterval: 0s}}`},
+	} {
+		t.Run(tt.TestName, func(t *testing.T) {
+			var rawConfig RawCaptureConfig
+			if err := yaml.Unmarshal([]byte(tt.Input), &rawConfig); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := newCaptureConfig(&rawConfig); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestParseSpeed(t *testing.T) {
+	for _, tt := range []struct {
+		Input       string
+		Expected    float64
+		ShouldError bool
+	}{
+		{Input: "max", Expected: 0},
+		{Input: "original", Expected: 1},
+		{Input: "2x", Expected: 2},
+		{Input: "0.5", Expected: 0.5},
+		{Input: "fast", ShouldError: true},
+		{Input: "0x", ShouldError: true},
+		{Input: "-1", ShouldError: true},
+	} {
+		t.Run(tt.Input, func(t *testing.T) {
+			speed, err := ParseSpeed(tt.Input)
+			if tt.ShouldError {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if speed != tt.Expected {
+				t.Errorf("expected %v, got %v", tt.Expected, speed)
+			}
+		})
+	}
+}
@@ -3,12 +3,10 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
-	"strings"
+	"os"
+	"runtime"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	"github.com/inhies/go-bytesize"
-
 	"github.com/klauspost/compress/s2"
 	"gopkg.in/yaml.v3"
 )
@@ -21,88 +19,66 @@ const (
 	All
 )
 
+// ShardBy decides how captured packets are spread across the gather and
+// compression workers. Packets of the same shard are always handled by the
+// same worker, so their order is preserved.
+type ShardBy int
+
 const (
-	kilobyte = 1024
+	ShardByFlow ShardBy = iota
+	ShardByInterface
 )
 
 const (
-	defaultClientId = "packetstreamer"
-	defaultTopic    = "packetstreamer"
-	defaultAcks     = "all"
+	kilobyte = 1024
 )
 
-type InputConfig struct {
-	Address string
-	Port    *int
-}
+// Transport is the protocol carrying the packets from sensors to receivers.
+type Transport int
 
-type FileOutputConfig struct {
-	Path string
-}
-
-type ServerOutputConfig struct {
-	Address string
-	Port    *int
-}
-
-type S3PluginConfig struct {
-	Region          string
-	Bucket          string
-	TotalFileSize   *bytesize.ByteSize `yaml:"totalFileSize,omitempty"`
-	UploadChunkSize *bytesize.ByteSize `yaml:"uploadChunkSize,omitempty"`
-	UploadTimeout   time.Duration      `yaml:"uploadTimeout,omitempty"`
-	CannedACL       string             `yaml:"cannedACL,omitempty"`
-}
-
-type KafkaPluginConfig struct {
-	Brokers     []string
-	ClientId    string             `yaml:"clientId,omitempty"`
-	Topic       string             `yaml:"topic,omitempty"`
-	MessageSize *bytesize.ByteSize `yaml:"messageSize,omitempty"`
-	Acks        string             `yaml:"acks,omitempty"`
-	FileSize    *bytesize.ByteSize `yaml:"fileSize,omitempty"`
-	Timeout     time.Duration      `yaml:"timeout,omitempty"`
-}
-
-type PluginsConfig struct {
-	S3    *S3PluginConfig
-	Kafka *KafkaPluginConfig
-}
-
-type OutputConfig struct {
-	File    *FileOutputConfig
-	Server  *ServerOutputConfig
-	Plugins *PluginsConfig
-}
+const (
+	TCPTransport Transport = iota
+	// QUICTransport always uses TLS 1.3. Every sensor gets its own stream,
+	// authentication happens on a separate control stream.
+	QUICTransport
+)
 
-type S3OutputRawConfig struct {
-	Bucket          string
-	Region          string
-	TotalFileSize   *string `yaml:"totalFileSize,omitempty"`
-	UploadChunkSize *string `yaml:"uploadChunkSize,omitempty"`
-	UploadTimeout   *string `yaml:"uploadTimeout,omitempty"`
-	CannedACL       *string `yaml:"cannedACL,omitempty"`
+func (t *Transport) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Value {
+	case "tcp", "":
+		*t = TCPTransport
+	case "quic":
+		*t = QUICTransport
+	default:
+		return fmt.Errorf("line %d: invalid transport \"%s\"", value.Line, value.Value)
+	}
+	return nil
 }
 
-type KafkaOutputRawConfig struct {
-	Brokers     string
-	ClientId    *string       `yaml:"clientId,omitempty"`
-	Topic       *string       `yaml:"topic,omitempty"`
-	MessageSize *string       `yaml:"messageSize,omitempty"`
-	Acks        *string       `yaml:"acks,omitempty"`
-	FileSize    *string       `yaml:"fileSize,omitempty"`
-	Timeout     time.Duration `yaml:"timeout,omitempty"`
+func (t Transport) String() string {
+	if t == QUICTransport {
+		return "quic"
+	}
+	return "tcp"
 }
 
-type PluginsRawConfig struct {
-	S3    *S3OutputRawConfig
-	Kafka *KafkaOutputRawConfig
+// InputConfig is where the receiver listens for sensors, on Port, and for
+// mirrored traffic in standard encapsulations, on every one of Mirrors.
+type InputConfig struct {
+	Address   string
+	Port      *int
+	Transport Transport
+	Mirrors   []MirrorInputConfig `yaml:"mirror"`
 }
 
-type OutputRawConfig struct {
-	File    *FileOutputConfig
-	Server  *ServerOutputConfig
-	Plugins *PluginsRawConfig
+// MirrorInputConfig accepts traffic mirrored by switches, cloud packet
+// mirroring or other PacketStreamer receivers. Address defaults to the one of
+// the input, Port is the UDP port of VXLAN and TZSP, which defaults to the
+// standard one. GRE and ERSPAN are the same input, which takes both of them.
+type MirrorInputConfig struct {
+	Address       string
+	Port          *int
+	Encapsulation Encapsulation
 }
 
 type TLSConfig struct {
@@ -123,17 +99,21 @@ type SamplingRateConfig struct {
 
 type RawConfig struct {
 	Input                  *InputConfig
-	Output                 *OutputRawConfig
+	Output                 *OutputConfig
 	TLS                    TLSConfig
 	Auth                   AuthConfig
-	CompressBlockSize      *int             `yaml:"compressBlockSize,omitempty"`
-	InputPacketLen         *int             `yaml:"inputPacketLen,omitempty"`
-	GatherMaxWaitSec       *int             `yaml:"gatherMaxWaitSec,omitempty"`
-	LogFilename            string           `yaml:"logFilename,omitempty"`
-	PcapMode               string           `yaml:"pcapMode,omitempty"`
-	CapturePorts           []int            `yaml:"capturePorts,omitempty"`
-	CaptureInterfacesPorts map[string][]int `yaml:"captureInterfacesPorts,omitempty"`
-	IgnorePorts            []int            `yaml:"ignorePorts,omitempty"`
+	SensorID               string            `yaml:"sensorId,omitempty"`
+	Capture                *RawCaptureConfig `yaml:"capture,omitempty"`
+	CompressBlockSize      *int              `yaml:"compressBlockSize,omitempty"`
+	InputPacketLen         *int              `yaml:"inputPacketLen,omitempty"`
+	GatherMaxWaitSec       *int              `yaml:"gatherMaxWaitSec,omitempty"`
+	Workers                *int              `yaml:"workers,omitempty"`
+	ShardBy                string            `yaml:"shardBy,omitempty"`
+	LogFilename            string            `yaml:"logFilename,omitempty"`
+	PcapMode               string            `yaml:"pcapMode,omitempty"`
+	CapturePorts           []int             `yaml:"capturePorts,omitempty"`
+	CaptureInterfacesPorts map[string][]int  `yaml:"captureInterfacesPorts,omitempty"`
+	IgnorePorts            []int             `yaml:"ignorePorts,omitempty"`
 }
 
 type Config struct {
@@ -141,6 +121,8 @@ type Config struct {
 	Output                 OutputConfig
 	TLS                    TLSConfig
 	Auth                   AuthConfig
+	SensorID               string
+	Capture                CaptureConfig
 	InputPacketLen         int
 	LogFilename            string
 	PcapMode               PcapMode
@@ -153,6 +135,8 @@ type Config struct {
 	MaxPayloadLen          int
 	MaxHeaderLen           int
 	MaxGatherWait          time.Duration
+	Workers                int
+	ShardBy                ShardBy
 }
 
 func NewConfig(configFileName string) (*Config, error) {
@@ -166,21 +150,9 @@ func NewConfig(configFileName string) (*Config, error) {
 		return nil, fmt.Errorf("could not parse the config file %s: %w", configFileName, err)
 	}
 
-	var s3Config *S3PluginConfig
-	var kafkaConfig *KafkaPluginConfig
-	if rawConfig.Output != nil && rawConfig.Output.Plugins != nil {
-
-		s3Config, err = populateS3Config(rawConfig)
-
-		if err != nil {
-			return nil, err
-		}
-
-		kafkaConfig, err = populateKafkaConfig(rawConfig)
-
-		if err != nil {
-			return nil, err
-		}
+	var output OutputConfig
+	if rawConfig.Output != nil {
+		output = *rawConfig.Output
 	}
 
 	compressBlockSize := 65
@@ -198,6 +170,37 @@ func NewConfig(configFileName string) (*Config, error) {
 		gatherMaxWaitSec = *rawConfig.GatherMaxWaitSec
 	}
 
+	workers := runtime.NumCPU()
+	if rawConfig.Workers != nil {
+		workers = *rawConfig.Workers
+	}
+	if workers < 1 {
+		return nil, fmt.Errorf("invalid number of workers %d", workers)
+	}
+
+	var shardBy ShardBy
+	switch rawConfig.ShardBy {
+	case "flow", "":
+		shardBy = ShardByFlow
+	case "interface":
+		shardBy = ShardByInterface
+	default:
+		return nil, fmt.Errorf("invalid shardBy \"%s\"", rawConfig.ShardBy)
+	}
+
+	sensorID := rawConfig.SensorID
+	if sensorID == "" {
+		sensorID, err = os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("could not get the hostname to use as sensorId: %w", err)
+		}
+	}
+
+	capture, err := newCaptureConfig(rawConfig.Capture)
+	if err != nil {
+		return nil, err
+	}
+
 	var pcapMode PcapMode
 	switch rawConfig.PcapMode {
 	case "allow":
@@ -213,17 +216,12 @@ func NewConfig(configFileName string) (*Config, error) {
 	}
 
 	config := &Config{
-		Input: rawConfig.Input,
-		Output: OutputConfig{
-			File:   rawConfig.Output.File,
-			Server: rawConfig.Output.Server,
-			Plugins: &PluginsConfig{
-				S3:    s3Config,
-				Kafka: kafkaConfig,
-			},
-		},
+		Input:                  rawConfig.Input,
+		Output:                 output,
 		TLS:                    rawConfig.TLS,
 		Auth:                   rawConfig.Auth,
+		SensorID:               sensorID,
+		Capture:                capture,
 		InputPacketLen:         inputPacketLen,
 		LogFilename:            rawConfig.LogFilename,
 		PcapMode:               pcapMode,
@@ -240,133 +238,9 @@ func NewConfig(configFileName string) (*Config, error) {
 		MaxGatherWait: time.Duration(gatherMaxWaitSec) * time.Second,
 		MaxPayloadLen: s2.MaxEncodedLen(compressBlockSize*kilobyte) + /*hdrData*/ 4 + /*payloadMarker*/ 4,
 		MaxHeaderLen:  + /*hdrData*/ 4 + /*payloadMarker*/ 4,
+		Workers:       workers,
+		ShardBy:       shardBy,
 	}
 
 	return config, nil
 }
-
-func populateKafkaConfig(rawConfig RawConfig) (*KafkaPluginConfig, error) {
-	if rawConfig.Output.Plugins.Kafka == nil {
-		return nil, nil
-	}
-
-	var (
-		clientId    string
-		topic       string
-		acks        string
-		messageSize *bytesize.ByteSize
-		fileSize    *bytesize.ByteSize
-	)
-
-	rawKafkaConfig := rawConfig.Output.Plugins.Kafka
-
-	if rawKafkaConfig.ClientId != nil {
-		clientId = *rawKafkaConfig.ClientId
-	} else {
-		clientId = defaultClientId
-	}
-
-	if rawKafkaConfig.Topic != nil {
-		topic = *rawKafkaConfig.Topic
-	} else {
-		topic = defaultTopic
-	}
-
-	if rawKafkaConfig.MessageSize != nil {
-		ms, err := bytesize.Parse(*rawKafkaConfig.MessageSize)
-		if err != nil {
-			return nil, fmt.Errorf("could not parse the messageSize field %s: %w", *rawKafkaConfig.MessageSize, err)
-		}
-		messageSize = &ms
-	} else {
-		ms := 65 * bytesize.KB
-		messageSize = &ms
-	}
-
-	if rawKafkaConfig.Acks != nil {
-		acks = *rawKafkaConfig.Acks
-	} else {
-		acks = defaultAcks
-	}
-
-	if rawKafkaConfig.FileSize != nil {
-		fs, err := bytesize.Parse(*rawKafkaConfig.FileSize)
-		if err != nil {
-			return nil, fmt.Errorf("could not parse the fileSize field %s: %w", *rawKafkaConfig.FileSize, err)
-		}
-		fileSize = &fs
-	} else {
-		fs := 1 * bytesize.MB
-		fileSize = &fs
-	}
-
-	return &KafkaPluginConfig{
-		Brokers:     strings.Split(rawConfig.Output.Plugins.Kafka.Brokers, ","),
-		ClientId:    clientId,
-		Topic:       topic,
-		MessageSize: messageSize,
-		Acks:        acks,
-		FileSize:    fileSize,
-		Timeout:     rawConfig.Output.Plugins.Kafka.Timeout,
-	}, nil
-}
-
-func populateS3Config(rawConfig RawConfig) (*S3PluginConfig, error) {
-	if rawConfig.Output.Plugins.S3 == nil {
-		return nil, nil
-	}
-
-	var (
-		totalFileSize   *bytesize.ByteSize
-		uploadTimeout   time.Duration
-		uploadChunkSize *bytesize.ByteSize
-		cannedACL       string
-	)
-
-	if rawConfig.Output.Plugins.S3.TotalFileSize != nil {
-		t, err := bytesize.Parse(*rawConfig.Output.Plugins.S3.TotalFileSize)
-		if err != nil {
-			return nil, fmt.Errorf("could not parse the totalFileSize field %s: %w", *rawConfig.Output.Plugins.S3.TotalFileSize, err)
-		}
-		totalFileSize = &t
-	} else {
-		t := 10 * bytesize.MB
-		totalFileSize = &t
-	}
-
-	if rawConfig.Output.Plugins.S3.UploadTimeout != nil {
-		var err error
-		uploadTimeout, err = time.ParseDuration(*rawConfig.Output.Plugins.S3.UploadTimeout)
-		if err != nil {
-			return nil, fmt.Errorf("could not parse the uploadTimeout field %s: %w", *rawConfig.Output.Plugins.S3.UploadTimeout, err)
-		}
-	} else {
-		uploadTimeout = time.Minute
-	}
-
-	if rawConfig.Output.Plugins.S3.UploadChunkSize != nil {
-		u, err := bytesize.Parse(*rawConfig.Output.Plugins.S3.UploadChunkSize)
-		if err != nil {
-			return nil, fmt.Errorf("could not parse the uploadChunkSize field %s: %w", *rawConfig.Output.Plugins.S3.UploadChunkSize, err)
-		}
-		uploadChunkSize = &u
-	} else {
-		u := 5 * bytesize.MB
-		totalFileSize = &u
-	}
-
-	if rawConfig.Output.Plugins.S3.CannedACL != nil {
-		cannedACL = *rawConfig.Output.Plugins.S3.CannedACL
-	} else {
-		cannedACL = string(types.ObjectCannedACLBucketOwnerFullControl)
-	}
-
-	return &S3PluginConfig{
-		Bucket:          rawConfig.Output.Plugins.S3.Bucket,
-		Region:          rawConfig.Output.Plugins.S3.Region,
-		TotalFileSize:   totalFileSize,
-		UploadChunkSize: uploadChunkSize,
-		UploadTimeout:   uploadTimeout,
-		CannedACL:       cannedACL,
-	}, nil
-}
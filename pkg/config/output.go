@@ -0,0 +1,405 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	sinkTypeKey = "type"
+
+	fileSinkType        = "file"
+	pipeSinkType        = "pipe"
+	unixSocketSinkType  = "unixSocket"
+	tcpListenerSinkType = "tcpListener"
+	serverSinkType      = "server"
+	mirrorSinkType      = "mirror"
+	pluginsKey          = "plugins"
+)
+
+type FileOutputConfig struct {
+	Path string
+}
+
+// PipeOutputConfig writes a pcap stream to a named pipe, which is created if
+// it doesn't exist. Once the reader of the pipe goes away, the receiver waits
+// for the next one.
+type PipeOutputConfig struct {
+	Path string
+}
+
+// UnixSocketOutputConfig serves a live pcap stream to every reader connecting
+// to a UNIX domain socket.
+type UnixSocketOutputConfig struct {
+	Path string
+}
+
+// TCPListenerOutputConfig serves a live pcap stream to every reader
+// connecting to a TCP port.
+type TCPListenerOutputConfig struct {
+	Address string
+	Port    *int
+}
+
+// ServerMode decides how a server output spreads packets across its
+// receivers.
+type ServerMode int
+
+const (
+	// FailoverMode streams to the first healthy receiver, in the order they
+	// are configured.
+	FailoverMode ServerMode = iota
+	// LoadBalanceMode spreads the batches across all the healthy receivers.
+	LoadBalanceMode
+)
+
+type ServerAddressConfig struct {
+	Address string
+	Port    *int
+}
+
+// ServerOutputConfig streams packets to one of several receivers, given by
+// Address and Port, by the Receivers list, or by the DNS SRV records of SRV.
+// Host names can resolve to several receivers, e.g. the endpoints of a
+// headless Kubernetes Service. The names are resolved again every
+// ResolveInterval, and receivers which are down are checked again every
+// HealthCheckInterval. Zero intervals mean the defaults. With the QUIC
+// transport, Datagrams sends the batches which fit in a datagram unreliably.
+type ServerOutputConfig struct {
+	Address             string
+	Port                *int
+	Receivers           []ServerAddressConfig
+	SRV                 string
+	Mode                ServerMode
+	HealthCheckInterval time.Duration
+	ResolveInterval     time.Duration
+	Transport           Transport
+	Datagrams           bool
+}
+
+type rawServerOutputConfig struct {
+	Address             string
+	Port                *int
+	Receivers           []ServerAddressConfig
+	SRV                 string `yaml:"srv"`
+	Mode                string
+	HealthCheckInterval string `yaml:"healthCheckInterval"`
+	ResolveInterval     string `yaml:"resolveInterval"`
+	Transport           Transport
+	Datagrams           bool
+}
+
+func (s *ServerOutputConfig) UnmarshalYAML(value *yaml.Node) error {
+	var raw rawServerOutputConfig
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+
+	server := ServerOutputConfig{
+		Address:   raw.Address,
+		Port:      raw.Port,
+		Receivers: raw.Receivers,
+		SRV:       raw.SRV,
+		Transport: raw.Transport,
+		Datagrams: raw.Datagrams,
+	}
+	switch raw.Mode {
+	case "failover", "":
+		server.Mode = FailoverMode
+	case "loadBalance":
+		server.Mode = LoadBalanceMode
+	default:
+		return fmt.Errorf("line %d: invalid server mode \"%s\"", value.Line, raw.Mode)
+	}
+	if raw.HealthCheckInterval != "" {
+		interval, err := time.ParseDuration(raw.HealthCheckInterval)
+		if err != nil {
+			return fmt.Errorf("line %d: could not parse the healthCheckInterval field %s: %w", value.Line, raw.HealthCheckInterval, err)
+		}
+		server.HealthCheckInterval = interval
+	}
+	if raw.ResolveInterval != "" {
+		interval, err := time.ParseDuration(raw.ResolveInterval)
+		if err != nil {
+			return fmt.Errorf("line %d: could not parse the resolveInterval field %s: %w", value.Line, raw.ResolveInterval, err)
+		}
+		server.ResolveInterval = interval
+	}
+
+	*s = server
+	return nil
+}
+
+// Addresses returns the configured receivers, starting with Address and Port.
+func (s *ServerOutputConfig) Addresses() []ServerAddressConfig {
+	var addresses []ServerAddressConfig
+	if s.Address != "" || (len(s.Receivers) == 0 && s.SRV == "") {
+		addresses = append(addresses, ServerAddressConfig{Address: s.Address, Port: s.Port})
+	}
+	return append(addresses, s.Receivers...)
+}
+
+func (s *ServerOutputConfig) String() string {
+	var receivers []string
+	for _, address := range s.Addresses() {
+		receivers = append(receivers, joinAddress(address.Address, address.Port))
+	}
+	if s.SRV != "" {
+		receivers = append(receivers, s.SRV)
+	}
+	return strings.Join(receivers, ",")
+}
+
+// Encapsulation is the format of the packets sent by a mirror output.
+type Encapsulation int
+
+const (
+	// VXLANEncapsulation sends the packets in UDP, like AWS VPC Traffic
+	// Mirroring.
+	VXLANEncapsulation Encapsulation = iota
+	// GREEncapsulation sends the packets in GRE, with the VNI as the key
+	// when set.
+	GREEncapsulation
+	// ERSPANEncapsulation sends the packets in ERSPAN type II, over GRE.
+	ERSPANEncapsulation
+	// TZSPEncapsulation sends the packets in UDP, in TaZmen Sniffer Protocol.
+	TZSPEncapsulation
+)
+
+func (e *Encapsulation) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Value {
+	case "vxlan", "":
+		*e = VXLANEncapsulation
+	case "gre":
+		*e = GREEncapsulation
+	case "erspan":
+		*e = ERSPANEncapsulation
+	case "tzsp":
+		*e = TZSPEncapsulation
+	default:
+		return fmt.Errorf("line %d: invalid encapsulation \"%s\"", value.Line, value.Value)
+	}
+	return nil
+}
+
+func (e Encapsulation) String() string {
+	switch e {
+	case VXLANEncapsulation:
+		return "vxlan"
+	case GREEncapsulation:
+		return "gre"
+	case ERSPANEncapsulation:
+		return "erspan"
+	case TZSPEncapsulation:
+		return "tzsp"
+	default:
+		return "unknown"
+	}
+}
+
+// MirrorOutputConfig sends every packet, encapsulated, to a traffic mirroring
+// target such as an NDR appliance. Port is the UDP port of VXLAN and TZSP,
+// which defaults to the standard one. VNI is the VXLAN network identifier or
+// the GRE key, SessionID the ERSPAN session. Packets over PacketsPerSecond or
+// BytesPerSecond are discarded, zero means no limit.
+type MirrorOutputConfig struct {
+	Address          string
+	Port             *int
+	Encapsulation    Encapsulation
+	VNI              uint32 `yaml:"vni"`
+	SessionID        uint16 `yaml:"sessionId"`
+	PacketsPerSecond int    `yaml:"packetsPerSecond"`
+	BytesPerSecond   int    `yaml:"bytesPerSecond"`
+}
+
+// SinkConfig describes a single core output. Exactly one of the fields is set.
+type SinkConfig struct {
+	File        *FileOutputConfig
+	Pipe        *PipeOutputConfig
+	UnixSocket  *UnixSocketOutputConfig
+	TCPListener *TCPListenerOutputConfig
+	Server      *ServerOutputConfig
+	Mirror      *MirrorOutputConfig
+}
+
+func (s SinkConfig) String() string {
+	switch {
+	case s.File != nil:
+		return fmt.Sprintf("%s %s", fileSinkType, s.File.Path)
+	case s.Pipe != nil:
+		return fmt.Sprintf("%s %s", pipeSinkType, s.Pipe.Path)
+	case s.UnixSocket != nil:
+		return fmt.Sprintf("%s %s", unixSocketSinkType, s.UnixSocket.Path)
+	case s.TCPListener != nil:
+		return fmt.Sprintf("%s %s", tcpListenerSinkType, joinAddress(s.TCPListener.Address, s.TCPListener.Port))
+	case s.Server != nil:
+		return fmt.Sprintf("%s %s", serverSinkType, s.Server)
+	case s.Mirror != nil:
+		return fmt.Sprintf("%s %s %s", mirrorSinkType, s.Mirror.Encapsulation, joinAddress(s.Mirror.Address, s.Mirror.Port))
+	default:
+		return "unknown"
+	}
+}
+
+func joinAddress(address string, port *int) string {
+	if port == nil {
+		return address
+	}
+	return fmt.Sprintf("%s:%d", address, *port)
+}
+
+// OutputConfig holds the core outputs (sinks) and the plugins. All of them
+// get every packet. In the configuration file it can be either a map of
+// output types, each of which can be a single output or a list of them:
+//
+//	output:
+//	  file:
+//	    path: /tmp/dump_file
+//	  server:
+//	    - address: 10.0.0.1
+//	      port: 8081
+//	  plugins:
+//	    s3:
+//	      bucket: foo-pcap
+//
+// or a list of outputs, where the types which are not core outputs are
+// plugins:
+//
+//	output:
+//	  - type: file
+//	    path: /tmp/dump_file
+//	  - type: server
+//	    address: 10.0.0.1
+//	    port: 8081
+//	  - type: s3
+//	    bucket: foo-pcap
+type OutputConfig struct {
+	Sinks   []SinkConfig
+	Plugins PluginsConfig
+}
+
+// Mirrors returns the configuration of all the mirror sinks.
+func (o OutputConfig) Mirrors() []*MirrorOutputConfig {
+	var mirrors []*MirrorOutputConfig
+	for _, sink := range o.Sinks {
+		if sink.Mirror != nil {
+			mirrors = append(mirrors, sink.Mirror)
+		}
+	}
+	return mirrors
+}
+
+// Servers returns the configuration of all the server sinks.
+func (o OutputConfig) Servers() []*ServerOutputConfig {
+	var servers []*ServerOutputConfig
+	for _, sink := range o.Sinks {
+		if sink.Server != nil {
+			servers = append(servers, sink.Server)
+		}
+	}
+	return servers
+}
+
+func (o *OutputConfig) UnmarshalYAML(value *yaml.Node) error {
+	var output OutputConfig
+
+	switch value.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			key, node := value.Content[i].Value, value.Content[i+1]
+			if key == pluginsKey {
+				if err := node.Decode(&output.Plugins); err != nil {
+					return err
+				}
+				continue
+			}
+
+			nodes := []*yaml.Node{node}
+			if node.Kind == yaml.SequenceNode {
+				nodes = node.Content
+			}
+			for _, node := range nodes {
+				sink, err := decodeSinkConfig(key, node)
+				if err != nil {
+					return err
+				}
+				output.Sinks = append(output.Sinks, sink)
+			}
+		}
+	case yaml.SequenceNode:
+		for _, node := range value.Content {
+			var entry struct {
+				Type string
+			}
+			if err := node.Decode(&entry); err != nil {
+				return err
+			}
+			if isSinkType(entry.Type) {
+				sink, err := decodeSinkConfig(entry.Type, node)
+				if err != nil {
+					return err
+				}
+				output.Sinks = append(output.Sinks, sink)
+				continue
+			}
+
+			var options map[string]interface{}
+			if err := node.Decode(&options); err != nil {
+				return err
+			}
+			plugin, err := newPluginConfig("", options)
+			if err != nil {
+				return err
+			}
+			output.Plugins = append(output.Plugins, plugin)
+		}
+	default:
+		return fmt.Errorf("line %d: output should be either a list or a map", value.Line)
+	}
+
+	*o = output
+	return nil
+}
+
+func isSinkType(sinkType string) bool {
+	switch sinkType {
+	case fileSinkType, pipeSinkType, unixSocketSinkType, tcpListenerSinkType, serverSinkType, mirrorSinkType:
+		return true
+	default:
+		return false
+	}
+}
+
+func decodeSinkConfig(sinkType string, node *yaml.Node) (SinkConfig, error) {
+	var sink SinkConfig
+	var out interface{}
+	switch sinkType {
+	case fileSinkType:
+		sink.File = &FileOutputConfig{}
+		out = sink.File
+	case pipeSinkType:
+		sink.Pipe = &PipeOutputConfig{}
+		out = sink.Pipe
+	case unixSocketSinkType:
+		sink.UnixSocket = &UnixSocketOutputConfig{}
+		out = sink.UnixSocket
+	case tcpListenerSinkType:
+		sink.TCPListener = &TCPListenerOutputConfig{}
+		out = sink.TCPListener
+	case serverSinkType:
+		sink.Server = &ServerOutputConfig{}
+		out = sink.Server
+	case mirrorSinkType:
+		sink.Mirror = &MirrorOutputConfig{}
+		out = sink.Mirror
+	default:
+		return SinkConfig{}, fmt.Errorf("line %d: unknown output type \"%s\"", node.Line, sinkType)
+	}
+	if err := node.Decode(out); err != nil {
+		return SinkConfig{}, err
+	}
+	return sink, nil
+}
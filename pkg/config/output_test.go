@@ -0,0 +1,222 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/deepfence/PacketStreamer/pkg/utils"
+)
+
+func TestOutputConfigUnmarshal(t *testing.T) {
+	for _, tt := range []struct {
+		TestName string
+		Input    string
+		Expected OutputConfig
+	}{
+		{
+			TestName: "map with single outputs",
+			Input: `
+file:
+  path: /tmp/dump_file
+server:
+  address: 10.0.0.1
+  port: 8081
+plugins:
+  s3:
+    bucket: foo-pcap
+`,
+			Expected: OutputConfig{
+				Sinks: []SinkConfig{
+					{File: &FileOutputConfig{Path: "/tmp/dump_file"}},
+					{Server: &ServerOutputConfig{Address: "10.0.0.1", Port: utils.IntPtr(8081)}},
+				},
+				Plugins: PluginsConfig{
+					{Type: "s3", Name: "s3", QueueSize: 100, FlushInterval: 10 * time.Second, Options: map[string]interface{}{"bucket": "foo-pcap"}},
+				},
+			},
+		},
+		{
+			TestName: "map with lists of outputs",
+			Input: `
+server:
+  - address: 10.0.0.1
+    port: 8081
+  - address: 10.0.0.2
+    port: 8081
+unixSocket:
+  path: /tmp/packets.sock
+`,
+			Expected: OutputConfig{
+				Sinks: []SinkConfig{
+					{Server: &ServerOutputConfig{Address: "10.0.0.1", Port: utils.IntPtr(8081)}},
+					{Server: &ServerOutputConfig{Address: "10.0.0.2", Port: utils.IntPtr(8081)}},
+					{UnixSocket: &UnixSocketOutputConfig{Path: "/tmp/packets.sock"}},
+				},
+			},
+		},
+		{
+			TestName: "server with several receivers",
+			Input: `
+server:
+  receivers:
+    - address: 10.0.0.1
+      port: 8081
+    - address: receiver.example.com
+      port: 8081
+  srv: _packetstreamer._tcp.receivers.example.com
+  mode: loadBalance
+  healthCheckInterval: 5s
+  resolveInterval: 1m
+  transport: quic
+  datagrams: true
+`,
+			Expected: OutputConfig{
+				Sinks: []SinkConfig{
+					{Server: &ServerOutputConfig{
+						Receivers: []ServerAddressConfig{
+							{Address: "10.0.0.1", Port: utils.IntPtr(8081)},
+							{Address: "receiver.example.com", Port: utils.IntPtr(8081)},
+						},
+						SRV:                 "_packetstreamer._tcp.receivers.example.com",
+						Mode:                LoadBalanceMode,
+						HealthCheckInterval: 5 * time.Second,
+						ResolveInterval:     time.Minute,
+						Transport:           QUICTransport,
+						Datagrams:           true,
+					}},
+				},
+			},
+		},
+		{
+			TestName: "mirror outputs",
+			Input: `
+mirror:
+  - address: 10.0.0.5
+    vni: 42
+    packetsPerSecond: 10000
+  - address: 10.0.0.6
+    encapsulation: erspan
+    sessionId: 7
+    bytesPerSecond: 1000000
+`,
+			Expected: OutputConfig{
+				Sinks: []SinkConfig{
+					{Mirror: &MirrorOutputConfig{Address: "10.0.0.5", VNI: 42, PacketsPerSecond: 10000}},
+					{Mirror: &MirrorOutputConfig{Address: "10.0.0.6", Encapsulation: ERSPANEncapsulation, SessionID: 7, BytesPerSecond: 1000000}},
+				},
+			},
+		},
+		{
+			TestName: "list of outputs and plugins",
+			Input: `
+- type: file
+  path: /tmp/dump_file
+- type: tcpListener
+  address: 127.0.0.1
+  port: 8082
+- type: kafka
+  name: events
+  brokers: 0.0.0.0:9092
+`,
+			Expected: OutputConfig{
+				Sinks: []SinkConfig{
+					{File: &FileOutputConfig{Path: "/tmp/dump_file"}},
+					{TCPListener: &TCPListenerOutputConfig{Address: "127.0.0.1", Port: utils.IntPtr(8082)}},
+				},
+				Plugins: PluginsConfig{
+					{Type: "kafka", Name: "events", QueueSize: 100, FlushInterval: 10 * time.Second, Options: map[string]interface{}{"brokers": "0.0.0.0:9092"}},
+				},
+			},
+		},
+	} {
+		t.Run(tt.TestName, func(t *testing.T) {
+			var output OutputConfig
+			if err := yaml.Unmarshal([]byte(tt.Input), &output); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(output, tt.Expected) {
+				t.Errorf("expected %+v, got %+v", tt.Expected, output)
+			}
+		})
+	}
+}
+
+func TestOutputConfigUnmarshalInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		TestName string
+		Input    string
+	}{
+		{
+			TestName: "unknown output type",
+			Input:    "carrierPigeon:\n  path: /tmp/dump_file\n",
+		},
+		{
+			TestName: "scalar",
+			Input:    "stdout",
+		},
+		{
+			TestName: "invalid server mode",
+			Input:    "server:\n  address: 10.0.0.1\n  port: 8081\n  mode: roundRobin\n",
+		},
+		{
+			TestName: "invalid health check interval",
+			Input:    "server:\n  address: 10.0.0.1\n  port: 8081\n  healthCheckInterval: often\n",
+		},
+		{
+			TestName: "invalid transport",
+			Input:    "server:\n  address: 10.0.0.1\n  port: 8081\n  transport: sctp\n",
+		},
+		{
+			TestName: "invalid encapsulation",
+			Input:    "mirror:\n  address: 10.0.0.5\n  encapsulation: mpls\n",
+		},
+		{
+			TestName: "invalid plugin in a list",
+			Input:    "- type: s3\n  overflow: sometimes\n",
+		},
+	} {
+		t.Run(tt.TestName, func(t *testing.T) {
+			var output OutputConfig
+			if err := yaml.Unmarshal([]byte(tt.Input), &output); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestOutputConfigServers(t *testing.T) {
+	output := OutputConfig{
+		Sinks: []SinkConfig{
+			{Server: &ServerOutputConfig{Address: "10.0.0.1"}},
+			{File: &FileOutputConfig{Path: "stdout"}},
+			{Server: &ServerOutputConfig{Address: "10.0.0.2"}},
+		},
+	}
+	servers := output.Servers()
+	if len(servers) != 2 || servers[0].Address != "10.0.0.1" || servers[1].Address != "10.0.0.2" {
+		t.Errorf("unexpected servers %+v", servers)
+	}
+}
+
+func TestServerOutputConfigAddresses(t *testing.T) {
+	server := ServerOutputConfig{
+		Address: "10.0.0.1",
+		Port:    utils.IntPtr(8081),
+		Receivers: []ServerAddressConfig{
+			{Address: "10.0.0.2", Port: utils.IntPtr(8082)},
+		},
+		SRV: "_packetstreamer._tcp.receivers.example.com",
+	}
+	expected := "10.0.0.1:8081,10.0.0.2:8082,_packetstreamer._tcp.receivers.example.com"
+	if server.String() != expected {
+		t.Errorf("expected %s, got %s", expected, server.String())
+	}
+
+	server = ServerOutputConfig{SRV: "_packetstreamer._tcp.receivers.example.com"}
+	if addresses := server.Addresses(); len(addresses) != 0 {
+		t.Errorf("expected no addresses, got %+v", addresses)
+	}
+}
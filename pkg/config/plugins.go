@@ -0,0 +1,191 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OverflowPolicy decides what happens to packets handed over to a plugin whose
+// queue is full.
+type OverflowPolicy int
+
+const (
+	DropNewest OverflowPolicy = iota
+	DropOldest
+	Block
+)
+
+const (
+	pluginTypeKey      = "type"
+	pluginNameKey      = "name"
+	pluginQueueSizeKey = "queueSize"
+	pluginOverflowKey  = "overflow"
+	pluginFlushKey     = "flushInterval"
+
+	defaultPluginQueueSize     = 100
+	defaultPluginFlushInterval = 10 * time.Second
+)
+
+var (
+	ErrNoPluginType        = errors.New("no type configured for plugin")
+	ErrDuplicatePluginName = errors.New("duplicate plugin name")
+)
+
+// PluginConfig describes a single plugin instance. Options contain the
+// plugin-specific settings, which are decoded by the plugin itself.
+type PluginConfig struct {
+	Type      string
+	Name      string
+	QueueSize int
+	Overflow  OverflowPolicy
+	// FlushInterval is how often the buffered data of the plugin is flushed,
+	// 0 to only flush it when the plugin is closed.
+	FlushInterval time.Duration
+	Options       map[string]interface{}
+}
+
+// Decode decodes the plugin-specific options into out, which should be a
+// pointer to a yaml-tagged struct.
+func (c PluginConfig) Decode(out interface{}) error {
+	raw, err := yaml.Marshal(c.Options)
+	if err != nil {
+		return fmt.Errorf("could not encode options of plugin %s: %w", c.Name, err)
+	}
+	if err := yaml.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("could not decode options of plugin %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+// PluginsConfig is the list of configured plugin instances. In the
+// configuration file it can be either a list of plugins:
+//
+//	plugins:
+//	  - type: s3
+//	    name: archive
+//	    queueSize: 500
+//	    overflow: dropOldest
+//	    flushInterval: 30s
+//	    bucket: foo-pcap
+//
+// or a map keyed by plugin type, where the type doubles as a name:
+//
+//	plugins:
+//	  s3:
+//	    bucket: foo-pcap
+type PluginsConfig []PluginConfig
+
+func (p *PluginsConfig) UnmarshalYAML(value *yaml.Node) error {
+	var plugins PluginsConfig
+
+	switch value.Kind {
+	case yaml.SequenceNode:
+		var entries []map[string]interface{}
+		if err := value.Decode(&entries); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			plugin, err := newPluginConfig("", entry)
+			if err != nil {
+				return err
+			}
+			plugins = append(plugins, plugin)
+		}
+	case yaml.MappingNode:
+		// Mapping nodes keep the order of the file, so iterate over the
+		// node content instead of decoding into a map.
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			var options map[string]interface{}
+			if err := value.Content[i+1].Decode(&options); err != nil {
+				return err
+			}
+			plugin, err := newPluginConfig(value.Content[i].Value, options)
+			if err != nil {
+				return err
+			}
+			plugins = append(plugins, plugin)
+		}
+	default:
+		return fmt.Errorf("line %d: plugins should be either a list or a map", value.Line)
+	}
+
+	*p = plugins
+	return nil
+}
+
+func newPluginConfig(pluginType string, options map[string]interface{}) (PluginConfig, error) {
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+	if t, ok := options[pluginTypeKey].(string); ok {
+		pluginType = t
+	}
+	delete(options, pluginTypeKey)
+
+	name := pluginType
+	if n, ok := options[pluginNameKey].(string); ok {
+		name = n
+	}
+	delete(options, pluginNameKey)
+
+	queueSize := defaultPluginQueueSize
+	if q, ok := options[pluginQueueSizeKey]; ok {
+		size, ok := q.(int)
+		if !ok || size <= 0 {
+			return PluginConfig{}, fmt.Errorf("invalid queueSize \"%v\" of plugin %s", q, name)
+		}
+		queueSize = size
+	}
+	delete(options, pluginQueueSizeKey)
+
+	var overflow OverflowPolicy
+	switch o := options[pluginOverflowKey]; o {
+	case "dropNewest":
+		fallthrough
+	case nil:
+		overflow = DropNewest
+	case "dropOldest":
+		overflow = DropOldest
+	case "block":
+		overflow = Block
+	default:
+		return PluginConfig{}, fmt.Errorf("invalid overflow \"%v\" of plugin %s", o, name)
+	}
+	delete(options, pluginOverflowKey)
+
+	flushInterval := defaultPluginFlushInterval
+	if f, ok := options[pluginFlushKey]; ok {
+		interval, err := time.ParseDuration(fmt.Sprint(f))
+		if err != nil || interval < 0 {
+			return PluginConfig{}, fmt.Errorf("invalid flushInterval \"%v\" of plugin %s", f, name)
+		}
+		flushInterval = interval
+	}
+	delete(options, pluginFlushKey)
+
+	return PluginConfig{
+		Type:          pluginType,
+		Name:          name,
+		QueueSize:     queueSize,
+		Overflow:      overflow,
+		FlushInterval: flushInterval,
+		Options:       options,
+	}, nil
+}
+
+func validatePlugins(plugins PluginsConfig) error {
+	names := make(map[string]bool, len(plugins))
+	for _, plugin := range plugins {
+		if plugin.Type == "" {
+			return ErrNoPluginType
+		}
+		if names[plugin.Name] {
+			return fmt.Errorf("%w: %s", ErrDuplicatePluginName, plugin.Name)
+		}
+		names[plugin.Name] = true
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestPluginsConfigUnmarshal(t *testing.T) {
+	for _, tt := range []struct {
+		TestName string
+		Input    string
+		Expected PluginsConfig
+	}{
+		{
+			TestName: "map keyed by plugin type",
+			Input: `
+s3:
+  bucket: foo-pcap
+kafka:
+  brokers: 0.0.0.0:9092
+`,
+			Expected: PluginsConfig{
+				{Type: "s3", Name: "s3", QueueSize: 100, FlushInterval: 10 * time.Second, Options: map[string]interface{}{"bucket": "foo-pcap"}},
+				{Type: "kafka", Name: "kafka", QueueSize: 100, FlushInterval: 10 * time.Second, Options: map[string]interface{}{"brokers": "0.0.0.0:9092"}},
+			},
+		},
+		{
+			TestName: "list with the same plugin type configured twice",
+			Input: `
+- type: s3
+  name: primary
+  queueSize: 500
+  overflow: block
+  flushInterval: 1m
+  bucket: foo-pcap
+- type: s3
+  name: secondary
+  overflow: dropOldest
+  bucket: bar-pcap
+`,
+			Expected: PluginsConfig{
+				{Type: "s3", Name: "primary", QueueSize: 500, Overflow: Block, FlushInterval: time.Minute, Options: map[string]interface{}{"bucket": "foo-pcap"}},
+				{Type: "s3", Name: "secondary", QueueSize: 100, Overflow: DropOldest, FlushInterval: 10 * time.Second, Options: map[string]interface{}{"bucket": "bar-pcap"}},
+			},
+		},
+		{
+			TestName: "list entry without a name",
+			Input: `
+- type: kafka
+`,
+			Expected: PluginsConfig{
+				{Type: "kafka", Name: "kafka", QueueSize: 100, FlushInterval: 10 * time.Second, Options: map[string]interface{}{}},
+			},
+		},
+	} {
+		t.Run(tt.TestName, func(t *testing.T) {
+			var plugins PluginsConfig
+			if err := yaml.Unmarshal([]byte(tt.Input), &plugins); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(plugins, tt.Expected) {
+				t.Errorf("expected %v, got %v", tt.Expected, plugins)
+			}
+		})
+	}
+}
+
+func TestPluginsConfigUnmarshalInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		TestName string
+		Input    string
+	}{
+		{
+			TestName: "invalid overflow policy",
+			Input:    "- type: s3\n  overflow: sometimes\n",
+		},
+		{
+			TestName: "negative queue size",
+			Input:    "- type: s3\n  queueSize: -1\n",
+		},
+		{
+			TestName: "invalid flush interval",
+			Input:    "- type: s3\n  flushInterval: often\n",
+		},
+		{
+			TestName: "scalar instead of list or map",
+			Input:    "s3",
+		},
+	} {
+		t.Run(tt.TestName, func(t *testing.T) {
+			var plugins PluginsConfig
+			if err := yaml.Unmarshal([]byte(tt.Input), &plugins); err == nil {
+				t.Errorf("expected an error, got %v", plugins)
+			}
+		})
+	}
+}
+
+func TestPluginConfigDecode(t *testing.T) {
+	pluginConfig := PluginConfig{
+		Type: "s3",
+		Name: "s3",
+		Options: map[string]interface{}{
+			"bucket":        "foo-pcap",
+			"totalFileSize": "10MB",
+		},
+	}
+
+	var decoded struct {
+		Bucket        string
+		TotalFileSize *string `yaml:"totalFileSize"`
+	}
+	if err := pluginConfig.Decode(&decoded); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decoded.Bucket != "foo-pcap" || decoded.TotalFileSize == nil || *decoded.TotalFileSize != "10MB" {
+		t.Errorf("unexpected decoded options: %+v", decoded)
+	}
+}
+
+func TestValidatePlugins(t *testing.T) {
+	for _, tt := range []struct {
+		TestName      string
+		ExpectedError error
+		Plugins       PluginsConfig
+	}{
+		{
+			TestName:      "Errors when a plugin has no type",
+			ExpectedError: ErrNoPluginType,
+			Plugins:       PluginsConfig{{Name: "foo"}},
+		},
+		{
+			TestName:      "Errors when two plugins have the same name",
+			ExpectedError: ErrDuplicatePluginName,
+			Plugins: PluginsConfig{
+				{Type: "s3", Name: "s3"},
+				{Type: "s3", Name: "s3"},
+			},
+		},
+		{
+			TestName:      "Accepts the same type with different names",
+			ExpectedError: nil,
+			Plugins: PluginsConfig{
+				{Type: "s3", Name: "primary"},
+				{Type: "s3", Name: "secondary"},
+			},
+		},
+	} {
+		t.Run(tt.TestName, func(t *testing.T) {
+			err := validatePlugins(tt.Plugins)
+			if !errors.Is(err, tt.ExpectedError) {
+				t.Errorf("expected error [%v], got error [%v]", tt.ExpectedError, err)
+			}
+		})
+	}
+}
@@ -5,17 +5,67 @@ import (
 )
 
 var (
-	ErrNoInputConfigured        = errors.New("no input configured")
-	ErrNoPortConfiguredForInput = errors.New("no port configured for input")
+	ErrNoInputConfigured                    = errors.New("no input configured")
+	ErrNoPortConfiguredForInput             = errors.New("no port configured for input")
+	ErrNoPathConfiguredForFileOutput        = errors.New("no path configured for file output")
+	ErrNoPathConfiguredForPipeOutput        = errors.New("no path configured for pipe output")
+	ErrNoPathConfiguredForUnixSocketOutput  = errors.New("no path configured for unixSocket output")
+	ErrNoPortConfiguredForTCPListenerOutput = errors.New("no port configured for tcpListener output")
+	ErrNoCertificateConfiguredForQUIC       = errors.New("no TLS certificate configured for the QUIC transport")
+	ErrNoAddressConfiguredForMirrorOutput   = errors.New("no address configured for mirror output")
+	ErrInvalidVNI                           = errors.New("VNI should be less than 2^24")
+	ErrInvalidERSPANSessionID               = errors.New("ERSPAN session ID should be less than 1024")
 )
 
 func ValidateReceiverConfig(config *Config) error {
 	if config.Input == nil {
 		return ErrNoInputConfigured
 	}
-	if config.Input.Port == nil {
+	if config.Input.Port == nil && len(config.Input.Mirrors) == 0 {
 		return ErrNoPortConfiguredForInput
 	}
+	if config.Input.Port != nil && config.Input.Transport == QUICTransport && (config.TLS.CertFile == "" || config.TLS.KeyFile == "") {
+		return ErrNoCertificateConfiguredForQUIC
+	}
+	for _, sink := range config.Output.Sinks {
+		if err := validateSink(sink); err != nil {
+			return err
+		}
+	}
 
+	return validatePlugins(config.Output.Plugins)
+}
+
+func validateSink(sink SinkConfig) error {
+	switch {
+	case sink.File != nil && sink.File.Path == "":
+		return ErrNoPathConfiguredForFileOutput
+	case sink.Pipe != nil && sink.Pipe.Path == "":
+		return ErrNoPathConfiguredForPipeOutput
+	case sink.UnixSocket != nil && sink.UnixSocket.Path == "":
+		return ErrNoPathConfiguredForUnixSocketOutput
+	case sink.TCPListener != nil && sink.TCPListener.Port == nil:
+		return ErrNoPortConfiguredForTCPListenerOutput
+	case sink.Server != nil:
+		for _, address := range sink.Server.Addresses() {
+			if address.Port == nil {
+				return ErrNoPortConfiguredForServerOutput
+			}
+		}
+	case sink.Mirror != nil:
+		return validateMirror(sink.Mirror)
+	}
+	return nil
+}
+
+func validateMirror(mirror *MirrorOutputConfig) error {
+	switch {
+	case mirror.Address == "":
+		return ErrNoAddressConfiguredForMirrorOutput
+	case mirror.VNI >= 1<<24:
+		return ErrInvalidVNI
+	case mirror.Encapsulation == ERSPANEncapsulation && mirror.SessionID >= 1<<10:
+		return ErrInvalidERSPANSessionID
+	}
 	return nil
 }
@@ -2,6 +2,7 @@ package config
 
 import (
 	"github.com/deepfence/PacketStreamer/pkg/testutils"
+	"github.com/deepfence/PacketStreamer/pkg/utils"
 	"testing"
 )
 
@@ -26,6 +27,80 @@ func TestValidateReceiverConfig(t *testing.T) {
 				Input: &InputConfig{},
 			},
 		},
+		{
+			TestName:      "Errors when no certificate is configured for the QUIC transport",
+			ShouldError:   true,
+			ExpectedError: ErrNoCertificateConfiguredForQUIC,
+			Config: &Config{
+				Input: &InputConfig{Port: utils.IntPtr(8081), Transport: QUICTransport},
+			},
+		},
+		{
+			TestName:      "Errors when no path is configured for the pipe output",
+			ShouldError:   true,
+			ExpectedError: ErrNoPathConfiguredForPipeOutput,
+			Config: &Config{
+				Input: &InputConfig{Port: utils.IntPtr(8081)},
+				Output: OutputConfig{
+					Sinks: []SinkConfig{{Pipe: &PipeOutputConfig{}}},
+				},
+			},
+		},
+		{
+			TestName:      "Errors when no path is configured for the unixSocket output",
+			ShouldError:   true,
+			ExpectedError: ErrNoPathConfiguredForUnixSocketOutput,
+			Config: &Config{
+				Input: &InputConfig{Port: utils.IntPtr(8081)},
+				Output: OutputConfig{
+					Sinks: []SinkConfig{{UnixSocket: &UnixSocketOutputConfig{}}},
+				},
+			},
+		},
+		{
+			TestName:      "Errors when no port is configured for the tcpListener output",
+			ShouldError:   true,
+			ExpectedError: ErrNoPortConfiguredForTCPListenerOutput,
+			Config: &Config{
+				Input: &InputConfig{Port: utils.IntPtr(8081)},
+				Output: OutputConfig{
+					Sinks: []SinkConfig{{TCPListener: &TCPListenerOutputConfig{Address: "127.0.0.1"}}},
+				},
+			},
+		},
+		{
+			TestName:      "Errors when no address is configured for the mirror output",
+			ShouldError:   true,
+			ExpectedError: ErrNoAddressConfiguredForMirrorOutput,
+			Config: &Config{
+				Input: &InputConfig{Port: utils.IntPtr(8081)},
+				Output: OutputConfig{
+					Sinks: []SinkConfig{{Mirror: &MirrorOutputConfig{}}},
+				},
+			},
+		},
+		{
+			TestName:      "Errors when the VNI doesn't fit in 24 bits",
+			ShouldError:   true,
+			ExpectedError: ErrInvalidVNI,
+			Config: &Config{
+				Input: &InputConfig{Port: utils.IntPtr(8081)},
+				Output: OutputConfig{
+					Sinks: []SinkConfig{{Mirror: &MirrorOutputConfig{Address: "10.0.0.5", VNI: 1 << 24}}},
+				},
+			},
+		},
+		{
+			TestName:      "Errors when the ERSPAN session ID doesn't fit in 10 bits",
+			ShouldError:   true,
+			ExpectedError: ErrInvalidERSPANSessionID,
+			Config: &Config{
+				Input: &InputConfig{Port: utils.IntPtr(8081)},
+				Output: OutputConfig{
+					Sinks: []SinkConfig{{Mirror: &MirrorOutputConfig{Address: "10.0.0.5", Encapsulation: ERSPANEncapsulation, SessionID: 1024}}},
+				},
+			},
+		},
 	} {
 		t.Run(tt.TestName, func(t *testing.T) {
 			err := ValidateReceiverConfig(tt.Config)
@@ -36,3 +111,14 @@ func TestValidateReceiverConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateReceiverConfigMirrorInput(t *testing.T) {
+	config := &Config{
+		Input: &InputConfig{
+			Mirrors: []MirrorInputConfig{{Encapsulation: VXLANEncapsulation}},
+		},
+	}
+	if err := ValidateReceiverConfig(config); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -7,17 +7,21 @@ import (
 var (
 	ErrNoOutputConfigured              = errors.New("no output configured")
 	ErrNoPortConfiguredForServerOutput = errors.New("no port configured for server output")
+	ErrPcapStreamOutputOnSensor        = errors.New("pipe, unixSocket and tcpListener outputs are only supported by the receiver")
 )
 
 func ValidateSensorConfig(config *Config) error {
-	if config.Output.File == nil && config.Output.Server == nil &&
-		(config.Output.Plugins == nil ||
-			(config.Output.Plugins.S3 == nil && config.Output.Plugins.Kafka == nil)) {
+	if len(config.Output.Sinks) == 0 && len(config.Output.Plugins) == 0 {
 		return ErrNoOutputConfigured
 	}
-	if config.Output.Server != nil && config.Output.Server.Port == nil {
-		return ErrNoPortConfiguredForServerOutput
+	for _, sink := range config.Output.Sinks {
+		if sink.Pipe != nil || sink.UnixSocket != nil || sink.TCPListener != nil {
+			return ErrPcapStreamOutputOnSensor
+		}
+		if err := validateSink(sink); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return validatePlugins(config.Output.Plugins)
 }
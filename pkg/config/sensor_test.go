@@ -16,22 +16,45 @@ func TestValidateSensorConfig(t *testing.T) {
 			TestName:      "Errors when no output is defined",
 			ShouldError:   true,
 			ExpectedError: ErrNoOutputConfigured,
+			Config: &Config{
+				Output: OutputConfig{},
+			},
+		},
+		{
+			TestName:      "Errors when mo port is configured for server output",
+			ShouldError:   true,
+			ExpectedError: ErrNoPortConfiguredForServerOutput,
 			Config: &Config{
 				Output: OutputConfig{
-					File:   nil,
-					Server: nil,
+					Sinks: []SinkConfig{{
+						Server: &ServerOutputConfig{
+							Port: nil,
+						},
+					}},
 				},
 			},
 		},
 		{
-			TestName:      "Errors when mo port is configured for server output",
+			TestName:      "Errors when no port is configured for a receiver of a server output",
 			ShouldError:   true,
 			ExpectedError: ErrNoPortConfiguredForServerOutput,
 			Config: &Config{
 				Output: OutputConfig{
-					Server: &ServerOutputConfig{
-						Port: nil,
-					},
+					Sinks: []SinkConfig{{
+						Server: &ServerOutputConfig{
+							Receivers: []ServerAddressConfig{{Address: "10.0.0.1"}},
+						},
+					}},
+				},
+			},
+		},
+		{
+			TestName:      "Errors when a pcap stream output is configured",
+			ShouldError:   true,
+			ExpectedError: ErrPcapStreamOutputOnSensor,
+			Config: &Config{
+				Output: OutputConfig{
+					Sinks: []SinkConfig{{Pipe: &PipeOutputConfig{Path: "/tmp/packets.pipe"}}},
 				},
 			},
 		},
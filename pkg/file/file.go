@@ -1,3 +1,13 @@
 package file
 
+// Header is the magic which starts every frame of packets sent by sensors.
 var Header = []byte{0xde, 0xef, 0xec, 0xe0}
+
+// SensorHeader is the magic of the frames carrying the ID of the sensor which
+// captured the packets of the following frames.
+var SensorHeader = []byte{0xde, 0xef, 0xec, 0xe1}
+
+// LinkTypeHeader is the magic of the frames carrying the link type of the
+// packets of the following frames, as a little-endian uint32. The packets are
+// Ethernet ones until the first of them.
+var LinkTypeHeader = []byte{0xde, 0xef, 0xec, 0xe2}
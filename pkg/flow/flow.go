@@ -0,0 +1,154 @@
+// Package flow identifies the flows packets belong to.
+package flow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// Key is the IP protocol, addresses and TCP, UDP or SCTP ports of a flow. The
+// endpoints are ordered, the lower one first, so that both directions of a
+// flow have the same key. The addresses point into the packet they were
+// parsed from.
+type Key struct {
+	Protocol layers.IPProtocol
+	AddrA    net.IP
+	AddrB    net.IP
+	PortA    uint16
+	PortB    uint16
+	// HasPorts is false for the other protocols, and for fragmented packets,
+	// since only the first fragment carries the ports.
+	HasPorts bool
+}
+
+// Parse returns the key of the flow of the packet. It returns false for
+// packets which are not IP.
+func Parse(linkType layers.LinkType, data []byte) (Key, bool) {
+	var offset int
+	var etherType layers.EthernetType
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		if len(data) < 14 {
+			return Key{}, false
+		}
+		etherType = layers.EthernetType(binary.BigEndian.Uint16(data[12:14]))
+		offset = 14
+		for etherType == layers.EthernetTypeDot1Q || etherType == layers.EthernetTypeQinQ {
+			if len(data) < offset+4 {
+				return Key{}, false
+			}
+			etherType = layers.EthernetType(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
+			offset += 4
+		}
+	case layers.LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return Key{}, false
+		}
+		etherType = layers.EthernetType(binary.BigEndian.Uint16(data[14:16]))
+		offset = 16
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		if len(data) < 1 {
+			return Key{}, false
+		}
+		switch data[0] >> 4 {
+		case 4:
+			etherType = layers.EthernetTypeIPv4
+		case 6:
+			etherType = layers.EthernetTypeIPv6
+		}
+	}
+	data = data[offset:]
+
+	var key Key
+	var transport []byte
+	switch etherType {
+	case layers.EthernetTypeIPv4:
+		if len(data) < 20 {
+			return Key{}, false
+		}
+		headerLen := int(data[0]&0x0f) * 4
+		if headerLen < 20 || len(data) < headerLen {
+			return Key{}, false
+		}
+		key.Protocol = layers.IPProtocol(data[9])
+		key.AddrA, key.AddrB = data[12:16], data[16:20]
+		// more fragments flag or a non-zero fragment offset
+		if binary.BigEndian.Uint16(data[6:8])&0x3fff == 0 {
+			transport = data[headerLen:]
+		}
+	case layers.EthernetTypeIPv6:
+		if len(data) < 40 {
+			return Key{}, false
+		}
+		key.Protocol = layers.IPProtocol(data[6])
+		key.AddrA, key.AddrB = data[8:24], data[24:40]
+		transport = data[40:]
+	default:
+		return Key{}, false
+	}
+
+	switch key.Protocol {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP, layers.IPProtocolSCTP:
+		if len(transport) >= 4 {
+			key.HasPorts = true
+			key.PortA = binary.BigEndian.Uint16(transport[0:2])
+			key.PortB = binary.BigEndian.Uint16(transport[2:4])
+		}
+	}
+
+	if compareEndpoints(key.AddrA, key.PortA, key.AddrB, key.PortB) > 0 {
+		key.AddrA, key.PortA, key.AddrB, key.PortB = key.AddrB, key.PortB, key.AddrA, key.PortA
+	}
+	return key, true
+}
+
+// Hash returns an FNV-1a hash of the key.
+func (k Key) Hash() uint32 {
+	hash := uint32(fnvOffset32)
+	hash = (hash ^ uint32(k.Protocol)) * fnvPrime32
+	for _, b := range k.AddrA {
+		hash = (hash ^ uint32(b)) * fnvPrime32
+	}
+	if k.HasPorts {
+		hash = (hash ^ uint32(k.PortA>>8)) * fnvPrime32
+		hash = (hash ^ uint32(k.PortA&0xff)) * fnvPrime32
+	}
+	for _, b := range k.AddrB {
+		hash = (hash ^ uint32(b)) * fnvPrime32
+	}
+	if k.HasPorts {
+		hash = (hash ^ uint32(k.PortB>>8)) * fnvPrime32
+		hash = (hash ^ uint32(k.PortB&0xff)) * fnvPrime32
+	}
+	return hash
+}
+
+// String returns the key like "tcp 10.0.0.1:1025 192.168.0.1:443", or without
+// the ports when there aren't any.
+func (k Key) String() string {
+	endpoint := func(addr net.IP, port uint16) string {
+		if !k.HasPorts {
+			return addr.String()
+		}
+		return net.JoinHostPort(addr.String(), fmt.Sprint(port))
+	}
+	return strings.ToLower(k.Protocol.String()) + " " + endpoint(k.AddrA, k.PortA) + " " + endpoint(k.AddrB, k.PortB)
+}
+
+func compareEndpoints(addrA net.IP, portA uint16, addrB net.IP, portB uint16) int {
+	for i := range addrA {
+		if addrA[i] != addrB[i] {
+			return int(addrA[i]) - int(addrB[i])
+		}
+	}
+	return int(portA) - int(portB)
+}
@@ -0,0 +1,76 @@
+package flow
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepfence/PacketStreamer/pkg/testutils"
+)
+
+func keyHash(linkType layers.LinkType, data []byte) (uint32, bool) {
+	key, ok := Parse(linkType, data)
+	return key.Hash(), ok
+}
+
+func TestKeyHash(t *testing.T) {
+	hash, ok := keyHash(layers.LinkTypeEthernet, testutils.SyntheticPacket(t, 1, false, 0, 8))
+	if !ok {
+		t.Fatal("expected an IPv4 packet to be hashed")
+	}
+
+	reverse, _ := keyHash(layers.LinkTypeEthernet, testutils.SyntheticPacket(t, 1, true, 0, 8))
+	if reverse != hash {
+		t.Errorf("expected both directions of a flow to have the same hash, got %d and %d", hash, reverse)
+	}
+
+	other, _ := keyHash(layers.LinkTypeEthernet, testutils.SyntheticPacket(t, 2, false, 0, 8))
+	if other == hash {
+		t.Error("expected different flows to have different hashes")
+	}
+
+	// the same packet with a VLAN tag
+	untagged := testutils.SyntheticPacket(t, 1, false, 0, 8)
+	tagged := append([]byte{}, untagged[:12]...)
+	tagged = append(tagged, 0x81, 0x00, 0x00, 0x64)
+	tagged = append(tagged, untagged[12:]...)
+	vlan, ok := keyHash(layers.LinkTypeEthernet, tagged)
+	if !ok || vlan != hash {
+		t.Errorf("expected the VLAN tagged packet to have hash %d, got %d", hash, vlan)
+	}
+
+	// the same packet without the link layer
+	raw, ok := keyHash(layers.LinkTypeRaw, untagged[14:])
+	if !ok || raw != hash {
+		t.Errorf("expected the raw IP packet to have hash %d, got %d", hash, raw)
+	}
+
+	arp := make([]byte, 42)
+	binary.BigEndian.PutUint16(arp[12:14], uint16(layers.EthernetTypeARP))
+	if _, ok := keyHash(layers.LinkTypeEthernet, arp); ok {
+		t.Error("expected an ARP packet not to be hashed")
+	}
+	if _, ok := keyHash(layers.LinkTypeEthernet, untagged[:20]); ok {
+		t.Error("expected a truncated packet not to be hashed")
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	data := testutils.SyntheticPacket(b, 1, false, 0, 1400)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Parse(layers.LinkTypeEthernet, data)
+	}
+}
+
+func TestKeyString(t *testing.T) {
+	key, ok := Parse(layers.LinkTypeEthernet, testutils.SyntheticPacket(t, 1, true, 0, 8))
+	if !ok {
+		t.Fatal("expected an IPv4 packet to be parsed")
+	}
+	if expected := "tcp 10.0.0.1:1025 192.168.0.1:443"; key.String() != expected {
+		t.Errorf("expected %q, got %q", expected, key.String())
+	}
+}
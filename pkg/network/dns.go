@@ -2,8 +2,10 @@ package network
 
 import (
 	"context"
+	"net"
 )
 
 type Resolver interface {
 	LookupHost(context.Context, string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
 }
@@ -0,0 +1,332 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inhies/go-bytesize"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/plugins"
+)
+
+const (
+	defaultRotateInterval = 5 * time.Minute
+	defaultMaxFileSize    = 100 * bytesize.MB
+
+	// rotateDelay is how long after the end of their time window the files
+	// are completed, so that the packets gathered at the time get in.
+	rotateDelay = 10 * time.Second
+
+	// unknownSensor is the directory of the packets without a sensor ID.
+	unknownSensor = "unknown"
+)
+
+var (
+	ErrMissingRoot            = errors.New("root should be set")
+	ErrRotateIntervalTooShort = errors.New("rotateInterval should be at least 1s")
+	ErrInvalidMaxFileSize     = errors.New("maxFileSize should be at least 1B")
+	ErrUnknownCompression     = errors.New("compression should be one of none or zstd")
+)
+
+func init() {
+	plugins.Register("archive", func() plugins.Plugin {
+		return &Plugin{}
+	})
+}
+
+type Config struct {
+	// Root is the directory of the archive, on a local or network file
+	// system.
+	Root string `yaml:"root"`
+	// RotateInterval cuts the files on time boundaries aligned to it, by the
+	// timestamps of the packets. MaxFileSize cuts them once they reach that
+	// size, before compression.
+	RotateInterval *string `yaml:"rotateInterval,omitempty"`
+	MaxFileSize    *string `yaml:"maxFileSize,omitempty"`
+	// Compression is none or zstd.
+	Compression string `yaml:"compression,omitempty"`
+	// MaxAge and MaxTotalSize are the retention policy. The oldest files are
+	// deleted once their last packet is older than MaxAge, or while the
+	// archive is bigger than MaxTotalSize. Files are kept forever without
+	// them.
+	MaxAge       *string `yaml:"maxAge,omitempty"`
+	MaxTotalSize *string `yaml:"maxTotalSize,omitempty"`
+}
+
+type Plugin struct {
+	Root           string
+	SnapLen        int
+	RotateInterval time.Duration
+	MaxFileSize    int
+	Compress       bool
+	MaxAge         time.Duration
+	MaxTotalSize   int64
+
+	mu sync.Mutex
+	// files are the files being written, by sensor directory.
+	files map[string]*archiveFile
+	// retention keeps track of the complete files, to delete the oldest ones.
+	retention *retention
+	// windows cut the files on the boundaries of RotateInterval, and
+	// rotateTimer completes the files of the past time windows and applies
+	// the retention policy.
+	windows     batch.Windows
+	rotateTimer *time.Timer
+	closed      bool
+	stats       plugins.Stats
+}
+
+func (p *Plugin) Init(ctx context.Context, global *config.Config, pluginConfig config.PluginConfig) error {
+	var cfg Config
+	if err := pluginConfig.Decode(&cfg); err != nil {
+		return err
+	}
+
+	if cfg.Root == "" {
+		return ErrMissingRoot
+	}
+
+	var err error
+	rotateInterval := defaultRotateInterval
+	if cfg.RotateInterval != nil {
+		rotateInterval, err = time.ParseDuration(*cfg.RotateInterval)
+		if err != nil {
+			return fmt.Errorf("could not parse the rotateInterval field %s: %w", *cfg.RotateInterval, err)
+		}
+		if rotateInterval < time.Second {
+			return ErrRotateIntervalTooShort
+		}
+	}
+
+	maxFileSize := defaultMaxFileSize
+	if cfg.MaxFileSize != nil {
+		maxFileSize, err = bytesize.Parse(*cfg.MaxFileSize)
+		if err != nil {
+			return fmt.Errorf("could not parse the maxFileSize field %s: %w", *cfg.MaxFileSize, err)
+		}
+	}
+	if maxFileSize < 1 {
+		return ErrInvalidMaxFileSize
+	}
+
+	var compress bool
+	switch strings.ToLower(cfg.Compression) {
+	case "", "none":
+	case "zstd":
+		compress = true
+	default:
+		return fmt.Errorf("%w, not %s", ErrUnknownCompression, cfg.Compression)
+	}
+
+	var maxAge time.Duration
+	if cfg.MaxAge != nil {
+		maxAge, err = time.ParseDuration(*cfg.MaxAge)
+		if err != nil {
+			return fmt.Errorf("could not parse the maxAge field %s: %w", *cfg.MaxAge, err)
+		}
+	}
+
+	var maxTotalSize bytesize.ByteSize
+	if cfg.MaxTotalSize != nil {
+		maxTotalSize, err = bytesize.Parse(*cfg.MaxTotalSize)
+		if err != nil {
+			return fmt.Errorf("could not parse the maxTotalSize field %s: %w", *cfg.MaxTotalSize, err)
+		}
+	}
+
+	if err := os.MkdirAll(cfg.Root, 0o700); err != nil {
+		return fmt.Errorf("could not create the archive directory: %w", err)
+	}
+	retention, err := scanArchive(cfg.Root)
+	if err != nil {
+		return fmt.Errorf("could not scan the archive: %w", err)
+	}
+
+	p.Root = cfg.Root
+	p.SnapLen = global.InputPacketLen
+	p.RotateInterval = rotateInterval
+	p.MaxFileSize = int(maxFileSize)
+	p.Compress = compress
+	p.MaxAge = maxAge
+	p.MaxTotalSize = int64(maxTotalSize)
+	p.files = make(map[string]*archiveFile)
+	p.retention = retention
+	p.applyRetention(time.Now())
+	p.windows = batch.Windows{Interval: rotateInterval, Delay: rotateDelay}
+	p.rotateTimer = time.AfterFunc(p.windows.UntilOver(time.Now()), p.onRotate)
+
+	return nil
+}
+
+// Write appends the packets of the batch to the files of their sensor, split
+// by time window. A file is completed once the packets of a later window or
+// of another link type come in, or once it reaches the maximum file size.
+func (p *Plugin) Write(ctx context.Context, b *batch.Batch) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.windows.Split(b.Metadata, b.Data, func(window time.Time, m batch.Metadata, records []byte) error {
+		return p.write(m, records, window)
+	})
+}
+
+func (p *Plugin) write(m batch.Metadata, records []byte, window time.Time) error {
+	sensor := sensorDir(m.SensorID)
+	f := p.files[sensor]
+	if f != nil && (window.After(f.window) || f.capture.LinkType != m.PcapLinkType()) {
+		// the packets of the previous windows are all there, and the packets
+		// of another link type need a file of their own
+		delete(p.files, sensor)
+		if err := p.complete(f); err != nil {
+			return err
+		}
+		f = nil
+	}
+	if f == nil {
+		var err error
+		f, err = createFile(p.Root, sensor, m, window, p.SnapLen, p.Compress)
+		if err != nil {
+			p.stats.Errors++
+			return err
+		}
+		p.files[sensor] = f
+	}
+
+	if err := f.write(records); err != nil {
+		p.stats.Errors++
+		delete(p.files, sensor)
+		// what was written so far is kept
+		if err := p.complete(f); err != nil {
+			log.Printf("error completing %s - %v\n", f.partial, err)
+		}
+		return err
+	}
+	f.addCapture(m)
+	p.stats.Writes++
+	p.stats.BytesWritten += uint64(len(records))
+
+	if f.size >= p.MaxFileSize {
+		// the next batch of the sensor starts a new file
+		delete(p.files, sensor)
+		return p.complete(f)
+	}
+	return nil
+}
+
+// complete gives the file its final name and side-car index, and applies the
+// retention policy.
+func (p *Plugin) complete(f *archiveFile) error {
+	archived, err := f.complete(p.RotateInterval)
+	if archived.path != "" {
+		p.retention.add(archived)
+		p.applyRetention(time.Now())
+	}
+	if err != nil {
+		p.stats.Errors++
+		return err
+	}
+	return nil
+}
+
+// completeFiles completes the files of all sensors. The following batches
+// start new ones.
+func (p *Plugin) completeFiles() error {
+	var errs []error
+	for sensor, f := range p.files {
+		delete(p.files, sensor)
+		if err := p.complete(f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// applyRetention deletes the oldest files, until the archive is within the
+// retention policy.
+func (p *Plugin) applyRetention(now time.Time) {
+	for _, path := range p.retention.expire(now, p.MaxAge, p.MaxTotalSize) {
+		if err := removeFile(p.Root, path); err != nil {
+			p.stats.Errors++
+			log.Printf("error deleting %s - %v\n", path, err)
+		}
+	}
+}
+
+// Flush writes the buffered packets to the files being written.
+func (p *Plugin) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var errs []error
+	for _, f := range p.files {
+		if err := f.flush(); err != nil {
+			p.stats.Errors++
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close completes the files being written.
+func (p *Plugin) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	if p.rotateTimer != nil {
+		p.rotateTimer.Stop()
+	}
+	return p.completeFiles()
+}
+
+func (p *Plugin) Stats() plugins.Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stats
+}
+
+// onRotate completes the files whose time window is over, even when there are
+// no packets of the following windows, and deletes the files which got too
+// old.
+func (p *Plugin) onRotate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	now := time.Now()
+	defer p.rotateTimer.Reset(p.windows.UntilOver(now))
+
+	for sensor, f := range p.files {
+		if !p.windows.Over(f.window, now) {
+			continue
+		}
+		delete(p.files, sensor)
+		if err := p.complete(f); err != nil {
+			log.Printf("error completing %s - %v\n", f.partial, err)
+		}
+	}
+	p.applyRetention(now)
+}
+
+// sensorDir returns the directory of the files of the sensor, keeping sensor
+// IDs from adding levels to the tree.
+func sensorDir(sensorID string) string {
+	switch sensorID {
+	case "":
+		return unknownSensor
+	case ".", "..":
+		return strings.Repeat("_", len(sensorID))
+	}
+	return strings.NewReplacer("/", "_", "\\", "_").Replace(sensorID)
+}
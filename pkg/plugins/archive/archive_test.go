@@ -0,0 +1,372 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/deepfence/PacketStreamer/pkg/plugins/plugintest"
+)
+
+var testStart = time.Date(2024, 5, 3, 12, 59, 0, 0, time.UTC)
+
+func newTestPlugin(t *testing.T, root string, options map[string]interface{}) *Plugin {
+	t.Helper()
+	options["root"] = root
+	plugin := &Plugin{}
+	plugintest.NewPlugin(t, plugin, "archive", options)
+	return plugin
+}
+
+// archiveFiles returns the paths of the archived files under root, relative
+// to it.
+func archiveFiles(t *testing.T, root string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, indexExt) {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		files = append(files, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// readPackets returns the timestamps of the packets of an archived file.
+func readPackets(t *testing.T, path string) []time.Time {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var r io.Reader = bytes.NewReader(raw)
+	if strings.HasSuffix(path, zstdExt) {
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer dec.Close()
+		r = dec
+	}
+	reader, err := pcapgo.NewReader(r)
+	if err != nil {
+		t.Fatalf("invalid pcap file %s: %v", path, err)
+	}
+	var timestamps []time.Time
+	for {
+		_, ci, err := reader.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			return timestamps
+		}
+		if err != nil {
+			t.Fatalf("invalid pcap file %s: %v", path, err)
+		}
+		timestamps = append(timestamps, ci.Timestamp.UTC())
+	}
+}
+
+func TestPluginWindows(t *testing.T) {
+	root := t.TempDir()
+	plugin := newTestPlugin(t, root, map[string]interface{}{"rotateInterval": "1m"})
+	ctx := context.Background()
+
+	// 3 packets 30s apart, from 12:59:00 to 13:00:00, split in two windows
+	if err := plugin.Write(ctx, plugintest.Batch(t, "sensor-1", testStart, 3, 30*time.Second)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := plugin.Write(ctx, plugintest.Batch(t, "sensor/2", testStart, 1, 0)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := plugin.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"sensor-1/2024/05/03/12/20240503T125900.000000Z-20240503T125930.000000Z.pcap",
+		"sensor-1/2024/05/03/13/20240503T130000.000000Z-20240503T130000.000000Z.pcap",
+		"sensor_2/2024/05/03/12/20240503T125900.000000Z-20240503T125900.000000Z.pcap",
+	}
+	files := archiveFiles(t, root)
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected %v, got %v", expected, files)
+	}
+	if packets := readPackets(t, filepath.Join(root, files[0])); len(packets) != 2 || !packets[1].Equal(testStart.Add(30*time.Second)) {
+		t.Errorf("unexpected packets %v", packets)
+	}
+
+	entry, err := readIndex(filepath.Join(root, files[0]))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	windowEnd := testStart.Add(time.Minute)
+	if entry.File != filepath.Base(files[0]) || entry.SensorID != "sensor-1" || entry.PacketCount != 2 ||
+		!reflect.DeepEqual(entry.Interfaces, []string{"eth0"}) || !entry.FirstPacket.Equal(testStart) ||
+		!entry.WindowStart.Equal(testStart) || !entry.WindowEnd.Equal(windowEnd) {
+		t.Errorf("unexpected index %+v", entry)
+	}
+
+	if stats := plugin.Stats(); stats.Writes != 3 || stats.Errors != 0 {
+		t.Errorf("expected 3 writes, got %+v", stats)
+	}
+}
+
+func TestPluginMaxFileSize(t *testing.T) {
+	root := t.TempDir()
+	// the pcap header and a packet of 86B with its record header fill a file
+	plugin := newTestPlugin(t, root, map[string]interface{}{"maxFileSize": "100B"})
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := plugin.Write(ctx, plugintest.Batch(t, "sensor", testStart.Add(time.Duration(i)*time.Second), 1, 0)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// every file is complete without waiting for the end of its window
+	files := archiveFiles(t, root)
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files, got %v", files)
+	}
+	for _, file := range files {
+		if packets := readPackets(t, filepath.Join(root, file)); len(packets) != 1 {
+			t.Errorf("expected 1 packet in %s, got %d", file, len(packets))
+		}
+	}
+}
+
+func TestPluginLinkType(t *testing.T) {
+	root := t.TempDir()
+	plugin := newTestPlugin(t, root, map[string]interface{}{})
+	ctx := context.Background()
+	linkTypes := []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL, layers.LinkTypeNull}
+	for i, linkType := range linkTypes {
+		b := plugintest.Batch(t, "sensor", testStart.Add(time.Duration(i)*time.Second), 1, 0)
+		b.LinkType = linkType
+		if err := plugin.Write(ctx, b); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := plugin.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// every change of link type starts a new file
+	files := archiveFiles(t, root)
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files, got %v", files)
+	}
+	for i, expected := range []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL, layers.LinkTypeEthernet} {
+		file, err := os.Open(filepath.Join(root, files[i]))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		reader, err := pcapgo.NewReader(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("invalid pcap file %s: %v", files[i], err)
+		}
+		if reader.LinkType() != expected {
+			t.Errorf("expected link type %v in %s, got %v", expected, files[i], reader.LinkType())
+		}
+	}
+}
+
+func TestPluginCompression(t *testing.T) {
+	root := t.TempDir()
+	plugin := newTestPlugin(t, root, map[string]interface{}{"compression": "zstd"})
+	ctx := context.Background()
+	if err := plugin.Write(ctx, plugintest.Batch(t, "sensor", testStart, 10, time.Millisecond)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := plugin.Flush(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := plugin.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	files := archiveFiles(t, root)
+	if len(files) != 1 || !strings.HasSuffix(files[0], pcapExt+zstdExt) {
+		t.Fatalf("expected a zstd file, got %v", files)
+	}
+	path := filepath.Join(root, files[0])
+	if packets := readPackets(t, path); len(packets) != 10 {
+		t.Errorf("expected 10 packets, got %d", len(packets))
+	}
+	entry, err := readIndex(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	info, _ := os.Stat(path)
+	if entry.Compression != "zstd" || int64(entry.Bytes) <= info.Size() {
+		t.Errorf("expected %d bytes compressed, got %+v", info.Size(), entry)
+	}
+}
+
+func TestPluginRetention(t *testing.T) {
+	t.Run("total size", func(t *testing.T) {
+		root := t.TempDir()
+		plugin := newTestPlugin(t, root, map[string]interface{}{"rotateInterval": "1h", "maxTotalSize": "1KB"})
+		ctx := context.Background()
+		// every file is a few hundred bytes with its index
+		for i := 0; i < 6; i++ {
+			if err := plugin.Write(ctx, plugintest.Batch(t, "sensor", testStart.Add(time.Duration(i)*time.Hour), 2, time.Second)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if err := plugin.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		files := archiveFiles(t, root)
+		if len(files) == 0 || len(files) >= 6 {
+			t.Fatalf("expected some files to be deleted, got %v", files)
+		}
+		if !strings.HasPrefix(files[len(files)-1], "sensor/2024/05/03/17/") {
+			t.Errorf("expected the newest files to be kept, got %v", files)
+		}
+		if plugin.retention.size > 1024 {
+			t.Errorf("expected at most 1KB, got %d", plugin.retention.size)
+		}
+		// the directories of the deleted files are gone
+		if _, err := os.Stat(filepath.Join(root, "sensor/2024/05/03/12")); !os.IsNotExist(err) {
+			t.Errorf("expected the directory of the oldest file to be deleted")
+		}
+	})
+
+	t.Run("age", func(t *testing.T) {
+		root := t.TempDir()
+		plugin := newTestPlugin(t, root, map[string]interface{}{"rotateInterval": "1h"})
+		ctx := context.Background()
+		// the last packet of the first file is a day old, the second file
+		// was completed before it
+		recent := time.Now().Add(-time.Minute).Truncate(time.Second).UTC()
+		old := recent.Add(-24 * time.Hour)
+		for _, start := range []time.Time{recent, old} {
+			if err := plugin.Write(ctx, plugintest.Batch(t, "sensor", start, 1, 0)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := plugin.completeFiles(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if err := plugin.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		first := filepath.Join(root, archiveFiles(t, root)[0])
+
+		newTestPlugin(t, root, map[string]interface{}{"maxAge": "1h"})
+		files := archiveFiles(t, root)
+		if len(files) != 1 || !strings.HasPrefix(filepath.Base(files[0]), recent.Format(fileTimeLayout)) {
+			t.Errorf("expected the file of the old packets to be deleted, got %v", files)
+		}
+		if _, err := os.Stat(first + indexExt); !os.IsNotExist(err) {
+			t.Errorf("expected the index of the old file to be deleted")
+		}
+	})
+}
+
+func TestRetentionOrder(t *testing.T) {
+	r := &retention{}
+	for _, f := range []archivedFile{
+		{path: "b", size: 10, lastPacket: testStart.Add(time.Hour)},
+		{path: "c", size: 10, lastPacket: testStart.Add(2 * time.Hour)},
+		// late packets of an earlier window
+		{path: "a", size: 10, lastPacket: testStart},
+	} {
+		r.add(f)
+	}
+	now := testStart.Add(3 * time.Hour)
+	if paths := r.expire(now, 90*time.Minute, 0); !reflect.DeepEqual(paths, []string{"a", "b"}) {
+		t.Errorf("expected the files of the oldest packets to expire, got %v", paths)
+	}
+	if paths := r.expire(now, 0, 5); !reflect.DeepEqual(paths, []string{"c"}) || r.size != 0 {
+		t.Errorf("expected the remaining file to expire by size, got %v and %d bytes", paths, r.size)
+	}
+}
+
+func TestRecoverPartial(t *testing.T) {
+	root := t.TempDir()
+	plugin := newTestPlugin(t, root, map[string]interface{}{})
+	if err := plugin.Write(context.Background(), plugintest.Batch(t, "sensor", testStart, 2, time.Second)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := plugin.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// a crash leaves the file partial
+	plugin.closed = true
+	plugin.rotateTimer.Stop()
+	partial := plugin.files["sensor"].partial
+	plugin.files = nil
+
+	modTime := testStart.Add(time.Minute)
+	if err := os.Chtimes(partial, modTime, modTime); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	recovered := newTestPlugin(t, root, map[string]interface{}{})
+	expected := []string{"sensor/2024/05/03/12/20240503T125900.000000Z-20240503T130000.000000Z.pcap"}
+	files := archiveFiles(t, root)
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected %v, got %v", expected, files)
+	}
+	if packets := readPackets(t, filepath.Join(root, files[0])); len(packets) != 2 {
+		t.Errorf("expected 2 packets, got %d", len(packets))
+	}
+	if len(recovered.retention.files) != 1 {
+		t.Errorf("expected the recovered file to be subject to retention")
+	}
+}
+
+func TestInitErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]interface{}
+		err     error
+	}{
+		{"missing root", map[string]interface{}{}, ErrMissingRoot},
+		{"short rotate interval", map[string]interface{}{"root": "/tmp", "rotateInterval": "10ms"}, ErrRotateIntervalTooShort},
+		{"empty files", map[string]interface{}{"root": "/tmp", "maxFileSize": "0B"}, ErrInvalidMaxFileSize},
+		{"unknown compression", map[string]interface{}{"root": "/tmp", "compression": "lz4"}, ErrUnknownCompression},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &Plugin{}
+			err := plugintest.Init(plugin, "archive", tt.options)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestSensorDir(t *testing.T) {
+	tests := map[string]string{
+		"":           unknownSensor,
+		"sensor-1":   "sensor-1",
+		"a/b":        "a_b",
+		"..":         "__",
+		"../escaped": ".._escaped",
+	}
+	for sensorID, expected := range tests {
+		if dir := sensorDir(sensorID); dir != expected {
+			t.Errorf("expected %s for %q, got %s", expected, sensorID, dir)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+)
+
+const (
+	pcapExt    = ".pcap"
+	zstdExt    = ".zst"
+	partialExt = ".part"
+	indexExt   = ".json"
+
+	// fileTimeLayout is the layout of the timestamps of the file names.
+	fileTimeLayout = "20060102T150405.000000Z"
+
+	bufferSize = 64 << 10
+)
+
+// archiveFile is a file being written, with a .part extension until it's
+// complete. Its directory is the hour of its first packet.
+type archiveFile struct {
+	sensorID string
+	dir      string
+	partial  string
+	ext      string
+	file     *os.File
+	buf      *bufio.Writer
+	// enc is nil when the file isn't compressed.
+	enc *zstd.Encoder
+	w   io.Writer
+	// size is the size of the pcap data, before compression.
+	size int
+	// start is the time of the first packet, or when the file was created if
+	// there was none.
+	start  time.Time
+	window time.Time
+	// capture describes the packets of the file, its link type is the one
+	// of the pcap header.
+	capture    batch.Metadata
+	interfaces map[string]struct{}
+}
+
+// createFile starts a file of the sensor, in the directory of the hour of its
+// first packet.
+func createFile(root, sensor string, m batch.Metadata, window time.Time, snapLen int, compress bool) (*archiveFile, error) {
+	start := window
+	if m.PacketCount > 0 {
+		start = m.FirstTimestamp
+	}
+	if start.IsZero() {
+		start = time.Now()
+	}
+	start = start.UTC()
+
+	dir := hourDir(root, sensor, start)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create the directory %s: %w", dir, err)
+	}
+	ext := pcapExt
+	if compress {
+		ext += zstdExt
+	}
+	file, err := os.CreateTemp(dir, start.Format(fileTimeLayout)+"-*"+ext+partialExt)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &archiveFile{
+		sensorID:   m.SensorID,
+		dir:        dir,
+		partial:    file.Name(),
+		ext:        ext,
+		file:       file,
+		buf:        bufio.NewWriterSize(file, bufferSize),
+		start:      start,
+		window:     window,
+		capture:    batch.Metadata{LinkType: m.PcapLinkType()},
+		interfaces: make(map[string]struct{}),
+	}
+	f.w = f.buf
+	if compress {
+		if f.enc, err = zstd.NewWriter(f.buf, zstd.WithEncoderConcurrency(1)); err != nil {
+			file.Close()
+			os.Remove(f.partial)
+			return nil, err
+		}
+		f.w = f.enc
+	}
+
+	var header bytes.Buffer
+	pcapgo.NewWriter(&header).WriteFileHeader(uint32(snapLen), f.capture.LinkType)
+	if err := f.write(header.Bytes()); err != nil {
+		f.close()
+		os.Remove(f.partial)
+		return nil, err
+	}
+	return f, nil
+}
+
+// hourDir returns the directory of the files of the sensor starting in the
+// hour of t.
+func hourDir(root, sensor string, t time.Time) string {
+	t = t.UTC()
+	return filepath.Join(root, sensor, t.Format("2006"), t.Format("01"), t.Format("02"), t.Format("15"))
+}
+
+func (f *archiveFile) write(data []byte) error {
+	n, err := f.w.Write(data)
+	f.size += n
+	if err != nil {
+		return fmt.Errorf("could not write to %s: %w", f.partial, err)
+	}
+	return nil
+}
+
+// addCapture adds the packets of a batch to the ones of the file.
+func (f *archiveFile) addCapture(m batch.Metadata) {
+	if m.Interface != "" {
+		f.interfaces[m.Interface] = struct{}{}
+	}
+	f.capture.Merge(m)
+}
+
+// flush writes the buffered data to the file.
+func (f *archiveFile) flush() error {
+	if f.enc != nil {
+		if err := f.enc.Flush(); err != nil {
+			return fmt.Errorf("could not write to %s: %w", f.partial, err)
+		}
+	}
+	if err := f.buf.Flush(); err != nil {
+		return fmt.Errorf("could not write to %s: %w", f.partial, err)
+	}
+	return nil
+}
+
+// close writes the buffered data, and syncs the file to the disk.
+func (f *archiveFile) close() error {
+	var errs []error
+	if f.enc != nil {
+		errs = append(errs, f.enc.Close())
+	}
+	errs = append(errs, f.buf.Flush(), f.file.Sync(), f.file.Close())
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("could not write to %s: %w", f.partial, err)
+	}
+	return nil
+}
+
+// complete closes the file, renames it after the timestamps of its first and
+// last packets and writes its side-car index. The file is archived even when
+// the index can't be written.
+func (f *archiveFile) complete(rotateInterval time.Duration) (archivedFile, error) {
+	if err := f.close(); err != nil {
+		// the partial file is recovered on the next start
+		return archivedFile{}, err
+	}
+
+	first, last := f.start, f.start
+	if f.capture.PacketCount > 0 {
+		first, last = f.capture.FirstTimestamp.UTC(), f.capture.LastTimestamp.UTC()
+	}
+	path, err := archivePath(f.dir, first, last, f.ext)
+	if err != nil {
+		return archivedFile{}, err
+	}
+	if err := os.Rename(f.partial, path); err != nil {
+		return archivedFile{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return archivedFile{}, err
+	}
+	archived := archivedFile{path: path, size: info.Size(), lastPacket: last}
+
+	entry := Entry{
+		File:        filepath.Base(path),
+		SensorID:    f.sensorID,
+		Interfaces:  make([]string, 0, len(f.interfaces)),
+		PacketCount: f.capture.PacketCount,
+		Bytes:       f.size,
+	}
+	if f.enc != nil {
+		entry.Compression = "zstd"
+	}
+	for iface := range f.interfaces {
+		entry.Interfaces = append(entry.Interfaces, iface)
+	}
+	sort.Strings(entry.Interfaces)
+	if f.capture.PacketCount > 0 {
+		entry.FirstPacket, entry.LastPacket = &first, &last
+	}
+	if !f.window.IsZero() {
+		start, end := f.window.UTC(), f.window.Add(rotateInterval).UTC()
+		entry.WindowStart, entry.WindowEnd = &start, &end
+	}
+	n, err := writeIndex(path, entry)
+	archived.size += n
+	return archived, err
+}
+
+// archivePath returns the path of a file with packets from first to last,
+// numbered when there's already one.
+func archivePath(dir string, first, last time.Time, ext string) (string, error) {
+	name := first.Format(fileTimeLayout) + "-" + last.Format(fileTimeLayout)
+	path := filepath.Join(dir, name+ext)
+	for i := 1; ; i++ {
+		_, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return path, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(dir, name+"-"+strconv.Itoa(i)+ext)
+	}
+}
+
+// parseName returns the timestamps of the first and last packets of an
+// archived file from its name.
+func parseName(name string) (time.Time, time.Time, bool) {
+	switch {
+	case strings.HasSuffix(name, pcapExt+zstdExt):
+		name = strings.TrimSuffix(name, pcapExt+zstdExt)
+	case strings.HasSuffix(name, pcapExt):
+		name = strings.TrimSuffix(name, pcapExt)
+	default:
+		return time.Time{}, time.Time{}, false
+	}
+	parts := strings.SplitN(name, "-", 3)
+	if len(parts) < 2 {
+		return time.Time{}, time.Time{}, false
+	}
+	first, err := time.Parse(fileTimeLayout, parts[0])
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	last, err := time.Parse(fileTimeLayout, parts[1])
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	return first, last, true
+}
+
+// writeIndex writes the side-car index of the file, and returns its size.
+func writeIndex(path string, entry Entry) (int64, error) {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(path+indexExt, raw, 0o600); err != nil {
+		return 0, fmt.Errorf("could not write the index of %s: %w", path, err)
+	}
+	return int64(len(raw)), nil
+}
+
+// removeFile deletes an archived file along with its index, and the
+// directories it leaves empty.
+func removeFile(root, path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(path + indexExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	root = filepath.Clean(root)
+	for dir := filepath.Dir(path); dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			// not empty
+			break
+		}
+	}
+	return nil
+}
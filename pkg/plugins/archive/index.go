@@ -0,0 +1,139 @@
+package archive
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is the side-car index of an archived file, kept next to it with a
+// .json extension, so that the files can be found by time range without
+// reading them.
+type Entry struct {
+	// Path is the path of the file, it's not part of the index.
+	Path        string   `json:"-"`
+	File        string   `json:"file"`
+	SensorID    string   `json:"sensorId,omitempty"`
+	Interfaces  []string `json:"interfaces,omitempty"`
+	PacketCount int      `json:"packetCount"`
+	// Bytes is the size of the pcap data, before compression.
+	Bytes       int        `json:"bytes"`
+	Compression string     `json:"compression,omitempty"`
+	FirstPacket *time.Time `json:"firstPacket,omitempty"`
+	LastPacket  *time.Time `json:"lastPacket,omitempty"`
+	// WindowStart and WindowEnd are the time window of the file.
+	WindowStart *time.Time `json:"windowStart,omitempty"`
+	WindowEnd   *time.Time `json:"windowEnd,omitempty"`
+}
+
+// Find returns the files of the archive in root with packets between from
+// and to, ordered by their first packet. All the sensors are searched when
+// sensorID is empty, and a zero from or to leaves the range open. Files
+// without an index, e.g. recovered after a crash, get an entry from their
+// name.
+func Find(root string, sensorID string, from, to time.Time) ([]Entry, error) {
+	var sensors []string
+	if sensorID != "" {
+		sensors = []string{sensorDir(sensorID)}
+	} else {
+		dirs, err := os.ReadDir(root)
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			if dir.IsDir() {
+				sensors = append(sensors, dir.Name())
+			}
+		}
+	}
+
+	type found struct {
+		entry Entry
+		first time.Time
+	}
+	var files []found
+	for _, sensor := range sensors {
+		sensorPath := filepath.Join(root, sensor)
+		err := filepath.WalkDir(sensorPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if path == sensorPath && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				// the files of the later hours all start after the range
+				if start, ok := dirStart(sensorPath, path); ok && !to.IsZero() && start.After(to) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			first, last, ok := parseName(d.Name())
+			if !ok || (!to.IsZero() && first.After(to)) || (!from.IsZero() && last.Before(from)) {
+				return nil
+			}
+			entry, err := readIndex(path)
+			if err != nil {
+				entry = Entry{File: d.Name(), FirstPacket: &first, LastPacket: &last}
+				if strings.HasSuffix(d.Name(), zstdExt) {
+					entry.Compression = "zstd"
+				}
+			}
+			entry.Path = path
+			files = append(files, found{entry: entry, first: first})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].first.Equal(files[j].first) {
+			return files[i].first.Before(files[j].first)
+		}
+		return files[i].entry.Path < files[j].entry.Path
+	})
+	entries := make([]Entry, len(files))
+	for i, f := range files {
+		entries[i] = f.entry
+	}
+	return entries, nil
+}
+
+// dirStart returns the start of the time span of a directory of the tree of
+// a sensor, from its year, month, day and hour levels.
+func dirStart(sensorPath, path string) (time.Time, bool) {
+	rel, err := filepath.Rel(sensorPath, path)
+	if err != nil || rel == "." {
+		return time.Time{}, false
+	}
+	levels := strings.Split(rel, string(filepath.Separator))
+	if len(levels) > 4 {
+		return time.Time{}, false
+	}
+	values := []int{0, 1, 1, 0}
+	for i, level := range levels {
+		v, err := strconv.Atoi(level)
+		if err != nil {
+			return time.Time{}, false
+		}
+		values[i] = v
+	}
+	return time.Date(values[0], time.Month(values[1]), values[2], values[3], 0, 0, 0, time.UTC), true
+}
+
+func readIndex(path string) (Entry, error) {
+	var entry Entry
+	raw, err := os.ReadFile(path + indexExt)
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(raw, &entry)
+	return entry, err
+}
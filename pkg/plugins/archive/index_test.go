@@ -0,0 +1,123 @@
+package archive
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/deepfence/PacketStreamer/pkg/plugins/plugintest"
+)
+
+func TestFind(t *testing.T) {
+	root := t.TempDir()
+	plugin := newTestPlugin(t, root, map[string]interface{}{"rotateInterval": "1h"})
+	ctx := context.Background()
+	// files from 12:59 to 12:59:10, 13:59 to 13:59:10 and 14:59 to
+	// 14:59:10 for sensor-1, and one at 13:59 for sensor-2
+	for i := 0; i < 3; i++ {
+		if err := plugin.Write(ctx, plugintest.Batch(t, "sensor-1", testStart.Add(time.Duration(i)*time.Hour), 2, 10*time.Second)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := plugin.Write(ctx, plugintest.Batch(t, "sensor-2", testStart.Add(time.Hour), 1, 0)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := plugin.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// a file without an index
+	noIndex := archiveFiles(t, root)[2]
+	if err := os.Remove(filepath.Join(root, noIndex) + indexExt); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		sensorID string
+		from, to time.Time
+		files    []string
+	}{
+		{
+			name:  "all",
+			files: []string{"125900", "135900", "135900", "145900"},
+		},
+		{
+			name:     "sensor",
+			sensorID: "sensor-1",
+			files:    []string{"125900", "135900", "145900"},
+		},
+		{
+			name:  "overlapping the end of a file",
+			from:  testStart.Add(time.Hour + 5*time.Second),
+			to:    testStart.Add(2 * time.Hour),
+			files: []string{"135900", "145900"},
+		},
+		{
+			name:  "between files",
+			from:  testStart.Add(time.Minute),
+			to:    testStart.Add(time.Hour - time.Second),
+			files: nil,
+		},
+		{
+			name:     "open start",
+			sensorID: "sensor-1",
+			to:       testStart.Add(30 * time.Minute),
+			files:    []string{"125900"},
+		},
+		{
+			name:     "unknown sensor",
+			sensorID: "sensor-3",
+			files:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := Find(root, tt.sensorID, tt.from, tt.to)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var files []string
+			for _, entry := range entries {
+				files = append(files, entry.FirstPacket.Format("150405"))
+				if filepath.Base(entry.Path) != entry.File {
+					t.Errorf("unexpected path %s of %s", entry.Path, entry.File)
+				}
+			}
+			if !reflect.DeepEqual(files, tt.files) {
+				t.Errorf("expected %v, got %v", tt.files, files)
+			}
+		})
+	}
+
+	entries, err := Find(root, "sensor-1", testStart.Add(2*time.Hour), time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 1 || entries[0].PacketCount != 0 || entries[0].File != filepath.Base(noIndex) {
+		t.Errorf("expected an entry from the name of %s, got %+v", noIndex, entries)
+	}
+}
+
+func TestDirStart(t *testing.T) {
+	sensorPath := filepath.Join("root", "sensor")
+	tests := []struct {
+		path  string
+		start time.Time
+		ok    bool
+	}{
+		{"2024", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{"2024/05", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), true},
+		{"2024/05/03/13", time.Date(2024, 5, 3, 13, 0, 0, 0, time.UTC), true},
+		{"2024/05/03/13/14", time.Time{}, false},
+		{"lost+found", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		start, ok := dirStart(sensorPath, filepath.Join(sensorPath, filepath.FromSlash(tt.path)))
+		if ok != tt.ok || !start.Equal(tt.start) {
+			t.Errorf("expected %v, %v for %s, got %v, %v", tt.start, tt.ok, tt.path, start, ok)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package archive
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archivedFile is a complete file of the archive.
+type archivedFile struct {
+	path string
+	// size is the size of the file and its index.
+	size int64
+	// lastPacket is the time of the last packet of the file, from its name.
+	lastPacket time.Time
+}
+
+// retention keeps track of the complete files, in the order of their last
+// packet, so that the oldest ones can be deleted.
+type retention struct {
+	files []archivedFile
+	size  int64
+}
+
+func (r *retention) add(f archivedFile) {
+	// the files mostly come in order, apart from late packets and replays
+	i := sort.Search(len(r.files), func(i int) bool {
+		return r.files[i].lastPacket.After(f.lastPacket)
+	})
+	r.files = append(r.files, archivedFile{})
+	copy(r.files[i+1:], r.files[i:])
+	r.files[i] = f
+	r.size += f.size
+}
+
+// expire takes the oldest files out, until the last packets of the remaining
+// ones are less than maxAge old and the files are smaller than maxSize in
+// total. It returns the paths of the files which were taken out. A zero
+// maxAge or maxSize doesn't limit the files.
+func (r *retention) expire(now time.Time, maxAge time.Duration, maxSize int64) []string {
+	var paths []string
+	for len(r.files) > 0 {
+		f := r.files[0]
+		tooOld := maxAge > 0 && now.Sub(f.lastPacket) > maxAge
+		tooBig := maxSize > 0 && r.size > maxSize
+		if !tooOld && !tooBig {
+			break
+		}
+		r.files = r.files[1:]
+		r.size -= f.size
+		paths = append(paths, f.path)
+	}
+	return paths
+}
+
+// scanArchive returns the files of the archive. The files left partial by a
+// previous run are kept with the data written so far, with the time they
+// were last written to as the time of their last packet.
+func scanArchive(root string) (*retention, error) {
+	r := &retention{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := d.Name()
+		if strings.HasSuffix(name, partialExt) {
+			recovered, err := recoverPartial(path)
+			if err != nil {
+				log.Printf("error recovering partial file %s - %v\n", path, err)
+				return nil
+			}
+			log.Printf("Recovered partial file %s\n", recovered)
+			path, name = recovered, filepath.Base(recovered)
+		}
+		_, last, ok := parseName(name)
+		if !ok {
+			return nil
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		f := archivedFile{path: path, size: info.Size(), lastPacket: last}
+		if index, err := os.Stat(path + indexExt); err == nil {
+			f.size += index.Size()
+		}
+		r.add(f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// recoverPartial gives a partial file the name of a complete one, and
+// returns its new path.
+func recoverPartial(path string) (string, error) {
+	name := strings.TrimSuffix(filepath.Base(path), partialExt)
+	ext := pcapExt
+	if strings.HasSuffix(name, pcapExt+zstdExt) {
+		ext += zstdExt
+	}
+	start, err := time.Parse(fileTimeLayout, strings.SplitN(name, "-", 2)[0])
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	end := info.ModTime().UTC()
+	if end.Before(start) {
+		end = start
+	}
+	recovered, err := archivePath(filepath.Dir(path), start, end, ext)
+	if err != nil {
+		return "", err
+	}
+	return recovered, os.Rename(path, recovered)
+}
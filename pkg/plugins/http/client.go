@@ -0,0 +1,291 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const maxRetryBackoff = 30 * time.Second
+
+var (
+	ErrConflictingAuth    = errors.New("only one of auth.bearerToken, auth.bearerTokenFile and auth.username can be set")
+	ErrMissingPassword    = errors.New("auth.password should be set along with auth.username")
+	ErrIncompleteKeyPair  = errors.New("both tls.certFile and tls.keyFile should be set")
+	ErrInvalidCA          = errors.New("no certificate found in tls.caFile")
+	ErrUnknownEncoding    = errors.New("encoding should be one of none, gzip or zstd")
+	ErrUnexpectedResponse = errors.New("unexpected response")
+)
+
+// AuthConfig is the authentication of the requests, either a bearer token or
+// a username and password for basic authentication. Client certificates are
+// set in TLSConfig.
+type AuthConfig struct {
+	BearerToken string `yaml:"bearerToken,omitempty"`
+	// BearerTokenFile is read for every request, so that the token can be
+	// refreshed without restarting.
+	BearerTokenFile string `yaml:"bearerTokenFile,omitempty"`
+	Username        string `yaml:"username,omitempty"`
+	Password        string `yaml:"password,omitempty"`
+}
+
+// TLSConfig is the TLS configuration of the https URLs. CAFile defaults to
+// the system certificates, CertFile and KeyFile are the client certificate,
+// for servers which authenticate the clients with it.
+type TLSConfig struct {
+	CAFile             string `yaml:"caFile,omitempty"`
+	CertFile           string `yaml:"certFile,omitempty"`
+	KeyFile            string `yaml:"keyFile,omitempty"`
+	ServerName         string `yaml:"serverName,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"`
+}
+
+// Auth adds the credentials to the requests.
+type Auth struct {
+	// token returns the bearer token, it's nil without one.
+	token              func() (string, error)
+	username, password string
+}
+
+func newAuth(cfg AuthConfig) (Auth, error) {
+	set := 0
+	for _, s := range []string{cfg.BearerToken, cfg.BearerTokenFile, cfg.Username} {
+		if s != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return Auth{}, ErrConflictingAuth
+	}
+	switch {
+	case cfg.BearerToken != "":
+		return Auth{token: func() (string, error) { return cfg.BearerToken, nil }}, nil
+	case cfg.BearerTokenFile != "":
+		return Auth{token: func() (string, error) {
+			token, err := os.ReadFile(cfg.BearerTokenFile)
+			if err != nil {
+				return "", fmt.Errorf("could not read the token file: %w", err)
+			}
+			return strings.TrimSpace(string(token)), nil
+		}}, nil
+	case cfg.Username != "":
+		if cfg.Password == "" {
+			return Auth{}, ErrMissingPassword
+		}
+		return Auth{username: cfg.Username, password: cfg.Password}, nil
+	}
+	return Auth{}, nil
+}
+
+func (a Auth) apply(req *http.Request) error {
+	switch {
+	case a.token != nil:
+		token, err := a.token()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case a.username != "":
+		req.SetBasicAuth(a.username, a.password)
+	}
+	return nil
+}
+
+func newTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, ErrInvalidCA
+		}
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, ErrIncompleteKeyPair
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Encoding is the Content-Encoding of the requests.
+type Encoding string
+
+const (
+	EncodingNone Encoding = ""
+	EncodingGzip Encoding = "gzip"
+	EncodingZstd Encoding = "zstd"
+)
+
+func parseEncoding(encoding string) (Encoding, error) {
+	switch strings.ToLower(encoding) {
+	case "", "none", "identity":
+		return EncodingNone, nil
+	case "gzip":
+		return EncodingGzip, nil
+	case "zstd":
+		return EncodingZstd, nil
+	}
+	return "", fmt.Errorf("%w, not %s", ErrUnknownEncoding, encoding)
+}
+
+// encode returns the body compressed with the encoding.
+func (e Encoding) encode(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch e {
+	case EncodingNone:
+		return body, nil
+	case EncodingGzip:
+		w = gzip.NewWriter(&buf)
+	case EncodingZstd:
+		var err error
+		if w, err = zstd.NewWriter(&buf); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// statusError is the error of a request which got a response other than 2xx.
+type statusError struct {
+	code int
+	// retryAfter is the delay the server asked for, 0 when it didn't.
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%v %d %s", ErrUnexpectedResponse, e.code, http.StatusText(e.code))
+}
+
+func (e *statusError) Unwrap() error {
+	return ErrUnexpectedResponse
+}
+
+// send sends the request, retrying it up to MaxRetries times with
+// exponential backoff, or after the delay asked for by the server. It
+// returns the size of the body which was sent.
+func (p *Plugin) send(ctx context.Context, r *request) (int, error) {
+	body, err := p.Encoding.encode(r.body.Bytes())
+	if err != nil {
+		return 0, err
+	}
+
+	backoff := p.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := p.do(ctx, r, body)
+		if err == nil {
+			return len(body), nil
+		}
+		if attempt >= p.MaxRetries || !retryable(err) {
+			return 0, err
+		}
+		wait := backoff
+		var statusErr *statusError
+		if errors.As(err, &statusErr) && statusErr.retryAfter > 0 {
+			wait = statusErr.retryAfter
+			if wait > maxRetryBackoff {
+				wait = maxRetryBackoff
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return 0, err
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+func (p *Plugin) do(ctx context.Context, r *request, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, p.Method, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, value := range p.Headers {
+		req.Header.Set(key, value)
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if p.Encoding != EncodingNone {
+		req.Header.Set("Content-Encoding", string(p.Encoding))
+	}
+	if r.capture.SensorID != "" {
+		req.Header.Set(sensorIDHeader, r.capture.SensorID)
+	}
+	if r.capture.Interface != "" {
+		req.Header.Set(interfaceHeader, r.capture.Interface)
+	}
+	req.Header.Set(packetCountHeader, strconv.Itoa(r.capture.PacketCount))
+	if r.capture.PacketCount > 0 {
+		req.Header.Set(captureStartHeader, r.capture.FirstTimestamp.UTC().Format(time.RFC3339Nano))
+		req.Header.Set(captureEndHeader, r.capture.LastTimestamp.UTC().Format(time.RFC3339Nano))
+	}
+	if err := p.Auth.apply(req); err != nil {
+		return err
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drained so that the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	statusErr := &statusError{code: resp.StatusCode}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		statusErr.retryAfter = time.Duration(seconds) * time.Second
+	}
+	return statusErr
+}
+
+// retryable tells whether the error is temporary. Errors without a response,
+// e.g. when the server can't be reached, are.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code >= 500 || statusErr.code == http.StatusRequestTimeout || statusErr.code == http.StatusTooManyRequests
+	}
+	return true
+}
@@ -0,0 +1,349 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/inhies/go-bytesize"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/plugins"
+)
+
+const (
+	defaultBatchSize     = bytesize.MB
+	defaultBatchInterval = 10 * time.Second
+	defaultTimeout       = 30 * time.Second
+	defaultMaxRetries    = 5
+	defaultRetryBackoff  = time.Second
+	defaultConcurrency   = 4
+
+	contentType = "application/vnd.tcpdump.pcap"
+
+	// headers describing the packets of a request
+	sensorIDHeader     = "X-PacketStreamer-Sensor-Id"
+	interfaceHeader    = "X-PacketStreamer-Interface"
+	packetCountHeader  = "X-PacketStreamer-Packet-Count"
+	captureStartHeader = "X-PacketStreamer-Capture-Start"
+	captureEndHeader   = "X-PacketStreamer-Capture-End"
+)
+
+var (
+	ErrMissingURL         = errors.New("url should be set")
+	ErrInvalidURL         = errors.New("url should be an http or https URL")
+	ErrInvalidConcurrency = errors.New("concurrency should be at least 1")
+	ErrInvalidBatchSize   = errors.New("batchSize should be at least 1B")
+)
+
+func init() {
+	plugins.Register("http", func() plugins.Plugin {
+		return &Plugin{}
+	})
+}
+
+type Config struct {
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// BatchSize and BatchInterval send a request once its body reaches that
+	// size, or that long after its first packet.
+	BatchSize     *string `yaml:"batchSize,omitempty"`
+	BatchInterval *string `yaml:"batchInterval,omitempty"`
+	Timeout       *string `yaml:"timeout,omitempty"`
+	// Encoding is the Content-Encoding of the requests, none, gzip or zstd.
+	Encoding     string     `yaml:"encoding,omitempty"`
+	Auth         AuthConfig `yaml:"auth,omitempty"`
+	TLS          TLSConfig  `yaml:"tls,omitempty"`
+	MaxRetries   *int       `yaml:"maxRetries,omitempty"`
+	RetryBackoff *string    `yaml:"retryBackoff,omitempty"`
+	// Concurrency is the maximum number of requests in flight.
+	Concurrency *int `yaml:"concurrency,omitempty"`
+}
+
+type Plugin struct {
+	Client        *http.Client
+	URL           string
+	Method        string
+	Headers       map[string]string
+	Auth          Auth
+	Encoding      Encoding
+	BatchSize     int
+	BatchInterval time.Duration
+	MaxRetries    int
+	RetryBackoff  time.Duration
+	SnapLen       int
+
+	mu sync.Mutex
+	// pending is the request being put together, nil when there are no
+	// packets to send.
+	pending *request
+	timer   *time.Timer
+	// slots limit the number of requests in flight.
+	slots  chan struct{}
+	wg     sync.WaitGroup
+	closed bool
+	stats  plugins.Stats
+}
+
+// request is the body of a request, a pcap file with the packets of batches
+// with the same sensor, interface and link type.
+type request struct {
+	body    bytes.Buffer
+	capture batch.Metadata
+}
+
+func (p *Plugin) Init(ctx context.Context, global *config.Config, pluginConfig config.PluginConfig) error {
+	var cfg Config
+	if err := pluginConfig.Decode(&cfg); err != nil {
+		return err
+	}
+
+	if cfg.URL == "" {
+		return ErrMissingURL
+	}
+	if u, err := url.Parse(cfg.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w, not %s", ErrInvalidURL, cfg.URL)
+	}
+	method := http.MethodPost
+	if cfg.Method != "" {
+		method = strings.ToUpper(cfg.Method)
+	}
+
+	batchSize := defaultBatchSize
+	if cfg.BatchSize != nil {
+		b, err := bytesize.Parse(*cfg.BatchSize)
+		if err != nil {
+			return fmt.Errorf("could not parse the batchSize field %s: %w", *cfg.BatchSize, err)
+		}
+		batchSize = b
+	}
+	if batchSize < 1 {
+		return ErrInvalidBatchSize
+	}
+
+	var err error
+	batchInterval := defaultBatchInterval
+	if cfg.BatchInterval != nil {
+		batchInterval, err = time.ParseDuration(*cfg.BatchInterval)
+		if err != nil {
+			return fmt.Errorf("could not parse the batchInterval field %s: %w", *cfg.BatchInterval, err)
+		}
+	}
+
+	timeout := defaultTimeout
+	if cfg.Timeout != nil {
+		timeout, err = time.ParseDuration(*cfg.Timeout)
+		if err != nil {
+			return fmt.Errorf("could not parse the timeout field %s: %w", *cfg.Timeout, err)
+		}
+	}
+
+	maxRetries := defaultMaxRetries
+	if cfg.MaxRetries != nil {
+		maxRetries = *cfg.MaxRetries
+	}
+	retryBackoff := defaultRetryBackoff
+	if cfg.RetryBackoff != nil {
+		retryBackoff, err = time.ParseDuration(*cfg.RetryBackoff)
+		if err != nil {
+			return fmt.Errorf("could not parse the retryBackoff field %s: %w", *cfg.RetryBackoff, err)
+		}
+	}
+
+	concurrency := defaultConcurrency
+	if cfg.Concurrency != nil {
+		concurrency = *cfg.Concurrency
+	}
+	if concurrency < 1 {
+		return ErrInvalidConcurrency
+	}
+
+	encoding, err := parseEncoding(cfg.Encoding)
+	if err != nil {
+		return err
+	}
+	auth, err := newAuth(cfg.Auth)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.MaxIdleConnsPerHost = concurrency
+	p.Client = &http.Client{Transport: transport, Timeout: timeout}
+	p.URL = cfg.URL
+	p.Method = method
+	p.Headers = cfg.Headers
+	p.Auth = auth
+	p.Encoding = encoding
+	p.BatchSize = int(batchSize)
+	p.BatchInterval = batchInterval
+	p.MaxRetries = maxRetries
+	p.RetryBackoff = retryBackoff
+	p.SnapLen = global.InputPacketLen
+	p.slots = make(chan struct{}, concurrency)
+
+	return nil
+}
+
+// Write adds the packets of the batch to the pending request, which is sent
+// once it reaches the batch size. Batches of another sensor, interface or
+// link type go to a request of their own. Write only blocks when the
+// maximum number of requests are in flight.
+func (p *Plugin) Write(ctx context.Context, b *batch.Batch) error {
+	if len(b.Data) == 0 {
+		return nil
+	}
+	linkType := b.PcapLinkType()
+
+	// the requests are sent once the lock is released
+	var requests []*request
+	defer func() {
+		for _, r := range requests {
+			p.start(r)
+		}
+	}()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pending != nil {
+		c := p.pending.capture
+		if c.SensorID != b.SensorID || c.Interface != b.Interface || c.LinkType != linkType {
+			requests = append(requests, p.takePending())
+		}
+	}
+	if p.pending == nil {
+		if err := p.newRequest(b.Metadata, linkType); err != nil {
+			return err
+		}
+	}
+
+	p.pending.body.Write(b.Data)
+	p.pending.capture.Merge(b.Metadata)
+	if p.pending.body.Len() >= p.BatchSize {
+		requests = append(requests, p.takePending())
+	}
+	return nil
+}
+
+func (p *Plugin) newRequest(m batch.Metadata, linkType layers.LinkType) error {
+	r := &request{capture: batch.Metadata{SensorID: m.SensorID, Interface: m.Interface, LinkType: linkType}}
+	if err := pcapgo.NewWriter(&r.body).WriteFileHeader(uint32(p.SnapLen), linkType); err != nil {
+		return err
+	}
+	p.pending = r
+	if p.BatchInterval > 0 {
+		p.timer = time.AfterFunc(p.BatchInterval, func() { p.onBatchInterval(r) })
+	}
+	return nil
+}
+
+// onBatchInterval sends the request once it has waited for the batch
+// interval. The timer of a request which was already sent may still fire,
+// when it couldn't be stopped in time, and mustn't send the next one early.
+func (p *Plugin) onBatchInterval(r *request) {
+	p.mu.Lock()
+	if p.closed || p.pending != r {
+		p.mu.Unlock()
+		return
+	}
+	r = p.takePending()
+	p.mu.Unlock()
+
+	p.start(r)
+}
+
+// takePending takes the pending request, which is in flight from then on, to
+// be sent once the lock is released.
+func (p *Plugin) takePending() *request {
+	r := p.pending
+	p.pending = nil
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.wg.Add(1)
+	return r
+}
+
+// start sends a request taken by takePending in the background, once a slot
+// is available. It's called without the lock, so that waiting for a slot only
+// blocks the caller.
+func (p *Plugin) start(r *request) {
+	p.slots <- struct{}{}
+	go func() {
+		defer p.wg.Done()
+
+		n, err := p.send(context.Background(), r)
+		<-p.slots
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if err != nil {
+			p.stats.Errors++
+			log.Printf("error sending %d packets to %s - %v\n", r.capture.PacketCount, p.URL, err)
+			return
+		}
+		p.stats.Writes++
+		p.stats.BytesWritten += uint64(n)
+	}()
+}
+
+// Flush sends the pending request, and waits for all the requests in flight.
+func (p *Plugin) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	var r *request
+	if p.pending != nil {
+		r = p.takePending()
+	}
+	p.mu.Unlock()
+
+	if r != nil {
+		p.start(r)
+	}
+	p.wg.Wait()
+	return nil
+}
+
+func (p *Plugin) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	var r *request
+	if p.pending != nil {
+		r = p.takePending()
+	}
+	p.mu.Unlock()
+
+	if r != nil {
+		p.start(r)
+	}
+	p.wg.Wait()
+	if p.Client != nil {
+		p.Client.CloseIdleConnections()
+	}
+	return nil
+}
+
+func (p *Plugin) Stats() plugins.Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stats
+}
@@ -0,0 +1,524 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/deepfence/PacketStreamer/pkg/plugins/plugintest"
+	"github.com/deepfence/PacketStreamer/pkg/testutils"
+)
+
+// fakeServer records the requests it gets, answering them with statuses in
+// turn, then with 200.
+type fakeServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []fakeRequest
+	statuses []int
+	// release, when set, holds the requests until it's closed.
+	release  chan struct{}
+	inFlight int
+	maxSeen  int
+}
+
+type fakeRequest struct {
+	method string
+	header http.Header
+	// body is the decoded body.
+	body []byte
+}
+
+func newFakeServer(t *testing.T, statuses ...int) *fakeServer {
+	t.Helper()
+	s := &fakeServer{statuses: statuses}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.inFlight++
+	if s.inFlight > s.maxSeen {
+		s.maxSeen = s.inFlight
+	}
+	release := s.release
+	s.mu.Unlock()
+	if release != nil {
+		<-release
+	}
+
+	body, err := decodeBody(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight--
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.requests = append(s.requests, fakeRequest{method: r.Method, header: r.Header.Clone(), body: body})
+	if len(s.statuses) > 0 {
+		status := s.statuses[0]
+		s.statuses = s.statuses[1:]
+		w.WriteHeader(status)
+	}
+}
+
+func decodeBody(r *http.Request) ([]byte, error) {
+	var body io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = gz
+	case "zstd":
+		dec, err := zstd.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		body = dec
+	}
+	return io.ReadAll(body)
+}
+
+func (s *fakeServer) received() []fakeRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeRequest(nil), s.requests...)
+}
+
+// newTestPlugin returns a plugin retrying every millisecond, unless the
+// options tell otherwise.
+func newTestPlugin(t *testing.T, options map[string]interface{}) *Plugin {
+	t.Helper()
+	if _, ok := options["retryBackoff"]; !ok {
+		options["retryBackoff"] = "1ms"
+	}
+	plugin := &Plugin{}
+	plugintest.NewPlugin(t, plugin, "http", options)
+	return plugin
+}
+
+func countPackets(t *testing.T, body []byte) int {
+	t.Helper()
+	r, err := pcapgo.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("invalid pcap body: %v", err)
+	}
+	packets := 0
+	for {
+		if _, _, err := r.ReadPacketData(); err == io.EOF {
+			return packets
+		} else if err != nil {
+			t.Fatalf("invalid pcap body: %v", err)
+		}
+		packets++
+	}
+}
+
+func TestPluginBatchSize(t *testing.T) {
+	server := newFakeServer(t)
+	server.Start()
+	plugin := newTestPlugin(t, map[string]interface{}{
+		"url":           server.URL + "/ingest",
+		"method":        "put",
+		"headers":       map[string]interface{}{"X-Tenant": "acme"},
+		"batchSize":     "512B",
+		"batchInterval": "1h",
+	})
+
+	// a batch is 3*(16+86) bytes, so every other batch fills a request
+	for i := 0; i < 4; i++ {
+		if err := plugin.Write(context.Background(), plugintest.Batch(t, "sensor-1", plugintest.Start, 3, time.Millisecond)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := plugin.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	requests := server.received()
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(requests))
+	}
+	for _, r := range requests {
+		if r.method != http.MethodPut || r.header.Get("X-Tenant") != "acme" || r.header.Get("Content-Type") != contentType {
+			t.Errorf("unexpected request %s %v", r.method, r.header)
+		}
+		if r.header.Get(sensorIDHeader) != "sensor-1" || r.header.Get(interfaceHeader) != "eth0" || r.header.Get(packetCountHeader) != "6" {
+			t.Errorf("unexpected capture headers %v", r.header)
+		}
+		if r.header.Get(captureStartHeader) != "2024-05-03T12:00:00Z" || r.header.Get(captureEndHeader) != "2024-05-03T12:00:00.002Z" {
+			t.Errorf("unexpected capture times %v", r.header)
+		}
+		if packets := countPackets(t, r.body); packets != 6 {
+			t.Errorf("expected 6 packets, got %d", packets)
+		}
+	}
+
+	if err := plugin.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats := plugin.Stats(); stats.Writes != 2 || stats.Errors != 0 {
+		t.Errorf("expected 2 writes, got %+v", stats)
+	}
+}
+
+func TestPluginBatchInterval(t *testing.T) {
+	server := newFakeServer(t)
+	server.Start()
+	plugin := newTestPlugin(t, map[string]interface{}{"url": server.URL, "batchInterval": "50ms"})
+	defer plugin.Close()
+
+	if err := plugin.Write(context.Background(), plugintest.Batch(t, "sensor-1", plugintest.Start, 3, time.Millisecond)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no request after the batch interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if packets := countPackets(t, server.received()[0].body); packets != 3 {
+		t.Errorf("expected 3 packets, got %d", packets)
+	}
+}
+
+func TestPluginStaleBatchInterval(t *testing.T) {
+	server := newFakeServer(t)
+	server.Start()
+	plugin := newTestPlugin(t, map[string]interface{}{"url": server.URL, "batchInterval": "1h"})
+	defer plugin.Close()
+
+	if err := plugin.Write(context.Background(), plugintest.Batch(t, "sensor-1", plugintest.Start, 3, time.Millisecond)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first := plugin.pending
+	// sends the request of sensor-1
+	if err := plugin.Write(context.Background(), plugintest.Batch(t, "sensor-2", plugintest.Start, 3, time.Millisecond)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the timer of the first request fires after it was sent
+	plugin.onBatchInterval(first)
+	plugin.mu.Lock()
+	pending := plugin.pending
+	plugin.mu.Unlock()
+	if pending == nil || pending.capture.SensorID != "sensor-2" {
+		t.Errorf("expected the request of sensor-2 to wait for its own interval, got %+v", pending)
+	}
+}
+
+func TestPluginSplitsSensors(t *testing.T) {
+	server := newFakeServer(t)
+	server.Start()
+	plugin := newTestPlugin(t, map[string]interface{}{"url": server.URL})
+
+	for _, sensor := range []string{"sensor-1", "sensor-1", "sensor-2"} {
+		if err := plugin.Write(context.Background(), plugintest.Batch(t, sensor, plugintest.Start, 3, time.Millisecond)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := plugin.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	packets := map[string]int{}
+	for _, r := range server.received() {
+		packets[r.header.Get(sensorIDHeader)] += countPackets(t, r.body)
+	}
+	if len(server.received()) != 2 || packets["sensor-1"] != 6 || packets["sensor-2"] != 3 {
+		t.Errorf("expected a request of 6 packets of sensor-1 and one of 3 packets of sensor-2, got %v", packets)
+	}
+}
+
+func TestPluginEncoding(t *testing.T) {
+	for _, encoding := range []string{"gzip", "zstd"} {
+		t.Run(encoding, func(t *testing.T) {
+			server := newFakeServer(t)
+			server.Start()
+			plugin := newTestPlugin(t, map[string]interface{}{"url": server.URL, "encoding": encoding})
+			b := plugintest.Batch(t, "sensor-1", plugintest.Start, 3, time.Millisecond)
+			if err := plugin.Write(context.Background(), b); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := plugin.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			requests := server.received()
+			if len(requests) != 1 {
+				t.Fatalf("expected 1 request, got %d", len(requests))
+			}
+			if got := requests[0].header.Get("Content-Encoding"); got != encoding {
+				t.Errorf("expected Content-Encoding %s, got %q", encoding, got)
+			}
+			if !bytes.HasSuffix(requests[0].body, b.Data) {
+				t.Errorf("expected the records of the batch in the body")
+			}
+			if stats := plugin.Stats(); stats.BytesWritten == 0 || stats.BytesWritten >= uint64(len(requests[0].body)) {
+				t.Errorf("expected the compressed size to be counted, got %+v for %d bytes", stats, len(requests[0].body))
+			}
+		})
+	}
+}
+
+func TestPluginAuth(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		auth     map[string]interface{}
+		expected string
+	}{
+		{"bearer token", map[string]interface{}{"bearerToken": "secret"}, "Bearer secret"},
+		{"bearer token file", map[string]interface{}{"bearerTokenFile": tokenFile}, "Bearer from-file"},
+		{"basic", map[string]interface{}{"username": "user", "password": "pass"}, "Basic dXNlcjpwYXNz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t)
+			server.Start()
+			plugin := newTestPlugin(t, map[string]interface{}{"url": server.URL, "auth": tt.auth})
+			if err := plugin.Write(context.Background(), plugintest.Batch(t, "sensor-1", plugintest.Start, 3, time.Millisecond)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := plugin.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			requests := server.received()
+			if len(requests) != 1 || requests[0].header.Get("Authorization") != tt.expected {
+				t.Errorf("expected Authorization %q, got %+v", tt.expected, requests)
+			}
+		})
+	}
+}
+
+func TestPluginMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, certFile, keyFile := testutils.WriteCertificate(t, dir)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	server := newFakeServer(t)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	server.StartTLS()
+
+	t.Run("client certificate", func(t *testing.T) {
+		plugin := newTestPlugin(t, map[string]interface{}{
+			"url": server.URL,
+			"tls": map[string]interface{}{"caFile": certFile, "certFile": certFile, "keyFile": keyFile},
+		})
+		if err := plugin.Write(context.Background(), plugintest.Batch(t, "sensor-1", plugintest.Start, 3, time.Millisecond)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := plugin.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if stats := plugin.Stats(); stats.Writes != 1 || stats.Errors != 0 {
+			t.Errorf("expected 1 write, got %+v", stats)
+		}
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		plugin := newTestPlugin(t, map[string]interface{}{
+			"url":        server.URL,
+			"maxRetries": 0,
+			"tls":        map[string]interface{}{"caFile": certFile},
+		})
+		if err := plugin.Write(context.Background(), plugintest.Batch(t, "sensor-1", plugintest.Start, 3, time.Millisecond)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := plugin.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if stats := plugin.Stats(); stats.Writes != 0 || stats.Errors != 1 {
+			t.Errorf("expected 1 error, got %+v", stats)
+		}
+	})
+}
+
+func TestPluginRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int
+		writes   uint64
+	}{
+		{"server errors", []int{http.StatusServiceUnavailable, http.StatusBadGateway}, 3, 1},
+		{"throttled", []int{http.StatusTooManyRequests}, 2, 1},
+		{"refused", []int{http.StatusBadRequest}, 1, 0},
+		{"too many failures", []int{500, 500, 500}, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, tt.statuses...)
+			server.Start()
+			plugin := newTestPlugin(t, map[string]interface{}{"url": server.URL, "maxRetries": 2})
+			if err := plugin.Write(context.Background(), plugintest.Batch(t, "sensor-1", plugintest.Start, 3, time.Millisecond)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := plugin.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if requests := len(server.received()); requests != tt.requests {
+				t.Errorf("expected %d requests, got %d", tt.requests, requests)
+			}
+			if stats := plugin.Stats(); stats.Writes != tt.writes || stats.Errors != 1-tt.writes {
+				t.Errorf("expected %d writes, got %+v", tt.writes, stats)
+			}
+		})
+	}
+}
+
+func TestPluginConcurrency(t *testing.T) {
+	server := newFakeServer(t)
+	server.release = make(chan struct{})
+	server.Start()
+	plugin := newTestPlugin(t, map[string]interface{}{"url": server.URL, "batchSize": "1B", "concurrency": 2})
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := 0; i < 5; i++ {
+			if err := plugin.Write(context.Background(), plugintest.Batch(t, "sensor-1", plugintest.Start, 3, time.Millisecond)); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+	}()
+	select {
+	case <-written:
+		t.Fatalf("expected the writes to wait for the requests in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(server.release)
+	<-written
+	if err := plugin.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	server.mu.Lock()
+	maxSeen := server.maxSeen
+	server.mu.Unlock()
+	if maxSeen > 2 {
+		t.Errorf("expected at most 2 requests in flight, got %d", maxSeen)
+	}
+	if requests := len(server.received()); requests != 5 {
+		t.Errorf("expected 5 requests, got %d", requests)
+	}
+}
+
+func TestPluginBatchIntervalWithoutSlot(t *testing.T) {
+	server := newFakeServer(t)
+	server.release = make(chan struct{})
+	server.Start()
+	plugin := newTestPlugin(t, map[string]interface{}{"url": server.URL, "batchInterval": "1h", "concurrency": 1})
+
+	// the request of sensor-1 takes the only slot
+	for _, sensorID := range []string{"sensor-1", "sensor-2"} {
+		if err := plugin.Write(context.Background(), plugintest.Batch(t, sensorID, plugintest.Start, 3, time.Millisecond)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	plugin.mu.Lock()
+	second := plugin.pending
+	plugin.mu.Unlock()
+	fired := make(chan struct{})
+	go func() {
+		defer close(fired)
+		plugin.onBatchInterval(second)
+	}()
+	for taken := false; !taken; {
+		time.Sleep(time.Millisecond)
+		plugin.mu.Lock()
+		taken = plugin.pending == nil
+		plugin.mu.Unlock()
+	}
+
+	// the timer waits for a slot, without holding up the batches
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		if err := plugin.Write(context.Background(), plugintest.Batch(t, "sensor-2", plugintest.Start, 3, time.Millisecond)); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the write not to wait for the timer")
+	}
+	close(server.release)
+	<-fired
+	if err := plugin.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requests := len(server.received()); requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+}
+
+func TestPluginInitErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  map[string]interface{}
+		expected error
+	}{
+		{"no URL", map[string]interface{}{}, ErrMissingURL},
+		{"invalid URL", map[string]interface{}{"url": "ftp://example.com"}, ErrInvalidURL},
+		{"no concurrency", map[string]interface{}{"url": "http://example.com", "concurrency": 0}, ErrInvalidConcurrency},
+		{"unknown encoding", map[string]interface{}{"url": "http://example.com", "encoding": "br"}, ErrUnknownEncoding},
+		{
+			"bearer and basic",
+			map[string]interface{}{"url": "http://example.com", "auth": map[string]interface{}{"bearerToken": "t", "username": "u", "password": "p"}},
+			ErrConflictingAuth,
+		},
+		{
+			"no password",
+			map[string]interface{}{"url": "http://example.com", "auth": map[string]interface{}{"username": "u"}},
+			ErrMissingPassword,
+		},
+		{
+			"certificate without key",
+			map[string]interface{}{"url": "https://example.com", "tls": map[string]interface{}{"certFile": "cert.pem"}},
+			ErrIncompleteKeyPair,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin := &Plugin{}
+			err := plugintest.Init(plugin, "http", tt.options)
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
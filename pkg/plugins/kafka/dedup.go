@@ -0,0 +1,89 @@
+package kafka
+
+import (
+	"strconv"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// defaultDedupWindow is how many sequence numbers of every producer a
+// Deduplicator remembers by default.
+const defaultDedupWindow = 1 << 16
+
+// Deduplicator drops the duplicates of the messages of idempotent writes,
+// which brokers store twice when a write is retried after it went through.
+// Together with the producer ID and the sequence number of the messages, it
+// makes the writes idempotent for its consumers.
+type Deduplicator struct {
+	// Window is how many sequence numbers of every producer are remembered,
+	// counting back from the highest one. The duplicates of the older
+	// messages can't be told apart anymore, and are let through.
+	Window uint64
+
+	producers map[string]*producerSequences
+}
+
+// producerSequences is the sequence numbers of the messages of a producer
+// received so far.
+type producerSequences struct {
+	highest uint64
+	seen    map[uint64]struct{}
+}
+
+func NewDeduplicator() *Deduplicator {
+	return &Deduplicator{Window: defaultDedupWindow, producers: map[string]*producerSequences{}}
+}
+
+// Duplicate tells whether the message was received before. The messages
+// without a producer ID and a sequence number never are.
+func (d *Deduplicator) Duplicate(msg kafka.Message) bool {
+	producerId, sequence, ok := sequenceHeaders(msg)
+	if !ok {
+		return false
+	}
+	s := d.producers[producerId]
+	if s == nil {
+		s = &producerSequences{seen: map[uint64]struct{}{}}
+		d.producers[producerId] = s
+	}
+	if s.highest > d.Window && sequence <= s.highest-d.Window {
+		return false
+	}
+	if _, ok := s.seen[sequence]; ok {
+		return true
+	}
+	s.seen[sequence] = struct{}{}
+	if sequence > s.highest {
+		s.highest = sequence
+	}
+	// forget the numbers out of the window once there are as many of them
+	if uint64(len(s.seen)) > 2*d.Window {
+		for seen := range s.seen {
+			if seen <= s.highest-d.Window {
+				delete(s.seen, seen)
+			}
+		}
+	}
+	return false
+}
+
+// sequenceHeaders returns the producer ID and the sequence number of a
+// message of idempotent writes.
+func sequenceHeaders(msg kafka.Message) (string, uint64, bool) {
+	var producerId string
+	var sequence uint64
+	var hasSequence bool
+	for _, header := range msg.Headers {
+		switch header.Key {
+		case headerProducerId:
+			producerId = string(header.Value)
+		case headerSequence:
+			s, err := strconv.ParseUint(string(header.Value), 10, 64)
+			if err != nil {
+				return "", 0, false
+			}
+			sequence, hasSequence = s, true
+		}
+	}
+	return producerId, sequence, producerId != "" && hasSequence
+}
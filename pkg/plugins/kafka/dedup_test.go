@@ -0,0 +1,57 @@
+package kafka
+
+import (
+	"strconv"
+	"testing"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+func sequencedMessage(producerId string, sequence int) kafka.Message {
+	return kafka.Message{Headers: []kafka.Header{
+		{Key: headerProducerId, Value: []byte(producerId)},
+		{Key: headerSequence, Value: []byte(strconv.Itoa(sequence))},
+	}}
+}
+
+func TestDeduplicator(t *testing.T) {
+	d := NewDeduplicator()
+	d.Window = 4
+
+	tests := []struct {
+		name      string
+		msg       kafka.Message
+		duplicate bool
+	}{
+		{"first", sequencedMessage("a", 1), false},
+		{"out of order", sequencedMessage("a", 3), false},
+		{"late", sequencedMessage("a", 2), false},
+		{"retried", sequencedMessage("a", 3), true},
+		{"other producer", sequencedMessage("b", 3), false},
+		{"without headers", kafka.Message{}, false},
+		{"without headers again", kafka.Message{}, false},
+		{"invalid sequence", kafka.Message{Headers: []kafka.Header{
+			{Key: headerProducerId, Value: []byte("a")},
+			{Key: headerSequence, Value: []byte("x")},
+		}}, false},
+		{"far ahead", sequencedMessage("a", 20), false},
+		{"out of the window", sequencedMessage("a", 3), false},
+		{"retried in the window", sequencedMessage("a", 20), true},
+	}
+	for _, tt := range tests {
+		if duplicate := d.Duplicate(tt.msg); duplicate != tt.duplicate {
+			t.Errorf("%s: expected duplicate %v, got %v", tt.name, tt.duplicate, duplicate)
+		}
+	}
+}
+
+func TestDeduplicatorForgets(t *testing.T) {
+	d := NewDeduplicator()
+	d.Window = 4
+	for i := 1; i <= 100; i++ {
+		d.Duplicate(sequencedMessage("a", i))
+	}
+	if seen := len(d.producers["a"].seen); seen > 8 {
+		t.Errorf("expected at most 8 remembered numbers, got %d", seen)
+	}
+}
@@ -0,0 +1,204 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/inhies/go-bytesize"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+const (
+	defaultMaxRetries   = 5
+	defaultRetryBackoff = time.Second
+	defaultBufferSize   = 32 * bytesize.MB
+	maxRetryBackoff     = 30 * time.Second
+
+	// headerTopic and headerError are the headers of the messages of the
+	// dead-letter topic with the topic which refused them, and why.
+	headerTopic = "topic"
+	headerError = "error"
+)
+
+// produce sends the messages to the brokers, retrying the ones which fail.
+// When the brokers can't be reached, the messages are buffered, to be sent
+// once they are back. New messages are buffered behind the ones which are
+// already, so that they stay in order.
+func (p *Plugin) produce(ctx context.Context, msgs []kafka.Message) error {
+	if len(p.buffer) > 0 {
+		p.drainBuffer(ctx, 0)
+		if len(p.buffer) > 0 {
+			p.bufferMessages(msgs)
+			return nil
+		}
+	}
+
+	failed, err := p.send(ctx, msgs, p.MaxRetries)
+	if len(failed) == 0 {
+		return nil
+	}
+	if retryable(err) && p.BufferSize > 0 {
+		log.Printf("error producing %d messages to %s, buffering them - %v\n", len(failed), p.Topic, err)
+		p.bufferMessages(failed)
+		p.scheduleRetry()
+		return nil
+	}
+	if retryable(err) || ctx.Err() != nil {
+		p.stats.Errors += uint64(len(failed))
+		return err
+	}
+	return p.refuse(ctx, failed, err)
+}
+
+// send writes the messages, and retries the ones which fail up to retries
+// times, with exponential backoff. This comes on top of the retries of the
+// writer, so that the messages survive outages longer than a few seconds. It
+// returns the messages which couldn't be written, along with the error.
+func (p *Plugin) send(ctx context.Context, msgs []kafka.Message, retries int) ([]kafka.Message, error) {
+	backoff := p.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		var err error
+		msgs, err = p.written(msgs, p.Writer.WriteMessages(ctx, msgs...))
+		if len(msgs) == 0 || attempt >= retries || !retryable(err) {
+			return msgs, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return msgs, err
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// written counts the messages which were written, and returns the ones
+// which weren't, along with the error of the first of them. When some of the
+// messages fail, the writer tells which ones.
+func (p *Plugin) written(msgs []kafka.Message, err error) ([]kafka.Message, error) {
+	var writeErrors kafka.WriteErrors
+	if err != nil && !(errors.As(err, &writeErrors) && len(writeErrors) == len(msgs)) {
+		return msgs, err
+	}
+
+	var failed []kafka.Message
+	err = nil
+	for i, msg := range msgs {
+		if writeErrors != nil && writeErrors[i] != nil {
+			if err == nil {
+				err = writeErrors[i]
+			}
+			failed = append(failed, msg)
+			continue
+		}
+		p.stats.Writes++
+		p.stats.BytesWritten += uint64(len(msg.Value))
+	}
+	return failed, err
+}
+
+// bufferMessages keeps the messages until the brokers are back. When the
+// buffer is full, the oldest messages are dropped.
+func (p *Plugin) bufferMessages(msgs []kafka.Message) {
+	for _, msg := range msgs {
+		p.buffer = append(p.buffer, msg)
+		p.bufferBytes += len(msg.Value)
+	}
+	dropped := 0
+	for p.bufferBytes > p.BufferSize && len(p.buffer) > 0 {
+		p.bufferBytes -= len(p.buffer[0].Value)
+		p.buffer = p.buffer[1:]
+		dropped++
+	}
+	if dropped > 0 {
+		p.stats.Errors += uint64(dropped)
+		log.Printf("buffer of %s is full, dropped %d messages\n", p.Topic, dropped)
+	}
+}
+
+// drainBuffer sends the buffered messages, oldest first, once their backoff
+// has elapsed. The messages which the topic refuses are taken out of the
+// buffer.
+func (p *Plugin) drainBuffer(ctx context.Context, retries int) {
+	if len(p.buffer) == 0 || time.Now().Before(p.nextRetry) {
+		return
+	}
+	failed, err := p.send(ctx, p.buffer, retries)
+	p.buffer = failed
+	p.bufferBytes = 0
+	for _, msg := range failed {
+		p.bufferBytes += len(msg.Value)
+	}
+	switch {
+	case len(failed) == 0:
+		p.bufferBackoff = 0
+	case retryable(err) || ctx.Err() != nil:
+		p.scheduleRetry()
+	default:
+		p.buffer, p.bufferBytes = nil, 0
+		if err := p.refuse(ctx, failed, err); err != nil {
+			log.Printf("error producing buffered messages to %s - %v\n", p.Topic, err)
+		}
+	}
+}
+
+// scheduleRetry sets when to send the buffered messages next, with
+// exponential backoff.
+func (p *Plugin) scheduleRetry() {
+	if p.bufferBackoff == 0 {
+		p.bufferBackoff = p.RetryBackoff
+	} else {
+		p.bufferBackoff *= 2
+		if p.bufferBackoff > maxRetryBackoff {
+			p.bufferBackoff = maxRetryBackoff
+		}
+	}
+	p.nextRetry = time.Now().Add(p.bufferBackoff)
+}
+
+// refuse handles the messages which the topic refused, which are produced to
+// the dead-letter topic when there's one. Either way, they count as errors.
+func (p *Plugin) refuse(ctx context.Context, msgs []kafka.Message, err error) error {
+	p.stats.Errors += uint64(len(msgs))
+	if p.DeadLetterTopic == "" {
+		return err
+	}
+
+	dead := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		msg.Topic = p.DeadLetterTopic
+		msg.Headers = append(append([]kafka.Header(nil), msg.Headers...),
+			kafka.Header{Key: headerTopic, Value: []byte(p.Topic)},
+			kafka.Header{Key: headerError, Value: []byte(err.Error())},
+		)
+		dead[i] = msg
+	}
+	if deadErr := p.Writer.WriteMessages(ctx, dead...); deadErr != nil {
+		return fmt.Errorf("%w, and producing to %s failed: %v", err, p.DeadLetterTopic, deadErr)
+	}
+	log.Printf("produced %d messages refused by %s to %s - %v\n", len(msgs), p.Topic, p.DeadLetterTopic, err)
+	return nil
+}
+
+// retryable tells whether the error is temporary. Errors without a Kafka
+// error code, e.g. when the brokers can't be reached, are.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrClosedPipe) {
+		return false
+	}
+	var tooLarge kafka.MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+		return false
+	}
+	var kafkaErr kafka.Error
+	if errors.As(err, &kafkaErr) {
+		return kafkaErr.Temporary()
+	}
+	return true
+}
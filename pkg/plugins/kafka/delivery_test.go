@@ -0,0 +1,248 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+)
+
+var errUnreachable = errors.New("dial tcp 127.0.0.1:9092: connect: connection refused")
+
+// flakyWriter fails the writes with errs in turn, before writing the
+// messages. With kafka.WriteErrors, the messages without an error are
+// written.
+type flakyWriter struct {
+	mockKafkaWriter
+	errs     []error
+	attempts int
+}
+
+func (w *flakyWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.attempts++
+	if len(w.errs) == 0 {
+		return w.mockKafkaWriter.WriteMessages(ctx, msgs...)
+	}
+	err := w.errs[0]
+	w.errs = w.errs[1:]
+	if writeErrors, ok := err.(kafka.WriteErrors); ok {
+		for i, msg := range msgs {
+			if writeErrors[i] == nil {
+				w.Messages = append(w.Messages, msg)
+			}
+		}
+	}
+	return err
+}
+
+func flakyPlugin(errs ...error) (*Plugin, *flakyWriter) {
+	writer := &flakyWriter{errs: errs}
+	return &Plugin{
+		Writer:       writer,
+		IdGenerator:  &mockIdGenerator{},
+		Topic:        "test",
+		MessageSize:  8,
+		FileSize:     1 << 20,
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+		BufferSize:   1024,
+	}, writer
+}
+
+func messageValues(msgs []kafka.Message) []string {
+	values := make([]string, len(msgs))
+	for i, msg := range msgs {
+		values[i] = string(msg.Value)
+	}
+	return values
+}
+
+func TestPluginRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		values   []string
+	}{
+		{
+			name:     "unreachable brokers",
+			errs:     []error{errUnreachable, errUnreachable},
+			attempts: 3,
+			values:   []string{"\xde\xef\xec\xe00123", "456789"},
+		},
+		{
+			name:     "some messages failed",
+			errs:     []error{kafka.WriteErrors{nil, kafka.NotEnoughReplicas}},
+			attempts: 2,
+			values:   []string{"\xde\xef\xec\xe00123", "456789"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin, writer := flakyPlugin(tt.errs...)
+			if err := plugin.Write(context.Background(), &batch.Batch{Data: []byte("0123456789")}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if writer.attempts != tt.attempts {
+				t.Errorf("expected %d attempts, got %d", tt.attempts, writer.attempts)
+			}
+			if values := messageValues(writer.Messages); !reflect.DeepEqual(values, tt.values) {
+				t.Errorf("expected %q, got %q", tt.values, values)
+			}
+			if stats := plugin.Stats(); stats.Writes != 2 || stats.BytesWritten != 14 || stats.Errors != 0 {
+				t.Errorf("expected 2 writes of 14 bytes, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestPluginBuffer(t *testing.T) {
+	// the first write and its retries fail, the second write fails to send
+	// the buffered messages
+	plugin, writer := flakyPlugin(errUnreachable, errUnreachable, errUnreachable, errUnreachable)
+	plugin.RetryBackoff = 0
+	ctx := context.Background()
+	for _, data := range []string{"0123456789", "abcd", "efghijklmn"} {
+		if err := plugin.Write(ctx, &batch.Batch{Data: []byte(data)}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := plugin.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"\xde\xef\xec\xe00123", "456789", "abcdefgh", "ijklmn", ""}
+	if values := messageValues(writer.Messages); !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %q, got %q", expected, values)
+	}
+	if stats := plugin.Stats(); stats.Writes != 5 || stats.Errors != 0 {
+		t.Errorf("expected 5 writes, got %+v", stats)
+	}
+}
+
+func TestPluginFlushBuffer(t *testing.T) {
+	// the write and its retries fail, the flush sends the buffered messages
+	plugin, writer := flakyPlugin(errUnreachable, errUnreachable, errUnreachable)
+	plugin.RetryBackoff = 0
+	ctx := context.Background()
+	if err := plugin.Write(ctx, &batch.Batch{Data: []byte("0123456789")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(plugin.buffer) != 2 {
+		t.Fatalf("expected 2 buffered messages, got %d", len(plugin.buffer))
+	}
+	if err := plugin.Flush(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"\xde\xef\xec\xe00123", "456789"}
+	if values := messageValues(writer.Messages); !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %q, got %q", expected, values)
+	}
+	if len(plugin.buffer) != 0 {
+		t.Errorf("expected the buffer to be drained, got %d messages", len(plugin.buffer))
+	}
+}
+
+func TestPluginBufferFull(t *testing.T) {
+	plugin, writer := flakyPlugin(errUnreachable, errUnreachable, errUnreachable, errUnreachable)
+	plugin.MaxRetries = 0
+	plugin.RetryBackoff = 0
+	plugin.BufferSize = 16
+	ctx := context.Background()
+	// every write fails and buffers two more messages, which push the oldest
+	// ones out
+	for _, data := range []string{"0123456789ab", "cdefghijklmnop", "qrstuvwxyzABCDEF"} {
+		if err := plugin.Write(ctx, &batch.Batch{Data: []byte(data)}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := plugin.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"qrstuvwx", "yzABCDEF", ""}
+	if values := messageValues(writer.Messages); !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %q, got %q", expected, values)
+	}
+	if stats := plugin.Stats(); stats.Writes != 3 || stats.Errors != 4 {
+		t.Errorf("expected 3 writes and 4 errors, got %+v", stats)
+	}
+}
+
+func TestPluginBufferLostOnClose(t *testing.T) {
+	plugin, _ := flakyPlugin(errUnreachable, errUnreachable, errUnreachable, errUnreachable, errUnreachable, errUnreachable)
+	if err := plugin.Write(context.Background(), &batch.Batch{Data: []byte("0123456789")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := plugin.Close(); err == nil {
+		t.Errorf("expected an error")
+	}
+	if stats := plugin.Stats(); stats.Writes != 0 || stats.Errors != 3 {
+		t.Errorf("expected 3 errors, got %+v", stats)
+	}
+}
+
+func TestPluginDeadLetter(t *testing.T) {
+	t.Run("dead-letter topic", func(t *testing.T) {
+		plugin, writer := flakyPlugin(kafka.WriteErrors{nil, kafka.MessageSizeTooLarge})
+		plugin.DeadLetterTopic = "dead"
+		if err := plugin.Write(context.Background(), &batch.Batch{Data: []byte("0123456789")}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(writer.Messages) != 2 {
+			t.Fatalf("expected 2 messages, got %d", len(writer.Messages))
+		}
+		dead := writer.Messages[1]
+		headers := messageHeaders(dead)
+		if dead.Topic != "dead" || string(dead.Value) != "456789" || headers["topic"] != "test" || headers["error"] != kafka.MessageSizeTooLarge.Error() {
+			t.Errorf("unexpected dead-letter message %+v", dead)
+		}
+		if stats := plugin.Stats(); stats.Writes != 1 || stats.Errors != 1 {
+			t.Errorf("expected 1 write and 1 error, got %+v", stats)
+		}
+	})
+
+	t.Run("no dead-letter topic", func(t *testing.T) {
+		plugin, writer := flakyPlugin(kafka.WriteErrors{nil, kafka.MessageSizeTooLarge})
+		if err := plugin.Write(context.Background(), &batch.Batch{Data: []byte("0123456789")}); !errors.Is(err, kafka.MessageSizeTooLarge) {
+			t.Errorf("expected %v, got %v", kafka.MessageSizeTooLarge, err)
+		}
+		if writer.attempts != 1 || len(writer.Messages) != 1 {
+			t.Errorf("expected 1 attempt and 1 message, got %d and %d", writer.attempts, len(writer.Messages))
+		}
+		if stats := plugin.Stats(); stats.Writes != 1 || stats.Errors != 1 {
+			t.Errorf("expected 1 write and 1 error, got %+v", stats)
+		}
+	})
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{errUnreachable, true},
+		{kafka.NotEnoughReplicas, true},
+		{kafka.LeaderNotAvailable, true},
+		{kafka.UnknownTopicOrPartition, true},
+		{kafka.RequestTimedOut, true},
+		{kafka.MessageSizeTooLarge, false},
+		{kafka.MessageTooLargeError{}, false},
+		{kafka.TopicAuthorizationFailed, false},
+		{kafka.SASLAuthenticationFailed, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		if retryable(tt.err) != tt.retryable {
+			t.Errorf("expected retryable(%v) to be %v", tt.err, tt.retryable)
+		}
+	}
+}
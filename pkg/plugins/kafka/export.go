@@ -0,0 +1,417 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	kafka "github.com/segmentio/kafka-go"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/file"
+)
+
+var (
+	ErrInvalidFileHeader = errors.New("the file doesn't start with the PacketStreamer header")
+	ErrMissingChunks     = errors.New("chunks of the file are missing")
+	ErrTruncatedFile     = errors.New("the file ends with a truncated pcap record")
+	ErrLinkTypeMismatch  = errors.New("the link type of the file differs from the one of the stream")
+)
+
+// ExportedFile describes a file of the file mode put back together by an
+// Exporter.
+type ExportedFile struct {
+	Key      string
+	Messages int
+	// LinkType is the link type of the packets of the file, Ethernet for the
+	// files produced before their messages carried it.
+	LinkType layers.LinkType
+	// Bytes and Packets are the size and the number of packets of the part of
+	// the file which could be exported.
+	Bytes   int
+	Packets int
+	// Complete is set when all the chunks of the file were received, and they
+	// make valid pcap records.
+	Complete bool
+	// Err tells why the file isn't complete.
+	Err error
+}
+
+// ExportSink gets the files put back together, as the pcap records following
+// the PacketStreamer header. A sink which can't take the link type of a file
+// returns ErrLinkTypeMismatch, and the file is reported as not exported.
+type ExportSink interface {
+	WriteFile(f ExportedFile, records []byte) error
+	Close() error
+}
+
+// MessageReader is a source of Kafka messages, like kafka.Reader.
+type MessageReader interface {
+	ReadMessage(ctx context.Context) (kafka.Message, error)
+}
+
+// Exporter puts the files of the file mode back together from the messages
+// of the topic. The messages of a file are grouped by their key, and put in
+// order by their offset header. A file is written to the sink once its last
+// message and all the ones before it have been received. The messages
+// produced before the offset header existed are taken in the order they come
+// in, and their files are only written when the exporter is closed, and
+// considered complete when their records are valid.
+type Exporter struct {
+	Sink ExportSink
+	// IdleTimeout stops Run once no message comes for that long, 0 means
+	// that it runs until its context is done.
+	IdleTimeout time.Duration
+	// Files describes the files written so far.
+	Files []ExportedFile
+	// Skipped is the number of messages of the packet and flow modes.
+	Skipped int
+	// Duplicates is the number of messages of idempotent writes which were
+	// received more than once.
+	Duplicates int
+
+	dedup   *Deduplicator
+	pending map[string]*pendingFile
+	written map[string]bool
+	// order is the keys of the pending files, in the order they came in.
+	order []string
+}
+
+// pendingFile is a file whose messages are being received.
+type pendingFile struct {
+	key      string
+	messages int
+	chunks   map[int64][]byte
+	// next is the offset of the next message without an offset header.
+	next int64
+	// unordered is set for the files whose messages have no offset header,
+	// whose missing chunks can only be told by the records they break.
+	unordered bool
+	// end is the size of the file, once its last message is received.
+	end      int64
+	linkType layers.LinkType
+}
+
+// NewReader returns a reader of the topic of the plugin configuration, as a
+// member of the consumer group. A group without committed offsets starts with
+// the oldest messages.
+func NewReader(cfg Config, groupID string) (*kafka.Reader, error) {
+	dialer, err := NewDialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	topic := defaultTopic
+	if cfg.Topic != nil {
+		topic = *cfg.Topic
+	}
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     strings.Split(cfg.Brokers, ","),
+		GroupID:     groupID,
+		Topic:       topic,
+		Dialer:      dialer,
+		StartOffset: kafka.FirstOffset,
+	}), nil
+}
+
+func NewExporter(sink ExportSink) *Exporter {
+	return &Exporter{Sink: sink, dedup: NewDeduplicator(), pending: map[string]*pendingFile{}, written: map[string]bool{}}
+}
+
+// Run adds the messages of the reader until its context is done, or
+// IdleTimeout elapses without messages, and closes the exporter.
+func (e *Exporter) Run(ctx context.Context, r MessageReader) error {
+	for {
+		msg, err := e.readMessage(ctx, r)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.EOF) {
+				return e.Close()
+			}
+			e.Close()
+			return err
+		}
+		if err := e.Add(msg); err != nil {
+			e.Close()
+			return err
+		}
+	}
+}
+
+func (e *Exporter) readMessage(ctx context.Context, r MessageReader) (kafka.Message, error) {
+	if e.IdleTimeout == 0 {
+		return r.ReadMessage(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.IdleTimeout)
+	defer cancel()
+	return r.ReadMessage(ctx)
+}
+
+// Add adds a message, and writes its file if it's complete.
+func (e *Exporter) Add(msg kafka.Message) error {
+	if e.dedup.Duplicate(msg) {
+		e.Duplicates++
+		return nil
+	}
+	offset, last, ok := chunkHeaders(msg)
+	if !ok || len(msg.Key) == 0 {
+		e.Skipped++
+		return nil
+	}
+
+	key := string(msg.Key)
+	if e.written[key] {
+		// a duplicate of a retried write
+		return nil
+	}
+	f := e.pending[key]
+	if f == nil {
+		f = &pendingFile{key: key, chunks: map[int64][]byte{}, end: -1, linkType: layers.LinkTypeEthernet}
+		e.pending[key] = f
+		e.order = append(e.order, key)
+	}
+	if offset < 0 {
+		f.unordered = true
+		offset = f.next
+	}
+	f.next = offset + int64(len(msg.Value))
+	f.messages++
+	if linkType, ok := messageLinkType(msg); ok {
+		f.linkType = linkType
+	}
+	// the messages of retried writes may come twice
+	if _, ok := f.chunks[offset]; !ok {
+		f.chunks[offset] = msg.Value
+	}
+	if last {
+		f.end = offset + int64(len(msg.Value))
+	}
+
+	if f.end < 0 {
+		return nil
+	}
+	data, size := f.assemble()
+	if size < f.end {
+		return nil
+	}
+	return e.write(f, data[:f.end])
+}
+
+// Close writes the files which are still incomplete, with the data up to
+// their first missing chunk, and closes the sink.
+func (e *Exporter) Close() error {
+	var firstErr error
+	// writing the files takes them out of the order
+	for _, key := range append([]string(nil), e.order...) {
+		f, ok := e.pending[key]
+		if !ok {
+			continue
+		}
+		data, _ := f.assemble()
+		if err := e.write(f, data); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := e.Sink.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// write validates the data of the file, and writes the valid records to the
+// sink.
+func (e *Exporter) write(f *pendingFile, data []byte) error {
+	delete(e.pending, f.key)
+	e.written[f.key] = true
+	for i, key := range e.order {
+		if key == f.key {
+			e.order = append(e.order[:i], e.order[i+1:]...)
+			break
+		}
+	}
+
+	exported := ExportedFile{Key: f.key, Messages: f.messages, LinkType: f.linkType}
+	var records []byte
+	if _, ok := f.chunks[0]; !ok {
+		exported.Err = ErrMissingChunks
+	} else if !bytes.HasPrefix(data, file.Header) {
+		exported.Err = ErrInvalidFileHeader
+	} else {
+		records = data[len(file.Header):]
+		n, packets, err := validRecords(records)
+		records = records[:n]
+		exported.Bytes, exported.Packets = n, packets
+		switch {
+		case !f.unordered && (f.end < 0 || int64(len(data)) < f.end):
+			exported.Err = ErrMissingChunks
+		case err != nil && f.unordered:
+			exported.Err = ErrMissingChunks
+		case err != nil:
+			exported.Err = ErrTruncatedFile
+		default:
+			exported.Complete = true
+		}
+	}
+	e.Files = append(e.Files, exported)
+	if len(records) == 0 {
+		return nil
+	}
+	err := e.Sink.WriteFile(exported, records)
+	if errors.Is(err, ErrLinkTypeMismatch) {
+		// the other files can still be exported
+		f := &e.Files[len(e.Files)-1]
+		f.Bytes, f.Packets, f.Complete, f.Err = 0, 0, false, err
+		return nil
+	}
+	return err
+}
+
+// assemble returns the data of the file up to its first missing chunk, along
+// with its size.
+func (f *pendingFile) assemble() ([]byte, int64) {
+	offsets := make([]int64, 0, len(f.chunks))
+	for offset := range f.chunks {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	var data []byte
+	for _, offset := range offsets {
+		if offset != int64(len(data)) {
+			break
+		}
+		data = append(data, f.chunks[offset]...)
+	}
+	return data, int64(len(data))
+}
+
+// validRecords returns the length and the number of packets of the pcap
+// records at the start of the data, and an error when there's anything after
+// them.
+func validRecords(records []byte) (int, int, error) {
+	n, packets := 0, 0
+	for n < len(records) {
+		_, _, rest, err := batch.NextRecord(records[n:])
+		if err != nil {
+			return n, packets, err
+		}
+		n = len(records) - len(rest)
+		packets++
+	}
+	return n, packets, nil
+}
+
+// chunkHeaders returns the offset of a message of the file mode, which is -1
+// when it has no offset header, and whether it's the last one of its file. It
+// returns false for the messages of the other modes.
+func chunkHeaders(msg kafka.Message) (int64, bool, bool) {
+	offset := int64(-1)
+	var last bool
+	for _, header := range msg.Headers {
+		switch header.Key {
+		case headerOffset:
+			o, err := strconv.ParseInt(string(header.Value), 10, 64)
+			if err != nil || o < 0 {
+				return 0, false, false
+			}
+			offset = o
+		case headerLast:
+			last = string(header.Value) == "true"
+		case headerFormat:
+			return 0, false, false
+		}
+	}
+	return offset, last, true
+}
+
+// messageLinkType returns the link type of the packets of a message, when its
+// header is set.
+func messageLinkType(msg kafka.Message) (layers.LinkType, bool) {
+	for _, header := range msg.Headers {
+		if header.Key == headerLinkType {
+			linkType, err := strconv.ParseUint(string(header.Value), 10, 8)
+			return layers.LinkType(linkType), err == nil
+		}
+	}
+	return 0, false
+}
+
+// dirSink writes every file to a directory, named after its key. The files
+// which aren't complete get an .incomplete extension before .pcap.
+type dirSink struct {
+	dir     string
+	snapLen int
+}
+
+// NewDirSink returns a sink writing pcap files to the directory.
+func NewDirSink(dir string, snapLen int) (ExportSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create the directory: %w", err)
+	}
+	return &dirSink{dir: dir, snapLen: snapLen}, nil
+}
+
+func (s *dirSink) WriteFile(f ExportedFile, records []byte) error {
+	name := filepath.Base(f.Key)
+	if !f.Complete {
+		name += ".incomplete"
+	}
+	out, err := os.Create(filepath.Join(s.dir, name+".pcap"))
+	if err != nil {
+		return err
+	}
+	if err := pcapgo.NewWriter(out).WriteFileHeader(uint32(s.snapLen), f.LinkType); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := out.Write(records); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (s *dirSink) Close() error {
+	return nil
+}
+
+// streamSink writes the packets of all the files as a single pcap stream, one
+// file after another. The stream has the link type of the first file, and
+// the files of other link types are refused.
+type streamSink struct {
+	w             io.Writer
+	snapLen       int
+	headerWritten bool
+	linkType      layers.LinkType
+}
+
+// NewStreamSink returns a sink writing a pcap stream to w.
+func NewStreamSink(w io.Writer, snapLen int) ExportSink {
+	return &streamSink{w: w, snapLen: snapLen}
+}
+
+func (s *streamSink) WriteFile(f ExportedFile, records []byte) error {
+	if !s.headerWritten {
+		if err := pcapgo.NewWriter(s.w).WriteFileHeader(uint32(s.snapLen), f.LinkType); err != nil {
+			return err
+		}
+		s.headerWritten = true
+		s.linkType = f.LinkType
+	} else if f.LinkType != s.linkType {
+		return fmt.Errorf("%w: %s, not %s", ErrLinkTypeMismatch, f.LinkType, s.linkType)
+	}
+	_, err := s.w.Write(records)
+	return err
+}
+
+func (s *streamSink) Close() error {
+	return nil
+}
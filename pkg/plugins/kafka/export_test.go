@@ -0,0 +1,318 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	kafka "github.com/segmentio/kafka-go"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+)
+
+type memorySink struct {
+	files   []ExportedFile
+	records map[string][]byte
+	closed  bool
+}
+
+func (s *memorySink) WriteFile(f ExportedFile, records []byte) error {
+	if s.records == nil {
+		s.records = map[string][]byte{}
+	}
+	s.files = append(s.files, f)
+	s.records[f.Key] = append([]byte(nil), records...)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.closed = true
+	return nil
+}
+
+type sliceReader struct {
+	msgs []kafka.Message
+}
+
+func (r *sliceReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	if len(r.msgs) == 0 {
+		return kafka.Message{}, io.EOF
+	}
+	msg := r.msgs[0]
+	r.msgs = r.msgs[1:]
+	return msg, nil
+}
+
+// exportTestFile produces the packets of packetBatch as a file in 40 bytes
+// chunks, and returns the messages along with the records of the file.
+func exportTestFile(t *testing.T, mode Mode) ([]kafka.Message, []byte) {
+	t.Helper()
+	writer := &mockKafkaWriter{}
+	plugin := &Plugin{
+		Writer:            writer,
+		IdGenerator:       &mockIdGenerator{},
+		Topic:             "test",
+		MessageSize:       40,
+		FileSize:          1 << 20,
+		Mode:              mode,
+		PacketsPerMessage: 1,
+		SnapLen:           65535,
+	}
+	b := packetBatch(t)
+	if err := plugin.Write(context.Background(), b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := plugin.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return writer.Messages, b.Data
+}
+
+func TestExporter(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages func([]kafka.Message) []kafka.Message
+		// written tells whether the file is written before the exporter is
+		// closed.
+		written  bool
+		complete bool
+		err      error
+	}{
+		{
+			name:     "in order",
+			messages: func(msgs []kafka.Message) []kafka.Message { return msgs },
+			written:  true,
+			complete: true,
+		},
+		{
+			name: "out of order with a duplicate",
+			messages: func(msgs []kafka.Message) []kafka.Message {
+				var out []kafka.Message
+				for i := len(msgs) - 1; i >= 0; i-- {
+					out = append(out, msgs[i])
+				}
+				return append(out[:2], append([]kafka.Message{msgs[1]}, out[2:]...)...)
+			},
+			written:  true,
+			complete: true,
+		},
+		{
+			name: "missing chunk",
+			messages: func(msgs []kafka.Message) []kafka.Message {
+				return append(msgs[:2:2], msgs[3:]...)
+			},
+			err: ErrMissingChunks,
+		},
+		{
+			name:     "missing head",
+			messages: func(msgs []kafka.Message) []kafka.Message { return msgs[1:] },
+			err:      ErrMissingChunks,
+		},
+		{
+			name:     "missing last message",
+			messages: func(msgs []kafka.Message) []kafka.Message { return msgs[:len(msgs)-1] },
+			err:      ErrMissingChunks,
+		},
+		{
+			name: "truncated record",
+			messages: func(msgs []kafka.Message) []kafka.Message {
+				last := &msgs[len(msgs)-1]
+				last.Value = append(last.Value, 0)
+				return msgs
+			},
+			written: true,
+			err:     ErrTruncatedFile,
+		},
+		{
+			name: "invalid header",
+			messages: func(msgs []kafka.Message) []kafka.Message {
+				msgs[0].Value = append([]byte("PCAP"), msgs[0].Value[4:]...)
+				return msgs
+			},
+			written: true,
+			err:     ErrInvalidFileHeader,
+		},
+		{
+			name: "without offset headers",
+			messages: func(msgs []kafka.Message) []kafka.Message {
+				for i := range msgs {
+					msgs[i].Headers = nil
+				}
+				return msgs
+			},
+			complete: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, records := exportTestFile(t, ModeFile)
+			sink := &memorySink{}
+			exporter := NewExporter(sink)
+			for _, msg := range tt.messages(msgs) {
+				if err := exporter.Add(msg); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if written := len(exporter.Files) == 1; written != tt.written {
+				t.Errorf("expected the file to be written before closing: %v, got %v", tt.written, written)
+			}
+			if err := exporter.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !sink.closed {
+				t.Errorf("expected the sink to be closed")
+			}
+			if len(exporter.Files) != 1 {
+				t.Fatalf("expected 1 file, got %+v", exporter.Files)
+			}
+
+			f := exporter.Files[0]
+			if f.Key != "test" || f.Complete != tt.complete || !errors.Is(f.Err, tt.err) {
+				t.Errorf("expected a file with complete %v and error %v, got %+v", tt.complete, tt.err, f)
+			}
+			exported := sink.records["test"]
+			if tt.complete && !bytes.Equal(exported, records) {
+				t.Errorf("expected the records of the file, got %d bytes out of %d", len(exported), len(records))
+			}
+			if !bytes.HasPrefix(records, exported) {
+				t.Errorf("expected a prefix of the records of the file")
+			}
+			if _, packets, err := validRecords(exported); err != nil || packets != f.Packets || len(exported) != f.Bytes {
+				t.Errorf("expected %d packets in %d bytes of valid records, got %d packets: %v", f.Packets, f.Bytes, packets, err)
+			}
+		})
+	}
+}
+
+func TestExporterDuplicates(t *testing.T) {
+	msgs, records := exportTestFile(t, ModeFile)
+	for i := range msgs {
+		msgs[i].Headers = append(msgs[i].Headers, sequencedMessage("producer", i+1).Headers...)
+	}
+	// the first message is stored twice by a retried write
+	sink := &memorySink{}
+	exporter := NewExporter(sink)
+	if err := exporter.Run(context.Background(), &sliceReader{msgs: append(msgs[:1:1], msgs...)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exporter.Duplicates != 1 || len(exporter.Files) != 1 || exporter.Files[0].Messages != len(msgs) {
+		t.Errorf("expected 1 duplicate and a file of %d messages, got %d and %+v", len(msgs), exporter.Duplicates, exporter.Files)
+	}
+	if !bytes.Equal(sink.records["test"], records) {
+		t.Errorf("expected the records of the file")
+	}
+}
+
+func TestExporterSkipsPacketMessages(t *testing.T) {
+	msgs, _ := exportTestFile(t, ModePacket)
+	sink := &memorySink{}
+	exporter := NewExporter(sink)
+	if err := exporter.Run(context.Background(), &sliceReader{msgs: msgs}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exporter.Skipped != len(msgs) || len(exporter.Files) != 0 || len(sink.files) != 0 {
+		t.Errorf("expected %d skipped messages and no files, got %d and %+v", len(msgs), exporter.Skipped, exporter.Files)
+	}
+}
+
+func readPcap(t *testing.T, r io.Reader) int {
+	t.Helper()
+	reader, err := pcapgo.NewReader(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	packets := 0
+	for {
+		if _, _, err := reader.ReadPacketData(); err == io.EOF {
+			return packets
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		packets++
+	}
+}
+
+func TestExportSinks(t *testing.T) {
+	msgs, _ := exportTestFile(t, ModeFile)
+	incomplete := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		msg.Key = []byte("other")
+		incomplete[i] = msg
+	}
+	// the file loses its last chunk of data, and the empty message marking
+	// its end
+	incomplete = incomplete[:len(incomplete)-2]
+	// a file of raw IP packets can't share the stream of Ethernet ones
+	raw := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		msg.Key = []byte("raw")
+		msg.Headers = append([]kafka.Header{{Key: "link-type", Value: []byte("101")}}, msg.Headers...)
+		raw[i] = msg
+	}
+	all := append(append(append([]kafka.Message(nil), msgs...), incomplete...), raw...)
+
+	t.Run("directory", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "export")
+		sink, err := NewDirSink(dir, 65535)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := NewExporter(sink).Run(context.Background(), &sliceReader{msgs: all}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for name, expected := range map[string]int{"test.pcap": 3, "other.incomplete.pcap": 2, "raw.pcap": 3} {
+			f, err := os.Open(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if packets := readPcap(t, f); packets != expected {
+				t.Errorf("expected %d packets in %s, got %d", expected, name, packets)
+			}
+			f.Close()
+		}
+		f, err := os.Open(filepath.Join(dir, "raw.pcap"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer f.Close()
+		reader, err := pcapgo.NewReader(f)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if linkType := reader.LinkType(); linkType != layers.LinkTypeRaw {
+			t.Errorf("expected raw.pcap to be %s, got %s", layers.LinkTypeRaw, linkType)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		var out bytes.Buffer
+		exporter := NewExporter(NewStreamSink(&out, 65535))
+		if err := exporter.Run(context.Background(), &sliceReader{msgs: all}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if packets := readPcap(t, &out); packets != 5 {
+			t.Errorf("expected 5 packets, got %d", packets)
+		}
+		// the incomplete file is only written once the exporter is closed
+		if f := exporter.Files[1]; f.Key != "raw" || f.Complete || f.Packets != 0 || !errors.Is(f.Err, ErrLinkTypeMismatch) {
+			t.Errorf("expected the raw file to be refused, got %+v", f)
+		}
+	})
+}
+
+func TestValidRecords(t *testing.T) {
+	_, records := exportTestFile(t, ModeFile)
+	if n, packets, err := validRecords(records); n != len(records) || packets != 3 || err != nil {
+		t.Errorf("expected 3 packets in %d bytes, got %d packets in %d bytes: %v", len(records), packets, n, err)
+	}
+	if _, packets, err := validRecords(records[:len(records)-1]); packets != 2 || !errors.Is(err, batch.ErrTruncatedRecord) {
+		t.Errorf("expected 2 packets and a truncated record, got %d packets: %v", packets, err)
+	}
+}
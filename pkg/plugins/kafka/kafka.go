@@ -2,15 +2,94 @@ package kafka
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/deepfence/PacketStreamer/pkg/batch"
 	"github.com/deepfence/PacketStreamer/pkg/config"
 	"github.com/deepfence/PacketStreamer/pkg/file"
+	"github.com/deepfence/PacketStreamer/pkg/plugins"
 	"github.com/google/uuid"
+	"github.com/inhies/go-bytesize"
 	kafka "github.com/segmentio/kafka-go"
 )
 
+const (
+	defaultClientId = "packetstreamer"
+	defaultTopic    = "packetstreamer"
+	defaultAcks     = "all"
+
+	defaultDialTimeout = 10 * time.Second
+	defaultBatchSize   = 100
+	defaultLinger      = 10 * time.Millisecond
+	// messageOverhead is the room left for the key and the headers of a
+	// message in a batch.
+	messageOverhead = 1024
+
+	// headerOffset and headerLast are the headers of the messages of the file
+	// mode with their offset in the file, and the mark of the last one.
+	headerOffset = "offset"
+	headerLast   = "last"
+	// headerFormat is the header of the messages of the packet and flow
+	// modes with their format.
+	headerFormat = "format"
+	// headerLinkType, headerCodec, headerSensorId and headerInterface are the
+	// headers of the messages of all the modes with the capture of their
+	// packets.
+	headerLinkType  = "link-type"
+	headerCodec     = "codec"
+	headerSensorId  = "sensor-id"
+	headerInterface = "interface"
+	// headerProducerId and headerSequence are the headers of the messages of
+	// idempotent writes with the ID of their producer and their number.
+	headerProducerId = "producer-id"
+	headerSequence   = "sequence"
+)
+
+func init() {
+	plugins.Register("kafka", func() plugins.Plugin {
+		return &Plugin{}
+	})
+}
+
+type Config struct {
+	Brokers     string
+	ClientId    *string       `yaml:"clientId,omitempty"`
+	Topic       *string       `yaml:"topic,omitempty"`
+	MessageSize *string       `yaml:"messageSize,omitempty"`
+	Acks        *string       `yaml:"acks,omitempty"`
+	FileSize    *string       `yaml:"fileSize,omitempty"`
+	Timeout     time.Duration `yaml:"timeout,omitempty"`
+	DialTimeout time.Duration `yaml:"dialTimeout,omitempty"`
+	// BatchSize and Linger are the maximum number of messages in a produce
+	// request, and how long to wait for more messages before sending it.
+	BatchSize   *int          `yaml:"batchSize,omitempty"`
+	Linger      time.Duration `yaml:"linger,omitempty"`
+	Compression string        `yaml:"compression,omitempty"`
+	// Idempotent adds a producer ID and a sequence number to the headers of
+	// the messages, with which consumers drop the duplicates of retried
+	// writes.
+	Idempotent bool `yaml:"idempotent,omitempty"`
+	// Mode is file, packet or flow, Format and PacketsPerMessage are the
+	// encoding and the size of the messages of the packet and flow modes.
+	Mode              string     `yaml:"mode,omitempty"`
+	Format            string     `yaml:"format,omitempty"`
+	PacketsPerMessage *int       `yaml:"packetsPerMessage,omitempty"`
+	TLS               TLSConfig  `yaml:"tls,omitempty"`
+	SASL              SASLConfig `yaml:"sasl,omitempty"`
+
+	MaxRetries   *int    `yaml:"maxRetries,omitempty"`
+	RetryBackoff *string `yaml:"retryBackoff,omitempty"`
+	// BufferSize is the size of the messages kept in memory while the
+	// brokers can't be reached, 0 disables the buffer.
+	BufferSize *string `yaml:"bufferSize,omitempty"`
+	// DeadLetterTopic gets the messages which the topic refuses, e.g. because
+	// they are too large. Without it, they are lost.
+	DeadLetterTopic string `yaml:"deadLetterTopic,omitempty"`
+}
+
 type KafkaWriter interface {
 	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
 	Close() error
@@ -20,6 +99,15 @@ type File struct {
 	Id     string
 	Buffer []byte
 	Sent   uint64
+	// Capture is the sensor, interface, link type and codec of the packets
+	// of the file.
+	Capture batch.Metadata
+}
+
+// sameCapture tells whether the packets described by m can go to the file.
+func (f *File) sameCapture(m batch.Metadata) bool {
+	c := f.Capture
+	return c.SensorID == m.SensorID && c.Interface == m.Interface && c.LinkType == m.PcapLinkType() && c.Codec == m.Codec
 }
 
 func (f *File) newBuffer(size int) {
@@ -40,119 +128,361 @@ type Plugin struct {
 	Writer      KafkaWriter
 	IdGenerator IdGenerator
 	Topic       string
+	ClientId    string
+	Acks        kafka.RequiredAcks
+	Timeout     time.Duration
 	MessageSize int
-	CloseChan   chan bool
 	FileSize    uint64
 	CurrentFile *File
+	Mode        Mode
+	Format      Format
+	// PacketsPerMessage is the maximum number of packets in a message of the
+	// packet and flow modes.
+	PacketsPerMessage int
+	SnapLen           int
+	// ProducerId is set when the writes are idempotent. The messages get
+	// it along with their sequence number in their headers, so that the
+	// duplicates of retried writes can be told apart.
+	ProducerId   string
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// BufferSize is the maximum size of the buffered messages, 0 disables
+	// the buffer.
+	BufferSize      int
+	DeadLetterTopic string
+
+	sequence  uint64
+	transport *kafka.Transport
+	// buffer is the messages which failed because the brokers couldn't be
+	// reached, oldest first. Sending them is tried again at nextRetry.
+	buffer        []kafka.Message
+	bufferBytes   int
+	bufferBackoff time.Duration
+	nextRetry     time.Time
+	// stats count the messages: Writes the ones written to the topic, Errors
+	// the ones which couldn't be.
+	stats plugins.Stats
 }
 
-func NewPlugin(config *config.KafkaPluginConfig) (*Plugin, error) {
-	dialer := &kafka.Dialer{
-		Timeout:   10 * time.Second,
-		DualStack: true,
-		TLS:       nil,
+func (p *Plugin) Init(ctx context.Context, global *config.Config, pluginConfig config.PluginConfig) error {
+	var cfg Config
+	if err := pluginConfig.Decode(&cfg); err != nil {
+		return err
+	}
+
+	p.ClientId = defaultClientId
+	if cfg.ClientId != nil {
+		p.ClientId = *cfg.ClientId
+	}
+
+	p.Topic = defaultTopic
+	if cfg.Topic != nil {
+		p.Topic = *cfg.Topic
+	}
+
+	messageSize := 65 * bytesize.KB
+	if cfg.MessageSize != nil {
+		ms, err := bytesize.Parse(*cfg.MessageSize)
+		if err != nil {
+			return fmt.Errorf("could not parse the messageSize field %s: %w", *cfg.MessageSize, err)
+		}
+		messageSize = ms
+	}
+	p.MessageSize = int(messageSize)
+
+	acks := defaultAcks
+	if cfg.Acks != nil {
+		acks = *cfg.Acks
+	}
+	var err error
+	if p.Acks, err = parseAcks(acks); err != nil {
+		return err
+	}
+	if cfg.Idempotent && p.Acks != kafka.RequireAll {
+		return ErrIdempotentAcks
+	}
+
+	fileSize := 1 * bytesize.MB
+	if cfg.FileSize != nil {
+		fs, err := bytesize.Parse(*cfg.FileSize)
+		if err != nil {
+			return fmt.Errorf("could not parse the fileSize field %s: %w", *cfg.FileSize, err)
+		}
+		fileSize = fs
+	}
+	p.FileSize = uint64(fileSize)
+	p.Timeout = cfg.Timeout
+
+	if p.Mode, err = parseMode(cfg.Mode); err != nil {
+		return err
+	}
+	if p.Format, err = parseFormat(cfg.Format); err != nil {
+		return err
+	}
+	p.PacketsPerMessage = 1
+	if cfg.PacketsPerMessage != nil {
+		if *cfg.PacketsPerMessage < 1 {
+			return ErrInvalidPacketsPerMessage
+		}
+		p.PacketsPerMessage = *cfg.PacketsPerMessage
+	}
+	p.SnapLen = global.InputPacketLen
+
+	p.MaxRetries = defaultMaxRetries
+	if cfg.MaxRetries != nil {
+		p.MaxRetries = *cfg.MaxRetries
+	}
+	p.RetryBackoff = defaultRetryBackoff
+	if cfg.RetryBackoff != nil {
+		if p.RetryBackoff, err = time.ParseDuration(*cfg.RetryBackoff); err != nil {
+			return fmt.Errorf("could not parse the retryBackoff field %s: %w", *cfg.RetryBackoff, err)
+		}
+	}
+	bufferSize := defaultBufferSize
+	if cfg.BufferSize != nil {
+		if bufferSize, err = bytesize.Parse(*cfg.BufferSize); err != nil {
+			return fmt.Errorf("could not parse the bufferSize field %s: %w", *cfg.BufferSize, err)
+		}
+	}
+	p.BufferSize = int(bufferSize)
+	p.DeadLetterTopic = cfg.DeadLetterTopic
+
+	compression, err := parseCompression(cfg.Compression)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return err
+	}
+	mechanism, err := newMechanism(cfg.SASL)
+	if err != nil {
+		return err
+	}
+
+	dialTimeout := defaultDialTimeout
+	if cfg.DialTimeout != 0 {
+		dialTimeout = cfg.DialTimeout
+	}
+	batchSize := defaultBatchSize
+	if cfg.BatchSize != nil {
+		batchSize = *cfg.BatchSize
+	}
+	linger := defaultLinger
+	if cfg.Linger != 0 {
+		linger = cfg.Linger
+	}
+	batchBytes := int64(bytesize.MB)
+	if size := int64(p.MessageSize + messageOverhead); size > batchBytes {
+		batchBytes = size
 	}
-	writer := kafka.NewWriter(kafka.WriterConfig{
-		Brokers:  config.Brokers,
-		Topic:    config.Topic,
-		Balancer: &kafka.Hash{},
-		Dialer:   dialer,
-	})
 
-	return &Plugin{
-		Writer:      writer,
-		Topic:       config.Topic,
-		MessageSize: int(*config.MessageSize),
-		FileSize:    uint64(*config.FileSize),
-		CloseChan:   make(chan bool),
-	}, nil
+	p.transport = &kafka.Transport{
+		DialTimeout: dialTimeout,
+		ClientID:    p.ClientId,
+		TLS:         tlsConfig,
+		SASL:        mechanism,
+	}
+	// the topic is set on the messages, kafka-go refuses it on both
+	p.Writer = &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(cfg.Brokers, ",")...),
+		Balancer:     &kafka.Hash{},
+		BatchSize:    batchSize,
+		BatchBytes:   batchBytes,
+		BatchTimeout: linger,
+		ReadTimeout:  p.Timeout,
+		WriteTimeout: p.Timeout,
+		RequiredAcks: p.Acks,
+		Compression:  compression,
+		Transport:    p.transport,
+	}
+	p.IdGenerator = &FileIdGenerator{}
+	if cfg.Idempotent {
+		p.ProducerId = p.IdGenerator.Generate()
+	}
+
+	return nil
 }
 
-func (p *Plugin) newFile(id string, messageSize int) {
+func (p *Plugin) newFile(id string, m batch.Metadata) {
 	p.CurrentFile = &File{
-		Id:     id,
-		Buffer: make([]byte, 0, messageSize),
+		Id:      id,
+		Buffer:  make([]byte, 0, p.MessageSize),
+		Capture: batch.Metadata{SensorID: m.SensorID, Interface: m.Interface, LinkType: m.PcapLinkType(), Codec: m.Codec},
 	}
 
 	p.CurrentFile.Buffer = append(p.CurrentFile.Buffer, file.Header...)
 }
 
-//Start produces Kafka messages containing data that is written to the returned channel
-func (p *Plugin) Start(ctx context.Context) chan<- string {
-	inputChan := make(chan string)
-	go func() {
-		defer p.Writer.Close()
-		p.newFile(p.IdGenerator.Generate(), p.MessageSize)
-
-		for {
-			select {
-			case pkt, more := <-inputChan:
-				if !more {
-					p.cleanup()
-					return
-				}
-
-				if len(p.CurrentFile.Buffer)+len(pkt) < p.MessageSize {
-					p.CurrentFile.Buffer = append(p.CurrentFile.Buffer, pkt...)
-				} else {
-					// chunk the message so that it fits in our configured message size
-					readFrom := 0
-					for readFrom < len(pkt) {
-						toTake := p.MessageSize - len(p.CurrentFile.Buffer)
-						if readFrom+toTake > len(pkt) {
-							p.CurrentFile.Buffer = append(p.CurrentFile.Buffer, pkt[readFrom:]...)
-							readFrom = len(pkt)
-
-						} else {
-							p.CurrentFile.Buffer = append(p.CurrentFile.Buffer, pkt[readFrom:readFrom+toTake]...)
-							readFrom += toTake
-						}
-
-						err := p.flush()
-
-						if err != nil {
-							//TODO: handle this better
-							log.Println(err)
-							return
-						}
-
-						if p.CurrentFile.Sent >= p.FileSize {
-							p.newFile(p.IdGenerator.Generate(), p.MessageSize)
-						} else {
-							p.CurrentFile.newBuffer(p.MessageSize)
-						}
-					}
-				}
-			case <-ctx.Done():
-				p.cleanup()
-				return
-			}
+// Write produces Kafka messages containing the data of the batch, chunked so
+// that each message fits in the configured message size. Batches of another
+// sensor, interface, link type or codec than the current file end it, and go
+// to a file of their own.
+func (p *Plugin) Write(ctx context.Context, b *batch.Batch) error {
+	if p.Mode != ModeFile {
+		return p.writePackets(ctx, b)
+	}
+
+	data := b.Data
+	if p.CurrentFile != nil && len(data) > 0 && !p.CurrentFile.sameCapture(b.Metadata) {
+		if err := p.endFile(ctx); err != nil {
+			return err
 		}
-	}()
-	return inputChan
-}
+	}
+	if p.CurrentFile == nil {
+		p.newFile(p.IdGenerator.Generate(), b.Metadata)
+	}
 
-func (p *Plugin) cleanup() {
-	// we only need to clean up if there's actually data to send
-	if len(p.CurrentFile.Buffer) > len(file.Header) {
-		err := p.flush()
-		if err != nil {
-			//TODO: handle this better
-			log.Println(err)
+	if len(p.CurrentFile.Buffer)+len(data) < p.MessageSize {
+		p.CurrentFile.Buffer = append(p.CurrentFile.Buffer, data...)
+		return nil
+	}
+
+	// chunk the message so that it fits in our configured message size, the
+	// chunks are produced at once so that they can share produce requests
+	var msgs []kafka.Message
+	readFrom := 0
+	for readFrom < len(data) {
+		toTake := p.MessageSize - len(p.CurrentFile.Buffer)
+		if readFrom+toTake > len(data) {
+			p.CurrentFile.Buffer = append(p.CurrentFile.Buffer, data[readFrom:]...)
+			readFrom = len(data)
+		} else {
+			p.CurrentFile.Buffer = append(p.CurrentFile.Buffer, data[readFrom:readFrom+toTake]...)
+			readFrom += toTake
 		}
+
+		msgs = append(msgs, p.message(false))
+		p.nextBuffer()
 	}
 
-	close(p.CloseChan)
+	return p.produce(ctx, msgs)
 }
 
-func (p *Plugin) flush() error {
-	err := p.Writer.WriteMessages(context.Background(), kafka.Message{
+// Flush produces a message with the buffered data, even if it's smaller than
+// the configured message size
+func (p *Plugin) Flush(ctx context.Context) error {
+	// the buffered messages go first, once their backoff has elapsed
+	p.drainBuffer(ctx, 0)
+
+	// we only need to flush if there's actually data to send
+	if !p.hasPendingData() {
+		return nil
+	}
+
+	msg := p.message(false)
+	p.nextBuffer()
+
+	return p.produce(ctx, []kafka.Message{msg})
+}
+
+// Close produces the rest of the current file, and makes a last attempt at
+// sending the buffered messages, which are lost if it fails.
+func (p *Plugin) Close() error {
+	if p.Writer == nil {
+		return nil
+	}
+	flushErr := p.endFile(context.Background())
+	if len(p.buffer) > 0 {
+		p.nextRetry = time.Time{}
+		p.drainBuffer(context.Background(), p.MaxRetries)
+	}
+	if len(p.buffer) > 0 {
+		p.stats.Errors += uint64(len(p.buffer))
+		flushErr = fmt.Errorf("could not produce %d buffered messages to %s", len(p.buffer), p.Topic)
+		p.buffer, p.bufferBytes = nil, 0
+	}
+	err := p.Writer.Close()
+	if p.transport != nil {
+		p.transport.CloseIdleConnections()
+	}
+	if err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// endFile produces the rest of the current file, which may be nothing but
+// the mark of its last message.
+func (p *Plugin) endFile(ctx context.Context) error {
+	if p.CurrentFile == nil || (p.CurrentFile.Sent == 0 && !p.hasPendingData()) {
+		p.CurrentFile = nil
+		return nil
+	}
+	msg := p.message(true)
+	p.CurrentFile = nil
+
+	return p.produce(ctx, []kafka.Message{msg})
+}
+
+func (p *Plugin) Stats() plugins.Stats {
+	return p.stats
+}
+
+func (p *Plugin) hasPendingData() bool {
+	if p.CurrentFile == nil {
+		return false
+	}
+	if p.CurrentFile.Sent == 0 {
+		return len(p.CurrentFile.Buffer) > len(file.Header)
+	}
+	return len(p.CurrentFile.Buffer) > 0
+}
+
+func (p *Plugin) nextBuffer() {
+	if p.CurrentFile.Sent >= p.FileSize {
+		p.newFile(p.IdGenerator.Generate(), p.CurrentFile.Capture)
+	} else {
+		p.CurrentFile.newBuffer(p.MessageSize)
+	}
+}
+
+// message returns the message with the buffered data of the current file.
+// The messages carry their offset in the file, and the last one of the file
+// is marked as such, so that consumers can tell when chunks are missing.
+func (p *Plugin) message(last bool) kafka.Message {
+	msg := kafka.Message{
 		Topic: p.Topic,
 		Key:   []byte(p.CurrentFile.Id),
 		Value: p.CurrentFile.Buffer,
-	})
-
+		Headers: captureHeaders([]kafka.Header{
+			{Key: headerOffset, Value: []byte(strconv.FormatUint(p.CurrentFile.Sent, 10))},
+		}, p.CurrentFile.Capture),
+	}
 	p.CurrentFile.Sent += uint64(len(p.CurrentFile.Buffer))
+	if last || p.CurrentFile.Sent >= p.FileSize {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: headerLast, Value: []byte("true")})
+	}
+	p.addSequence(&msg)
+	return msg
+}
+
+// captureHeaders adds the link type, the codec, and when they're known the
+// sensor and the interface of the packets to the headers.
+func captureHeaders(headers []kafka.Header, m batch.Metadata) []kafka.Header {
+	headers = append(headers,
+		kafka.Header{Key: headerLinkType, Value: []byte(strconv.Itoa(int(m.PcapLinkType())))},
+		kafka.Header{Key: headerCodec, Value: []byte(m.Codec.String())},
+	)
+	if m.SensorID != "" {
+		headers = append(headers, kafka.Header{Key: headerSensorId, Value: []byte(m.SensorID)})
+	}
+	if m.Interface != "" {
+		headers = append(headers, kafka.Header{Key: headerInterface, Value: []byte(m.Interface)})
+	}
+	return headers
+}
 
-	return err
+// addSequence adds the producer ID and the sequence number of the message to
+// its headers, when the writes are idempotent. The number is given once, so
+// that the retries of the message keep it.
+func (p *Plugin) addSequence(msg *kafka.Message) {
+	if p.ProducerId == "" {
+		return
+	}
+	p.sequence++
+	msg.Headers = append(msg.Headers,
+		kafka.Header{Key: headerProducerId, Value: []byte(p.ProducerId)},
+		kafka.Header{Key: headerSequence, Value: []byte(strconv.FormatUint(p.sequence, 10))},
+	)
 }
@@ -1,13 +1,39 @@
 package kafka
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/deepfence/PacketStreamer/pkg/batch"
 	"github.com/deepfence/PacketStreamer/pkg/file"
+	"github.com/deepfence/PacketStreamer/pkg/plugins/plugintest"
+	"github.com/deepfence/PacketStreamer/pkg/testutils"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
 	kafka "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/compress"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/apiversions"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+	"github.com/segmentio/kafka-go/protocol/saslauthenticate"
+	"github.com/segmentio/kafka-go/protocol/saslhandshake"
+	xdgscram "github.com/xdg/scram"
 )
 
 type mockKafkaWriter struct {
@@ -29,7 +55,7 @@ func (g *mockIdGenerator) Generate() string {
 	return "test"
 }
 
-func TestPluginStart(t *testing.T) {
+func TestPluginWrite(t *testing.T) {
 	tests := []struct {
 		TestName         string
 		Topic            string
@@ -49,6 +75,7 @@ func TestPluginStart(t *testing.T) {
 					Offset:    0,
 					Key:       []byte("test"),
 					Value:     []byte(fmt.Sprintf("%sregu", file.Header)),
+					Headers:   []kafka.Header{{Key: "offset", Value: []byte("0")}, {Key: "link-type", Value: []byte("1")}, {Key: "codec", Value: []byte("none")}},
 				},
 				{
 					Topic:     "test",
@@ -56,6 +83,7 @@ func TestPluginStart(t *testing.T) {
 					Offset:    0,
 					Key:       []byte("test"),
 					Value:     []byte("lar mess"),
+					Headers:   []kafka.Header{{Key: "offset", Value: []byte("8")}, {Key: "link-type", Value: []byte("1")}, {Key: "codec", Value: []byte("none")}},
 				},
 				{
 					Topic:     "test",
@@ -63,6 +91,7 @@ func TestPluginStart(t *testing.T) {
 					Offset:    0,
 					Key:       []byte("test"),
 					Value:     []byte("age"),
+					Headers:   []kafka.Header{{Key: "offset", Value: []byte("16")}, {Key: "link-type", Value: []byte("1")}, {Key: "codec", Value: []byte("none")}, {Key: "last", Value: []byte("true")}},
 				},
 			},
 		},
@@ -78,6 +107,7 @@ func TestPluginStart(t *testing.T) {
 					Offset:    0,
 					Key:       []byte("test"),
 					Value:     []byte(fmt.Sprintf("%sThis is a message that's not long enough", file.Header)),
+					Headers:   []kafka.Header{{Key: "offset", Value: []byte("0")}, {Key: "link-type", Value: []byte("1")}, {Key: "codec", Value: []byte("none")}, {Key: "last", Value: []byte("true")}},
 				},
 			},
 		},
@@ -93,6 +123,7 @@ func TestPluginStart(t *testing.T) {
 					Offset:    0,
 					Key:       []byte("test"),
 					Value:     []byte(fmt.Sprintf("%sHello, the secon", file.Header)),
+					Headers:   []kafka.Header{{Key: "offset", Value: []byte("0")}, {Key: "link-type", Value: []byte("1")}, {Key: "codec", Value: []byte("none")}},
 				},
 				{
 					Topic:     "test",
@@ -100,6 +131,7 @@ func TestPluginStart(t *testing.T) {
 					Offset:    0,
 					Key:       []byte("test"),
 					Value:     []byte("d part of this messa"),
+					Headers:   []kafka.Header{{Key: "offset", Value: []byte("20")}, {Key: "link-type", Value: []byte("1")}, {Key: "codec", Value: []byte("none")}},
 				},
 				{
 					Topic:     "test",
@@ -107,6 +139,7 @@ func TestPluginStart(t *testing.T) {
 					Offset:    0,
 					Key:       []byte("test"),
 					Value:     []byte("ge is longer"),
+					Headers:   []kafka.Header{{Key: "offset", Value: []byte("40")}, {Key: "link-type", Value: []byte("1")}, {Key: "codec", Value: []byte("none")}, {Key: "last", Value: []byte("true")}},
 				},
 			},
 		},
@@ -124,18 +157,16 @@ func TestPluginStart(t *testing.T) {
 				Topic:       tt.Topic,
 				MessageSize: tt.MessageSize,
 				FileSize:    getFileSizeFromMessages(t, tt.ToSend),
-				CloseChan:   make(chan bool),
 			}
 
-			inputChan := plugin.Start(context.TODO())
-			{
-				for _, s := range tt.ToSend {
-					inputChan <- s
+			for _, s := range tt.ToSend {
+				if err := plugin.Write(context.TODO(), &batch.Batch{Data: []byte(s)}); err != nil {
+					t.Fatalf("unexpected error: %v", err)
 				}
 			}
-			close(inputChan)
-
-			<-plugin.CloseChan
+			if err := plugin.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 
 			if !reflect.DeepEqual(mockWriter.Messages, tt.ExpectedMessages) {
 				t.Errorf("expected %v, got %v", tt.ExpectedMessages, mockWriter.Messages)
@@ -144,6 +175,57 @@ func TestPluginStart(t *testing.T) {
 	}
 }
 
+func TestPluginWriteCaptures(t *testing.T) {
+	mockWriter := &mockKafkaWriter{}
+	ids := 0
+	plugin := &Plugin{
+		Writer:      mockWriter,
+		IdGenerator: idGeneratorFunc(func() string { ids++; return strconv.Itoa(ids) }),
+		Topic:       "test",
+		MessageSize: 100,
+		FileSize:    1000,
+	}
+
+	ethernet := batch.Metadata{SensorID: "sensor-1", Interface: "eth0", LinkType: layers.LinkTypeEthernet}
+	raw := batch.Metadata{SensorID: "sensor-1", Interface: "tun0", LinkType: layers.LinkTypeRaw}
+	for _, m := range []batch.Metadata{ethernet, {SensorID: "sensor-1", Interface: "eth0"}, raw, ethernet} {
+		if err := plugin.Write(context.TODO(), &batch.Batch{Metadata: m, Data: []byte("data")}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := plugin.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the batches without a link type are Ethernet ones, and share the file
+	expected := []struct {
+		key     string
+		value   string
+		headers map[string]string
+	}{
+		{"1", string(file.Header) + "datadata", map[string]string{"offset": "0", "last": "true", "link-type": "1", "codec": "none", "sensor-id": "sensor-1", "interface": "eth0"}},
+		{"2", string(file.Header) + "data", map[string]string{"offset": "0", "last": "true", "link-type": "101", "codec": "none", "sensor-id": "sensor-1", "interface": "tun0"}},
+		{"3", string(file.Header) + "data", map[string]string{"offset": "0", "last": "true", "link-type": "1", "codec": "none", "sensor-id": "sensor-1", "interface": "eth0"}},
+	}
+	if len(mockWriter.Messages) != len(expected) {
+		t.Fatalf("expected %d messages, got %d", len(expected), len(mockWriter.Messages))
+	}
+	for i, msg := range mockWriter.Messages {
+		if string(msg.Key) != expected[i].key || string(msg.Value) != expected[i].value {
+			t.Errorf("expected %q of file %s, got %q of file %s", expected[i].value, expected[i].key, msg.Value, msg.Key)
+		}
+		if headers := messageHeaders(msg); !reflect.DeepEqual(headers, expected[i].headers) {
+			t.Errorf("expected headers %v, got %v", expected[i].headers, headers)
+		}
+	}
+}
+
+type idGeneratorFunc func() string
+
+func (f idGeneratorFunc) Generate() string {
+	return f()
+}
+
 func getFileSizeFromMessages(t *testing.T, sentMessages []string) uint64 {
 	t.Helper()
 	var fileSize uint64 = uint64(len(file.Header))
@@ -154,3 +236,658 @@ func getFileSizeFromMessages(t *testing.T, sentMessages []string) uint64 {
 
 	return fileSize
 }
+
+// fakeBroker is a single Kafka broker, which leads a single partition of
+// each of its topics, and keeps the messages it's sent.
+type fakeBroker struct {
+	listener net.Listener
+	topics   []string
+	// authenticators return the server side of the SASL mechanisms the broker
+	// accepts.
+	authenticators map[string]func() fakeAuthenticator
+
+	mu       sync.Mutex
+	messages []fakeMessage
+}
+
+type fakeMessage struct {
+	clientID    string
+	acks        int16
+	compression compress.Compression
+	topic       string
+	key         string
+	value       []byte
+	headers     map[string]string
+}
+
+// fakeAuthenticator is the server side of a SASL authentication, it returns
+// an error when the client is refused.
+type fakeAuthenticator interface {
+	step(auth []byte) (challenge []byte, err error)
+}
+
+type plainAuthenticator struct {
+	username, password string
+}
+
+func (a plainAuthenticator) step(auth []byte) ([]byte, error) {
+	if string(auth) != "\x00"+a.username+"\x00"+a.password {
+		return nil, errors.New("invalid credentials")
+	}
+	return nil, nil
+}
+
+type scramAuthenticator struct {
+	conversation *xdgscram.ServerConversation
+}
+
+func newSCRAMAuthenticator(hash xdgscram.HashGeneratorFcn, username, password string) func() fakeAuthenticator {
+	return func() fakeAuthenticator {
+		client, _ := hash.NewClient(username, password, "")
+		credentials := client.GetStoredCredentials(xdgscram.KeyFactors{Salt: "salt", Iters: 4096})
+		server, _ := hash.NewServer(func(name string) (xdgscram.StoredCredentials, error) {
+			if name != username {
+				return xdgscram.StoredCredentials{}, errors.New("unknown user")
+			}
+			return credentials, nil
+		})
+		return &scramAuthenticator{conversation: server.NewConversation()}
+	}
+}
+
+func (a *scramAuthenticator) step(auth []byte) ([]byte, error) {
+	challenge, err := a.conversation.Step(string(auth))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(challenge), nil
+}
+
+type bearerAuthenticator struct {
+	token string
+}
+
+func (a bearerAuthenticator) step(auth []byte) ([]byte, error) {
+	if string(auth) != "n,,\x01auth=Bearer "+a.token+"\x01\x01" {
+		return nil, errors.New("invalid token")
+	}
+	return nil, nil
+}
+
+// newFakeBroker starts a broker accepting the given SASL mechanisms, or
+// unauthenticated clients when there are none.
+func newFakeBroker(t *testing.T, tlsConfig *tls.Config, authenticators map[string]func() fakeAuthenticator) *fakeBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	broker := &fakeBroker{
+		listener:       listener,
+		topics:         []string{defaultTopic, "pcaps"},
+		authenticators: authenticators,
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (b *fakeBroker) addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	var authenticator fakeAuthenticator
+	authenticated := len(b.authenticators) == 0
+	for {
+		version, correlationID, clientID, msg, err := protocol.ReadRequest(conn)
+		if err != nil {
+			return
+		}
+		var res protocol.Message
+		switch req := msg.(type) {
+		case *apiversions.Request:
+			res = b.apiVersions()
+		case *saslhandshake.Request:
+			handshake := &saslhandshake.Response{}
+			for mechanism := range b.authenticators {
+				handshake.Mechanisms = append(handshake.Mechanisms, mechanism)
+			}
+			if newAuthenticator, ok := b.authenticators[req.Mechanism]; ok {
+				authenticator = newAuthenticator()
+			} else {
+				handshake.ErrorCode = int16(kafka.UnsupportedSASLMechanism)
+			}
+			res = handshake
+		case *saslauthenticate.Request:
+			if authenticator == nil {
+				return
+			}
+			challenge, err := authenticator.step(req.AuthBytes)
+			if err != nil {
+				res = &saslauthenticate.Response{ErrorCode: int16(kafka.SASLAuthenticationFailed), ErrorMessage: err.Error()}
+				break
+			}
+			authenticated = true
+			res = &saslauthenticate.Response{AuthBytes: challenge}
+		case *metadata.Request:
+			if !authenticated {
+				return
+			}
+			res = b.metadata(req)
+		case *produce.Request:
+			if !authenticated {
+				return
+			}
+			res = b.produce(clientID, req)
+			if !req.HasResponse() {
+				continue
+			}
+		default:
+			return
+		}
+		if err := protocol.WriteResponse(conn, version, correlationID, res); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) apiVersions() *apiversions.Response {
+	res := &apiversions.Response{}
+	for _, key := range []protocol.ApiKey{protocol.Produce, protocol.Metadata, protocol.ApiVersions, protocol.SaslHandshake, protocol.SaslAuthenticate} {
+		maxVersion := key.MaxVersion()
+		// later versions of the metadata are flexible, which the decoding
+		// of the requests doesn't support
+		if key == protocol.Metadata && maxVersion > 8 {
+			maxVersion = 8
+		}
+		res.ApiKeys = append(res.ApiKeys, apiversions.ApiKeyResponse{
+			ApiKey:     int16(key),
+			MinVersion: key.MinVersion(),
+			MaxVersion: maxVersion,
+		})
+	}
+	return res
+}
+
+func (b *fakeBroker) metadata(req *metadata.Request) *metadata.Response {
+	host, port, _ := net.SplitHostPort(b.addr())
+	portNumber, _ := strconv.Atoi(port)
+	res := &metadata.Response{
+		Brokers: []metadata.ResponseBroker{{NodeID: 1, Host: host, Port: int32(portNumber)}},
+	}
+	topics := req.TopicNames
+	if topics == nil {
+		topics = b.topics
+	}
+	for _, topic := range topics {
+		res.Topics = append(res.Topics, metadata.ResponseTopic{
+			Name:       topic,
+			Partitions: []metadata.ResponsePartition{{LeaderID: 1, ReplicaNodes: []int32{1}, IsrNodes: []int32{1}}},
+		})
+	}
+	return res
+}
+
+func (b *fakeBroker) produce(clientID string, req *produce.Request) *produce.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := &produce.Response{}
+	for _, topic := range req.Topics {
+		resTopic := produce.ResponseTopic{Topic: topic.Topic}
+		for _, partition := range topic.Partitions {
+			records := partition.RecordSet.Records
+			for {
+				record, err := records.ReadRecord()
+				if err != nil {
+					break
+				}
+				msg := fakeMessage{
+					clientID:    clientID,
+					acks:        req.Acks,
+					compression: partition.RecordSet.Attributes.Compression(),
+					topic:       topic.Topic,
+					headers:     map[string]string{},
+				}
+				key, _ := protocol.ReadAll(record.Key)
+				msg.key = string(key)
+				msg.value, _ = protocol.ReadAll(record.Value)
+				for _, header := range record.Headers {
+					msg.headers[header.Key] = string(header.Value)
+				}
+				b.messages = append(b.messages, msg)
+			}
+			resTopic.Partitions = append(resTopic.Partitions, produce.ResponsePartition{Partition: partition.Partition})
+		}
+		res.Topics = append(res.Topics, resTopic)
+	}
+	return res
+}
+
+func (b *fakeBroker) received() []fakeMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]fakeMessage(nil), b.messages...)
+}
+
+// produceTestFile initializes the plugin with the options, and writes a file
+// of two messages with it, the second one when it's closed.
+func produceTestFile(t *testing.T, broker *fakeBroker, options map[string]interface{}) {
+	t.Helper()
+	options["brokers"] = broker.addr()
+	options["messageSize"] = "8B"
+	options["timeout"] = "5s"
+	options["dialTimeout"] = "5s"
+	plugin := &Plugin{}
+	if err := plugintest.Init(plugin, "kafka", options); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, data := range []string{"0123", "45"} {
+		if err := plugin.Write(ctx, &batch.Batch{Data: []byte(data)}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := plugin.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats := plugin.Stats(); stats.Writes != 2 || stats.Errors != 0 {
+		t.Errorf("expected 2 writes and no errors, got %+v", stats)
+	}
+}
+
+func TestPluginBroker(t *testing.T) {
+	broker := newFakeBroker(t, nil, nil)
+	produceTestFile(t, broker, map[string]interface{}{
+		"clientId":    "sensor-1",
+		"topic":       "pcaps",
+		"acks":        "one",
+		"compression": "zstd",
+		"batchSize":   10,
+		"linger":      "1ms",
+	})
+
+	messages := broker.received()
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	value := append(append([]byte{}, messages[0].value...), messages[1].value...)
+	if expected := append(append([]byte{}, file.Header...), "012345"...); !bytes.Equal(value, expected) {
+		t.Errorf("expected %q, got %q", expected, value)
+	}
+	if expected := map[string]string{"offset": "8", "last": "true", "link-type": "1", "codec": "none"}; !reflect.DeepEqual(messages[1].headers, expected) {
+		t.Errorf("expected headers %v, got %v", expected, messages[1].headers)
+	}
+	for _, msg := range messages {
+		if msg.clientID != "sensor-1" || msg.topic != "pcaps" || msg.acks != 1 || msg.compression != compress.Zstd {
+			t.Errorf("unexpected message %+v", msg)
+		}
+		if msg.key != messages[0].key {
+			t.Errorf("unexpected message %+v", msg)
+		}
+	}
+}
+
+func TestPluginTLS(t *testing.T) {
+	for _, clientCert := range []bool{false, true} {
+		t.Run(fmt.Sprintf("clientCert=%t", clientCert), func(t *testing.T) {
+			dir := t.TempDir()
+			cert, certFile, keyFile := testutils.WriteCertificate(t, dir)
+			tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+			options := map[string]interface{}{
+				"tls": map[string]interface{}{"enable": true, "caFile": certFile},
+			}
+			if clientCert {
+				tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+				tlsConfig.ClientCAs = x509.NewCertPool()
+				tlsConfig.ClientCAs.AddCert(cert.Leaf)
+				options["tls"] = map[string]interface{}{"enable": true, "caFile": certFile, "certFile": certFile, "keyFile": keyFile}
+			}
+			broker := newFakeBroker(t, tlsConfig, nil)
+			produceTestFile(t, broker, options)
+			if messages := broker.received(); len(messages) != 2 {
+				t.Errorf("expected 2 messages, got %d", len(messages))
+			}
+		})
+	}
+}
+
+func TestPluginSASL(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		TestName      string
+		Mechanism     string
+		Authenticator func() fakeAuthenticator
+		SASL          map[string]interface{}
+	}{
+		{
+			TestName:      "plain",
+			Mechanism:     "PLAIN",
+			Authenticator: func() fakeAuthenticator { return plainAuthenticator{"user", "secret"} },
+			SASL:          map[string]interface{}{"mechanism": "PLAIN", "username": "user", "password": "secret"},
+		},
+		{
+			TestName:      "scram-sha-256",
+			Mechanism:     "SCRAM-SHA-256",
+			Authenticator: newSCRAMAuthenticator(xdgscram.SHA256, "user", "secret"),
+			SASL:          map[string]interface{}{"mechanism": "SCRAM-SHA-256", "username": "user", "password": "secret"},
+		},
+		{
+			TestName:      "scram-sha-512",
+			Mechanism:     "SCRAM-SHA-512",
+			Authenticator: newSCRAMAuthenticator(xdgscram.HashGeneratorFcn(sha512.New), "user", "secret"),
+			SASL:          map[string]interface{}{"mechanism": "scram-sha-512", "username": "user", "password": "secret"},
+		},
+		{
+			TestName:      "oauthbearer",
+			Mechanism:     "OAUTHBEARER",
+			Authenticator: func() fakeAuthenticator { return bearerAuthenticator{"token"} },
+			SASL:          map[string]interface{}{"mechanism": "OAUTHBEARER", "token": "token"},
+		},
+		{
+			TestName:      "oauthbearer token file",
+			Mechanism:     "OAUTHBEARER",
+			Authenticator: func() fakeAuthenticator { return bearerAuthenticator{"file-token"} },
+			SASL:          map[string]interface{}{"mechanism": "OAUTHBEARER", "tokenFile": tokenFile},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.TestName, func(t *testing.T) {
+			broker := newFakeBroker(t, nil, map[string]func() fakeAuthenticator{tt.Mechanism: tt.Authenticator})
+			produceTestFile(t, broker, map[string]interface{}{"sasl": tt.SASL})
+			if messages := broker.received(); len(messages) != 2 {
+				t.Errorf("expected 2 messages, got %d", len(messages))
+			}
+		})
+	}
+}
+
+func TestPluginSASLRefused(t *testing.T) {
+	broker := newFakeBroker(t, nil, map[string]func() fakeAuthenticator{
+		"PLAIN": func() fakeAuthenticator { return plainAuthenticator{"user", "secret"} },
+	})
+	plugin := &Plugin{}
+	options := map[string]interface{}{
+		"brokers":     broker.addr(),
+		"messageSize": "8B",
+		"sasl":        map[string]interface{}{"mechanism": "PLAIN", "username": "user", "password": "wrong"},
+	}
+	if err := plugintest.Init(plugin, "kafka", options); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer plugin.Close()
+	plugin.Writer.(*kafka.Writer).MaxAttempts = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := plugin.Write(ctx, &batch.Batch{Data: []byte("0123456789")}); !errors.Is(err, kafka.SASLAuthenticationFailed) {
+		t.Errorf("expected %v, got %v", kafka.SASLAuthenticationFailed, err)
+	}
+	// both messages of the batch failed
+	if stats := plugin.Stats(); stats.Writes != 0 || stats.Errors != 2 {
+		t.Errorf("expected 2 errors, got %+v", stats)
+	}
+}
+
+func TestPluginIdempotent(t *testing.T) {
+	broker := newFakeBroker(t, nil, nil)
+	produceTestFile(t, broker, map[string]interface{}{"idempotent": true})
+
+	messages := broker.received()
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	for i, msg := range messages {
+		if msg.acks != -1 {
+			t.Errorf("expected acks all, got %d", msg.acks)
+		}
+		if msg.headers["producer-id"] == "" || msg.headers["producer-id"] != messages[0].headers["producer-id"] {
+			t.Errorf("unexpected producer ID %q", msg.headers["producer-id"])
+		}
+		if expected := strconv.Itoa(i + 1); msg.headers["sequence"] != expected {
+			t.Errorf("expected sequence %s, got %q", expected, msg.headers["sequence"])
+		}
+	}
+}
+
+func TestPluginInitErrors(t *testing.T) {
+	tests := []struct {
+		TestName string
+		Options  map[string]interface{}
+		Expected error
+	}{
+		{
+			TestName: "unknown mode",
+			Options:  map[string]interface{}{"mode": "stream"},
+			Expected: ErrUnknownMode,
+		},
+		{
+			TestName: "unknown format",
+			Options:  map[string]interface{}{"mode": "packet", "format": "csv"},
+			Expected: ErrUnknownFormat,
+		},
+		{
+			TestName: "no packets per message",
+			Options:  map[string]interface{}{"mode": "flow", "packetsPerMessage": 0},
+			Expected: ErrInvalidPacketsPerMessage,
+		},
+		{
+			TestName: "invalid acks",
+			Options:  map[string]interface{}{"acks": "2"},
+			Expected: ErrInvalidAcks,
+		},
+		{
+			TestName: "sequence headers without acks all",
+			Options:  map[string]interface{}{"acks": "one", "idempotent": true},
+			Expected: ErrIdempotentAcks,
+		},
+		{
+			TestName: "unknown compression",
+			Options:  map[string]interface{}{"compression": "brotli"},
+			Expected: ErrUnknownCompression,
+		},
+		{
+			TestName: "TLS files without TLS",
+			Options:  map[string]interface{}{"tls": map[string]interface{}{"caFile": "ca.pem"}},
+			Expected: ErrTLSNotEnabled,
+		},
+		{
+			TestName: "certificate without key",
+			Options:  map[string]interface{}{"tls": map[string]interface{}{"enable": true, "certFile": "cert.pem"}},
+			Expected: ErrIncompleteKeyPair,
+		},
+		{
+			TestName: "unknown mechanism",
+			Options:  map[string]interface{}{"sasl": map[string]interface{}{"mechanism": "GSSAPI"}},
+			Expected: ErrUnknownMechanism,
+		},
+		{
+			TestName: "SCRAM without password",
+			Options:  map[string]interface{}{"sasl": map[string]interface{}{"mechanism": "SCRAM-SHA-256", "username": "user"}},
+			Expected: ErrMissingCredentials,
+		},
+		{
+			TestName: "OAUTHBEARER without token",
+			Options:  map[string]interface{}{"sasl": map[string]interface{}{"mechanism": "OAUTHBEARER"}},
+			Expected: ErrMissingToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.TestName, func(t *testing.T) {
+			tt.Options["brokers"] = "127.0.0.1:9092"
+			err := plugintest.Init(&Plugin{}, "kafka", tt.Options)
+			if !errors.Is(err, tt.Expected) {
+				t.Errorf("expected %v, got %v", tt.Expected, err)
+			}
+		})
+	}
+}
+
+// packetBatch returns a batch with a packet of flow 1, its reply and a packet
+// of flow 2, one millisecond apart.
+func packetBatch(t *testing.T) *batch.Batch {
+	t.Helper()
+	b := &batch.Batch{Metadata: batch.Metadata{SensorID: "sensor-1", Interface: "eth0", LinkType: layers.LinkTypeEthernet}}
+	start := time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)
+	for i, data := range [][]byte{
+		testutils.SyntheticPacket(t, 1, false, 0, 8),
+		testutils.SyntheticPacket(t, 1, true, 0, 8),
+		testutils.SyntheticPacket(t, 2, false, 0, 8),
+	} {
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(data), Length: len(data)}
+		b.AppendPacket(ci, data)
+	}
+	return b
+}
+
+func messageHeaders(msg kafka.Message) map[string]string {
+	headers := map[string]string{}
+	for _, header := range msg.Headers {
+		headers[header.Key] = string(header.Value)
+	}
+	return headers
+}
+
+func TestPluginPacketModes(t *testing.T) {
+	tests := []struct {
+		TestName          string
+		Mode              Mode
+		Format            Format
+		PacketsPerMessage int
+		ExpectedKeys      []string
+		ExpectedPackets   []int
+	}{
+		{
+			TestName:          "packet",
+			Mode:              ModePacket,
+			PacketsPerMessage: 1,
+			ExpectedKeys:      []string{"", "", ""},
+			ExpectedPackets:   []int{1, 1, 1},
+		},
+		{
+			TestName:          "packet batches",
+			Mode:              ModePacket,
+			Format:            FormatJSON,
+			PacketsPerMessage: 2,
+			ExpectedKeys:      []string{"", ""},
+			ExpectedPackets:   []int{2, 1},
+		},
+		{
+			TestName:          "flow",
+			Mode:              ModeFlow,
+			PacketsPerMessage: 1,
+			ExpectedKeys:      []string{"tcp 10.0.0.1:1025 192.168.0.1:443", "tcp 10.0.0.1:1025 192.168.0.1:443", "tcp 10.0.0.2:1026 192.168.0.1:443"},
+			ExpectedPackets:   []int{1, 1, 1},
+		},
+		{
+			TestName:          "flow batches",
+			Mode:              ModeFlow,
+			Format:            FormatJSON,
+			PacketsPerMessage: 10,
+			ExpectedKeys:      []string{"tcp 10.0.0.1:1025 192.168.0.1:443", "tcp 10.0.0.2:1026 192.168.0.1:443"},
+			ExpectedPackets:   []int{2, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.TestName, func(t *testing.T) {
+			mockWriter := &mockKafkaWriter{}
+			plugin := &Plugin{
+				Writer:            mockWriter,
+				Topic:             "test",
+				Mode:              tt.Mode,
+				Format:            tt.Format,
+				PacketsPerMessage: tt.PacketsPerMessage,
+				SnapLen:           65535,
+			}
+			b := packetBatch(t)
+			if err := plugin.Write(context.TODO(), b); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := plugin.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(mockWriter.Messages) != len(tt.ExpectedKeys) {
+				t.Fatalf("expected %d messages, got %d", len(tt.ExpectedKeys), len(mockWriter.Messages))
+			}
+			var packets [][]byte
+			for i, msg := range mockWriter.Messages {
+				if string(msg.Key) != tt.ExpectedKeys[i] {
+					t.Errorf("expected key %q, got %q", tt.ExpectedKeys[i], msg.Key)
+				}
+				headers := messageHeaders(msg)
+				expectedHeaders := map[string]string{
+					"sensor-id":    "sensor-1",
+					"interface":    "eth0",
+					"timestamp":    headers["timestamp"],
+					"packet-count": strconv.Itoa(tt.ExpectedPackets[i]),
+					"link-type":    "1",
+					"codec":        "none",
+					"format":       tt.Format.String(),
+				}
+				if !reflect.DeepEqual(headers, expectedHeaders) {
+					t.Errorf("expected headers %v, got %v", expectedHeaders, headers)
+				}
+				if _, err := time.Parse(time.RFC3339Nano, headers["timestamp"]); err != nil {
+					t.Errorf("unexpected timestamp %q: %v", headers["timestamp"], err)
+				}
+
+				var messagePackets [][]byte
+				switch tt.Format {
+				case FormatPcap:
+					r, err := pcapgo.NewReader(bytes.NewReader(msg.Value))
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					for {
+						data, _, err := r.ReadPacketData()
+						if err != nil {
+							break
+						}
+						messagePackets = append(messagePackets, data)
+					}
+				case FormatJSON:
+					var records []PacketRecord
+					if err := json.Unmarshal(msg.Value, &records); err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					for _, record := range records {
+						messagePackets = append(messagePackets, record.Data)
+					}
+				}
+				if len(messagePackets) != tt.ExpectedPackets[i] {
+					t.Errorf("expected %d packets, got %d", tt.ExpectedPackets[i], len(messagePackets))
+				}
+				packets = append(packets, messagePackets...)
+			}
+
+			var expected [][]byte
+			for records := b.Data; len(records) > 0; {
+				_, data, rest, _ := batch.NextRecord(records)
+				expected = append(expected, data)
+				records = rest
+			}
+			if !reflect.DeepEqual(packets, expected) {
+				t.Error("expected the messages to contain the packets of the batch")
+			}
+		})
+	}
+}
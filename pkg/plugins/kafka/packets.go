@@ -0,0 +1,187 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	kafka "github.com/segmentio/kafka-go"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/flow"
+)
+
+var (
+	ErrUnknownMode   = errors.New("mode should be one of file, packet or flow")
+	ErrUnknownFormat = errors.New("format should be either pcap or json")
+
+	ErrInvalidPacketsPerMessage = errors.New("packetsPerMessage should be at least 1")
+)
+
+// Mode is how the packets are split into messages.
+type Mode int
+
+const (
+	// ModeFile splits a pcap byte stream into chunks of MessageSize, keyed by
+	// the ID of the file they belong to.
+	ModeFile Mode = iota
+	// ModePacket sends every PacketsPerMessage packets as a message, without
+	// a key.
+	ModePacket
+	// ModeFlow sends every PacketsPerMessage packets of the same flow as a
+	// message, keyed by the flow, so that a flow lands on one partition.
+	ModeFlow
+)
+
+// Format is the encoding of the messages of the packet and flow modes.
+type Format int
+
+const (
+	// FormatPcap makes every message a pcap file of its own.
+	FormatPcap Format = iota
+	// FormatJSON makes every message a JSON array of packet records.
+	FormatJSON
+)
+
+func (f Format) String() string {
+	if f == FormatJSON {
+		return "json"
+	}
+	return "pcap"
+}
+
+func parseMode(mode string) (Mode, error) {
+	switch strings.ToLower(mode) {
+	case "", "file":
+		return ModeFile, nil
+	case "packet":
+		return ModePacket, nil
+	case "flow":
+		return ModeFlow, nil
+	}
+	return 0, fmt.Errorf("%w, not %s", ErrUnknownMode, mode)
+}
+
+func parseFormat(format string) (Format, error) {
+	switch strings.ToLower(format) {
+	case "", "pcap":
+		return FormatPcap, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("%w, not %s", ErrUnknownFormat, format)
+}
+
+// PacketRecord is a packet in the messages of the JSON format.
+type PacketRecord struct {
+	Timestamp     time.Time `json:"timestamp"`
+	CaptureLength int       `json:"captureLength"`
+	Length        int       `json:"length"`
+	Data          []byte    `json:"data"`
+}
+
+// packetGroup is the packets of a message being put together.
+type packetGroup struct {
+	key     string
+	infos   []gopacket.CaptureInfo
+	packets [][]byte
+}
+
+// writePackets produces the packets of the batch as messages of up to
+// PacketsPerMessage packets. Messages never span batches, so the last
+// message of every key may be smaller.
+func (p *Plugin) writePackets(ctx context.Context, b *batch.Batch) error {
+	linkType := b.PcapLinkType()
+
+	var msgs []kafka.Message
+	var groups []*packetGroup
+	pending := map[string]*packetGroup{}
+	for records := b.Data; len(records) > 0; {
+		ci, data, rest, err := batch.NextRecord(records)
+		if err != nil {
+			// a truncated record can't make a packet
+			break
+		}
+		records = rest
+
+		var key string
+		if p.Mode == ModeFlow {
+			if k, ok := flow.Parse(linkType, data); ok {
+				key = k.String()
+			}
+		}
+		group := pending[key]
+		if group == nil {
+			group = &packetGroup{key: key}
+			pending[key] = group
+			groups = append(groups, group)
+		}
+		group.infos = append(group.infos, ci)
+		group.packets = append(group.packets, data)
+		if len(group.packets) >= p.PacketsPerMessage {
+			delete(pending, key)
+		}
+	}
+
+	for _, group := range groups {
+		msg, err := p.packetMessage(b.Metadata, linkType, group)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+	}
+	return p.produce(ctx, msgs)
+}
+
+// packetMessage returns the message with the packets of the group.
+func (p *Plugin) packetMessage(metadata batch.Metadata, linkType layers.LinkType, group *packetGroup) (kafka.Message, error) {
+	var value bytes.Buffer
+	switch p.Format {
+	case FormatPcap:
+		w := pcapgo.NewWriter(&value)
+		if err := w.WriteFileHeader(uint32(p.SnapLen), linkType); err != nil {
+			return kafka.Message{}, err
+		}
+		for i, data := range group.packets {
+			if err := w.WritePacket(group.infos[i], data); err != nil {
+				return kafka.Message{}, err
+			}
+		}
+	case FormatJSON:
+		records := make([]PacketRecord, len(group.packets))
+		for i, data := range group.packets {
+			records[i] = PacketRecord{
+				Timestamp:     group.infos[i].Timestamp,
+				CaptureLength: group.infos[i].CaptureLength,
+				Length:        group.infos[i].Length,
+				Data:          data,
+			}
+		}
+		if err := json.NewEncoder(&value).Encode(records); err != nil {
+			return kafka.Message{}, err
+		}
+	}
+
+	msg := kafka.Message{
+		Topic: p.Topic,
+		Value: value.Bytes(),
+		Headers: captureHeaders([]kafka.Header{
+			{Key: "timestamp", Value: []byte(group.infos[0].Timestamp.UTC().Format(time.RFC3339Nano))},
+			{Key: "packet-count", Value: []byte(strconv.Itoa(len(group.packets)))},
+			{Key: headerFormat, Value: []byte(p.Format.String())},
+		}, metadata),
+	}
+	if group.key != "" {
+		msg.Key = []byte(group.key)
+	}
+	p.addSequence(&msg)
+	return msg, nil
+}
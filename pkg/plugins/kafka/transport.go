@@ -0,0 +1,218 @@
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const (
+	mechanismPlain       = "PLAIN"
+	mechanismSCRAMSHA256 = "SCRAM-SHA-256"
+	mechanismSCRAMSHA512 = "SCRAM-SHA-512"
+	mechanismOAuthBearer = "OAUTHBEARER"
+)
+
+var (
+	ErrTLSNotEnabled      = errors.New("tls.enable should be set to use the TLS files")
+	ErrIncompleteKeyPair  = errors.New("both tls.certFile and tls.keyFile should be set")
+	ErrInvalidCA          = errors.New("no certificate found in tls.caFile")
+	ErrUnknownMechanism   = errors.New("unknown SASL mechanism")
+	ErrMissingCredentials = errors.New("sasl.username and sasl.password should be set")
+	ErrMissingToken       = errors.New("either sasl.token or sasl.tokenFile should be set")
+	ErrInvalidAcks        = errors.New("acks should be one of all, one or none")
+	ErrIdempotentAcks     = errors.New("idempotent writes require acks: all")
+	ErrUnknownCompression = errors.New("compression should be one of none, gzip, snappy, lz4 or zstd")
+)
+
+// TLSConfig is the TLS configuration of the connections to the brokers.
+// CAFile defaults to the system certificates, CertFile and KeyFile are the
+// client certificate, for brokers which authenticate the clients with it.
+type TLSConfig struct {
+	Enable             bool   `yaml:"enable,omitempty"`
+	CAFile             string `yaml:"caFile,omitempty"`
+	CertFile           string `yaml:"certFile,omitempty"`
+	KeyFile            string `yaml:"keyFile,omitempty"`
+	ServerName         string `yaml:"serverName,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"`
+}
+
+// SASLConfig is the SASL authentication to the brokers. Username and Password
+// are used by PLAIN and SCRAM, Token or TokenFile by OAUTHBEARER.
+type SASLConfig struct {
+	Mechanism string `yaml:"mechanism,omitempty"`
+	Username  string `yaml:"username,omitempty"`
+	Password  string `yaml:"password,omitempty"`
+	Token     string `yaml:"token,omitempty"`
+	// TokenFile is read on every authentication, so that the token can be
+	// refreshed without restarting.
+	TokenFile string `yaml:"tokenFile,omitempty"`
+}
+
+// NewDialer returns a dialer connecting to the brokers of the plugin
+// configuration, for consuming the messages of the plugin.
+func NewDialer(cfg Config) (*kafka.Dialer, error) {
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	mechanism, err := newMechanism(cfg.SASL)
+	if err != nil {
+		return nil, err
+	}
+	clientID := defaultClientId
+	if cfg.ClientId != nil {
+		clientID = *cfg.ClientId
+	}
+	timeout := defaultDialTimeout
+	if cfg.DialTimeout != 0 {
+		timeout = cfg.DialTimeout
+	}
+	return &kafka.Dialer{
+		ClientID:      clientID,
+		Timeout:       timeout,
+		DualStack:     true,
+		TLS:           tlsConfig,
+		SASLMechanism: mechanism,
+	}, nil
+}
+
+func newTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	if !cfg.Enable {
+		if cfg.CAFile != "" || cfg.CertFile != "" || cfg.KeyFile != "" {
+			return nil, ErrTLSNotEnabled
+		}
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, ErrInvalidCA
+		}
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, ErrIncompleteKeyPair
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// newMechanism returns the SASL mechanism, which is nil without
+// authentication.
+func newMechanism(cfg SASLConfig) (sasl.Mechanism, error) {
+	mechanism := strings.ToUpper(cfg.Mechanism)
+	switch mechanism {
+	case "":
+		return nil, nil
+	case mechanismPlain, mechanismSCRAMSHA256, mechanismSCRAMSHA512:
+		if cfg.Username == "" || cfg.Password == "" {
+			return nil, ErrMissingCredentials
+		}
+	case mechanismOAuthBearer:
+		if (cfg.Token == "") == (cfg.TokenFile == "") {
+			return nil, ErrMissingToken
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMechanism, cfg.Mechanism)
+	}
+
+	switch mechanism {
+	case mechanismPlain:
+		return plain.Mechanism{Username: cfg.Username, Password: cfg.Password}, nil
+	case mechanismSCRAMSHA256:
+		return scram.Mechanism(scram.SHA256, cfg.Username, cfg.Password)
+	case mechanismSCRAMSHA512:
+		return scram.Mechanism(scram.SHA512, cfg.Username, cfg.Password)
+	}
+	if cfg.TokenFile == "" {
+		return &oauthBearer{token: func() (string, error) { return cfg.Token, nil }}, nil
+	}
+	return &oauthBearer{token: func() (string, error) {
+		token, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("could not read the token file: %w", err)
+		}
+		return strings.TrimSpace(string(token)), nil
+	}}, nil
+}
+
+// oauthBearer is the OAUTHBEARER SASL mechanism (RFC 7628), which kafka-go
+// doesn't provide.
+type oauthBearer struct {
+	token func() (string, error)
+}
+
+func (m *oauthBearer) Name() string {
+	return mechanismOAuthBearer
+}
+
+func (m *oauthBearer) Start(ctx context.Context) (sasl.StateMachine, []byte, error) {
+	token, err := m.token()
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, []byte("n,,\x01auth=Bearer " + token + "\x01\x01"), nil
+}
+
+// Next gets an empty challenge when the token is accepted, and the error
+// otherwise.
+func (m *oauthBearer) Next(ctx context.Context, challenge []byte) (bool, []byte, error) {
+	if len(challenge) > 0 {
+		return false, nil, fmt.Errorf("OAUTHBEARER authentication failed: %s", challenge)
+	}
+	return true, nil, nil
+}
+
+func parseAcks(acks string) (kafka.RequiredAcks, error) {
+	switch strings.ToLower(acks) {
+	case "all", "-1":
+		return kafka.RequireAll, nil
+	case "one", "leader", "1":
+		return kafka.RequireOne, nil
+	case "none", "0":
+		return kafka.RequireNone, nil
+	}
+	return 0, fmt.Errorf("%w, not %s", ErrInvalidAcks, acks)
+}
+
+// parseCompression returns the compression codec, which is zero without
+// compression.
+func parseCompression(compression string) (kafka.Compression, error) {
+	switch strings.ToLower(compression) {
+	case "", "none":
+		return 0, nil
+	case "gzip":
+		return kafka.Gzip, nil
+	case "snappy":
+		return kafka.Snappy, nil
+	case "lz4":
+		return kafka.Lz4, nil
+	case "zstd":
+		return kafka.Zstd, nil
+	}
+	return 0, fmt.Errorf("%w, not %s", ErrUnknownCompression, compression)
+}
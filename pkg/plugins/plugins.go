@@ -2,69 +2,136 @@ package plugins
 
 import (
 	"context"
-	"fmt"
 	"log"
+	"sync"
 
+	"github.com/deepfence/PacketStreamer/pkg/batch"
 	"github.com/deepfence/PacketStreamer/pkg/config"
-	"github.com/deepfence/PacketStreamer/pkg/plugins/kafka"
-	"github.com/deepfence/PacketStreamer/pkg/plugins/s3"
 )
 
-//Start uses the provided config to start the execution of any plugin outputs that have been defined.
-//Packets that are written to the returned channel will be fanned out to N configured plugins.
-func Start(ctx context.Context, config *config.Config) (chan<- string, error) {
-	if !pluginsAreDefined(config.Output.Plugins) {
+// Stats are the counters reported by a plugin.
+type Stats struct {
+	Writes       uint64
+	BytesWritten uint64
+	Errors       uint64
+}
+
+// Plugin is an output which streams packet data to an external service. The
+// methods of a Plugin are never called concurrently.
+type Plugin interface {
+	//Init configures the plugin. It's called once, before any other method.
+	Init(ctx context.Context, global *config.Config, pluginConfig config.PluginConfig) error
+	//Write hands a batch of uncompressed pcap records over to the plugin. The
+	//plugin must not retain the batch after Write returns.
+	Write(ctx context.Context, b *batch.Batch) error
+	//Flush sends any buffered data to the external service.
+	Flush(ctx context.Context) error
+	//Close flushes the buffered data and releases all resources of the plugin.
+	Close() error
+	Stats() Stats
+}
+
+// Manager fans packet data out to the configured plugins. Every plugin has its
+// own bounded queue and worker, so a slow or failing plugin doesn't affect the
+// others, nor the caller.
+type Manager struct {
+	mu        sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+	runners   []*runner
+	wg        sync.WaitGroup
+}
+
+// Start uses the provided config to start the execution of any plugin outputs that have been defined.
+// Packets that are written to the returned Manager will be fanned out to N configured plugins.
+// If no plugins are defined, the returned Manager is nil, which is safe to use.
+func Start(ctx context.Context, config *config.Config) (*Manager, error) {
+	if len(config.Output.Plugins) == 0 {
 		return nil, nil
 	}
 
-	var plugins []chan<- string
-
-	if config.Output.Plugins.S3 != nil {
-		log.Println("Starting S3 plugin")
-		s3plugin, err := s3.NewPlugin(ctx, config)
+	m := &Manager{}
+	var started []Plugin
 
+	for _, pluginConfig := range config.Output.Plugins {
+		log.Printf("Starting %s plugin %s\n", pluginConfig.Type, pluginConfig.Name)
+		r := newRunner(config, pluginConfig)
+		plugin, err := r.newPlugin(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("error starting S3 plugin, %v", err)
+			for i, p := range started {
+				m.runners[i].closePlugin(p)
+			}
+			return nil, err
 		}
 
-		s3Chan := s3plugin.Start(ctx)
-		plugins = append(plugins, s3Chan)
+		m.runners = append(m.runners, r)
+		started = append(started, plugin)
 	}
 
-	if config.Output.Plugins.Kafka != nil {
-		log.Println("Starting Kafka plugin")
-		kafkaPlugin, err := kafka.NewPlugin(config.Output.Plugins.Kafka)
+	for i, r := range m.runners {
+		m.wg.Add(1)
+		go func(r *runner, plugin Plugin) {
+			defer m.wg.Done()
+			r.run(ctx, plugin)
+		}(r, started[i])
+	}
 
-		if err != nil {
-			return nil, fmt.Errorf("error starting Kafka plugin, %v", err)
-		}
+	return m, nil
+}
 
-		kafkaChan := kafkaPlugin.Start(ctx)
-		plugins = append(plugins, kafkaChan)
+// Write hands the batch over to all plugins. It doesn't block, unless a plugin
+// is configured with the block overflow policy. Every plugin gets its own
+// reference to the batch, so the caller still has to release its own one.
+func (m *Manager) Write(b *batch.Batch) {
+	if m == nil {
+		return
 	}
 
-	inputChan := make(chan string)
-	go func() {
-		defer func() {
-			for _, p := range plugins {
-				close(p)
-			}
-		}()
-
-		for {
-			select {
-			case pkt := <-inputChan:
-				for _, p := range plugins {
-					p <- pkt
-				}
-			case <-ctx.Done():
-				return
-			}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return
+	}
+	for _, r := range m.runners {
+		r.enqueue(b.Retain())
+	}
+}
+
+// Close stops accepting new data, waits for the queued data to be written and
+// closes all plugins.
+func (m *Manager) Close() {
+	if m == nil {
+		return
+	}
+
+	m.closeOnce.Do(func() {
+		// Unblock the writers waiting for a full queue first, so that the
+		// lock can be taken.
+		for _, r := range m.runners {
+			close(r.stop)
 		}
-	}()
-	return inputChan, nil
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.closed = true
+		for _, r := range m.runners {
+			close(r.queue)
+		}
+	})
+
+	m.wg.Wait()
 }
 
-func pluginsAreDefined(pluginsConfig *config.PluginsConfig) bool {
-	return pluginsConfig != nil && (pluginsConfig.S3 != nil || pluginsConfig.Kafka != nil)
+// Stats returns the counters of all plugins.
+func (m *Manager) Stats() []RunnerStats {
+	if m == nil {
+		return nil
+	}
+
+	stats := make([]RunnerStats, 0, len(m.runners))
+	for _, r := range m.runners {
+		stats = append(stats, r.Stats())
+	}
+	return stats
 }
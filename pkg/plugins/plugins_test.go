@@ -0,0 +1,396 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+)
+
+type mockPlugin struct {
+	mu      sync.Mutex
+	bucket  string
+	written []string
+	flushes int
+	closed  bool
+	// block, when not nil, makes Write wait until it's closed.
+	block chan struct{}
+	// fail makes Write return an error for the given data.
+	fail string
+	// panic makes Write panic for the given data.
+	panic string
+}
+
+func (m *mockPlugin) Init(ctx context.Context, global *config.Config, pluginConfig config.PluginConfig) error {
+	var cfg struct {
+		Bucket string
+	}
+	if err := pluginConfig.Decode(&cfg); err != nil {
+		return err
+	}
+	m.bucket = cfg.Bucket
+	return nil
+}
+
+func (m *mockPlugin) Write(ctx context.Context, b *batch.Batch) error {
+	data := b.Data
+	if m.block != nil {
+		<-m.block
+	}
+	switch string(data) {
+	case m.fail:
+		return errors.New("write failed")
+	case m.panic:
+		panic("write panicked")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.written = append(m.written, string(data))
+	return nil
+}
+
+func (m *mockPlugin) Flush(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flushes++
+	return nil
+}
+
+func (m *mockPlugin) Flushes() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.flushes
+}
+
+func (m *mockPlugin) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	return nil
+}
+
+func (m *mockPlugin) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return Stats{Writes: uint64(len(m.written))}
+}
+
+func (m *mockPlugin) Written() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.written...)
+}
+
+var mockTypes uint64
+
+// registerMock registers a new mock plugin type and returns its name. Every new
+// instance is set up by the setup function and recorded in the returned slice.
+func registerMock(setup func(*mockPlugin)) (string, *[]*mockPlugin) {
+	var (
+		mu        sync.Mutex
+		instances []*mockPlugin
+	)
+	mockTypes++
+	name := fmt.Sprintf("mock-%d", mockTypes)
+	Register(name, func() Plugin {
+		m := &mockPlugin{}
+		if setup != nil {
+			setup(m)
+		}
+		mu.Lock()
+		instances = append(instances, m)
+		mu.Unlock()
+		return m
+	})
+	return name, &instances
+}
+
+func TestNewUnknownPlugin(t *testing.T) {
+	if _, err := New("does-not-exist"); err == nil {
+		t.Error("expected an error for an unknown plugin type")
+	}
+}
+
+func TestStart(t *testing.T) {
+	pluginType, instances := registerMock(nil)
+
+	cfg := &config.Config{
+		Output: config.OutputConfig{
+			Plugins: config.PluginsConfig{
+				{Type: pluginType, Name: "first", QueueSize: 10, Overflow: config.Block, Options: map[string]interface{}{"bucket": "foo"}},
+				{Type: pluginType, Name: "second", QueueSize: 10, Overflow: config.Block, Options: map[string]interface{}{"bucket": "bar"}},
+			},
+		},
+	}
+
+	manager, err := Start(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	write(manager, []byte("first packet"))
+	write(manager, []byte("second packet"))
+	manager.Close()
+
+	if len(*instances) != 2 {
+		t.Fatalf("expected 2 plugin instances, got %d", len(*instances))
+	}
+	expected := []string{"first packet", "second packet"}
+	for i, bucket := range []string{"foo", "bar"} {
+		instance := (*instances)[i]
+		if instance.bucket != bucket {
+			t.Errorf("expected bucket %s, got %s", bucket, instance.bucket)
+		}
+		if !reflect.DeepEqual(instance.Written(), expected) {
+			t.Errorf("expected %v, got %v", expected, instance.Written())
+		}
+		if !instance.closed {
+			t.Errorf("expected plugin %d to be closed", i)
+		}
+	}
+}
+
+func TestNilManager(t *testing.T) {
+	manager, err := Start(context.Background(), &config.Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	write(manager, []byte("packet"))
+	if stats := manager.Stats(); len(stats) != 0 {
+		t.Errorf("expected no stats, got %v", stats)
+	}
+	manager.Close()
+}
+
+func TestOverflow(t *testing.T) {
+	block := make(chan struct{})
+	slowType, instances := registerMock(func(m *mockPlugin) {
+		m.block = block
+	})
+	fastType, _ := registerMock(nil)
+
+	for _, tt := range []struct {
+		TestName        string
+		Overflow        config.OverflowPolicy
+		ExpectedWritten []string
+	}{
+		{
+			TestName:        "drop newest",
+			Overflow:        config.DropNewest,
+			ExpectedWritten: []string{"1", "2"},
+		},
+		{
+			TestName:        "drop oldest",
+			Overflow:        config.DropOldest,
+			ExpectedWritten: []string{"1", "4"},
+		},
+	} {
+		t.Run(tt.TestName, func(t *testing.T) {
+			*instances = nil
+			block = make(chan struct{})
+
+			cfg := &config.Config{
+				Output: config.OutputConfig{
+					Plugins: config.PluginsConfig{
+						{Type: slowType, Name: "slow", QueueSize: 1, Overflow: tt.Overflow},
+						{Type: fastType, Name: "fast", QueueSize: 10, Overflow: config.Block},
+					},
+				},
+			}
+			manager, err := Start(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			write(manager, []byte("1"))
+			// wait for the worker to pick up the first write, so it's stuck
+			// in the plugin and the queue is empty
+			waitFor(t, func() bool { return manager.Stats()[0].Queued == 0 })
+			for _, data := range []string{"2", "3", "4"} {
+				write(manager, []byte(data))
+			}
+
+			stats := manager.Stats()
+			if stats[0].Dropped != 2 {
+				t.Errorf("expected 2 dropped writes for the slow plugin, got %d", stats[0].Dropped)
+			}
+			if stats[1].Dropped != 0 {
+				t.Errorf("expected no dropped writes for the fast plugin, got %d", stats[1].Dropped)
+			}
+
+			close(block)
+			manager.Close()
+
+			if written := (*instances)[0].Written(); !reflect.DeepEqual(written, tt.ExpectedWritten) {
+				t.Errorf("expected %v, got %v", tt.ExpectedWritten, written)
+			}
+		})
+	}
+}
+
+func TestRestart(t *testing.T) {
+	minRestartBackoff = time.Millisecond
+	defer func() { minRestartBackoff = time.Second }()
+
+	for _, tt := range []struct {
+		TestName string
+		Setup    func(*mockPlugin)
+	}{
+		{
+			TestName: "plugin returning an error",
+			Setup:    func(m *mockPlugin) { m.fail = "bad" },
+		},
+		{
+			TestName: "panicking plugin",
+			Setup:    func(m *mockPlugin) { m.panic = "bad" },
+		},
+	} {
+		t.Run(tt.TestName, func(t *testing.T) {
+			pluginType, instances := registerMock(tt.Setup)
+
+			cfg := &config.Config{
+				Output: config.OutputConfig{
+					Plugins: config.PluginsConfig{
+						{Type: pluginType, Name: "restarted", QueueSize: 10, Overflow: config.Block},
+					},
+				},
+			}
+			manager, err := Start(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			write(manager, []byte("good"))
+			write(manager, []byte("bad"))
+			write(manager, []byte("after restart"))
+			waitFor(t, func() bool { return manager.Stats()[0].Writes == 2 })
+			manager.Close()
+
+			stats := manager.Stats()[0]
+			if stats.Failed != 1 || stats.Restarts != 1 {
+				t.Errorf("expected 1 failure and 1 restart, got %+v", stats)
+			}
+			if len(*instances) != 2 {
+				t.Fatalf("expected 2 plugin instances, got %d", len(*instances))
+			}
+			if !(*instances)[0].closed {
+				t.Error("expected the failed plugin to be closed")
+			}
+			if written := (*instances)[1].Written(); !reflect.DeepEqual(written, []string{"after restart"}) {
+				t.Errorf("expected the restarted plugin to get the next write, got %v", written)
+			}
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	defer func() { idleFlushDelay = time.Second }()
+
+	for _, tt := range []struct {
+		TestName      string
+		FlushInterval time.Duration
+		IdleDelay     time.Duration
+		Flushes       int
+	}{
+		{
+			TestName:      "flushed once idle",
+			FlushInterval: time.Hour,
+			IdleDelay:     10 * time.Millisecond,
+			Flushes:       1,
+		},
+		{
+			TestName:      "flushed every interval",
+			FlushInterval: 20 * time.Millisecond,
+			IdleDelay:     time.Hour,
+			Flushes:       1,
+		},
+		{
+			TestName:  "never flushed",
+			IdleDelay: 10 * time.Millisecond,
+			Flushes:   0,
+		},
+	} {
+		t.Run(tt.TestName, func(t *testing.T) {
+			idleFlushDelay = tt.IdleDelay
+			pluginType, instances := registerMock(nil)
+			cfg := &config.Config{
+				Output: config.OutputConfig{
+					Plugins: config.PluginsConfig{
+						{Type: pluginType, Name: "flushed", QueueSize: 10, Overflow: config.Block, FlushInterval: tt.FlushInterval},
+					},
+				},
+			}
+			manager, err := Start(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer manager.Close()
+
+			write(manager, []byte("packet"))
+			waitFor(t, func() bool { return manager.Stats()[0].Writes == 1 })
+			if tt.Flushes > 0 {
+				waitFor(t, func() bool { return (*instances)[0].Flushes() == tt.Flushes })
+			}
+			// nothing more to flush
+			time.Sleep(50 * time.Millisecond)
+			if flushes := (*instances)[0].Flushes(); flushes != tt.Flushes {
+				t.Errorf("expected %d flushes, got %d", tt.Flushes, flushes)
+			}
+		})
+	}
+}
+
+func TestCloseWhileRestarting(t *testing.T) {
+	minRestartBackoff = time.Hour
+	defer func() { minRestartBackoff = time.Second }()
+
+	pluginType, _ := registerMock(func(m *mockPlugin) { m.fail = "bad" })
+	cfg := &config.Config{
+		Output: config.OutputConfig{
+			Plugins: config.PluginsConfig{
+				{Type: pluginType, Name: "restarting", QueueSize: 10, Overflow: config.Block},
+			},
+		},
+	}
+	manager, err := Start(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	write(manager, []byte("bad"))
+	waitFor(t, func() bool { return manager.Stats()[0].Failed == 1 })
+	write(manager, []byte("queued"))
+	write(manager, []byte("queued"))
+	manager.Close()
+
+	// the queued batches are released
+	if stats := manager.Stats()[0]; stats.Dropped != 2 || stats.Queued != 0 {
+		t.Errorf("expected 2 dropped writes, got %+v", stats)
+	}
+}
+
+var testPool = batch.NewPool(64)
+
+// write hands a pooled batch with the given data over to the manager.
+func write(manager *Manager, data []byte) {
+	b := testPool.Get()
+	b.Data = append(b.Data, data...)
+	manager.Write(b)
+	b.Release()
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
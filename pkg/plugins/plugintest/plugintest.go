@@ -0,0 +1,64 @@
+// Package plugintest has the fixtures shared by the tests of the plugins.
+package plugintest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/plugins"
+	"github.com/deepfence/PacketStreamer/pkg/testutils"
+)
+
+const (
+	// SnapLen is the snap length the plugins are initialized with.
+	SnapLen = 65535
+	// PacketLen is the length of the packets of the test batches, with
+	// their Ethernet, IPv4 and TCP headers.
+	PacketLen = 54 + payloadLen
+
+	payloadLen = 32
+)
+
+// Start is the time of the first packet of the test batches of the plugins
+// without a start of their own.
+var Start = time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)
+
+// Config returns the configuration of a plugin of the given type, named
+// after it.
+func Config(pluginType string, options map[string]interface{}) config.PluginConfig {
+	return config.PluginConfig{Type: pluginType, Name: pluginType, Options: options}
+}
+
+// Init initializes the plugin with the options.
+func Init(plugin plugins.Plugin, pluginType string, options map[string]interface{}) error {
+	return plugin.Init(context.Background(), &config.Config{InputPacketLen: SnapLen}, Config(pluginType, options))
+}
+
+// NewPlugin initializes the plugin with the options, and closes it at the
+// end of the test.
+func NewPlugin(t *testing.T, plugin plugins.Plugin, pluginType string, options map[string]interface{}) {
+	t.Helper()
+	if err := Init(plugin, pluginType, options); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { plugin.Close() })
+}
+
+// Batch returns a batch of count Ethernet packets of the sensor, captured on
+// eth0 every step from start. Every packet is a flow of its own.
+func Batch(t *testing.T, sensorID string, start time.Time, count int, step time.Duration) *batch.Batch {
+	t.Helper()
+	b := &batch.Batch{Metadata: batch.Metadata{SensorID: sensorID, Interface: "eth0", LinkType: layers.LinkTypeEthernet}}
+	for i := 0; i < count; i++ {
+		data := testutils.SyntheticPacket(t, i, false, uint32(i), payloadLen)
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * step), CaptureLength: len(data), Length: len(data)}
+		b.AppendPacket(ci, data)
+	}
+	return b
+}
@@ -0,0 +1,57 @@
+package plugins
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Factory creates a new, uninitialized instance of a plugin.
+type Factory func() Plugin
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a plugin type available under the given name. It's meant to
+// be called from the init function of the package implementing the plugin.
+// Register panics when called twice with the same name.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("plugins: Register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("plugins: Register called twice for plugin " + name)
+	}
+	registry[name] = factory
+}
+
+// Registered returns the sorted names of all registered plugin types.
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates an uninitialized instance of the plugin registered under the
+// given name.
+func New(name string) (Plugin, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown plugin type %q, available: %v", name, Registered())
+	}
+	return factory(), nil
+}
@@ -0,0 +1,285 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+)
+
+const (
+	maxRestartBackoff = time.Minute
+	// healthyRunTime is the time after which a restarted plugin is considered
+	// healthy again, which resets the restart backoff.
+	healthyRunTime = time.Minute
+)
+
+var (
+	minRestartBackoff = time.Second
+	// idleFlushDelay is how long the queue stays empty before the data
+	// written so far is flushed, without waiting for the flush interval.
+	idleFlushDelay = time.Second
+)
+
+// RunnerStats are the counters of a single plugin instance, including the ones
+// of the queue in front of it.
+type RunnerStats struct {
+	Stats
+	Name     string
+	Type     string
+	Queued   int
+	Dropped  uint64
+	Failed   uint64
+	Restarts uint64
+}
+
+// runner owns a plugin instance, its bounded queue and the worker goroutine
+// which feeds the queued data to the plugin. A plugin which fails is restarted
+// with backoff, without affecting any other plugin.
+type runner struct {
+	global       *config.Config
+	pluginConfig config.PluginConfig
+	queue        chan *batch.Batch
+	stop         chan struct{}
+
+	dropped  uint64
+	failed   uint64
+	restarts uint64
+
+	statsMu   sync.Mutex
+	prevStats Stats
+	stats     Stats
+}
+
+func newRunner(global *config.Config, pluginConfig config.PluginConfig) *runner {
+	queueSize := pluginConfig.QueueSize
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+	return &runner{
+		global:       global,
+		pluginConfig: pluginConfig,
+		queue:        make(chan *batch.Batch, queueSize),
+		stop:         make(chan struct{}),
+	}
+}
+
+func (r *runner) newPlugin(ctx context.Context) (Plugin, error) {
+	plugin, err := New(r.pluginConfig.Type)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.callSafely(func() error {
+		return plugin.Init(ctx, r.global, r.pluginConfig)
+	}); err != nil {
+		return nil, fmt.Errorf("error starting %s plugin %s, %w", r.pluginConfig.Type, r.pluginConfig.Name, err)
+	}
+	return plugin, nil
+}
+
+// enqueue hands the batch over to the worker, applying the overflow policy
+// when the queue is full. It never blocks unless the policy is Block. The
+// runner takes over the reference to the batch.
+func (r *runner) enqueue(b *batch.Batch) {
+	switch r.pluginConfig.Overflow {
+	case config.Block:
+		select {
+		case r.queue <- b:
+		case <-r.stop:
+			r.drop(b)
+		}
+	case config.DropOldest:
+		for {
+			select {
+			case r.queue <- b:
+				return
+			default:
+			}
+			select {
+			case oldest := <-r.queue:
+				r.drop(oldest)
+			default:
+			}
+		}
+	default:
+		select {
+		case r.queue <- b:
+		default:
+			r.drop(b)
+		}
+	}
+}
+
+func (r *runner) drop(b *batch.Batch) {
+	atomic.AddUint64(&r.dropped, 1)
+	b.Release()
+}
+
+// run feeds the queued data to the plugin until the queue gets closed. plugin
+// is the already initialized first instance of the plugin.
+func (r *runner) run(ctx context.Context, plugin Plugin) {
+	backoff := minRestartBackoff
+	for {
+		started := time.Now()
+		err := r.process(ctx, plugin)
+		r.closePlugin(plugin)
+		if err == nil {
+			return
+		}
+
+		log.Printf("Plugin %s failed: %v\n", r.pluginConfig.Name, err)
+		if time.Since(started) > healthyRunTime {
+			backoff = minRestartBackoff
+		}
+
+		for {
+			log.Printf("Restarting plugin %s in %v\n", r.pluginConfig.Name, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-r.stop:
+				r.drain()
+				return
+			}
+			backoff *= 2
+			if backoff > maxRestartBackoff {
+				backoff = maxRestartBackoff
+			}
+
+			atomic.AddUint64(&r.restarts, 1)
+			plugin, err = r.newPlugin(ctx)
+			if err == nil {
+				break
+			}
+			log.Println(err)
+		}
+	}
+}
+
+// process writes the queued data to the plugin, and flushes it every flush
+// interval and once the queue stays empty for a while. It returns nil when the
+// queue got closed and an error when the plugin failed and has to be
+// restarted.
+func (r *runner) process(ctx context.Context, plugin Plugin) error {
+	var tick <-chan time.Time
+	if r.pluginConfig.FlushInterval > 0 {
+		ticker := time.NewTicker(r.pluginConfig.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	idle := time.NewTimer(idleFlushDelay)
+	idle.Stop()
+	defer idle.Stop()
+	// dirty tells whether data was written since the last flush
+	dirty := false
+
+	for {
+		select {
+		case b, ok := <-r.queue:
+			if !ok {
+				return nil
+			}
+			err := r.callSafely(func() error {
+				return plugin.Write(ctx, b)
+			})
+			b.Release()
+			r.updateStats(plugin)
+			if err != nil {
+				atomic.AddUint64(&r.failed, 1)
+				return err
+			}
+			dirty = true
+			if len(r.queue) == 0 && r.pluginConfig.FlushInterval > 0 {
+				idle.Reset(idleFlushDelay)
+			}
+			continue
+		case <-tick:
+		case <-idle.C:
+		}
+		if !dirty {
+			continue
+		}
+		idle.Stop()
+		dirty = false
+		err := r.callSafely(func() error {
+			return plugin.Flush(ctx)
+		})
+		r.updateStats(plugin)
+		if err != nil {
+			atomic.AddUint64(&r.failed, 1)
+			return err
+		}
+	}
+}
+
+// drain releases the batches left in the queue, once the runner is stopped
+// while the plugin is down. The queue gets closed right after.
+func (r *runner) drain() {
+	for b := range r.queue {
+		r.drop(b)
+	}
+}
+
+func (r *runner) closePlugin(plugin Plugin) {
+	if err := r.callSafely(plugin.Close); err != nil {
+		log.Printf("Error while closing plugin %s: %v\n", r.pluginConfig.Name, err)
+	}
+	r.updateStats(plugin)
+
+	r.statsMu.Lock()
+	r.prevStats = addStats(r.prevStats, r.stats)
+	r.stats = Stats{}
+	r.statsMu.Unlock()
+}
+
+// callSafely calls f, turning a panic into an error.
+func (r *runner) callSafely(f func() error) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("panic: %v", rec)
+		}
+	}()
+	return f()
+}
+
+func (r *runner) updateStats(plugin Plugin) {
+	var stats Stats
+	if err := r.callSafely(func() error {
+		stats = plugin.Stats()
+		return nil
+	}); err != nil {
+		return
+	}
+
+	r.statsMu.Lock()
+	r.stats = stats
+	r.statsMu.Unlock()
+}
+
+func (r *runner) Stats() RunnerStats {
+	r.statsMu.Lock()
+	stats := addStats(r.prevStats, r.stats)
+	r.statsMu.Unlock()
+
+	return RunnerStats{
+		Stats:    stats,
+		Name:     r.pluginConfig.Name,
+		Type:     r.pluginConfig.Type,
+		Queued:   len(r.queue),
+		Dropped:  atomic.LoadUint64(&r.dropped),
+		Failed:   atomic.LoadUint64(&r.failed),
+		Restarts: atomic.LoadUint64(&r.restarts),
+	}
+}
+
+func addStats(a, b Stats) Stats {
+	return Stats{
+		Writes:       a.Writes + b.Writes,
+		BytesWritten: a.BytesWritten + b.BytesWritten,
+		Errors:       a.Errors + b.Errors,
+	}
+}
@@ -0,0 +1,150 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultKeyTemplate lays the objects out in Hive-style partitions, so
+	// that Athena and Glue can prune them by date, hour and sensor, and names
+	// them after the timestamps of their packets.
+	DefaultKeyTemplate = "dt={yyyy}-{MM}-{dd}/hour={HH}/sensor={sensorId}/{firstPacket}-{lastPacket}-{hostname}-{seq}-{uuid}.{ext}"
+
+	unknownKeyValue = "unknown"
+
+	// packetTimeLayout keeps the microseconds of the pcap timestamps.
+	packetTimeLayout = "20060102T150405.000000Z"
+)
+
+var (
+	ErrKeyTemplateNotUnique = errors.New("the key template should contain {uuid}, so that the keys are unique")
+
+	keyPlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+)
+
+// KeyFields are the values of the placeholders of a key template.
+type KeyFields struct {
+	SensorID  string
+	Hostname  string
+	Interface string
+	Time      time.Time
+	UUID      string
+	Seq       uint64
+	Ext       string
+	// FirstPacket and LastPacket are the timestamps of the first and the last
+	// packet of the object, only known once it's complete.
+	FirstPacket time.Time
+	LastPacket  time.Time
+}
+
+// KeyTemplate renders the keys of the uploaded objects. The placeholders are
+// {sensorId}, {hostname}, {interface}, {yyyy}, {MM}, {dd}, {HH}, {mm}, {ss},
+// {uuid}, {seq}, {ext}, {firstPacket} and {lastPacket}. The date and time are
+// in UTC.
+type KeyTemplate struct {
+	template    string
+	bySensor    bool
+	byInterface bool
+	deferred    bool
+}
+
+func ParseKeyTemplate(template string) (*KeyTemplate, error) {
+	t := &KeyTemplate{template: template}
+	unique := false
+	for _, match := range keyPlaceholder.FindAllStringSubmatch(template, -1) {
+		switch match[1] {
+		case "sensorId":
+			t.bySensor = true
+		case "interface":
+			t.byInterface = true
+		case "uuid":
+			unique = true
+		case "firstPacket", "lastPacket":
+			t.deferred = true
+		case "hostname", "yyyy", "MM", "dd", "HH", "mm", "ss", "seq", "ext":
+		default:
+			return nil, fmt.Errorf("unknown placeholder %s in the key template", match[0])
+		}
+	}
+	if !unique {
+		return nil, ErrKeyTemplateNotUnique
+	}
+	return t, nil
+}
+
+// Deferred tells whether the keys can only be rendered once the objects are
+// complete, as they contain the timestamp of their last packet.
+func (t *KeyTemplate) Deferred() bool {
+	return t.deferred
+}
+
+// Partition returns the partition of the packets of a sensor and interface.
+// The packets of every partition go to objects of their own, when the
+// template splits them by sensor or interface.
+func (t *KeyTemplate) Partition(sensorID, intf string) string {
+	var partition []string
+	if t.bySensor {
+		partition = append(partition, sensorID)
+	}
+	if t.byInterface {
+		partition = append(partition, intf)
+	}
+	return strings.Join(partition, "\x00")
+}
+
+func (t *KeyTemplate) Render(fields KeyFields) string {
+	ts := fields.Time.UTC()
+	return keyPlaceholder.ReplaceAllStringFunc(t.template, func(placeholder string) string {
+		switch placeholder[1 : len(placeholder)-1] {
+		case "sensorId":
+			return keyValue(fields.SensorID)
+		case "hostname":
+			return keyValue(fields.Hostname)
+		case "interface":
+			return keyValue(fields.Interface)
+		case "yyyy":
+			return fmt.Sprintf("%04d", ts.Year())
+		case "MM":
+			return fmt.Sprintf("%02d", ts.Month())
+		case "dd":
+			return fmt.Sprintf("%02d", ts.Day())
+		case "HH":
+			return fmt.Sprintf("%02d", ts.Hour())
+		case "mm":
+			return fmt.Sprintf("%02d", ts.Minute())
+		case "ss":
+			return fmt.Sprintf("%02d", ts.Second())
+		case "uuid":
+			return fields.UUID
+		case "seq":
+			return fmt.Sprintf("%06d", fields.Seq)
+		case "ext":
+			return fields.Ext
+		case "firstPacket":
+			return packetTime(fields.FirstPacket)
+		case "lastPacket":
+			return packetTime(fields.LastPacket)
+		default:
+			return placeholder
+		}
+	})
+}
+
+func packetTime(t time.Time) string {
+	if t.IsZero() {
+		return unknownKeyValue
+	}
+	return t.UTC().Format(packetTimeLayout)
+}
+
+// keyValue keeps values from adding levels to the key.
+func keyValue(value string) string {
+	if value == "" {
+		return unknownKeyValue
+	}
+	return strings.ReplaceAll(value, "/", "_")
+}
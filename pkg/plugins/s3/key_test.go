@@ -0,0 +1,109 @@
+package s3
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyTemplateRender(t *testing.T) {
+	fields := KeyFields{
+		SensorID: "vxlan-42@10.0.1.5",
+		Hostname: "receiver-0",
+		Time:     time.Date(2024, 5, 3, 14, 7, 9, 0, time.FixedZone("CEST", 2*60*60)),
+		UUID:     "5f0c0d2e-7f4c-4c39-9a55-0f5e0c8c1a2b",
+		Seq:      12,
+		Ext:      "pcap",
+		// the last packet is unknown
+		FirstPacket: time.Date(2024, 5, 3, 12, 0, 0, 1500, time.UTC),
+	}
+
+	for _, tt := range []struct {
+		testName string
+		template string
+		expected string
+	}{
+		{
+			testName: "default",
+			template: DefaultKeyTemplate,
+			expected: "dt=2024-05-03/hour=12/sensor=vxlan-42@10.0.1.5/20240503T120000.000001Z-unknown-receiver-0-000012-5f0c0d2e-7f4c-4c39-9a55-0f5e0c8c1a2b.pcap",
+		},
+		{
+			testName: "prefix and interface",
+			template: "pcap/{interface}/{sensorId}/{yyyy}/{MM}/{dd}/{HH}{mm}-{uuid}.{ext}",
+			expected: "pcap/unknown/vxlan-42@10.0.1.5/2024/05/03/1207-5f0c0d2e-7f4c-4c39-9a55-0f5e0c8c1a2b.pcap",
+		},
+		{
+			testName: "packet timestamps",
+			template: "{sensorId}/{firstPacket}-{lastPacket}-{uuid}.{ext}",
+			expected: "vxlan-42@10.0.1.5/20240503T120000.000001Z-unknown-5f0c0d2e-7f4c-4c39-9a55-0f5e0c8c1a2b.pcap",
+		},
+	} {
+		t.Run(tt.testName, func(t *testing.T) {
+			template, err := ParseKeyTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if key := template.Render(fields); key != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, key)
+			}
+		})
+	}
+
+	template, err := ParseKeyTemplate("{sensorId}-{uuid}")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key := template.Render(KeyFields{SensorID: "a/b", UUID: "1"}); key != "a_b-1" {
+		t.Errorf("expected the sensor ID not to add a level to the key, got %s", key)
+	}
+}
+
+func TestParseKeyTemplateInvalid(t *testing.T) {
+	if _, err := ParseKeyTemplate("{yyyy}/{seq}.pcap"); err != ErrKeyTemplateNotUnique {
+		t.Errorf("expected ErrKeyTemplateNotUnique, got %v", err)
+	}
+	if _, err := ParseKeyTemplate("{year}/{uuid}.pcap"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestKeyTemplateDeferred(t *testing.T) {
+	for template, expected := range map[string]bool{
+		DefaultKeyTemplate:               true,
+		"{sensorId}/{seq}-{uuid}":        false,
+		"{firstPacket}-{uuid}":           true,
+		"{sensorId}/{lastPacket}-{uuid}": true,
+	} {
+		parsed, err := ParseKeyTemplate(template)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if parsed.Deferred() != expected {
+			t.Errorf("%s: expected deferred keys: %v", template, expected)
+		}
+	}
+}
+
+func TestKeyTemplatePartition(t *testing.T) {
+	for _, tt := range []struct {
+		template    string
+		bySensor    bool
+		byInterface bool
+	}{
+		{template: "{uuid}"},
+		{template: "{sensorId}/{uuid}", bySensor: true},
+		{template: "{sensorId}/{interface}/{uuid}", bySensor: true, byInterface: true},
+	} {
+		template, err := ParseKeyTemplate(tt.template)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		partition := template.Partition("sensor-a", "eth0")
+		if bySensor := partition != template.Partition("sensor-b", "eth0"); bySensor != tt.bySensor {
+			t.Errorf("%s: expected partitions by sensor: %v", tt.template, tt.bySensor)
+		}
+		if byInterface := partition != template.Partition("sensor-a", "eth1"); byInterface != tt.byInterface {
+			t.Errorf("%s: expected partitions by interface: %v", tt.template, tt.byInterface)
+		}
+	}
+}
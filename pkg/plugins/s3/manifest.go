@@ -0,0 +1,50 @@
+package s3
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// manifestExt is added to the key of an object to get the key of its
+	// manifest.
+	manifestExt = ".json"
+)
+
+// Manifest describes the packets of an object, so that they can be found
+// without downloading it.
+type Manifest struct {
+	Key         string     `json:"key"`
+	PacketCount int        `json:"packetCount"`
+	Bytes       int        `json:"bytes"`
+	Sensors     []string   `json:"sensors"`
+	FirstPacket *time.Time `json:"firstPacket,omitempty"`
+	LastPacket  *time.Time `json:"lastPacket,omitempty"`
+	// WindowStart and WindowEnd are the time window of the object, when the
+	// objects are aligned on time boundaries.
+	WindowStart *time.Time `json:"windowStart,omitempty"`
+	WindowEnd   *time.Time `json:"windowEnd,omitempty"`
+}
+
+// manifest returns the manifest of the object.
+func (mpu *MultipartUpload) manifest(rotateInterval time.Duration) *Manifest {
+	m := &Manifest{
+		Key:         mpu.Key,
+		PacketCount: mpu.Capture.PacketCount,
+		Bytes:       mpu.Size,
+		Sensors:     make([]string, 0, len(mpu.sensors)),
+	}
+	for sensorID := range mpu.sensors {
+		m.Sensors = append(m.Sensors, sensorID)
+	}
+	sort.Strings(m.Sensors)
+	if mpu.Capture.PacketCount > 0 {
+		first, last := mpu.Capture.FirstTimestamp.UTC(), mpu.Capture.LastTimestamp.UTC()
+		m.FirstPacket, m.LastPacket = &first, &last
+	}
+	if !mpu.Window.IsZero() {
+		start, end := mpu.Window.UTC(), mpu.Window.Add(rotateInterval).UTC()
+		m.WindowStart, m.WindowEnd = &start, &end
+	}
+	return m
+}
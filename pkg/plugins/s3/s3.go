@@ -3,26 +3,133 @@ package s3
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
+	"github.com/google/uuid"
+	"github.com/inhies/go-bytesize"
 
+	"github.com/deepfence/PacketStreamer/pkg/batch"
 	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/plugins"
 )
 
 const (
 	MaxParts = 10_000
+	// minPartSize is the minimum size of the parts of a multipart upload,
+	// but the last one.
+	minPartSize = 5 << 20
+
+	pcapExt = "pcap"
+
+	defaultRegion     = "us-east-1"
+	defaultMaxRetries = 5
+
+	// rotateDelay is how long after the end of their time window the objects
+	// are completed, so that the packets gathered at the time get in.
+	rotateDelay = 10 * time.Second
+
+	sseCustomerAlgorithm = "AES256"
+	sseCustomerKeyLen    = 32
+
+	// maxTags is the maximum number of tags of an S3 object.
+	maxTags = 10
+
+	// keys of the metadata and tags describing the capture
+	sensorIDKey     = "sensor-id"
+	interfaceKey    = "interface"
+	hostnameKey     = "hostname"
+	filterKey       = "bpf-filter"
+	captureStartKey = "capture-start"
+	captureEndKey   = "capture-end"
+	packetCountKey  = "packet-count"
 )
 
+var (
+	ErrIncompleteCredentials   = errors.New("both accessKeyId and secretAccessKey should be set")
+	ErrKMSKeyWithoutKMS        = errors.New("kmsKeyId requires the aws:kms server-side encryption")
+	ErrConflictingEncryption   = errors.New("sseCustomerKey can't be used along with serverSideEncryption")
+	ErrInvalidSSECustomerKey   = errors.New("sseCustomerKey should be a base64-encoded 256-bit key")
+	ErrRotateIntervalTooShort  = errors.New("rotateInterval should be at least 1s")
+	ErrUploadChunkSizeTooSmall = errors.New("uploadChunkSize should be at least 5MB, the minimum size of the parts of S3")
+	ErrTooManyTags             = fmt.Errorf("there can't be more than %d tags", maxTags-len(captureTags))
+
+	// captureTags are the tags added to every object once it's uploaded.
+	captureTags = []string{captureStartKey, captureEndKey, packetCountKey}
+)
+
+func init() {
+	plugins.Register("s3", func() plugins.Plugin {
+		return &Plugin{}
+	})
+}
+
+type Config struct {
+	Bucket          string
+	Region          string
+	TotalFileSize   *string `yaml:"totalFileSize,omitempty"`
+	UploadChunkSize *string `yaml:"uploadChunkSize,omitempty"`
+	UploadTimeout   *string `yaml:"uploadTimeout,omitempty"`
+	CannedACL       *string `yaml:"cannedACL,omitempty"`
+	KeyTemplate     *string `yaml:"keyTemplate,omitempty"`
+
+	// Endpoint is the URL of an S3-compatible service, like MinIO or Ceph.
+	Endpoint  string `yaml:"endpoint,omitempty"`
+	PathStyle bool   `yaml:"pathStyle,omitempty"`
+	// Static credentials, or the ones of Profile in CredentialsFile, take
+	// precedence over the default credential chain.
+	AccessKeyID     string `yaml:"accessKeyId,omitempty"`
+	SecretAccessKey string `yaml:"secretAccessKey,omitempty"`
+	SessionToken    string `yaml:"sessionToken,omitempty"`
+	CredentialsFile string `yaml:"credentialsFile,omitempty"`
+	Profile         string `yaml:"profile,omitempty"`
+	// RoleARN is a role assumed with the credentials.
+	RoleARN    string `yaml:"roleArn,omitempty"`
+	ExternalID string `yaml:"externalId,omitempty"`
+	// CABundle is a file of PEM certificates trusted besides the system ones.
+	CABundle string `yaml:"caBundle,omitempty"`
+
+	// ServerSideEncryption is AES256 (SSE-S3) or aws:kms (SSE-KMS), which
+	// KMSKeyID implies.
+	ServerSideEncryption string `yaml:"serverSideEncryption,omitempty"`
+	KMSKeyID             string `yaml:"kmsKeyId,omitempty"`
+	// SSECustomerKey is a base64-encoded 256-bit key for SSE-C.
+	SSECustomerKey string            `yaml:"sseCustomerKey,omitempty"`
+	StorageClass   string            `yaml:"storageClass,omitempty"`
+	Tags           map[string]string `yaml:"tags,omitempty"`
+	Metadata       map[string]string `yaml:"metadata,omitempty"`
+
+	MaxRetries   *int    `yaml:"maxRetries,omitempty"`
+	RetryBackoff *string `yaml:"retryBackoff,omitempty"`
+	// SpoolDir is where the objects are kept until they are uploaded, so that
+	// S3 outages don't lose them. Without it, the objects which fail to
+	// upload are lost.
+	SpoolDir  string  `yaml:"spoolDir,omitempty"`
+	SpoolSize *string `yaml:"spoolSize,omitempty"`
+
+	// RotateInterval cuts the objects on time boundaries aligned to it, by
+	// the timestamps of the packets.
+	RotateInterval *string `yaml:"rotateInterval,omitempty"`
+	// Manifest uploads a manifest along with every object.
+	Manifest bool `yaml:"manifest,omitempty"`
+}
+
 type Plugin struct {
-	S3Client        *s3.Client
+	S3Client        Client
 	Region          string
 	Bucket          string
 	InputPacketLen  int
@@ -30,147 +137,533 @@ type Plugin struct {
 	UploadChunkSize uint64
 	UploadTimeout   time.Duration
 	CannedACL       string
+	KeyTemplate     *KeyTemplate
+	Hostname        string
+	Encryption      Encryption
+	StorageClass    types.StorageClass
+	Tags            map[string]string
+	Metadata        map[string]string
+	MaxRetries      int
+	RetryBackoff    time.Duration
+	// Spool is nil when there's no spool directory.
+	Spool          *Spool
+	RotateInterval time.Duration
+	Manifest       bool
+
+	mu sync.Mutex
+	// uploads are the current multipart uploads of every partition and time
+	// window.
+	uploads   map[uploadKey]*MultipartUpload
+	seq       uint64
+	idleTimer *time.Timer
+	// windows cut the objects on the boundaries of RotateInterval, and
+	// rotateTimer completes the objects of the past time windows.
+	windows     batch.Windows
+	rotateTimer *time.Timer
+	closed      bool
+	// completing counts the timers completing uploads without mu, which
+	// Close waits for.
+	completing sync.WaitGroup
+
+	// drainMu is held while the spooled objects are uploaded. nextDrain is
+	// when that's tried next.
+	drainMu   sync.Mutex
+	nextDrain time.Time
+
+	// statsMu guards the stats, which the uploads completed without mu
+	// update too.
+	statsMu sync.Mutex
+	stats   plugins.Stats
 }
 
+// uploadKey is the partition and the time window of an upload, the start of
+// the window in seconds, which is 0 when the objects aren't aligned on time
+// boundaries.
+type uploadKey struct {
+	partition string
+	window    int64
+}
+
+// Encryption is the server-side encryption of the uploaded objects.
+type Encryption struct {
+	ServerSideEncryption types.ServerSideEncryption
+	KMSKeyID             string
+	// SSECustomerKey and SSECustomerKeyMD5 are base64-encoded.
+	SSECustomerKey    string
+	SSECustomerKeyMD5 string
+}
+
+// MultipartUpload is an object being uploaded. Its Upload is nil until its key
+// is known, when the key template is deferred, and when S3 couldn't be
+// reached, in which case the object is only spooled, to be uploaded once it's
+// complete.
 type MultipartUpload struct {
+	Key           string
+	Metadata      map[string]string
 	Upload        *s3.CreateMultipartUploadOutput
 	Parts         []types.CompletedPart
 	Buffer        []byte
 	TotalDataSent int
+	// Size is the size of the whole object so far.
+	Size int
+	// Capture describes the packets of the object, which are tagged with it
+	// once the upload is complete. Its link type is the one of the pcap
+	// header of the object.
+	Capture batch.Metadata
+	// Window is the start of the time window of the object, when the objects
+	// are aligned on time boundaries.
+	Window time.Time
+
+	fields    KeyFields
+	sensors   map[string]struct{}
+	abandoned bool
+	spool     *spoolFile
 }
 
-func NewPlugin(ctx context.Context, config *config.Config) (*Plugin, error) {
-	awsCfg, err := awsConfig.LoadDefaultConfig(ctx,
-		awsConfig.WithRegion(config.Output.Plugins.S3.Region))
+func (p *Plugin) Init(ctx context.Context, global *config.Config, pluginConfig config.PluginConfig) error {
+	var cfg Config
+	if err := pluginConfig.Decode(&cfg); err != nil {
+		return err
+	}
+
+	totalFileSize := 10 * bytesize.MB
+	if cfg.TotalFileSize != nil {
+		t, err := bytesize.Parse(*cfg.TotalFileSize)
+		if err != nil {
+			return fmt.Errorf("could not parse the totalFileSize field %s: %w", *cfg.TotalFileSize, err)
+		}
+		totalFileSize = t
+	}
+
+	uploadTimeout := time.Minute
+	if cfg.UploadTimeout != nil {
+		var err error
+		uploadTimeout, err = time.ParseDuration(*cfg.UploadTimeout)
+		if err != nil {
+			return fmt.Errorf("could not parse the uploadTimeout field %s: %w", *cfg.UploadTimeout, err)
+		}
+	}
 
+	uploadChunkSize := 5 * bytesize.MB
+	if cfg.UploadChunkSize != nil {
+		u, err := bytesize.Parse(*cfg.UploadChunkSize)
+		if err != nil {
+			return fmt.Errorf("could not parse the uploadChunkSize field %s: %w", *cfg.UploadChunkSize, err)
+		}
+		uploadChunkSize = u
+	}
+	if uploadChunkSize < minPartSize {
+		return ErrUploadChunkSizeTooSmall
+	}
+
+	cannedACL := string(types.ObjectCannedACLBucketOwnerFullControl)
+	if cfg.CannedACL != nil {
+		cannedACL = *cfg.CannedACL
+	}
+
+	keyTemplate := DefaultKeyTemplate
+	if cfg.KeyTemplate != nil {
+		keyTemplate = *cfg.KeyTemplate
+	}
+	template, err := ParseKeyTemplate(keyTemplate)
 	if err != nil {
-		return nil, fmt.Errorf("error loading AWS config when creating S3 client, %v", err)
+		return err
 	}
 
-	s3Client := s3.NewFromConfig(awsCfg)
+	// keys get "unknown" instead
+	hostname, _ := os.Hostname()
 
+	encryption, err := newEncryption(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("invalid upload timeout duration, %v", err)
-	}
-
-	return &Plugin{
-		S3Client:        s3Client,
-		Region:          config.Output.Plugins.S3.Region,
-		Bucket:          config.Output.Plugins.S3.Bucket,
-		TotalFileSize:   uint64(*config.Output.Plugins.S3.TotalFileSize),
-		UploadChunkSize: uint64(*config.Output.Plugins.S3.UploadChunkSize),
-		UploadTimeout:   config.Output.Plugins.S3.UploadTimeout,
-		CannedACL:       config.Output.Plugins.S3.CannedACL,
-	}, nil
-}
-
-func newMultipartUpload(createOutput *s3.CreateMultipartUploadOutput) *MultipartUpload {
-	return &MultipartUpload{
-		Upload:        createOutput,
-		Parts:         make([]types.CompletedPart, 0),
-		Buffer:        make([]byte, 0),
-		TotalDataSent: 0,
-	}
-}
-
-func (mpu *MultipartUpload) appendToBuffer(data []byte) {
-	mpu.Buffer = append(mpu.Buffer, data...)
-}
-
-//Start returns a write-only channel to which packet chunks should be written should they wish to be streamed to S3.
-//It is the responsibility of the caller to close the returned channel.
-func (p *Plugin) Start(ctx context.Context) chan<- string {
-	inputChan := make(chan string)
-	go func() {
-		var mpu *MultipartUpload
-
-		for {
-			select {
-			case chunk := <-inputChan:
-				if mpu == nil {
-					var err error
-					mpu, err = p.createMultipartUpload(ctx)
-
-					if err != nil {
-						log.Printf("error creating multipart upload, stopping... - %v\n", err)
-						return
-					}
-				}
-				data := []byte(chunk)
-				mpu.appendToBuffer(data)
-
-				if uint64(len(mpu.Buffer)) >= p.UploadChunkSize {
-					p.flushData(ctx, mpu)
-				}
-
-				if len(mpu.Parts) == MaxParts {
-					err := p.completeUpload(ctx, mpu)
-
-					if err != nil {
-						log.Printf("error completing multipart upload, stopping... - %v\n", err)
-						return
-					}
-
-					mpu, err = p.createMultipartUpload(ctx)
-
-					if err != nil {
-						log.Printf("error creating multipart upload, stopping... - %v\n", err)
-						return
-					}
-
-					continue
-				}
-
-				if uint64(mpu.TotalDataSent) >= p.TotalFileSize {
-					err := p.completeUpload(ctx, mpu)
-
-					if err != nil {
-						log.Printf("error completing multipart upload, stopping... - %v\n", err)
-						return
-					}
-
-					mpu, err = p.createMultipartUpload(ctx)
-
-					if err != nil {
-						log.Printf("error creating multipart upload, stopping... - %v\n", err)
-						return
-					}
-				}
-			case <-time.After(p.UploadTimeout):
-				// write whatever data we have to
-				if mpu != nil && (len(mpu.Buffer) > 0 || len(mpu.Parts) > 0) {
-					log.Println("timeout internal expired - flushing...")
-					p.completeUpload(ctx, mpu)
-				}
-
-				var err error
-				mpu, err = p.createMultipartUpload(ctx)
-
-				if err != nil {
-					log.Printf("error creating multipart upload, stopping... - %v\n", err)
-					return
-				}
-			case <-ctx.Done():
-				p.flushData(ctx, mpu)
-				return
+		return err
+	}
+	if len(cfg.Tags) > maxTags-len(captureTags) {
+		return ErrTooManyTags
+	}
+
+	maxRetries := defaultMaxRetries
+	if cfg.MaxRetries != nil {
+		maxRetries = *cfg.MaxRetries
+	}
+
+	retryBackoff := time.Second
+	if cfg.RetryBackoff != nil {
+		retryBackoff, err = time.ParseDuration(*cfg.RetryBackoff)
+		if err != nil {
+			return fmt.Errorf("could not parse the retryBackoff field %s: %w", *cfg.RetryBackoff, err)
+		}
+	}
+
+	var rotateInterval time.Duration
+	if cfg.RotateInterval != nil {
+		rotateInterval, err = time.ParseDuration(*cfg.RotateInterval)
+		if err != nil {
+			return fmt.Errorf("could not parse the rotateInterval field %s: %w", *cfg.RotateInterval, err)
+		}
+		if rotateInterval < time.Second {
+			return ErrRotateIntervalTooShort
+		}
+	}
+
+	var spool *Spool
+	if cfg.SpoolDir != "" {
+		spoolSize := bytesize.GB
+		if cfg.SpoolSize != nil {
+			spoolSize, err = bytesize.Parse(*cfg.SpoolSize)
+			if err != nil {
+				return fmt.Errorf("could not parse the spoolSize field %s: %w", *cfg.SpoolSize, err)
 			}
 		}
-	}()
-	return inputChan
+		spool, err = NewSpool(cfg.SpoolDir, int64(spoolSize))
+		if err != nil {
+			return err
+		}
+	}
+
+	client, err := newClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	p.S3Client = client
+	p.Region = cfg.Region
+	p.Bucket = cfg.Bucket
+	p.InputPacketLen = global.InputPacketLen
+	p.TotalFileSize = uint64(totalFileSize)
+	p.UploadChunkSize = uint64(uploadChunkSize)
+	p.UploadTimeout = uploadTimeout
+	p.CannedACL = cannedACL
+	p.KeyTemplate = template
+	p.Hostname = hostname
+	p.Encryption = encryption
+	p.StorageClass = types.StorageClass(cfg.StorageClass)
+	p.Tags = cfg.Tags
+	p.Metadata = cfg.Metadata
+	p.MaxRetries = maxRetries
+	p.RetryBackoff = retryBackoff
+	p.Spool = spool
+	p.RotateInterval = rotateInterval
+	p.Manifest = cfg.Manifest
+	p.uploads = make(map[uploadKey]*MultipartUpload)
+	p.idleTimer = time.AfterFunc(p.UploadTimeout, p.onUploadTimeout)
+	if p.RotateInterval != 0 {
+		p.windows = batch.Windows{Interval: p.RotateInterval, Delay: rotateDelay}
+		p.rotateTimer = time.AfterFunc(p.windows.UntilOver(time.Now()), p.onRotate)
+	}
+
+	return nil
+}
+
+func newEncryption(cfg Config) (Encryption, error) {
+	encryption := Encryption{
+		ServerSideEncryption: types.ServerSideEncryption(cfg.ServerSideEncryption),
+		KMSKeyID:             cfg.KMSKeyID,
+	}
+	if cfg.KMSKeyID != "" && encryption.ServerSideEncryption == "" {
+		encryption.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+	}
+	switch encryption.ServerSideEncryption {
+	case "", types.ServerSideEncryptionAes256:
+		if cfg.KMSKeyID != "" {
+			return Encryption{}, ErrKMSKeyWithoutKMS
+		}
+	case types.ServerSideEncryptionAwsKms:
+	default:
+		return Encryption{}, fmt.Errorf("invalid serverSideEncryption %s, expected %s or %s",
+			cfg.ServerSideEncryption, types.ServerSideEncryptionAes256, types.ServerSideEncryptionAwsKms)
+	}
+
+	if cfg.SSECustomerKey != "" {
+		if encryption.ServerSideEncryption != "" {
+			return Encryption{}, ErrConflictingEncryption
+		}
+		key, err := base64.StdEncoding.DecodeString(cfg.SSECustomerKey)
+		if err != nil || len(key) != sseCustomerKeyLen {
+			return Encryption{}, ErrInvalidSSECustomerKey
+		}
+		sum := md5.Sum(key)
+		encryption.SSECustomerKey = cfg.SSECustomerKey
+		encryption.SSECustomerKeyMD5 = base64.StdEncoding.EncodeToString(sum[:])
+	}
+	return encryption, nil
+}
+
+// sseCustomerAlgorithm returns the SSE-C algorithm, if any.
+func (e Encryption) sseCustomerAlgorithm() *string {
+	if e.SSECustomerKey == "" {
+		return nil
+	}
+	return aws.String(sseCustomerAlgorithm)
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+// append adds data to the object, buffering it for the next part of the
+// upload and writing it to the spool.
+func (mpu *MultipartUpload) append(data []byte) {
+	if !mpu.abandoned {
+		mpu.Buffer = append(mpu.Buffer, data...)
+	}
+	if mpu.spool != nil {
+		if _, err := mpu.spool.Write(data); err != nil {
+			// the upload goes on without the spool
+			log.Printf("error spooling %s - %v\n", mpu.Key, err)
+			mpu.spool.Close()
+			mpu.spool = nil
+		}
+	}
+	mpu.Size += len(data)
+}
+
+// Write appends the batch to the current multipart upload of its partition,
+// uploading a part once enough data is buffered and completing the upload once
+// it reaches the configured total file size. When the objects are aligned on
+// time boundaries, the packets of the batch are split by time window.
+func (p *Plugin) Write(ctx context.Context, b *batch.Batch) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.idleTimer.Reset(p.UploadTimeout)
+
+	var err error
+	if p.RotateInterval == 0 {
+		err = p.write(ctx, b.Metadata, b.Data, time.Time{})
+	} else {
+		err = p.windows.Split(b.Metadata, b.Data, func(window time.Time, m batch.Metadata, records []byte) error {
+			return p.write(ctx, m, records, window)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	p.drainSpool(ctx)
+
+	return nil
+}
+
+// write appends records to the object of their partition and time window.
+// The packets of a window come late when it's over by the time of the
+// packets of later ones, and go to a new object of their window.
+func (p *Plugin) write(ctx context.Context, m batch.Metadata, records []byte, window time.Time) error {
+	key := uploadKey{partition: p.KeyTemplate.Partition(m.SensorID, m.Interface)}
+	if !window.IsZero() {
+		key.window = window.Unix()
+		// the packets of the previous windows are all there
+		over := p.takeUploads(func(k uploadKey, mpu *MultipartUpload) bool {
+			return k.partition == key.partition && p.windows.Over(mpu.Window, m.LastTimestamp)
+		})
+		if err := p.completeUploads(ctx, over); err != nil {
+			return err
+		}
+	}
+	mpu := p.uploads[key]
+	if mpu != nil && mpu.Capture.LinkType != m.PcapLinkType() {
+		// the packets of another link type need an object of their own
+		delete(p.uploads, key)
+		if err := p.completeUpload(ctx, mpu); err != nil {
+			return err
+		}
+		mpu = nil
+	}
+	if mpu == nil {
+		var err error
+		mpu, err = p.createMultipartUpload(ctx, m, window)
+		if err != nil {
+			p.countError()
+			return err
+		}
+		p.uploads[key] = mpu
+	}
+	mpu.append(records)
+	mpu.addCapture(m)
+
+	if mpu.Upload != nil && uint64(len(mpu.Buffer)) >= p.UploadChunkSize {
+		if err := p.flushData(ctx, mpu); err != nil {
+			if err := p.abandonUpload(ctx, mpu, err); err != nil {
+				delete(p.uploads, key)
+				return err
+			}
+		}
+	}
+
+	if len(mpu.Parts) == MaxParts || uint64(mpu.Size) >= p.TotalFileSize {
+		// the next batch of the partition starts a new upload
+		delete(p.uploads, key)
+		if err := p.completeUpload(ctx, mpu); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush uploads the buffered data as parts of the current multipart uploads.
+// The data which is too small for a part stays buffered, until the upload is
+// complete.
+func (p *Plugin) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var errs []error
+	for key, mpu := range p.uploads {
+		if len(mpu.Buffer) < minPartSize {
+			continue
+		}
+		if err := p.flushData(ctx, mpu); err != nil {
+			if err := p.abandonUpload(ctx, mpu, err); err != nil {
+				delete(p.uploads, key)
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close completes the current multipart uploads, and waits for the ones the
+// timers are completing. The spooled objects are left for the next start.
+func (p *Plugin) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	if p.idleTimer != nil {
+		p.idleTimer.Stop()
+	}
+	if p.rotateTimer != nil {
+		p.rotateTimer.Stop()
+	}
+	err := p.completeUploads(context.Background(), p.takeUploads(func(uploadKey, *MultipartUpload) bool { return true }))
+	p.mu.Unlock()
+
+	p.completing.Wait()
+	return err
+}
+
+func (p *Plugin) Stats() plugins.Stats {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+
+	return p.stats
+}
+
+func (p *Plugin) countError() {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+
+	p.stats.Errors++
+}
+
+// countWrite counts an object or a part of an object uploaded.
+func (p *Plugin) countWrite(size int) {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+
+	p.stats.Writes++
+	p.stats.BytesWritten += uint64(size)
+}
+
+// onUploadTimeout completes the current uploads once no batch came for the
+// upload timeout. They are completed without the lock, so that the batches
+// coming in meanwhile start new ones instead of waiting.
+func (p *Plugin) onUploadTimeout() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.idleTimer.Reset(p.UploadTimeout)
+	uploads := p.takeUploads(func(uploadKey, *MultipartUpload) bool { return true })
+	p.completing.Add(1)
+	p.mu.Unlock()
+	defer p.completing.Done()
+
+	// write whatever data we have to
+	if len(uploads) > 0 {
+		log.Println("timeout internal expired - flushing...")
+		if err := p.completeUploads(context.Background(), uploads); err != nil {
+			log.Printf("error completing multipart uploads - %v\n", err)
+		}
+	}
+	p.drainSpool(context.Background())
+}
+
+// onRotate completes the objects whose time window is over, even when there
+// are no packets of the following windows, without the lock like
+// onUploadTimeout.
+func (p *Plugin) onRotate() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	p.rotateTimer.Reset(p.windows.UntilOver(now))
+	uploads := p.takeUploads(func(_ uploadKey, mpu *MultipartUpload) bool { return p.windows.Over(mpu.Window, now) })
+	p.completing.Add(1)
+	p.mu.Unlock()
+	defer p.completing.Done()
+
+	if err := p.completeUploads(context.Background(), uploads); err != nil {
+		log.Printf("error completing multipart uploads - %v\n", err)
+	}
+}
+
+// takeUploads removes the uploads which are done from the current ones, so
+// that they can be completed. The following batches of their partitions
+// start new ones.
+func (p *Plugin) takeUploads(done func(uploadKey, *MultipartUpload) bool) []*MultipartUpload {
+	var uploads []*MultipartUpload
+	for key, mpu := range p.uploads {
+		if done(key, mpu) {
+			delete(p.uploads, key)
+			uploads = append(uploads, mpu)
+		}
+	}
+	return uploads
+}
+
+// completeUploads completes the uploads, which have to be taken from the
+// current ones.
+func (p *Plugin) completeUploads(ctx context.Context, uploads []*MultipartUpload) error {
+	var errs []error
+	for _, mpu := range uploads {
+		if err := p.completeUpload(ctx, mpu); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// addCapture adds the packets of a batch to the ones of the object.
+func (mpu *MultipartUpload) addCapture(m batch.Metadata) {
+	mpu.sensors[m.SensorID] = struct{}{}
+	mpu.Capture.Merge(m)
 }
 
 func (p *Plugin) flushData(ctx context.Context, mpu *MultipartUpload) error {
-	if len(mpu.Buffer) == 0 {
+	if mpu.Upload == nil || len(mpu.Buffer) == 0 {
 		return nil
 	}
 
-	upr, err := p.S3Client.UploadPart(ctx, &s3.UploadPartInput{
-		Bucket:        mpu.Upload.Bucket,
-		Key:           mpu.Upload.Key,
-		PartNumber:    int32(len(mpu.Parts) + 1),
-		UploadId:      mpu.Upload.UploadId,
-		Body:          bytes.NewBuffer(mpu.Buffer),
-		ContentLength: int64(len(mpu.Buffer)),
+	var upr *s3.UploadPartOutput
+	err := p.retry(ctx, func() error {
+		var err error
+		upr, err = p.S3Client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     mpu.Upload.Bucket,
+			Key:        mpu.Upload.Key,
+			PartNumber: int32(len(mpu.Parts) + 1),
+			UploadId:   mpu.Upload.UploadId,
+			// seekable, so that the payload can be signed over plain HTTP
+			Body:                 bytes.NewReader(mpu.Buffer),
+			ContentLength:        int64(len(mpu.Buffer)),
+			SSECustomerAlgorithm: p.Encryption.sseCustomerAlgorithm(),
+			SSECustomerKey:       optionalString(p.Encryption.SSECustomerKey),
+			SSECustomerKeyMD5:    optionalString(p.Encryption.SSECustomerKeyMD5),
+		})
+		return err
 	})
 
 	if err != nil {
@@ -182,54 +675,367 @@ func (p *Plugin) flushData(ctx context.Context, mpu *MultipartUpload) error {
 		PartNumber: int32(len(mpu.Parts) + 1),
 	})
 	mpu.TotalDataSent += len(mpu.Buffer)
+	p.countWrite(len(mpu.Buffer))
 	mpu.Buffer = make([]byte, 0)
 
 	return nil
 }
 
+// completeUpload completes the upload of the object, or keeps it in the spool
+// when it can't be uploaded.
 func (p *Plugin) completeUpload(ctx context.Context, mpu *MultipartUpload) error {
-	err := p.flushData(ctx, mpu)
+	if !mpu.abandoned && mpu.Upload == nil {
+		// the key of a deferred object is only known now
+		mpu.fields.FirstPacket = mpu.Capture.FirstTimestamp
+		mpu.fields.LastPacket = mpu.Capture.LastTimestamp
+		mpu.Key = p.KeyTemplate.Render(mpu.fields)
+		if err := p.startUpload(ctx, mpu); err != nil {
+			if err := p.abandonUpload(ctx, mpu, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	if mpu.Upload != nil {
+		err := p.flushData(ctx, mpu)
+		if err != nil {
+			err = fmt.Errorf("error flushing data before upload complete, %v", err)
+		} else {
+			err = p.retry(ctx, func() error {
+				_, err := p.S3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+					Bucket:   mpu.Upload.Bucket,
+					Key:      mpu.Upload.Key,
+					UploadId: mpu.Upload.UploadId,
+					MultipartUpload: &types.CompletedMultipartUpload{
+						Parts: mpu.Parts,
+					},
+				})
+				return err
+			})
+			if err != nil {
+				err = fmt.Errorf("error completing multipart upload, %v", err)
+			}
+		}
+		if err != nil {
+			if err := p.abandonUpload(ctx, mpu, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	var manifest *Manifest
+	if p.Manifest {
+		manifest = mpu.manifest(p.RotateInterval)
+	}
+
+	if mpu.abandoned {
+		if mpu.spool == nil {
+			p.countError()
+			return fmt.Errorf("%s could be neither uploaded nor spooled", mpu.Key)
+		}
+		if err := p.Spool.seal(mpu.spool, mpu.Key, p.objectTags(mpu), manifest); err != nil {
+			p.countError()
+			return fmt.Errorf("error spooling %s, %v", mpu.Key, err)
+		}
+		return nil
+	}
+	if mpu.spool != nil {
+		p.Spool.discard(mpu.spool)
+	}
 
+	// the object is there even if it can't be tagged, e.g. by services which
+	// don't support tagging
+	if err := p.tagCapture(ctx, mpu); err != nil {
+		log.Printf("error tagging %s - %v\n", mpu.Key, err)
+	}
+	if manifest != nil {
+		if err := p.uploadManifest(ctx, manifest); err != nil {
+			p.countError()
+			log.Printf("error uploading the manifest of %s - %v\n", mpu.Key, err)
+		}
+	}
+
+	return nil
+}
+
+// uploadManifest uploads the manifest next to its object.
+func (p *Plugin) uploadManifest(ctx context.Context, manifest *Manifest) error {
+	raw, err := json.Marshal(manifest)
 	if err != nil {
-		return fmt.Errorf("error flushing data before upload complete, %v", err)
+		return err
 	}
+	return p.retry(ctx, func() error {
+		_, err := p.S3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(p.Bucket),
+			Key:                  aws.String(manifest.Key + manifestExt),
+			Body:                 bytes.NewReader(raw),
+			ContentLength:        int64(len(raw)),
+			ContentType:          aws.String("application/json"),
+			ACL:                  types.ObjectCannedACL(p.CannedACL),
+			ServerSideEncryption: p.Encryption.ServerSideEncryption,
+			SSEKMSKeyId:          optionalString(p.Encryption.KMSKeyID),
+			SSECustomerAlgorithm: p.Encryption.sseCustomerAlgorithm(),
+			SSECustomerKey:       optionalString(p.Encryption.SSECustomerKey),
+			SSECustomerKeyMD5:    optionalString(p.Encryption.SSECustomerKeyMD5),
+			StorageClass:         p.StorageClass,
+		})
+		return err
+	})
+}
 
-	_, err = p.S3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
-		Bucket:   mpu.Upload.Bucket,
-		Key:      mpu.Upload.Key,
-		UploadId: mpu.Upload.UploadId,
-		MultipartUpload: &types.CompletedMultipartUpload{
-			Parts: mpu.Parts,
-		},
+// abandonUpload aborts the multipart upload of the object after err, so that
+// its parts don't pile up. The object goes on in the spool, when there is
+// one, and err is returned otherwise.
+func (p *Plugin) abandonUpload(ctx context.Context, mpu *MultipartUpload, err error) error {
+	p.countError()
+	p.abortUpload(ctx, mpu)
+	mpu.abandoned = true
+	mpu.Upload = nil
+	mpu.Parts = nil
+	mpu.Buffer = nil
+	if mpu.spool == nil {
+		return err
+	}
+	log.Printf("spooling %s - %v\n", mpu.Key, err)
+	return nil
+}
+
+func (p *Plugin) abortUpload(ctx context.Context, mpu *MultipartUpload) {
+	if mpu.Upload == nil {
+		return
+	}
+	err := p.retry(ctx, func() error {
+		_, err := p.S3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   mpu.Upload.Bucket,
+			Key:      mpu.Upload.Key,
+			UploadId: mpu.Upload.UploadId,
+		})
+		return err
 	})
+	if err != nil {
+		log.Printf("error aborting multipart upload of %s, its parts stay until a lifecycle rule removes them - %v\n", mpu.Key, err)
+	}
+}
+
+// drainSpool uploads the spooled objects, oldest first. After a failure, it
+// waits for the upload timeout before trying again. It returns right away
+// when they are already being uploaded.
+func (p *Plugin) drainSpool(ctx context.Context) {
+	if p.Spool == nil || !p.drainMu.TryLock() {
+		return
+	}
+	defer p.drainMu.Unlock()
+
+	if time.Now().Before(p.nextDrain) {
+		return
+	}
+	entries, err := p.Spool.pending()
+	if err != nil {
+		log.Printf("error listing the spool - %v\n", err)
+		return
+	}
+	for _, entry := range entries {
+		err := p.uploadSpooled(ctx, entry)
+		if err == nil && entry.Manifest != nil {
+			err = p.uploadManifest(ctx, entry.Manifest)
+		}
+		if err != nil {
+			p.countError()
+			log.Printf("error uploading spooled %s - %v\n", entry.Key, err)
+			p.nextDrain = time.Now().Add(p.UploadTimeout)
+			return
+		}
+		p.Spool.remove(entry)
+	}
+}
 
+func (p *Plugin) uploadSpooled(ctx context.Context, entry spoolEntry) error {
+	f, err := os.Open(p.Spool.path(entry.name, spoolDataExt))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
 	if err != nil {
-		return fmt.Errorf("error completing multipart upload, %v", err)
+		return err
 	}
 
+	err = p.retry(ctx, func() error {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := p.S3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(p.Bucket),
+			Key:                  aws.String(entry.Key),
+			Body:                 f,
+			ContentLength:        info.Size(),
+			ACL:                  types.ObjectCannedACL(p.CannedACL),
+			ServerSideEncryption: p.Encryption.ServerSideEncryption,
+			SSEKMSKeyId:          optionalString(p.Encryption.KMSKeyID),
+			SSECustomerAlgorithm: p.Encryption.sseCustomerAlgorithm(),
+			SSECustomerKey:       optionalString(p.Encryption.SSECustomerKey),
+			SSECustomerKeyMD5:    optionalString(p.Encryption.SSECustomerKeyMD5),
+			StorageClass:         p.StorageClass,
+			Tagging:              encodeTags(entry.Tags),
+			Metadata:             entry.Metadata,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	p.countWrite(int(info.Size()))
 	return nil
 }
 
-func (p *Plugin) createMultipartUpload(ctx context.Context) (*MultipartUpload, error) {
-	t := time.Now()
-	output, err := p.S3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
-		Bucket: aws.String(p.Bucket),
-		//TODO: make this configurable / as intended
-		Key: aws.String(fmt.Sprintf("%d-%d-%d-%d-%d", t.Year(), t.Month(), t.Day(), t.Hour(), t.Second())),
-		ACL: types.ObjectCannedACL(p.CannedACL),
+// tagCapture adds the capture start and end times and the packet count to the
+// tags of the object, which lifecycle rules can filter on.
+func (p *Plugin) tagCapture(ctx context.Context, mpu *MultipartUpload) error {
+	tags := make([]types.Tag, 0, len(p.Tags)+len(captureTags))
+	for key, value := range p.objectTags(mpu) {
+		tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	_, err := p.S3Client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  mpu.Upload.Bucket,
+		Key:     mpu.Upload.Key,
+		Tagging: &types.Tagging{TagSet: tags},
 	})
+	return err
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("error creating multipart upload, %v", err)
+// objectTags returns the configured tags along with the ones describing the
+// capture.
+func (p *Plugin) objectTags(mpu *MultipartUpload) map[string]string {
+	tags := make(map[string]string, len(p.Tags)+len(captureTags))
+	for key, value := range p.Tags {
+		tags[key] = value
+	}
+	tags[packetCountKey] = strconv.Itoa(mpu.Capture.PacketCount)
+	if mpu.Capture.PacketCount > 0 {
+		tags[captureStartKey] = mpu.Capture.FirstTimestamp.UTC().Format(time.RFC3339Nano)
+		tags[captureEndKey] = mpu.Capture.LastTimestamp.UTC().Format(time.RFC3339Nano)
 	}
+	return tags
+}
 
-	mpu := newMultipartUpload(output)
+// objectMetadata returns the user metadata of the object the packets start.
+// The configured metadata can't override the one describing the capture.
+func (p *Plugin) objectMetadata(b batch.Metadata) map[string]string {
+	metadata := make(map[string]string, len(p.Metadata)+5)
+	for key, value := range p.Metadata {
+		metadata[key] = value
+	}
+	for key, value := range map[string]string{
+		sensorIDKey:  b.SensorID,
+		interfaceKey: b.Interface,
+		hostnameKey:  p.Hostname,
+		filterKey:    b.Filter,
+	} {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	if b.PacketCount > 0 {
+		metadata[captureStartKey] = b.FirstTimestamp.UTC().Format(time.RFC3339Nano)
+	}
+	return metadata
+}
+
+// encodeTags encodes the tags as URL query parameters.
+func encodeTags(tags map[string]string) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+	tagging := url.Values{}
+	for key, value := range tags {
+		tagging.Set(key, value)
+	}
+	return aws.String(tagging.Encode())
+}
+
+// createMultipartUpload starts an object for the partition and time window of
+// the packets. When S3 can't be reached, the object is only spooled, if
+// there's a spool. The upload of deferred objects only starts once they are
+// complete.
+func (p *Plugin) createMultipartUpload(ctx context.Context, m batch.Metadata, window time.Time) (*MultipartUpload, error) {
+	id := uuid.New().String()
+	started := time.Now()
+	if !window.IsZero() {
+		started = window
+	}
+	mpu := &MultipartUpload{
+		Metadata: p.objectMetadata(m),
+		Parts:    make([]types.CompletedPart, 0),
+		Buffer:   make([]byte, 0),
+		Window:   window,
+		Capture:  batch.Metadata{LinkType: m.PcapLinkType()},
+		fields: KeyFields{
+			SensorID:  m.SensorID,
+			Hostname:  p.Hostname,
+			Interface: m.Interface,
+			Time:      started,
+			UUID:      id,
+			Seq:       p.seq,
+			Ext:       pcapExt,
+		},
+		sensors: make(map[string]struct{}),
+	}
+	p.seq++
+	if !p.KeyTemplate.Deferred() {
+		mpu.Key = p.KeyTemplate.Render(mpu.fields)
+	}
+
+	if p.Spool != nil {
+		var err error
+		// deferred objects left partial by a crash keep the key without
+		// the packet timestamps
+		mpu.spool, err = p.Spool.create(p.KeyTemplate.Render(mpu.fields), mpu.Metadata, id)
+		if err != nil {
+			log.Printf("error spooling %s - %v\n", mpu.fields.UUID, err)
+		}
+	}
+
+	if !p.KeyTemplate.Deferred() {
+		if err := p.startUpload(ctx, mpu); err != nil {
+			if mpu.spool == nil {
+				return nil, err
+			}
+			p.countError()
+			log.Printf("spooling %s - %v\n", mpu.Key, err)
+			mpu.abandoned = true
+		}
+	}
 
 	var pcapBuffer bytes.Buffer
 	pcapWriter := pcapgo.NewWriter(&pcapBuffer)
-	pcapWriter.WriteFileHeader(uint32(p.InputPacketLen), layers.LinkTypeEthernet)
+	pcapWriter.WriteFileHeader(uint32(p.InputPacketLen), mpu.Capture.LinkType)
 
-	mpu.appendToBuffer(pcapBuffer.Bytes())
+	mpu.append(pcapBuffer.Bytes())
 
 	return mpu, nil
 }
+
+// startUpload creates the multipart upload of the object.
+func (p *Plugin) startUpload(ctx context.Context, mpu *MultipartUpload) error {
+	err := p.retry(ctx, func() error {
+		var err error
+		mpu.Upload, err = p.S3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:               aws.String(p.Bucket),
+			Key:                  aws.String(mpu.Key),
+			ACL:                  types.ObjectCannedACL(p.CannedACL),
+			ServerSideEncryption: p.Encryption.ServerSideEncryption,
+			SSEKMSKeyId:          optionalString(p.Encryption.KMSKeyID),
+			SSECustomerAlgorithm: p.Encryption.sseCustomerAlgorithm(),
+			SSECustomerKey:       optionalString(p.Encryption.SSECustomerKey),
+			SSECustomerKeyMD5:    optionalString(p.Encryption.SSECustomerKeyMD5),
+			StorageClass:         p.StorageClass,
+			Tagging:              encodeTags(p.Tags),
+			Metadata:             mpu.Metadata,
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error creating multipart upload, %v", err)
+	}
+	return nil
+}
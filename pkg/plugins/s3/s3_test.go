@@ -0,0 +1,796 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/uuid"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/plugins/plugintest"
+)
+
+// fakeS3 is an in-process S3-compatible service, taking path-style multipart
+// uploads.
+type fakeS3 struct {
+	mu sync.Mutex
+	// objects are the completed objects, by bucket and key.
+	objects map[string][]byte
+	// uploads are the parts of the ongoing multipart uploads, by upload ID.
+	uploads map[string]map[int][]byte
+	// tags are the tags of the objects, by bucket and key.
+	tags     map[string]map[string]string
+	requests []fakeRequest
+	nextID   int
+}
+
+type fakeRequest struct {
+	method string
+	object string
+	query  url.Values
+	header http.Header
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+		tags:    make(map[string]map[string]string),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	object := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key, _ := strings.Cut(object, "/")
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+	f.requests = append(f.requests, fakeRequest{method: r.Method, object: object, query: query, header: r.Header.Clone()})
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		uploadID = fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[uploadID] = make(map[int][]byte)
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: uploadID})
+	case r.Method == http.MethodPut && uploadID != "":
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		var partNumber int
+		fmt.Sscan(query.Get("partNumber"), &partNumber)
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parts[partNumber] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, uploadID, partNumber))
+	case r.Method == http.MethodPost && uploadID != "":
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		var data []byte
+		for i := 1; i <= len(parts); i++ {
+			data = append(data, parts[i]...)
+		}
+		delete(f.uploads, uploadID)
+		f.objects[object] = data
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+		}{Bucket: bucket, Key: key})
+	case r.Method == http.MethodPut && query.Has("tagging"):
+		var tagging struct {
+			TagSet []struct {
+				Key   string
+				Value string
+			} `xml:"TagSet>Tag"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&tagging); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tags := make(map[string]string)
+		for _, tag := range tagging.TagSet {
+			tags[tag.Key] = tag.Value
+		}
+		f.tags[object] = tags
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+// pcapHeaderLen is the length of the pcap file header.
+const pcapHeaderLen = 24
+
+// dataBatch returns a batch of the sensor with raw records, for the tests
+// that don't look into the packets.
+func dataBatch(sensorID string, data string) *batch.Batch {
+	return &batch.Batch{Metadata: batch.Metadata{SensorID: sensorID}, Data: []byte(data)}
+}
+
+func TestPluginCompatibleEndpoint(t *testing.T) {
+	for _, tls := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tls=%t", tls), func(t *testing.T) {
+			fake := newFakeS3()
+			options := map[string]interface{}{
+				"bucket":          "pcaps",
+				"pathStyle":       true,
+				"accessKeyId":     "minio",
+				"secretAccessKey": "minio123",
+				"keyTemplate":     "{sensorId}/{uuid}.{ext}",
+			}
+			var server *httptest.Server
+			if tls {
+				server = httptest.NewTLSServer(fake)
+				caBundle := filepath.Join(t.TempDir(), "ca.pem")
+				cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+				if err := os.WriteFile(caBundle, cert, 0o600); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				options["caBundle"] = caBundle
+			} else {
+				server = httptest.NewServer(fake)
+			}
+			defer server.Close()
+			options["endpoint"] = server.URL
+
+			p := &Plugin{}
+			if err := plugintest.Init(p, "s3", options); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, b := range []*batch.Batch{dataBatch("a", "first"), dataBatch("b", "second"), dataBatch("a", "third")} {
+				if err := p.Write(context.Background(), b); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if err := p.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			expected := map[string]string{"a": "firstthird", "b": "second"}
+			if len(fake.objects) != len(expected) {
+				t.Fatalf("expected %d objects, got %d", len(expected), len(fake.objects))
+			}
+			for object, data := range fake.objects {
+				sensorID := strings.Split(object, "/")[1]
+				if _, err := pcapgo.NewReader(bytes.NewReader(data)); err != nil {
+					t.Fatalf("expected a pcap file in %s: %v", object, err)
+				}
+				if records := string(data[pcapHeaderLen:]); records != expected[sensorID] {
+					t.Errorf("expected %s in %s, got %s", expected[sensorID], object, records)
+				}
+			}
+			for _, request := range fake.requests {
+				if auth := request.header.Get("Authorization"); !strings.Contains(auth, "Credential=minio/") {
+					t.Errorf("expected requests signed with the static credentials, got %s", auth)
+				}
+			}
+		})
+	}
+}
+
+func TestNewClientIncompleteCredentials(t *testing.T) {
+	_, err := newClient(context.Background(), Config{Endpoint: "http://127.0.0.1:9000", AccessKeyID: "minio"})
+	if !errors.Is(err, ErrIncompleteCredentials) {
+		t.Errorf("expected %v, got %v", ErrIncompleteCredentials, err)
+	}
+}
+
+func TestPluginObjectProperties(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	key := bytes.Repeat([]byte{0x42}, sseCustomerKeyLen)
+	p := &Plugin{}
+	err := plugintest.Init(p, "s3", map[string]interface{}{
+		"endpoint":        server.URL,
+		"pathStyle":       true,
+		"bucket":          "pcaps",
+		"accessKeyId":     "minio",
+		"secretAccessKey": "minio123",
+		"sseCustomerKey":  base64.StdEncoding.EncodeToString(key),
+		"storageClass":    "STANDARD_IA",
+		"tags":            map[string]string{"retention": "30d"},
+		"metadata":        map[string]string{"team": "netops", "sensor-id": "spoofed"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Date(2024, 5, 3, 12, 7, 9, 0, time.UTC)
+	for i, data := range []string{"first", "second"} {
+		b := dataBatch("sensor-1", data)
+		b.Interface = "eth0"
+		b.Filter = "not ( dst host 10.0.0.1 and port 8081 )"
+		b.FirstTimestamp = start.Add(time.Duration(i) * time.Minute)
+		b.LastTimestamp = b.FirstTimestamp.Add(time.Second)
+		b.PacketCount = 2
+		if err := p.Write(context.Background(), b); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sum := md5.Sum(key)
+	keyMD5 := base64.StdEncoding.EncodeToString(sum[:])
+	parts := 0
+	for _, request := range fake.requests {
+		switch {
+		case request.method == http.MethodPost && request.query.Has("uploads"):
+			for header, expected := range map[string]string{
+				"X-Amz-Storage-Class":                           "STANDARD_IA",
+				"X-Amz-Tagging":                                 "retention=30d",
+				"X-Amz-Meta-Team":                               "netops",
+				"X-Amz-Meta-Sensor-Id":                          "sensor-1",
+				"X-Amz-Meta-Interface":                          "eth0",
+				"X-Amz-Meta-Bpf-Filter":                         "not ( dst host 10.0.0.1 and port 8081 )",
+				"X-Amz-Meta-Capture-Start":                      "2024-05-03T12:07:09Z",
+				"X-Amz-Meta-Hostname":                           p.Hostname,
+				"X-Amz-Server-Side-Encryption-Customer-Key-Md5": keyMD5,
+			} {
+				if got := request.header.Get(header); got != expected {
+					t.Errorf("expected %s: %s, got %s", header, expected, got)
+				}
+			}
+		case request.method == http.MethodPut && request.query.Has("partNumber"):
+			parts++
+			if got := request.header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm"); got != sseCustomerAlgorithm {
+				t.Errorf("expected the parts to be encrypted with SSE-C, got algorithm %s", got)
+			}
+		}
+	}
+	if parts != 1 {
+		t.Errorf("expected 1 part, got %d", parts)
+	}
+
+	if len(fake.tags) != 1 {
+		t.Fatalf("expected 1 tagged object, got %d", len(fake.tags))
+	}
+	for _, tags := range fake.tags {
+		expected := map[string]string{
+			"retention":     "30d",
+			"capture-start": "2024-05-03T12:07:09Z",
+			"capture-end":   "2024-05-03T12:08:10Z",
+			"packet-count":  "4",
+		}
+		if !reflect.DeepEqual(tags, expected) {
+			t.Errorf("expected tags %v, got %v", expected, tags)
+		}
+	}
+}
+
+func TestNewEncryption(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, sseCustomerKeyLen))
+
+	for _, tt := range []struct {
+		testName      string
+		config        Config
+		expected      types.ServerSideEncryption
+		expectedError error
+	}{
+		{testName: "none"},
+		{testName: "sse-s3", config: Config{ServerSideEncryption: "AES256"}, expected: types.ServerSideEncryptionAes256},
+		{testName: "kms key implies sse-kms", config: Config{KMSKeyID: "alias/pcaps"}, expected: types.ServerSideEncryptionAwsKms},
+		{testName: "kms key with sse-s3", config: Config{ServerSideEncryption: "AES256", KMSKeyID: "alias/pcaps"}, expectedError: ErrKMSKeyWithoutKMS},
+		{testName: "sse-c", config: Config{SSECustomerKey: key}},
+		{testName: "sse-c with sse-s3", config: Config{ServerSideEncryption: "AES256", SSECustomerKey: key}, expectedError: ErrConflictingEncryption},
+		{testName: "short sse-c key", config: Config{SSECustomerKey: "c2hvcnQ="}, expectedError: ErrInvalidSSECustomerKey},
+	} {
+		t.Run(tt.testName, func(t *testing.T) {
+			encryption, err := newEncryption(tt.config)
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("expected error %v, got %v", tt.expectedError, err)
+			}
+			if encryption.ServerSideEncryption != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, encryption.ServerSideEncryption)
+			}
+		})
+	}
+
+	if _, err := newEncryption(Config{ServerSideEncryption: "rot13"}); err == nil {
+		t.Error("expected an error for an unknown encryption")
+	}
+}
+
+var errOutage = errors.New("dial tcp: connection refused")
+
+// responseError is an error response of S3.
+type responseError int
+
+func (e responseError) Error() string {
+	return fmt.Sprintf("status code %d", int(e))
+}
+
+func (e responseError) HTTPStatusCode() int {
+	return int(e)
+}
+
+// fakeClient is an S3 client keeping the objects in memory, which fails the
+// given number of calls of every operation.
+type fakeClient struct {
+	failures map[string]int
+	err      error
+	calls    map[string]int
+	objects  map[string][]byte
+	tags     map[string]map[string]string
+	uploads  map[string]map[int32][]byte
+	aborted  int
+	nextID   int
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		failures: make(map[string]int),
+		err:      errOutage,
+		calls:    make(map[string]int),
+		objects:  make(map[string][]byte),
+		tags:     make(map[string]map[string]string),
+		uploads:  make(map[string]map[int32][]byte),
+	}
+}
+
+func (c *fakeClient) call(op string) error {
+	c.calls[op]++
+	if c.failures[op] != 0 {
+		// negative failures never end
+		c.failures[op]--
+		return c.err
+	}
+	return nil
+}
+
+func (c *fakeClient) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	if err := c.call("create"); err != nil {
+		return nil, err
+	}
+	c.nextID++
+	uploadID := fmt.Sprintf("upload-%d", c.nextID)
+	c.uploads[uploadID] = make(map[int32][]byte)
+	return &s3.CreateMultipartUploadOutput{Bucket: params.Bucket, Key: params.Key, UploadId: aws.String(uploadID)}, nil
+}
+
+func (c *fakeClient) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if err := c.call("part"); err != nil {
+		return nil, err
+	}
+	data, _ := io.ReadAll(params.Body)
+	c.uploads[*params.UploadId][params.PartNumber] = data
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("%d", params.PartNumber))}, nil
+}
+
+func (c *fakeClient) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	if err := c.call("complete"); err != nil {
+		return nil, err
+	}
+	var data []byte
+	for _, part := range params.MultipartUpload.Parts {
+		data = append(data, c.uploads[*params.UploadId][part.PartNumber]...)
+	}
+	delete(c.uploads, *params.UploadId)
+	c.objects[*params.Key] = data
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (c *fakeClient) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	if err := c.call("abort"); err != nil {
+		return nil, err
+	}
+	delete(c.uploads, *params.UploadId)
+	c.aborted++
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (c *fakeClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if err := c.call("put"); err != nil {
+		return nil, err
+	}
+	data, _ := io.ReadAll(params.Body)
+	c.objects[*params.Key] = data
+	tags, _ := url.ParseQuery(aws.ToString(params.Tagging))
+	c.tags[*params.Key] = make(map[string]string)
+	for key := range tags {
+		c.tags[*params.Key][key] = tags.Get(key)
+	}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (c *fakeClient) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	if err := c.call("tagging"); err != nil {
+		return nil, err
+	}
+	c.tags[*params.Key] = make(map[string]string)
+	for _, tag := range params.Tagging.TagSet {
+		c.tags[*params.Key][*tag.Key] = *tag.Value
+	}
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+// newTestPlugin returns a plugin using a fake client, which retries once and
+// uploads parts of 8 bytes, which the fake client takes unlike S3.
+func newTestPlugin(t *testing.T, options map[string]interface{}) (*Plugin, *fakeClient) {
+	t.Helper()
+	for key, value := range map[string]interface{}{
+		"bucket":          "pcaps",
+		"region":          "eu-west-1",
+		"accessKeyId":     "key",
+		"secretAccessKey": "secret",
+		"keyTemplate":     "{sensorId}-{uuid}.{ext}",
+		"maxRetries":      1,
+		"retryBackoff":    "1ms",
+	} {
+		if _, ok := options[key]; !ok {
+			options[key] = value
+		}
+	}
+	p := &Plugin{}
+	plugintest.NewPlugin(t, p, "s3", options)
+	p.UploadChunkSize = 8
+	client := newFakeClient()
+	p.S3Client = client
+	return p, client
+}
+
+func TestPluginUploadChunkSize(t *testing.T) {
+	options := map[string]interface{}{
+		"bucket":          "pcaps",
+		"region":          "eu-west-1",
+		"accessKeyId":     "key",
+		"secretAccessKey": "secret",
+		"uploadChunkSize": "1MB",
+	}
+	if err := plugintest.Init(&Plugin{}, "s3", options); !errors.Is(err, ErrUploadChunkSizeTooSmall) {
+		t.Errorf("expected %v, got %v", ErrUploadChunkSizeTooSmall, err)
+	}
+}
+
+// expectObjects checks the records of the objects, by sensor ID. Manifests
+// are left out.
+func expectObjects(t *testing.T, objects map[string][]byte, expected map[string]string) {
+	t.Helper()
+	got := make(map[string]string)
+	for key, data := range objects {
+		if strings.HasSuffix(key, manifestExt) {
+			continue
+		}
+		if len(data) < pcapHeaderLen {
+			t.Fatalf("expected a pcap file in %s", key)
+		}
+		sensorID, _, _ := strings.Cut(key, "-")
+		got[sensorID] = string(data[pcapHeaderLen:])
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected objects %v, got %v", expected, got)
+	}
+}
+
+func TestPluginRetries(t *testing.T) {
+	p, client := newTestPlugin(t, map[string]interface{}{})
+	client.failures["create"] = 1
+	client.failures["part"] = 1
+	client.failures["complete"] = 1
+
+	if err := p.Write(context.Background(), dataBatch("a", "records")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectObjects(t, client.objects, map[string]string{"a": "records"})
+	if client.calls["create"] != 2 || client.calls["complete"] != 2 || client.aborted != 0 {
+		t.Errorf("unexpected calls %v", client.calls)
+	}
+	if stats := p.Stats(); stats.Errors != 0 {
+		t.Errorf("expected no errors, got %+v", stats)
+	}
+}
+
+func TestPluginAbortsFailedUploads(t *testing.T) {
+	for _, tt := range []struct {
+		testName string
+		err      error
+		calls    int
+	}{
+		{testName: "outage", err: errOutage, calls: 2},
+		{testName: "access denied", err: responseError(403), calls: 1},
+	} {
+		t.Run(tt.testName, func(t *testing.T) {
+			p, client := newTestPlugin(t, map[string]interface{}{})
+			client.err = tt.err
+			client.failures["part"] = -1
+
+			if err := p.Write(context.Background(), dataBatch("a", "lost")); err == nil {
+				t.Fatal("expected an error")
+			}
+			if client.calls["part"] != tt.calls || client.aborted != 1 || len(client.uploads) != 0 {
+				t.Errorf("expected the upload to be aborted after %d attempts, got calls %v", tt.calls, client.calls)
+			}
+
+			// the next batch starts a new upload
+			client.failures["part"] = 0
+			if err := p.Write(context.Background(), dataBatch("a", "uploaded")); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := p.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expectObjects(t, client.objects, map[string]string{"a": "uploaded"})
+		})
+	}
+}
+
+// unlockedClient checks that the plugin isn't locked while it completes the
+// uploads, so that the batches don't wait for it.
+type unlockedClient struct {
+	*fakeClient
+	p      *Plugin
+	locked bool
+}
+
+func (c *unlockedClient) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	if c.p.mu.TryLock() {
+		c.p.mu.Unlock()
+	} else {
+		c.locked = true
+	}
+	return c.fakeClient.CompleteMultipartUpload(ctx, params, optFns...)
+}
+
+func TestPluginIdleTimeout(t *testing.T) {
+	p, client := newTestPlugin(t, map[string]interface{}{})
+	unlocked := &unlockedClient{fakeClient: client, p: p}
+	p.S3Client = unlocked
+
+	// no empty uploads
+	p.onUploadTimeout()
+	if len(client.calls) != 0 {
+		t.Errorf("unexpected calls %v", client.calls)
+	}
+
+	if err := p.Write(context.Background(), dataBatch("a", "records")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.onUploadTimeout()
+	expectObjects(t, client.objects, map[string]string{"a": "records"})
+	if unlocked.locked {
+		t.Errorf("expected the upload to be completed without the lock")
+	}
+}
+
+func TestPluginLinkType(t *testing.T) {
+	p, client := newTestPlugin(t, map[string]interface{}{})
+	sll := dataBatch("a", "sll")
+	sll.LinkType = layers.LinkTypeLinuxSLL
+	for _, b := range []*batch.Batch{dataBatch("a", "first"), sll, dataBatch("a", "second")} {
+		if err := p.Write(context.Background(), b); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// every change of link type starts a new object
+	var got []string
+	for key, data := range client.objects {
+		if strings.HasSuffix(key, manifestExt) {
+			continue
+		}
+		reader, err := pcapgo.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("expected a pcap file in %s: %v", key, err)
+		}
+		got = append(got, fmt.Sprintf("%v %s", reader.LinkType(), data[pcapHeaderLen:]))
+	}
+	sort.Strings(got)
+	expected := []string{"Ethernet first", "Ethernet second", "Linux SLL sll"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected objects %v, got %v", expected, got)
+	}
+}
+
+func TestPluginSpool(t *testing.T) {
+	spoolDir := t.TempDir()
+	p, client := newTestPlugin(t, map[string]interface{}{
+		"spoolDir": spoolDir,
+		"tags":     map[string]string{"retention": "30d"},
+		"manifest": true,
+	})
+
+	// a is uploaded until the outage, b starts during it
+	if err := p.Write(context.Background(), dataBatch("a", "before")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client.failures["create"] = -1
+	client.failures["part"] = -1
+	for _, b := range []*batch.Batch{dataBatch("a", "during"), dataBatch("b", "during")} {
+		b.PacketCount = 1
+		if err := p.Write(context.Background(), b); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.aborted != 1 {
+		t.Errorf("expected the upload of a to be aborted, got calls %v", client.calls)
+	}
+	if len(client.objects) != 0 {
+		t.Fatalf("expected no objects during the outage, got %d", len(client.objects))
+	}
+
+	// the spooled objects are uploaded by the next plugin, once S3 is back
+	p, client = newTestPlugin(t, map[string]interface{}{"spoolDir": spoolDir})
+	if err := p.Write(context.Background(), dataBatch("c", "after")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectObjects(t, client.objects, map[string]string{"a": "beforeduring", "b": "during", "c": "after"})
+	// the manifests of the spooled objects
+	if len(client.objects) != 5 {
+		t.Errorf("expected 5 objects, got %d", len(client.objects))
+	}
+	for key, tags := range client.tags {
+		if strings.HasPrefix(key, "b-") && strings.HasSuffix(key, pcapExt) && (tags["retention"] != "30d" || tags["packet-count"] != "1") {
+			t.Errorf("unexpected tags of %s: %v", key, tags)
+		}
+	}
+	if files, _ := os.ReadDir(spoolDir); len(files) != 0 {
+		t.Errorf("expected an empty spool, got %d files", len(files))
+	}
+}
+
+func TestPluginRotation(t *testing.T) {
+	p, client := newTestPlugin(t, map[string]interface{}{
+		"keyTemplate":    "{sensorId}/{yyyy}{MM}{dd}T{HH}{mm}/{firstPacket}-{lastPacket}-{uuid}.{ext}",
+		"rotateInterval": "5m",
+		"manifest":       true,
+	})
+	unlocked := &unlockedClient{fakeClient: client, p: p}
+	p.S3Client = unlocked
+
+	start := time.Date(2024, 5, 3, 12, 3, 0, 0, time.UTC)
+	if err := p.Write(context.Background(), plugintest.Batch(t, "a", start, 3, time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the last window is over, even though no packets follow, the first one
+	// was completed by the batch
+	unlocked.locked = false
+	p.onRotate()
+	if unlocked.locked {
+		t.Errorf("expected the last upload to be completed without the lock")
+	}
+
+	objects := make(map[string]int)
+	manifests := make(map[string]Manifest)
+	for key, data := range client.objects {
+		if strings.HasSuffix(key, manifestExt) {
+			var manifest Manifest
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			manifests[manifest.Key] = manifest
+			continue
+		}
+		objects[key] = len(data)
+	}
+
+	expected := map[string]struct {
+		packets int
+		window  time.Time
+	}{
+		"a/20240503T1200/20240503T120300.000000Z-20240503T120400.000000Z": {2, start.Add(-3 * time.Minute)},
+		"a/20240503T1205/20240503T120500.000000Z-20240503T120500.000000Z": {1, start.Add(2 * time.Minute)},
+	}
+	if len(objects) != len(expected) || len(manifests) != len(expected) {
+		t.Fatalf("expected %d objects with manifests, got %v and %v", len(expected), objects, manifests)
+	}
+	for key, size := range objects {
+		// without the UUID and extension
+		prefix := key[:len(key)-len("-"+uuid.Nil.String()+".pcap")]
+		e, ok := expected[prefix]
+		if !ok {
+			t.Errorf("unexpected object %s", key)
+			continue
+		}
+		manifest := manifests[key]
+		if manifest.PacketCount != e.packets || manifest.Bytes != size || !reflect.DeepEqual(manifest.Sensors, []string{"a"}) {
+			t.Errorf("unexpected manifest %+v of %s", manifest, key)
+		}
+		if manifest.WindowStart == nil || !manifest.WindowStart.Equal(e.window) || !manifest.WindowEnd.Equal(e.window.Add(5*time.Minute)) {
+			t.Errorf("unexpected window in manifest %+v of %s", manifest, key)
+		}
+		if size != pcapHeaderLen+e.packets*(batch.RecordHeaderLen+plugintest.PacketLen) {
+			t.Errorf("unexpected size %d of %s", size, key)
+		}
+	}
+}
+
+func TestPluginLatePackets(t *testing.T) {
+	p, client := newTestPlugin(t, map[string]interface{}{
+		"keyTemplate":    "{sensorId}/{yyyy}{MM}{dd}T{HH}{mm}/{firstPacket}-{lastPacket}-{uuid}.{ext}",
+		"rotateInterval": "5m",
+	})
+
+	window := time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)
+	for _, at := range []time.Duration{
+		3 * time.Minute,
+		5*time.Minute + 5*time.Second,
+		// late, but the window isn't over by the time of the packets
+		4*time.Minute + 59*time.Second,
+		// the first window is over
+		6 * time.Minute,
+		4*time.Minute + 50*time.Second,
+	} {
+		if err := p.Write(context.Background(), plugintest.Batch(t, "a", window.Add(at), 1, 0)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	p.onRotate()
+
+	var got []string
+	for key, data := range client.objects {
+		// without the UUID and extension
+		prefix := key[:len(key)-len("-"+uuid.Nil.String()+".pcap")]
+		got = append(got, fmt.Sprintf("%s %d", prefix, (len(data)-pcapHeaderLen)/(batch.RecordHeaderLen+plugintest.PacketLen)))
+	}
+	sort.Strings(got)
+	expected := []string{
+		"a/20240503T1200/20240503T120300.000000Z-20240503T120459.000000Z 2",
+		"a/20240503T1200/20240503T120450.000000Z-20240503T120450.000000Z 1",
+		"a/20240503T1205/20240503T120505.000000Z-20240503T120600.000000Z 2",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected objects %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,181 @@
+package s3
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	spoolDataExt    = ".pcap"
+	spoolPartialExt = ".pcap.part"
+	spoolEntryExt   = ".json"
+)
+
+// Spool keeps the objects on the local disk while they are uploaded, so that
+// they can be uploaded as a whole once S3 is back when their multipart
+// upload fails. Every object is a pcap file and a JSON file with its key,
+// metadata and tags. The pcap files of the objects which are still written
+// to have a .part extension.
+type Spool struct {
+	dir     string
+	maxSize int64
+}
+
+// spoolEntry describes a spooled object. Deferred objects get their final key
+// once they are complete.
+type spoolEntry struct {
+	Key      string            `json:"key"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Manifest *Manifest         `json:"manifest,omitempty"`
+
+	name string
+}
+
+// spoolFile is the pcap file of an object which is still written to.
+type spoolFile struct {
+	*os.File
+	entry spoolEntry
+}
+
+// NewSpool opens the spool in dir, creating it if needed. Objects left
+// partial by a previous run are kept with the data written so far.
+func NewSpool(dir string, maxSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create the spool directory: %w", err)
+	}
+	partial, err := filepath.Glob(filepath.Join(dir, "*"+spoolPartialExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range partial {
+		if err := os.Rename(path, strings.TrimSuffix(path, spoolPartialExt)+spoolDataExt); err != nil {
+			return nil, err
+		}
+	}
+	return &Spool{dir: dir, maxSize: maxSize}, nil
+}
+
+// create starts spooling an object. The names start with the time, so that
+// the objects are uploaded in order.
+func (s *Spool) create(key string, metadata map[string]string, id string) (*spoolFile, error) {
+	s.trim()
+	entry := spoolEntry{
+		Key:      key,
+		Metadata: metadata,
+		name:     fmt.Sprintf("%019d-%s", time.Now().UnixNano(), id),
+	}
+	if err := s.writeEntry(entry); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.path(entry.name, spoolPartialExt), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		os.Remove(s.path(entry.name, spoolEntryExt))
+		return nil, err
+	}
+	return &spoolFile{File: f, entry: entry}, nil
+}
+
+// seal keeps a complete object in the spool, until it's uploaded.
+func (s *Spool) seal(f *spoolFile, key string, tags map[string]string, manifest *Manifest) error {
+	f.entry.Key = key
+	f.entry.Tags = tags
+	f.entry.Manifest = manifest
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := s.writeEntry(f.entry); err != nil {
+		return err
+	}
+	return os.Rename(s.path(f.entry.name, spoolPartialExt), s.path(f.entry.name, spoolDataExt))
+}
+
+// discard removes an object which got uploaded.
+func (s *Spool) discard(f *spoolFile) {
+	f.Close()
+	s.remove(f.entry)
+}
+
+func (s *Spool) remove(entry spoolEntry) {
+	os.Remove(s.path(entry.name, spoolDataExt))
+	os.Remove(s.path(entry.name, spoolPartialExt))
+	os.Remove(s.path(entry.name, spoolEntryExt))
+}
+
+// pending returns the complete objects, oldest first.
+func (s *Spool) pending() ([]spoolEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolDataExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	entries := make([]spoolEntry, 0, len(paths))
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), spoolDataExt)
+		raw, err := os.ReadFile(s.path(name, spoolEntryExt))
+		if err != nil {
+			log.Printf("Discarding spooled object %s without description - %v\n", name, err)
+			os.Remove(path)
+			continue
+		}
+		entry := spoolEntry{name: name}
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			log.Printf("Discarding spooled object %s with invalid description - %v\n", name, err)
+			s.remove(entry)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// trim discards the oldest complete objects until the spool is within its
+// maximum size.
+func (s *Spool) trim() {
+	entries, err := s.pending()
+	if err != nil {
+		return
+	}
+	size := s.size()
+	for _, entry := range entries {
+		if size <= s.maxSize {
+			return
+		}
+		info, err := os.Stat(s.path(entry.name, spoolDataExt))
+		if err != nil {
+			continue
+		}
+		log.Printf("Spool is full, discarding %s\n", entry.Key)
+		s.remove(entry)
+		size -= info.Size()
+	}
+}
+
+func (s *Spool) size() int64 {
+	var size int64
+	files, _ := os.ReadDir(s.dir)
+	for _, file := range files {
+		if info, err := file.Info(); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func (s *Spool) writeEntry(entry spoolEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(entry.name, spoolEntryExt), raw, 0o600)
+}
+
+func (s *Spool) path(name string, ext string) string {
+	return filepath.Join(s.dir, name+ext)
+}
@@ -0,0 +1,57 @@
+package replay
+
+import (
+	"context"
+	"time"
+)
+
+// Clock paces packets according to their timestamps, at Speed times the
+// original speed, and no faster than Rate packets per second. A Speed of 0
+// doesn't follow the timestamps, and a Rate of 0 doesn't limit the rate.
+type Clock struct {
+	Speed float64
+	Rate  float64
+
+	start      time.Time
+	firstPktTs time.Time
+	// next is when the next packet is due at the rate limit.
+	next time.Time
+}
+
+// Wait blocks until the packet with the given timestamp is due.
+func (c *Clock) Wait(ctx context.Context, ts time.Time) error {
+	var due time.Time
+	if c.Speed != 0 {
+		if c.start.IsZero() {
+			c.start = time.Now()
+			c.firstPktTs = ts
+		} else {
+			due = c.start.Add(time.Duration(float64(ts.Sub(c.firstPktTs)) / c.Speed))
+		}
+	}
+	if c.Rate > 0 {
+		interval := time.Duration(float64(time.Second) / c.Rate)
+		// packets which fell behind catch up, but without bursting after
+		// a pause
+		if now := time.Now(); c.next.Before(now.Add(-interval)) {
+			c.next = now
+		}
+		if c.next.After(due) {
+			due = c.next
+		}
+		defer func() { c.next = due.Add(interval) }()
+	}
+
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,60 @@
+package replay
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	ts := time.Unix(1650000000, 0)
+	clock := Clock{Speed: 10}
+
+	start := time.Now()
+	for _, offset := range []time.Duration{0, 100 * time.Millisecond, 500 * time.Millisecond} {
+		if err := clock.Wait(context.Background(), ts.Add(offset)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected 500ms of packets to be replayed in ~50ms at 10x speed, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := clock.Wait(ctx, ts.Add(time.Hour)); err == nil {
+		t.Error("expected an error when the context is done")
+	}
+}
+
+func TestClockRate(t *testing.T) {
+	ts := time.Unix(1650000000, 0)
+	tests := []struct {
+		name  string
+		clock Clock
+		step  time.Duration
+	}{
+		{
+			name:  "as fast as possible",
+			clock: Clock{Rate: 100},
+		},
+		{
+			name:  "faster than the timestamps",
+			clock: Clock{Speed: 1, Rate: 100},
+			step:  time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			for i := 0; i < 6; i++ {
+				if err := tt.clock.Wait(context.Background(), ts.Add(time.Duration(i)*tt.step)); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+				t.Errorf("expected 6 packets to be replayed in ~50ms at 100 packets per second, took %v", elapsed)
+			}
+		})
+	}
+}
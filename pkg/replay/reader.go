@@ -0,0 +1,182 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/s2"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/file"
+)
+
+const (
+	// frameHeaderLen is the length of the header of every frame of the
+	// PacketStreamer stream: the magic and the length of the payload.
+	frameHeaderLen = 8
+	// linkTypeLen is the length of the payload of the link type frames.
+	linkTypeLen = 4
+)
+
+var (
+	pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+	ErrInvalidFrame = errors.New("invalid PacketStreamer frame")
+)
+
+// Reader reads packets from a capture. The returned data is only valid until
+// the next call. ReadPacket returns io.EOF at the end of the capture.
+type Reader interface {
+	ReadPacket() ([]byte, gopacket.CaptureInfo, layers.LinkType, error)
+}
+
+// NewReader returns a reader for a pcap (optionally gzipped) or pcapng file,
+// or a PacketStreamer stream, depending on the magic at the start of r.
+func NewReader(r io.Reader) (Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the capture header: %w", err)
+	}
+
+	switch {
+	case bytes.Equal(magic, pcapngMagic):
+		reader, err := pcapgo.NewNgReader(br, pcapgo.NgReaderOptions{
+			WantMixedLinkType:  true,
+			SkipUnknownVersion: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return pcapngReader{reader}, nil
+	case bytes.Equal(magic, file.Header), bytes.Equal(magic, file.SensorHeader), bytes.Equal(magic, file.LinkTypeHeader):
+		return &streamReader{r: br, linkType: layers.LinkTypeEthernet}, nil
+	default:
+		reader, err := pcapgo.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return pcapReader{reader}, nil
+	}
+}
+
+type pcapReader struct {
+	*pcapgo.Reader
+}
+
+func (r pcapReader) ReadPacket() ([]byte, gopacket.CaptureInfo, layers.LinkType, error) {
+	data, ci, err := r.ZeroCopyReadPacketData()
+	return data, ci, r.LinkType(), err
+}
+
+type pcapngReader struct {
+	*pcapgo.NgReader
+}
+
+func (r pcapngReader) ReadPacket() ([]byte, gopacket.CaptureInfo, layers.LinkType, error) {
+	data, ci, err := r.ZeroCopyReadPacketData()
+	if err != nil {
+		return nil, ci, 0, err
+	}
+	// with mixed link types, the link type of every packet is passed in the
+	// ancillary data
+	linkType, _ := ci.AncillaryData[0].(layers.LinkType)
+	return data, ci, linkType, nil
+}
+
+// streamReader reads the frames sent by sensors to receivers, each of which
+// holds S2 compressed pcap records of the packets of the link type announced
+// by the last link type frame. The frames carrying sensor IDs are skipped.
+type streamReader struct {
+	r          *bufio.Reader
+	linkType   layers.LinkType
+	header     [frameHeaderLen]byte
+	compressed []byte
+	decoded    []byte
+	records    []byte
+}
+
+func (r *streamReader) ReadPacket() ([]byte, gopacket.CaptureInfo, layers.LinkType, error) {
+	for len(r.records) == 0 {
+		if err := r.readFrame(); err != nil {
+			return nil, gopacket.CaptureInfo{}, 0, err
+		}
+	}
+	if len(r.records) < batch.RecordHeaderLen {
+		return nil, gopacket.CaptureInfo{}, 0, fmt.Errorf("%w: truncated pcap record", ErrInvalidFrame)
+	}
+
+	var ci gopacket.CaptureInfo
+	ci.Timestamp = time.Unix(int64(binary.LittleEndian.Uint32(r.records[0:4])),
+		int64(binary.LittleEndian.Uint32(r.records[4:8]))*int64(time.Microsecond)).UTC()
+	ci.CaptureLength = int(binary.LittleEndian.Uint32(r.records[8:12]))
+	ci.Length = int(binary.LittleEndian.Uint32(r.records[12:16]))
+	end := batch.RecordHeaderLen + ci.CaptureLength
+	if len(r.records) < end {
+		return nil, gopacket.CaptureInfo{}, 0, fmt.Errorf("%w: truncated pcap record", ErrInvalidFrame)
+	}
+	data := r.records[batch.RecordHeaderLen:end]
+	r.records = r.records[end:]
+	return data, ci, r.linkType, nil
+}
+
+func (r *streamReader) readFrame() error {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: truncated header", ErrInvalidFrame)
+		}
+		return err
+	}
+	magic := r.header[:len(file.Header)]
+	payloadLen := int(binary.LittleEndian.Uint32(r.header[len(file.Header):]))
+	if bytes.Equal(magic, file.SensorHeader) {
+		// the packets of all the sensors are replayed alike
+		if _, err := r.r.Discard(payloadLen); err != nil {
+			return fmt.Errorf("%w: truncated sensor ID: %v", ErrInvalidFrame, err)
+		}
+		return nil
+	}
+	if bytes.Equal(magic, file.LinkTypeHeader) {
+		if payloadLen != linkTypeLen {
+			return fmt.Errorf("%w: invalid link type length %d", ErrInvalidFrame, payloadLen)
+		}
+		var linkType [linkTypeLen]byte
+		if _, err := io.ReadFull(r.r, linkType[:]); err != nil {
+			return fmt.Errorf("%w: truncated link type: %v", ErrInvalidFrame, err)
+		}
+		value := binary.LittleEndian.Uint32(linkType[:])
+		if value > math.MaxUint8 {
+			return fmt.Errorf("%w: unsupported link type %d", ErrInvalidFrame, value)
+		}
+		r.linkType = layers.LinkType(value)
+		return nil
+	}
+	if !bytes.Equal(magic, file.Header) {
+		return fmt.Errorf("%w: unexpected magic %x", ErrInvalidFrame, magic)
+	}
+
+	if cap(r.compressed) < payloadLen {
+		r.compressed = make([]byte, payloadLen)
+	}
+	r.compressed = r.compressed[:payloadLen]
+	if _, err := io.ReadFull(r.r, r.compressed); err != nil {
+		return fmt.Errorf("%w: truncated payload: %v", ErrInvalidFrame, err)
+	}
+
+	decoded, err := s2.Decode(r.decoded[:cap(r.decoded)], r.compressed)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidFrame, err)
+	}
+	r.decoded = decoded
+	r.records = decoded
+	return nil
+}
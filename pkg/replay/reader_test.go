@@ -0,0 +1,220 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/s2"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/file"
+)
+
+type testPacket struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+func testPackets(n int) []testPacket {
+	ts := time.Unix(1650000000, 0).UTC()
+	packets := make([]testPacket, 0, n)
+	for i := 0; i < n; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 60+i)
+		packets = append(packets, testPacket{
+			ci: gopacket.CaptureInfo{
+				Timestamp:     ts.Add(time.Duration(i) * 10 * time.Millisecond),
+				CaptureLength: len(data),
+				Length:        len(data),
+			},
+			data: data,
+		})
+	}
+	return packets
+}
+
+func pcapFile(t *testing.T, packets []testPacket) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := pcapgo.NewWriter(&buf)
+	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, p := range packets {
+		if err := writer.WritePacket(p.ci, p.data); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func pcapngFile(t *testing.T, packets []testPacket) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer, err := pcapgo.NewNgWriter(&buf, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, p := range packets {
+		if err := writer.WritePacket(p.ci, p.data); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// streamFile frames the packets the way sensors do, with the given number of
+// packets per frame.
+func streamFile(t *testing.T, packets []testPacket, perFrame int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for len(packets) > 0 {
+		n := perFrame
+		if n > len(packets) {
+			n = len(packets)
+		}
+		b := &batch.Batch{}
+		for _, p := range packets[:n] {
+			b.AppendPacket(p.ci, p.data)
+		}
+		packets = packets[n:]
+
+		payload := s2.Encode(nil, b.Data)
+		buf.Write(file.Header)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(payload)))
+		buf.Write(payload)
+	}
+	return buf.Bytes()
+}
+
+// sensorFrame returns the frame announcing the sensor of the following
+// frames.
+func sensorFrame(sensorID string) []byte {
+	var buf bytes.Buffer
+	buf.Write(file.SensorHeader)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(sensorID)))
+	buf.WriteString(sensorID)
+	return buf.Bytes()
+}
+
+// linkTypeFrame returns the frame announcing the link type of the packets of
+// the following frames.
+func linkTypeFrame(linkType layers.LinkType) []byte {
+	var buf bytes.Buffer
+	buf.Write(file.LinkTypeHeader)
+	binary.Write(&buf, binary.LittleEndian, uint32(4))
+	binary.Write(&buf, binary.LittleEndian, uint32(linkType))
+	return buf.Bytes()
+}
+
+func TestNewReader(t *testing.T) {
+	packets := testPackets(10)
+	for _, tt := range []struct {
+		TestName string
+		Input    []byte
+	}{
+		{TestName: "pcap", Input: pcapFile(t, packets)},
+		{TestName: "pcapng", Input: pcapngFile(t, packets)},
+		{TestName: "stream", Input: streamFile(t, packets, 3)},
+		{TestName: "stream with sensor IDs", Input: bytes.Join([][]byte{
+			sensorFrame("sensor-a"), streamFile(t, packets[:4], 3),
+			sensorFrame("sensor-b"), streamFile(t, packets[4:], 3),
+		}, nil)},
+	} {
+		t.Run(tt.TestName, func(t *testing.T) {
+			reader, err := NewReader(bytes.NewReader(tt.Input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, p := range packets {
+				data, ci, linkType, err := reader.ReadPacket()
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !bytes.Equal(data, p.data) {
+					t.Errorf("expected packet %x, got %x", p.data, data)
+				}
+				if !ci.Timestamp.Equal(p.ci.Timestamp) || ci.CaptureLength != p.ci.CaptureLength || ci.Length != p.ci.Length {
+					t.Errorf("expected capture info %+v, got %+v", p.ci, ci)
+				}
+				if linkType != layers.LinkTypeEthernet {
+					t.Errorf("expected link type %v, got %v", layers.LinkTypeEthernet, linkType)
+				}
+			}
+			if _, _, _, err := reader.ReadPacket(); !errors.Is(err, io.EOF) {
+				t.Errorf("expected EOF, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStreamReaderLinkType(t *testing.T) {
+	packets := testPackets(6)
+	input := bytes.Join([][]byte{
+		streamFile(t, packets[:2], 2),
+		linkTypeFrame(layers.LinkTypeLinuxSLL), streamFile(t, packets[2:4], 2),
+		linkTypeFrame(layers.LinkTypeEthernet), streamFile(t, packets[4:], 2),
+	}, nil)
+	reader, err := NewReader(bytes.NewReader(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []layers.LinkType{
+		layers.LinkTypeEthernet, layers.LinkTypeEthernet,
+		layers.LinkTypeLinuxSLL, layers.LinkTypeLinuxSLL,
+		layers.LinkTypeEthernet, layers.LinkTypeEthernet,
+	}
+	for i := range packets {
+		_, _, linkType, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if linkType != expected[i] {
+			t.Errorf("expected link type %v of packet %d, got %v", expected[i], i, linkType)
+		}
+	}
+}
+
+func TestNewReaderInvalid(t *testing.T) {
+	stream := streamFile(t, testPackets(2), 2)
+
+	for _, tt := range []struct {
+		TestName string
+		Input    []byte
+	}{
+		{TestName: "truncated frame", Input: stream[:len(stream)-1]},
+		{TestName: "garbage after a frame", Input: append(append([]byte{}, stream...), file.Header[0], 0x1, 0x2, 0x3, 0, 0, 0, 0)},
+	} {
+		t.Run(tt.TestName, func(t *testing.T) {
+			reader, err := NewReader(bytes.NewReader(tt.Input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for {
+				_, _, _, err = reader.ReadPacket()
+				if err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, ErrInvalidFrame) {
+				t.Errorf("expected error %v, got %v", ErrInvalidFrame, err)
+			}
+		})
+	}
+
+	if _, err := NewReader(bytes.NewReader([]byte("not a capture file"))); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
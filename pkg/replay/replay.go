@@ -0,0 +1,123 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	// loopGap separates the last packet of a loop from the first packet of
+	// the next one.
+	loopGap = time.Millisecond
+)
+
+var (
+	ErrLinkTypeMismatch = errors.New("link type mismatch")
+	ErrStdinLoop        = errors.New("standard input can only be replayed once")
+)
+
+type Options struct {
+	// Speed is the multiple of the original speed to replay the packets at,
+	// 0 means as fast as possible.
+	Speed float64
+	// Rate is the maximum number of packets per second, 0 means no limit.
+	Rate float64
+	// Loops is the number of times the inputs are replayed, 0 means forever.
+	Loops int
+}
+
+type Stats struct {
+	Packets uint64
+	Bytes   uint64
+	Skipped uint64
+	Loops   int
+}
+
+// Replay writes the packets of the input files ("-" for the standard input)
+// to the sink, one file after another. Packets of every loop after the first
+// one get their timestamps shifted past the last packet of the previous loop,
+// so that time keeps moving forward for the consumer.
+func Replay(ctx context.Context, inputs []string, sink Sink, opts Options) (Stats, error) {
+	var stats Stats
+	for _, input := range inputs {
+		if input == "-" && opts.Loops != 1 {
+			return stats, ErrStdinLoop
+		}
+	}
+
+	clock := Clock{Speed: opts.Speed, Rate: opts.Rate}
+	var offset time.Duration
+	var first, last time.Time
+	for opts.Loops == 0 || stats.Loops < opts.Loops {
+		for _, input := range inputs {
+			err := replayFile(ctx, input, sink, &clock, offset, &first, &last, &stats)
+			if err != nil {
+				return stats, err
+			}
+		}
+		stats.Loops++
+		if first.IsZero() {
+			// nothing to loop over
+			break
+		}
+		offset += last.Sub(first) + loopGap
+		first = time.Time{}
+	}
+	return stats, nil
+}
+
+// replayFile replays a single input, shifting the timestamps by offset. It
+// updates the timestamps of the first and last original packets of the loop.
+func replayFile(ctx context.Context, input string, sink Sink, clock *Clock, offset time.Duration,
+	first, last *time.Time, stats *Stats) error {
+
+	var r io.Reader = os.Stdin
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	reader, err := NewReader(r)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", input, err)
+	}
+
+	for {
+		data, ci, linkType, err := reader.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", input, err)
+		}
+
+		if first.IsZero() {
+			*first = ci.Timestamp
+		}
+		*last = ci.Timestamp
+		ci.Timestamp = ci.Timestamp.Add(offset)
+
+		if err := clock.Wait(ctx, ci.Timestamp); err != nil {
+			return err
+		}
+		if err := sink.WritePacket(ci, data, linkType); err != nil {
+			if errors.Is(err, ErrLinkTypeMismatch) {
+				log.Printf("Skipping packet: %v\n", err)
+				stats.Skipped++
+				continue
+			}
+			return err
+		}
+		stats.Packets++
+		stats.Bytes += uint64(len(data))
+	}
+}
@@ -0,0 +1,242 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func writeTempFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return path
+}
+
+func TestReplayUnixSocket(t *testing.T) {
+	packets := testPackets(5)
+	inputs := []string{
+		writeTempFile(t, "a.pcap", pcapFile(t, packets[:2])),
+		writeTempFile(t, "b.stream", streamFile(t, packets[2:], 2)),
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "replay.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+
+	type result struct {
+		packets []testPacket
+		err     error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		reader, err := pcapgo.NewReader(conn)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		var received []testPacket
+		for {
+			data, ci, err := reader.ReadPacketData()
+			if err != nil {
+				results <- result{packets: received}
+				return
+			}
+			received = append(received, testPacket{ci: ci, data: data})
+		}
+	}()
+
+	sink, err := NewPcapSink("unix://" + socketPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stats, err := Replay(context.Background(), inputs, sink, Options{Speed: 0, Loops: 2})
+	sink.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Packets != 10 || stats.Loops != 2 {
+		t.Errorf("expected 10 packets in 2 loops, got %+v", stats)
+	}
+
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("unexpected error: %v", res.err)
+	}
+	if len(res.packets) != 10 {
+		t.Fatalf("expected 10 packets, got %d", len(res.packets))
+	}
+	// the second loop continues after the first one
+	span := packets[4].ci.Timestamp.Sub(packets[0].ci.Timestamp)
+	for i, p := range res.packets {
+		expected := packets[i%5].ci.Timestamp
+		if i >= 5 {
+			expected = expected.Add(span + loopGap)
+		}
+		if !p.ci.Timestamp.Equal(expected) {
+			t.Errorf("expected packet %d at %v, got %v", i, expected, p.ci.Timestamp)
+		}
+	}
+}
+
+func TestReplayLoops(t *testing.T) {
+	packets := testPackets(5)
+	input := writeTempFile(t, "a.pcap", pcapFile(t, packets))
+
+	const speed = 2
+	sink := &recordingSink{}
+	stats, err := Replay(context.Background(), []string{input}, sink, Options{Speed: speed, Loops: 3})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Packets != 15 || stats.Loops != 3 || len(sink.packets) != 15 {
+		t.Fatalf("expected 15 packets in 3 loops, got %+v", stats)
+	}
+
+	// every loop continues after the previous one
+	span := packets[4].ci.Timestamp.Sub(packets[0].ci.Timestamp)
+	start := packets[0].ci.Timestamp
+	for i, p := range sink.packets {
+		loop := time.Duration(i / 5)
+		expected := packets[i%5].ci.Timestamp.Add(loop * (span + loopGap))
+		if !p.ci.Timestamp.Equal(expected) {
+			t.Errorf("expected packet %d at %v, got %v", i, expected, p.ci.Timestamp)
+		}
+		// and is paced by the shifted timestamps
+		due := time.Duration(float64(expected.Sub(start)) / speed)
+		if elapsed := sink.written[i].Sub(sink.written[0]); elapsed < due-time.Millisecond {
+			t.Errorf("expected packet %d to be written after %v, got %v", i, due, elapsed)
+		}
+	}
+	if elapsed := sink.written[14].Sub(sink.written[0]); elapsed > time.Second {
+		t.Errorf("expected the 3 loops to be replayed in ~61ms, took %v", elapsed)
+	}
+}
+
+func TestReplayNamedPipe(t *testing.T) {
+	pipePath := filepath.Join(t.TempDir(), "replay.pipe")
+	if err := syscall.Mkfifo(pipePath, 0600); err != nil {
+		t.Skipf("could not create a named pipe: %v", err)
+	}
+	input := writeTempFile(t, "a.pcapng", pcapngFile(t, testPackets(3)))
+
+	done := make(chan int, 1)
+	go func() {
+		f, err := os.Open(pipePath)
+		if err != nil {
+			done <- -1
+			return
+		}
+		defer f.Close()
+		reader, err := pcapgo.NewReader(f)
+		if err != nil {
+			done <- -1
+			return
+		}
+		n := 0
+		for {
+			if _, _, err := reader.ReadPacketData(); err != nil {
+				done <- n
+				return
+			}
+			n++
+		}
+	}()
+
+	sink, err := NewPcapSink("pipe://" + pipePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := Replay(context.Background(), []string{input}, sink, Options{Speed: 100, Loops: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sink.Close()
+
+	select {
+	case n := <-done:
+		if n != 3 {
+			t.Errorf("expected 3 packets, got %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the reader")
+	}
+}
+
+type recordingSink struct {
+	packets []testPacket
+	// written are the times the packets were written at.
+	written []time.Time
+}
+
+func (s *recordingSink) WritePacket(ci gopacket.CaptureInfo, data []byte, linkType layers.LinkType) error {
+	if linkType != layers.LinkTypeEthernet {
+		return ErrLinkTypeMismatch
+	}
+	s.packets = append(s.packets, testPacket{ci: ci, data: append([]byte{}, data...)})
+	s.written = append(s.written, time.Now())
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+func TestReplaySkipsLinkTypeMismatch(t *testing.T) {
+	var buf []byte
+	{
+		packets := testPackets(2)
+		f := filepath.Join(t.TempDir(), "raw.pcap")
+		out, err := os.Create(f)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		writer := pcapgo.NewWriter(out)
+		writer.WriteFileHeader(65535, layers.LinkTypeRaw)
+		for _, p := range packets {
+			writer.WritePacket(p.ci, p.data)
+		}
+		out.Close()
+		buf, _ = os.ReadFile(f)
+	}
+	inputs := []string{
+		writeTempFile(t, "raw.pcap", buf),
+		writeTempFile(t, "eth.pcap", pcapFile(t, testPackets(3))),
+	}
+
+	sink := &recordingSink{}
+	stats, err := Replay(context.Background(), inputs, sink, Options{Loops: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Packets != 3 || stats.Skipped != 2 || len(sink.packets) != 3 {
+		t.Errorf("expected 3 packets and 2 skipped, got %+v", stats)
+	}
+}
+
+func TestReplayStdinLoop(t *testing.T) {
+	_, err := Replay(context.Background(), []string{"-"}, &recordingSink{}, Options{Loops: 2})
+	if !errors.Is(err, ErrStdinLoop) {
+		t.Errorf("expected error %v, got %v", ErrStdinLoop, err)
+	}
+}
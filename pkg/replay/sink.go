@@ -0,0 +1,100 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	defaultSnapLen = 65535
+)
+
+// Sink is a destination of replayed packets.
+type Sink interface {
+	WritePacket(ci gopacket.CaptureInfo, data []byte, linkType layers.LinkType) error
+	Close() error
+}
+
+// interfaceSink injects the packets onto a network interface.
+type interfaceSink struct {
+	handle *pcap.Handle
+}
+
+// NewInterfaceSink opens the interface for injecting packets.
+func NewInterfaceSink(intfName string) (Sink, error) {
+	handle, err := pcap.OpenLive(intfName, defaultSnapLen, false, pcap.BlockForever)
+	if err != nil {
+		return nil, fmt.Errorf("could not open interface %s: %w", intfName, err)
+	}
+	return &interfaceSink{handle: handle}, nil
+}
+
+func (s *interfaceSink) WritePacket(ci gopacket.CaptureInfo, data []byte, linkType layers.LinkType) error {
+	return s.handle.WritePacketData(data)
+}
+
+func (s *interfaceSink) Close() error {
+	s.handle.Close()
+	return nil
+}
+
+// pcapSink writes the packets as a pcap stream. The file header is written
+// along with the first packet, using its link type.
+type pcapSink struct {
+	w             io.WriteCloser
+	writer        *pcapgo.Writer
+	headerWritten bool
+	linkType      layers.LinkType
+}
+
+// NewPcapSink connects to a consumer of a pcap stream. The address is either
+// tcp://host:port, unix:///path/to/socket or a path to a named pipe or a file,
+// optionally prefixed with pipe://.
+func NewPcapSink(address string) (Sink, error) {
+	var w io.WriteCloser
+	var err error
+	switch {
+	case strings.HasPrefix(address, "tcp://"):
+		w, err = net.Dial("tcp", strings.TrimPrefix(address, "tcp://"))
+	case strings.HasPrefix(address, "unix://"):
+		w, err = net.Dial("unix", strings.TrimPrefix(address, "unix://"))
+	default:
+		// opening a named pipe blocks until the consumer opens it too
+		w, err = os.OpenFile(strings.TrimPrefix(address, "pipe://"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %w", address, err)
+	}
+	return NewPcapWriterSink(w), nil
+}
+
+// NewPcapWriterSink writes a pcap stream to w.
+func NewPcapWriterSink(w io.WriteCloser) Sink {
+	return &pcapSink{w: w, writer: pcapgo.NewWriter(w)}
+}
+
+func (s *pcapSink) WritePacket(ci gopacket.CaptureInfo, data []byte, linkType layers.LinkType) error {
+	if !s.headerWritten {
+		if err := s.writer.WriteFileHeader(defaultSnapLen, linkType); err != nil {
+			return err
+		}
+		s.headerWritten = true
+		s.linkType = linkType
+	}
+	if linkType != s.linkType {
+		return fmt.Errorf("%w: %v, the stream has %v", ErrLinkTypeMismatch, linkType, s.linkType)
+	}
+	return s.writer.WritePacket(ci, data)
+}
+
+func (s *pcapSink) Close() error {
+	return s.w.Close()
+}
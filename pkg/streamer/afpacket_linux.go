@@ -0,0 +1,173 @@
+package streamer
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+
+	"github.com/deepfence/PacketStreamer/pkg/config"
+)
+
+var fanoutTypes = map[config.FanoutType]afpacket.FanoutType{
+	// hash is the zero fanout type, defragmenting the packets before hashing
+	// keeps the fragments of a flow on the same socket
+	config.FanoutHash:         afpacket.FanoutHashWithDefrag,
+	config.FanoutLoadBalance:  afpacket.FanoutLoadBalance,
+	config.FanoutCPU:          afpacket.FanoutCPU,
+	config.FanoutRollover:     afpacket.FanoutRollover,
+	config.FanoutRandom:       afpacket.FanoutRandom,
+	config.FanoutQueueMapping: afpacket.FanoutQueueMapping,
+}
+
+// ARPHRD types of the interfaces, from linux/if_arp.h.
+const (
+	arphrdEther             = 1
+	arphrdTunnel            = 768
+	arphrdTunnel6           = 769
+	arphrdLoopback          = 772
+	arphrdSit               = 776
+	arphrdIEEE80211Radiotap = 803
+	arphrdNone              = 0xfffe
+)
+
+// dltRaw is the libpcap DLT of raw IP packets on Linux, which differs from
+// their link type in pcap files.
+const dltRaw = 12
+
+// afpacketHandle captures packets from a memory mapped TPACKET_V3 ring.
+type afpacketHandle struct {
+	*afpacket.TPacket
+	linkType layers.LinkType
+	snapLen  int
+}
+
+func (h *afpacketHandle) LinkType() layers.LinkType {
+	return h.linkType
+}
+
+func (h *afpacketHandle) SetBPFFilter(filter string) error {
+	// libpcap compiles the filters for DLTs rather than link types
+	linkType := h.linkType
+	if linkType == layers.LinkTypeRaw {
+		linkType = dltRaw
+	}
+	instructions, err := compileBPFFilter(linkType, h.snapLen, filter)
+	if err != nil {
+		return err
+	}
+	rawInstructions := make([]bpf.RawInstruction, 0, len(instructions))
+	for _, instruction := range instructions {
+		rawInstructions = append(rawInstructions, bpf.RawInstruction{
+			Op: instruction.Code,
+			Jt: instruction.Jt,
+			Jf: instruction.Jf,
+			K:  instruction.K,
+		})
+	}
+	return h.SetBPF(rawInstructions)
+}
+
+func openAFPacket(config *config.Config, intfName string) ([]captureHandle, error) {
+	sockets := 1
+	if config.Capture.Fanout != nil {
+		sockets = config.Capture.Fanout.Sockets
+	}
+
+	linkType, err := interfaceLinkType(intfName)
+	if err != nil {
+		return nil, err
+	}
+
+	var group uint16
+	if config.Capture.Fanout != nil {
+		var err error
+		if group, err = fanoutGroup(config.Capture.Fanout.Group, intfName); err != nil {
+			return nil, err
+		}
+	}
+
+	handles := make([]captureHandle, 0, sockets)
+	for i := 0; i < sockets; i++ {
+		tpacket, err := afpacket.NewTPacket(
+			afpacket.OptInterface(intfName),
+			afpacket.TPacketVersion3,
+			afpacket.OptBlockSize(config.Capture.BlockSize),
+			afpacket.OptNumBlocks(config.Capture.RingSize/config.Capture.BlockSize),
+			afpacket.OptBlockTimeout(config.Capture.Timeout),
+			afpacket.OptPollTimeout(config.Capture.Timeout),
+		)
+		if err != nil {
+			closeCapture(handles)
+			return nil, fmt.Errorf("could not open AF_PACKET socket on %s: %w", intfName, err)
+		}
+		handles = append(handles, &afpacketHandle{TPacket: tpacket, linkType: linkType, snapLen: config.InputPacketLen})
+
+		if config.Capture.Fanout != nil {
+			if err := tpacket.SetFanout(fanoutTypes[config.Capture.Fanout.Type], group); err != nil {
+				closeCapture(handles)
+				return nil, fmt.Errorf("could not join fanout group %d on %s: %w", group, intfName, err)
+			}
+		}
+	}
+	return handles, nil
+}
+
+// fanoutGroup returns the fanout group of the sockets of an interface, the
+// configured group plus the index of the interface. The kernel only lets the
+// sockets of a single interface join a group, so every interface needs its
+// own. Groups which don't fit in 16 bits are rejected rather than wrapped
+// around.
+func fanoutGroup(group uint16, intfName string) (uint16, error) {
+	intf, err := net.InterfaceByName(intfName)
+	if err != nil {
+		return 0, fmt.Errorf("could not find interface %s: %w", intfName, err)
+	}
+	if int(group)+intf.Index > math.MaxUint16 {
+		return 0, fmt.Errorf("fanout group %d plus the index %d of interface %s is over %d", group, intf.Index, intfName, math.MaxUint16)
+	}
+	return group + uint16(intf.Index), nil
+}
+
+// interfaceLinkType returns the link type of the packets captured on the
+// interface, after its ARPHRD type.
+func interfaceLinkType(intfName string) (layers.LinkType, error) {
+	data, err := os.ReadFile(filepath.Join("/sys/class/net", intfName, "type"))
+	if err != nil {
+		return 0, fmt.Errorf("could not read the type of interface %s: %w", intfName, err)
+	}
+	arphrd, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid type of interface %s: %w", intfName, err)
+	}
+	linkType, err := arphrdLinkType(arphrd)
+	if err != nil {
+		return 0, fmt.Errorf("could not capture on interface %s: %w", intfName, err)
+	}
+	return linkType, nil
+}
+
+// arphrdLinkType maps the ARPHRD type of an interface to the link type of the
+// packets read from its AF_PACKET sockets, like libpcap does. The sockets are
+// raw ones, so the interfaces for which libpcap falls back to cooked Linux
+// headers aren't supported.
+func arphrdLinkType(arphrd int) (layers.LinkType, error) {
+	switch arphrd {
+	case arphrdEther, arphrdLoopback:
+		return layers.LinkTypeEthernet, nil
+	case arphrdNone, arphrdTunnel, arphrdTunnel6, arphrdSit:
+		// tun, WireGuard and IP in IP tunnels have no link-layer header
+		return layers.LinkTypeRaw, nil
+	case arphrdIEEE80211Radiotap:
+		return layers.LinkTypeIEEE80211Radio, nil
+	default:
+		return 0, fmt.Errorf("unsupported ARPHRD type %d, use the pcap capture backend", arphrd)
+	}
+}
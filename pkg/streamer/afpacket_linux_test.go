@@ -0,0 +1,128 @@
+package streamer
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepfence/PacketStreamer/pkg/config"
+)
+
+func TestAFPacketLoopback(t *testing.T) {
+	cfg := testConfig()
+	cfg.Capture = config.CaptureConfig{
+		Backend:   config.AFPacketBackend,
+		RingSize:  1024 * 1024,
+		BlockSize: 256 * 1024,
+		Timeout:   10 * time.Millisecond,
+		Fanout:    &config.FanoutConfig{Group: 4242, Type: config.FanoutHash, Sockets: 2},
+	}
+
+	handles, err := openCapture(cfg, "lo")
+	if err != nil {
+		// opening AF_PACKET sockets requires CAP_NET_RAW
+		t.Skipf("could not open AF_PACKET sockets: %v", err)
+	}
+	defer closeCapture(handles)
+	if len(handles) != 2 {
+		t.Fatalf("expected 2 fanout sockets, got %d", len(handles))
+	}
+
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+
+	conn, err := net.DialUDP("udp4", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	payload := []byte(fmt.Sprintf("packetstreamer afpacket test %d", time.Now().UnixNano()))
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the fanout hash picks one of the sockets for the packet, other traffic
+	// on the loopback interface is skipped
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, handle := range handles {
+			data, ci, err := handle.ZeroCopyReadPacketData()
+			if err != nil || !bytes.HasSuffix(data, payload) {
+				continue
+			}
+			if ci.CaptureLength != len(data) {
+				t.Errorf("expected capture length %d, got %d", len(data), ci.CaptureLength)
+			}
+			return
+		}
+	}
+	t.Error("no packet captured")
+}
+
+func TestFanoutGroup(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	group, err := fanoutGroup(4242, "lo")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if group != 4242+uint16(lo.Index) {
+		t.Errorf("expected group %d, got %d", 4242+lo.Index, group)
+	}
+	if _, err := fanoutGroup(4242, "does-not-exist0"); err == nil {
+		t.Error("expected an error for an unknown interface")
+	}
+	if _, err := fanoutGroup(math.MaxUint16, "lo"); err == nil {
+		t.Error("expected an error for a group over 16 bits")
+	}
+}
+
+func TestArphrdLinkType(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		arphrd   int
+		linkType layers.LinkType
+		err      bool
+	}{
+		{name: "ethernet", arphrd: arphrdEther, linkType: layers.LinkTypeEthernet},
+		{name: "loopback", arphrd: arphrdLoopback, linkType: layers.LinkTypeEthernet},
+		{name: "tun", arphrd: arphrdNone, linkType: layers.LinkTypeRaw},
+		{name: "ipip", arphrd: arphrdTunnel, linkType: layers.LinkTypeRaw},
+		{name: "radiotap", arphrd: arphrdIEEE80211Radiotap, linkType: layers.LinkTypeIEEE80211Radio},
+		{name: "ppp", arphrd: 512, err: true},
+		{name: "infiniband", arphrd: 32, err: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			linkType, err := arphrdLinkType(tt.arphrd)
+			if (err != nil) != tt.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if linkType != tt.linkType {
+				t.Errorf("expected link type %v, got %v", tt.linkType, linkType)
+			}
+		})
+	}
+}
+
+func TestInterfaceLinkType(t *testing.T) {
+	linkType, err := interfaceLinkType("lo")
+	if err != nil {
+		t.Skipf("could not read the type of the loopback interface: %v", err)
+	}
+	if linkType != layers.LinkTypeEthernet {
+		t.Errorf("expected link type %v, got %v", layers.LinkTypeEthernet, linkType)
+	}
+	if _, err := interfaceLinkType("does-not-exist0"); err == nil {
+		t.Error("expected an error for an unknown interface")
+	}
+}
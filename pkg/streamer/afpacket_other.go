@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package streamer
+
+import (
+	"errors"
+
+	"github.com/deepfence/PacketStreamer/pkg/config"
+)
+
+func openAFPacket(config *config.Config, intfName string) ([]captureHandle, error) {
+	return nil, errors.New("the afpacket capture backend is only supported on Linux")
+}
@@ -0,0 +1,52 @@
+package streamer
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+
+	"github.com/deepfence/PacketStreamer/pkg/config"
+)
+
+// captureHandle is a source of packets captured on an interface. The data
+// returned by ZeroCopyReadPacketData is only valid until the next call.
+type captureHandle interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+	SetBPFFilter(filter string) error
+	Close()
+}
+
+// openCapture opens the configured capture backend on the interface. It
+// returns more than one handle when the AF_PACKET backend is configured with
+// several fanout sockets.
+func openCapture(c *config.Config, intfName string) ([]captureHandle, error) {
+	switch c.Capture.Backend {
+	case config.AFPacketBackend:
+		return openAFPacket(c, intfName)
+	default:
+		handle, err := pcap.OpenLive(intfName, int32(c.InputPacketLen), false, c.Capture.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		return []captureHandle{handle}, nil
+	}
+}
+
+func closeCapture(handles []captureHandle) {
+	for _, handle := range handles {
+		handle.Close()
+	}
+}
+
+// compileBPFFilter compiles the filter for the backends which don't do it on
+// their own. It still takes libpcap, there's no filter compiler in Go.
+func compileBPFFilter(linkType layers.LinkType, snapLen int, filter string) ([]pcap.BPFInstruction, error) {
+	instructions, err := pcap.CompileBPFFilter(linkType, snapLen, filter)
+	if err != nil {
+		return nil, fmt.Errorf("could not compile BPF filter %s: %w", filter, err)
+	}
+	return instructions, nil
+}
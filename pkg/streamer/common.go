@@ -1,140 +1,128 @@
 package streamer
 
 import (
-	"bytes"
-	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
-	"net"
-	"os"
+	"math"
+	"sync/atomic"
 
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
 
+	"github.com/deepfence/PacketStreamer/pkg/batch"
 	"github.com/deepfence/PacketStreamer/pkg/config"
-)
-
-const (
-	maxWriteAttempts = 10
+	"github.com/deepfence/PacketStreamer/pkg/plugins"
 )
 
 var (
-	outputFd      io.Writer
 	pktsRead      uint64
 	totalDataSize uint64
 	hdrData       = [...]byte{0xde, 0xef, 0xec, 0xe0}
+	// sensorHdrData starts the frames carrying the ID of the sensor which
+	// captured the packets of the following frames on the connection. Relays
+	// use it to forward the packets of many sensors over one connection.
+	sensorHdrData = [...]byte{0xde, 0xef, 0xec, 0xe1}
+	// linkTypeHdrData starts the frames carrying the link type of the packets
+	// of the following frames on the connection, as a little-endian uint32.
+	// The packets are Ethernet ones until the first of them.
+	linkTypeHdrData = [...]byte{0xde, 0xef, 0xec, 0xe2}
 )
 
-func writeOutput(config *config.Config, tmpData []byte) error {
-	if outputFd == nil {
-		return nil
-	}
-
-	var numAttempts = 0
-	reconnectAttempt := false
-	dataLen := len(tmpData)
-	totalBytesWritten := 0
-	for {
-		if numAttempts == maxWriteAttempts {
-			if !reconnectAttempt {
-				reconnectAttempt = true
-				err := InitOutput(config, "tcp")
-				if err != nil {
-					return fmt.Errorf("tried to reconnect but got: %w", err)
-				}
-				log.Printf("Tried to write for %d times. Reconnecting once. \n", numAttempts)
-				numAttempts = 0
-				continue
-			}
-			return fmt.Errorf("tried to write for %d times", numAttempts)
-		}
+const (
+	maxSensorIDLen = 255
+	linkTypeLen    = 4
+)
 
-		bytesWritten, err := outputFd.Write(tmpData[totalBytesWritten:])
+const (
+	// pooledPacketLen is the capacity of the pooled buffers for single
+	// packets. It fits a full-sized frame of a network with the default MTU,
+	// larger packets get their own buffer.
+	pooledPacketLen = 2048
+)
 
-		if err != nil {
-			log.Printf("Error while writing data to output. Reason = %s \n", err.Error())
-			numAttempts += 1
-			continue
-		}
-		if (totalBytesWritten + bytesWritten) != dataLen {
-			log.Printf("Not all bytes written to output. Wanted to write  %d, but wrote only %d \n", (dataLen - totalBytesWritten), bytesWritten)
-			totalBytesWritten += bytesWritten
-			numAttempts += 1
-			continue
-		}
+// batchPools hold the buffers flowing through the pipeline: single packets,
+// raw batches with plain pcap records and compressed batches.
+type batchPools struct {
+	packets    *batch.BufferPool
+	raw        *batch.Pool
+	compressed *batch.Pool
+}
 
-		return nil
+func newBatchPools(config *config.Config) *batchPools {
+	return &batchPools{
+		packets:    batch.NewBufferPool(pooledPacketLen),
+		raw:        batch.NewPool(config.MaxGatherLen),
+		compressed: batch.NewPool(config.MaxEncodedLen),
 	}
 }
 
-func InitOutput(config *config.Config, proto string) error {
-
-	if config.Output.File != nil {
-		var pcapBuffer bytes.Buffer
-		pcapWriter := pcapgo.NewWriter(&pcapBuffer)
-		fileFd := os.Stdout
-		if config.Output.File.Path != "stdout" {
-			var err error
-			fileFd, err = os.OpenFile(config.Output.File.Path, os.O_CREATE|os.O_RDWR, 0644)
-			if err != nil {
-				return err
-			}
-		}
-		pcapWriter.WriteFileHeader(uint32(config.InputPacketLen), layers.LinkTypeEthernet)
-		fileFd.Write(pcapBuffer.Bytes())
-		outputFd = fileFd
-	} else if config.Output.Server != nil {
-
-		addr := config.Output.Server.Address
-		if config.Output.Server.Port != nil {
-			addr = fmt.Sprintf("%s:%d", config.Output.Server.Address, *config.Output.Server.Port)
-		}
-		var authConn authConnIntf
-		if config.TLS.Enable {
-			tlsConfig, err := getTlsConfig(config.TLS.CertFile, config.TLS.KeyFile, "")
-			if err != nil {
-				return err
-			}
-			conn, err := tls.Dial(proto, addr, tlsConfig)
-			if err != nil {
-				return err
-			}
-			err = conn.Handshake()
-			if err != nil {
-				return err
-			}
-			outputFd = conn
-			authConn = conn
-		} else {
-			conn, err := net.Dial(proto, addr)
-			if err != nil {
-				return err
-			}
-			log.Println("Connection established, TLS disabled: ", proto, conn.RemoteAddr())
-			outputFd = conn
-			authConn = conn
+// frameState is the metadata announced by the frames written to a connection
+// so far, so that the sensor ID and link type frames are only written when
+// they change.
+type frameState struct {
+	sensorID string
+	linkType layers.LinkType
+	// resumed is set when the frames follow ones of an unknown link type,
+	// written to a file before it was reopened.
+	resumed bool
+}
+
+// write writes the frame of the payload, preceded by the frames of the sensor
+// ID and link type of its packets when they weren't announced yet.
+func (s *frameState) write(w io.Writer, sensorID string, linkType layers.LinkType, payload []byte) error {
+	if sensorID != "" && sensorID != s.sensorID {
+		if err := writeFrame(w, sensorHdrData[:], []byte(sensorID)); err != nil {
+			return err
 		}
-		if config.Auth.Enable {
-			err := handleClientAuth(authConn, config.Auth.Key)
-			if err != nil {
-				return err
-			}
+		s.sensorID = sensorID
+	}
+	if s.resumed || linkType != s.streamLinkType() {
+		if err := writeFrame(w, linkTypeHdrData[:], linkTypePayload(linkType)); err != nil {
+			return err
 		}
+		s.linkType = linkType
+		s.resumed = false
 	}
+	return writeFrame(w, hdrData[:], payload)
+}
 
-	return nil
+func (s *frameState) streamLinkType() layers.LinkType {
+	if s.linkType == layers.LinkTypeNull {
+		return layers.LinkTypeEthernet
+	}
+	return s.linkType
+}
+
+// linkTypePayload returns the payload of the frame carrying the link type.
+func linkTypePayload(linkType layers.LinkType) []byte {
+	payload := make([]byte, linkTypeLen)
+	binary.LittleEndian.PutUint32(payload, uint32(linkType))
+	return payload
+}
+
+// parseLinkType returns the link type carried by the payload of a link type
+// frame.
+func parseLinkType(payload []byte) (layers.LinkType, error) {
+	if len(payload) != linkTypeLen {
+		return 0, fmt.Errorf("invalid link type length %d", len(payload))
+	}
+	linkType := binary.LittleEndian.Uint32(payload)
+	if linkType > math.MaxUint8 {
+		return 0, fmt.Errorf("unsupported link type %d", linkType)
+	}
+	return layers.LinkType(linkType), nil
 }
 
 func calculateDataSize(sizeChannel chan int) {
 	for {
 		dataSize := <-sizeChannel
-		totalDataSize += uint64(dataSize)
+		atomic.AddUint64(&totalDataSize, uint64(dataSize))
 	}
 }
 
 func printDataSize() {
-	currSize := totalDataSize
+	currSize := atomic.LoadUint64(&totalDataSize)
 	v := []string{"B", "KB", "MB", "GB", "TB", "PB", "EB"}
 	l := 0
 	for ; currSize > 1024; currSize = currSize / 1024 {
@@ -143,6 +131,23 @@ func printDataSize() {
 	log.Printf("Total data transfer size is %d %s\n", currSize, v[l])
 }
 
+func printPluginStats(pluginManager *plugins.Manager) {
+	for _, stats := range pluginManager.Stats() {
+		log.Printf("Plugin %s: %d writes, %d bytes written, %d errors, %d queued, %d dropped, %d failed, %d restarts\n",
+			stats.Name, stats.Writes, stats.BytesWritten, stats.Errors, stats.Queued, stats.Dropped, stats.Failed, stats.Restarts)
+	}
+}
+
+func printOutputStats(outputs *Outputs) {
+	for _, stats := range outputs.Stats() {
+		log.Printf("Output %s: %d batches written, %d dropped, %d reconnects, %d queued\n",
+			stats.Name, stats.Written, stats.Dropped, stats.Reconnects, stats.Queued)
+		if stats.Limited > 0 {
+			log.Printf("Output %s: %d packets over the rate limits discarded\n", stats.Name, stats.Limited)
+		}
+	}
+}
+
 func printPacketCount() {
-	log.Printf("Total packets read from interface is %d\n", pktsRead)
+	log.Printf("Total packets read from interface is %d\n", atomic.LoadUint64(&pktsRead))
 }
@@ -5,45 +5,79 @@ import (
 
 	"github.com/klauspost/compress/s2"
 
+	"github.com/deepfence/PacketStreamer/pkg/batch"
 	"github.com/deepfence/PacketStreamer/pkg/config"
 )
 
-func compressPkts(config *config.Config, pktCompressChannel, output chan string) {
-	var packetData = make([]byte, config.MaxEncodedLen)
-
+func compressPkts(config *config.Config, pools *batchPools, pktCompressChannel, output chan *batch.Batch, lossless bool) {
 	for {
 		inputData, chanExitVal := <-pktCompressChannel
 		if !chanExitVal {
 			log.Println("Error while reading from compression channel")
 			break
 		}
-		compressedData := s2.Encode(packetData, []byte(inputData))
+		compressedData := pools.compressed.Get()
+		compressedData.Metadata = inputData.Metadata
+		compressedData.Codec = batch.CodecS2
+		compressedData.Data = s2.Encode(compressedData.Data[:cap(compressedData.Data)], inputData.Data)
+		inputData.Release()
+		if lossless {
+			output <- compressedData
+			continue
+		}
 		select {
-		case output <- string(compressedData):
+		case output <- compressedData:
 		default:
 			log.Println("Compression output queue is full. Discarding")
+			compressedData.Release()
 		}
 	}
 }
 
-func decompressPkts(config *config.Config, pktUncompressChannel, output chan string) {
-	var packetData = make([]byte, config.MaxEncodedLen)
-
+// decompressPkts decodes the compressed batches. With keepSource, the
+// decoded batches keep the compressed ones as their source, for the outputs
+// which forward them as they are.
+func decompressPkts(config *config.Config, pools *batchPools, pktUncompressChannel, output chan *batch.Batch, keepSource bool) {
 	for {
 		decompressBuff, chanExitVal := <-pktUncompressChannel
 		if chanExitVal == false {
 			// log.Println("Exiting uncompress channel")
 			break
 		}
-		deCompressedData, err := s2.Decode(packetData, []byte(decompressBuff))
+		deCompressedData := pools.raw.Get()
+		deCompressedData.Metadata = decompressBuff.Metadata
+		deCompressedData.Codec = batch.CodecNone
+		var err error
+		deCompressedData.Data, err = s2.Decode(deCompressedData.Data[:cap(deCompressedData.Data)], decompressBuff.Data)
+		if keepSource && err == nil {
+			deCompressedData.Source = decompressBuff
+		} else {
+			decompressBuff.Release()
+		}
 		if err != nil {
 			log.Printf("Error while S2 decompress. Reason %s\n", err.Error())
+			deCompressedData.Release()
 			continue
 		}
+		deCompressedData.ScanPackets()
 		select {
-		case output <- string(deCompressedData):
+		case output <- deCompressedData:
 		default:
 			log.Println("Decompression output channel is full. Discarding")
+			deCompressedData.Release()
+		}
+	}
+}
+
+// forwardPkts passes the compressed batches on as they are, for receivers
+// which only relay them to other receivers.
+func forwardPkts(pktUncompressChannel, output chan *batch.Batch) {
+	for compressedData := range pktUncompressChannel {
+		select {
+		case output <- compressedData:
+		default:
+			log.Println("Forward output channel is full. Discarding")
+			compressedData.Release()
 		}
 	}
 }
@@ -0,0 +1,117 @@
+package streamer
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+)
+
+func testConfig() *config.Config {
+	return &config.Config{
+		SensorID:       "test-sensor",
+		InputPacketLen: 65535,
+		SamplingRate: config.SamplingRateConfig{
+			MaxPktsToWrite: 1,
+			MaxTotalPkts:   1,
+		},
+		MaxEncodedLen: 80 * 1024,
+		MaxGatherLen:  65 * 1024,
+		MaxGatherWait: time.Hour,
+		MaxPayloadLen: 80*1024 + 8,
+		MaxHeaderLen:  8,
+	}
+}
+
+func TestGatherCompressDecompress(t *testing.T) {
+	config := testConfig()
+	pools := newBatchPools(config)
+
+	pktGatherChannel := make(chan capturedPacket, 10)
+	compressChannel := make(chan *batch.Batch, 10)
+	compressedChannel := make(chan *batch.Batch, 10)
+	decompressedChannel := make(chan *batch.Batch, 10)
+
+	setIntfFilter("eth0", "port 80")
+	t.Cleanup(func() { intfFilters.Delete("eth0") })
+
+	go gatherPkts(config, pools, pktGatherChannel, compressChannel, nil, false)
+	go compressPkts(config, pools, compressChannel, compressedChannel, false)
+	go decompressPkts(config, pools, compressedChannel, decompressedChannel, false)
+
+	ts := time.Unix(1650000000, 0)
+	payload := bytes.Repeat([]byte{0xab}, 100)
+	for i := 0; i < 3; i++ {
+		data := pools.packets.Get(len(payload))
+		copy(*data, payload)
+		pktGatherChannel <- capturedPacket{
+			intf:     "eth0",
+			linkType: layers.LinkTypeEthernet,
+			ci: gopacket.CaptureInfo{
+				Timestamp:     ts.Add(time.Duration(i) * time.Second),
+				CaptureLength: len(payload),
+				Length:        len(payload),
+			},
+			data: data,
+		}
+	}
+	close(pktGatherChannel)
+
+	b := <-decompressedChannel
+	defer b.Release()
+
+	if b.SensorID != "test-sensor" || b.Interface != "eth0" || b.LinkType != layers.LinkTypeEthernet || b.Filter != "port 80" {
+		t.Errorf("unexpected metadata: %+v", b.Metadata)
+	}
+	if b.Codec != batch.CodecNone {
+		t.Errorf("expected an uncompressed batch, got codec %v", b.Codec)
+	}
+	if b.PacketCount != 3 || !b.FirstTimestamp.Equal(ts) || !b.LastTimestamp.Equal(ts.Add(2*time.Second)) {
+		t.Errorf("unexpected packet metadata: %+v", b.Metadata)
+	}
+	if len(b.Data) != 3*(batch.RecordHeaderLen+len(payload)) {
+		t.Errorf("unexpected batch length %d", len(b.Data))
+	}
+}
+
+func TestGatherLinkTypes(t *testing.T) {
+	config := testConfig()
+	pools := newBatchPools(config)
+
+	pktGatherChannel := make(chan capturedPacket, 10)
+	compressChannel := make(chan *batch.Batch, 10)
+	go gatherPkts(config, pools, pktGatherChannel, compressChannel, nil, false)
+
+	linkTypes := []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeEthernet, layers.LinkTypeRaw, layers.LinkTypeEthernet}
+	for i, linkType := range linkTypes {
+		data := pools.packets.Get(4)
+		pktGatherChannel <- capturedPacket{
+			intf:     "eth0",
+			linkType: linkType,
+			ci:       gopacket.CaptureInfo{Timestamp: time.Unix(int64(i), 0), CaptureLength: 4, Length: 4},
+			data:     data,
+		}
+	}
+	close(pktGatherChannel)
+
+	// a batch is sent whenever the link type changes
+	for _, expected := range []struct {
+		linkType layers.LinkType
+		packets  int
+	}{
+		{layers.LinkTypeEthernet, 2},
+		{layers.LinkTypeRaw, 1},
+		{layers.LinkTypeEthernet, 1},
+	} {
+		b := <-compressChannel
+		if b.LinkType != expected.linkType || b.PacketCount != expected.packets {
+			t.Errorf("expected a batch of %d %v packets, got %d %v ones", expected.packets, expected.linkType, b.PacketCount, b.LinkType)
+		}
+		b.Release()
+	}
+}
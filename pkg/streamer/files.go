@@ -0,0 +1,172 @@
+package streamer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/plugins"
+	"github.com/deepfence/PacketStreamer/pkg/replay"
+)
+
+var (
+	// packetFileExtensions are the extensions of the files picked up from
+	// directories.
+	packetFileExtensions = []string{".pcap", ".pcapng", ".cap", ".pcap.gz"}
+)
+
+func isPacketFile(name string) bool {
+	for _, ext := range packetFileExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// listPacketFiles returns the configured files and the packet files in the
+// configured directories, along with their sizes.
+func listPacketFiles(paths []string) (map[string]int64, []string, error) {
+	sizes := make(map[string]int64)
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !info.IsDir() {
+			sizes[path] = info.Size()
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || !isPacketFile(entry.Name()) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				// removed in the meantime
+				continue
+			}
+			file := filepath.Join(path, entry.Name())
+			sizes[file] = info.Size()
+			files = append(files, file)
+		}
+	}
+	return sizes, files, nil
+}
+
+// readPacketFiles sends the packets of all the configured files to the
+// pipeline, one file after another. In the watch mode, it keeps polling for new
+// files until the context is done. Files are only picked up once their size
+// didn't change since the previous poll, so that files which are still being
+// written aren't read halfway.
+func readPacketFiles(ctx context.Context, config *config.Config, pools *batchPools, pipeline *pipeline) {
+	fileConfig := config.Capture.File
+	processed := make(map[string]bool)
+	prevSizes := make(map[string]int64)
+
+	for {
+		sizes, files, err := listPacketFiles(fileConfig.Paths)
+		if err != nil {
+			log.Printf("Error while listing packet files: %v\n", err)
+			if !fileConfig.Watch {
+				return
+			}
+		}
+
+		for _, file := range files {
+			if processed[file] {
+				continue
+			}
+			if fileConfig.Watch {
+				if prevSize, ok := prevSizes[file]; !ok || prevSize != sizes[file] {
+					continue
+				}
+			}
+			processed[file] = true
+
+			log.Printf("Reading packets from %s\n", file)
+			if err := readPacketFile(ctx, config, pools, pipeline, file); err != nil {
+				log.Printf("Error while reading packets from %s: %v\n", file, err)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+		prevSizes = sizes
+
+		if !fileConfig.Watch {
+			return
+		}
+		select {
+		case <-time.After(fileConfig.PollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func readPacketFile(ctx context.Context, config *config.Config, pools *batchPools, pipeline *pipeline, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := replay.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	clock := replay.Clock{Speed: config.Capture.File.Speed}
+	intfName := filepath.Base(path)
+	for {
+		pktData, pktCi, linkType, err := reader.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if pktCi.CaptureLength != len(pktData) {
+			log.Printf("Capture length %d does not match data length %d. Skipping packet\n", pktCi.CaptureLength, len(pktData))
+			continue
+		}
+		if err := clock.Wait(ctx, pktCi.Timestamp); err != nil {
+			return err
+		}
+
+		data := pools.packets.Get(len(pktData))
+		copy(*data, pktData)
+		if !pipeline.send(ctx, capturedPacket{intf: intfName, linkType: linkType, ci: pktCi, data: data}) {
+			pools.packets.Put(data)
+			return ctx.Err()
+		}
+	}
+}
+
+// processFileCapture streams the packets of the configured files to the
+// output. It closes the output once all the files are read, unless in the
+// watch mode.
+func processFileCapture(ctx context.Context, config *config.Config,
+	agentPktOutputChannel chan *batch.Batch, pluginManager *plugins.Manager) {
+
+	pools := newBatchPools(config)
+	pipeline := startPipeline(config, pools, agentPktOutputChannel, pluginManager)
+	readPacketFiles(ctx, config, pools, pipeline)
+	pipeline.close()
+	close(agentPktOutputChannel)
+}
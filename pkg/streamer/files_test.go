@@ -0,0 +1,193 @@
+package streamer
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/s2"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/testutils"
+)
+
+const testFilePackets = 20
+
+// writePacketFile writes packets of a single flow to a pcap or pcapng file,
+// one millisecond apart.
+func writePacketFile(t *testing.T, path string, flow int, ng bool) {
+	t.Helper()
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer file.Close()
+
+	var writePacket func(gopacket.CaptureInfo, []byte) error
+	if ng {
+		writer, err := pcapgo.NewNgWriter(file, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer writer.Flush()
+		writePacket = writer.WritePacket
+	} else {
+		writer := pcapgo.NewWriter(file)
+		if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		writePacket = writer.WritePacket
+	}
+
+	ts := time.Unix(1650000000, 0)
+	for seq := 0; seq < testFilePackets; seq++ {
+		data := testutils.SyntheticPacket(t, flow, false, uint32(seq), 64)
+		ci := gopacket.CaptureInfo{
+			Timestamp:     ts.Add(time.Duration(seq) * time.Millisecond),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}
+		if err := writePacket(ci, data); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+// readSequences collects the sequence numbers of the packets of every flow in
+// the compressed batch.
+func readSequences(t *testing.T, b *batch.Batch, received map[uint32][]uint32) {
+	t.Helper()
+
+	defer b.Release()
+	if b.LinkType != layers.LinkTypeEthernet {
+		t.Errorf("expected link type %v, got %v", layers.LinkTypeEthernet, b.LinkType)
+	}
+	records, err := s2.Decode(nil, b.Data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for len(records) > 0 {
+		capLen := int(binary.LittleEndian.Uint32(records[8:12]))
+		payload := records[batch.RecordHeaderLen+capLen-64 : batch.RecordHeaderLen+capLen]
+		flow := binary.BigEndian.Uint32(payload[4:8])
+		received[flow] = append(received[flow], binary.BigEndian.Uint32(payload[0:4]))
+		records = records[batch.RecordHeaderLen+capLen:]
+	}
+}
+
+func checkSequences(t *testing.T, received map[uint32][]uint32, flows int) {
+	t.Helper()
+
+	if len(received) != flows {
+		t.Fatalf("expected %d flows, got %d", flows, len(received))
+	}
+	for flow, seqs := range received {
+		if len(seqs) != testFilePackets {
+			t.Errorf("expected %d packets in flow %d, got %d", testFilePackets, flow, len(seqs))
+		}
+		for i, seq := range seqs {
+			if seq != uint32(i) {
+				t.Errorf("expected packet %d of flow %d, got %d", i, flow, seq)
+				break
+			}
+		}
+	}
+}
+
+func fileTestConfig(paths ...string) *config.Config {
+	cfg := testConfig()
+	cfg.Workers = 2
+	cfg.Capture.Backend = config.FileBackend
+	cfg.Capture.File = &config.FileCaptureConfig{
+		Paths:        paths,
+		PollInterval: 10 * time.Millisecond,
+	}
+	return cfg
+}
+
+func TestProcessFileCapture(t *testing.T) {
+	dir := t.TempDir()
+	writePacketFile(t, filepath.Join(dir, "a.pcap"), 0, false)
+	writePacketFile(t, filepath.Join(dir, "b.pcapng"), 1, true)
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a capture"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	single := filepath.Join(t.TempDir(), "c.dump")
+	writePacketFile(t, single, 2, false)
+
+	cfg := fileTestConfig(dir, single)
+	output := make(chan *batch.Batch)
+	go processFileCapture(context.Background(), cfg, output, nil)
+
+	// the output is closed after all the files are read
+	received := make(map[uint32][]uint32)
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case b, ok := <-output:
+			if !ok {
+				checkSequences(t, received, 3)
+				return
+			}
+			readSequences(t, b, received)
+		case <-timeout:
+			t.Fatal("timed out waiting for the packets")
+		}
+	}
+}
+
+func TestProcessFileCaptureSpeed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.pcap")
+	writePacketFile(t, path, 0, false)
+
+	cfg := fileTestConfig(path)
+	cfg.Capture.File.Speed = 0.5
+	output := make(chan *batch.Batch, maxNumPkts)
+	start := time.Now()
+	go processFileCapture(context.Background(), cfg, output, nil)
+
+	received := make(map[uint32][]uint32)
+	for b := range output {
+		readSequences(t, b, received)
+	}
+	checkSequences(t, received, 1)
+	// 19ms of packets at half the original speed
+	if elapsed := time.Since(start); elapsed < 38*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("expected the file to be replayed in ~38ms at 0.5x speed, took %v", elapsed)
+	}
+}
+
+func TestProcessFileCaptureWatch(t *testing.T) {
+	dir := t.TempDir()
+	cfg := fileTestConfig(dir)
+	cfg.Capture.File.Watch = true
+	cfg.MaxGatherWait = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	output := make(chan *batch.Batch, maxNumPkts)
+	go processFileCapture(ctx, cfg, output, nil)
+
+	// written after the sensor started
+	time.Sleep(50 * time.Millisecond)
+	writePacketFile(t, filepath.Join(dir, "new.pcap"), 0, false)
+
+	received := make(map[uint32][]uint32)
+	deadline := time.Now().Add(10 * time.Second)
+	for len(received[0]) < testFilePackets && time.Now().Before(deadline) {
+		select {
+		case b := <-output:
+			readSequences(t, b, received)
+		case <-time.After(time.Until(deadline)):
+		}
+	}
+	checkSequences(t, received, 1)
+}
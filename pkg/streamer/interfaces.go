@@ -1,7 +1,6 @@
 package streamer
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -9,23 +8,22 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/pcapgo"
-
 	"github.com/deepfence/PacketStreamer/pkg/config"
 	"github.com/deepfence/PacketStreamer/pkg/network"
 )
 
 var (
 	interfaceToPortMap map[string][]int
+	// intfFilters are the BPF filters of the captured interfaces, by name.
+	intfFilters sync.Map
 )
 
 const (
 	bpfParamInputDelimiter  = ";"
 	bpfParamOutputDelimiter = "  "
-	pktCaptureTimeout       = 5
 	dnsResolveTimeout       = 10
 	maxReadErrCnt           = 10
 	timeoutErrString        = "timeout expired"
@@ -69,18 +67,18 @@ func formInterfacePortMap(interfaceName string, portsList []int) {
 	interfaceToPortMap[interfaceName] = append(interfaceToPortMap[interfaceName], portsList...)
 }
 
-func initAllInterfaces(config *config.Config) ([]*pcap.Handle, error) {
+func initAllInterfaces(config *config.Config) (map[string][]captureHandle, error) {
 	err := findAllInterfaces()
 	if err != nil {
 		return nil, err
 	}
-	var intfPtr []*pcap.Handle
+	intfPtr := make(map[string][]captureHandle)
 	for interfaceName, portList := range interfaceToPortMap {
 		intf, err := initInterface(config, interfaceName, portList)
 		if err != nil {
 			return nil, err
 		}
-		intfPtr = append(intfPtr, intf)
+		intfPtr[interfaceName] = intf
 
 	}
 	return intfPtr, nil
@@ -90,6 +88,8 @@ func grabInterface(ctx context.Context, config *config.Config) chan intfPorts {
 	res := make(chan intfPorts)
 	ticker := time.NewTicker(PROCESS_SCAN_FREQUENCY)
 	go func() {
+		// the filters are updated when the receivers change
+		receivers, _ := receiverAddresses(config, net.DefaultResolver)
 		for {
 			oldMap := interfaceToPortMap
 			interfaceToPortMap = map[string][]int{}
@@ -103,8 +103,14 @@ func grabInterface(ctx context.Context, config *config.Config) chan intfPorts {
 				continue
 			}
 
+			receiversChanged := false
+			if current, err := receiverAddresses(config, net.DefaultResolver); err == nil && current != receivers {
+				log.Printf("Receivers changed to %s, updating the filters\n", current)
+				receivers = current
+				receiversChanged = true
+			}
 			for interf, ports := range interfaceToPortMap {
-				if !compareIntSets(ports, oldMap[interf]) {
+				if receiversChanged || !compareIntSets(ports, oldMap[interf]) {
 					res <- intfPorts{
 						interf,
 						ports,
@@ -121,13 +127,13 @@ func grabInterface(ctx context.Context, config *config.Config) chan intfPorts {
 	return res
 }
 
-func initInterface(config *config.Config, intfName string, portList []int) (*pcap.Handle, error) {
+func initInterface(config *config.Config, intfName string, portList []int) ([]captureHandle, error) {
 
 	if intfName == "" {
 		return nil, errors.New("no interface specified")
 	}
 
-	packetHandle, err := pcap.OpenLive(intfName, int32(config.InputPacketLen), false, pktCaptureTimeout*time.Second)
+	packetHandles, err := openCapture(config, intfName)
 
 	if err != nil {
 		return nil, err
@@ -135,27 +141,42 @@ func initInterface(config *config.Config, intfName string, portList []int) (*pca
 
 	bpfString, err := createBpfString(config, net.DefaultResolver, portList)
 	if err != nil {
+		closeCapture(packetHandles)
 		return nil, fmt.Errorf("could not generate BPF filter: %w", err)
 	}
 	intfBpf := strings.Replace(bpfString, bpfParamInputDelimiter, bpfParamOutputDelimiter, -1)
 
 	if intfBpf != "" {
 		bpfStrings := strings.Replace(intfBpf, bpfParamInputDelimiter, bpfParamOutputDelimiter, -1)
-		err = packetHandle.SetBPFFilter(bpfStrings)
-		if err != nil {
-			return nil, err
+		for _, packetHandle := range packetHandles {
+			err = packetHandle.SetBPFFilter(bpfStrings)
+			if err != nil {
+				closeCapture(packetHandles)
+				return nil, err
+			}
 		}
 	}
-	return packetHandle, nil
+	setIntfFilter(intfName, intfBpf)
+	return packetHandles, nil
+}
+
+// setIntfFilter records the BPF filter an interface is captured with, so that
+// it ends up in the metadata of its batches.
+func setIntfFilter(intfName string, filter string) {
+	intfFilters.Store(intfName, filter)
 }
 
-func readPacketOnIntf(config *config.Config, intf *pcap.Handle, pktGatherChannel chan string) {
+func intfFilter(intfName string) string {
+	filter, _ := intfFilters.Load(intfName)
+	s, _ := filter.(string)
+	return s
+}
+
+func readPacketOnIntf(config *config.Config, pools *batchPools, intfName string, intf captureHandle, pipeline *pipeline) {
 	pktsRead := 0
 	errCntr := 0
-	var pcapBuffer bytes.Buffer
-	var pcapWriter = pcapgo.NewWriter(&pcapBuffer)
+	linkType := intf.LinkType()
 	for {
-		pcapBuffer.Reset()
 		if errCntr == maxReadErrCnt {
 			log.Println("Maximum packet read error reached. Exiting")
 			break
@@ -175,16 +196,17 @@ func readPacketOnIntf(config *config.Config, intf *pcap.Handle, pktGatherChannel
 		if pktsRead >= config.SamplingRate.MaxPktsToWrite {
 			continue
 		}
-		err := pcapWriter.WritePacket(pktCi, pktData)
-		if err != nil {
-			log.Printf("Unable to convert packet to byte buffer. Reason %v\n", err)
+		if pktCi.CaptureLength != len(pktData) {
+			log.Printf("Capture length %d does not match data length %d. Skipping packet\n", pktCi.CaptureLength, len(pktData))
 			continue
 		}
 		errCntr = 0
-		select {
-		case pktGatherChannel <- pcapBuffer.String():
-		default:
+		// the zero-copy data is only valid until the next read
+		data := pools.packets.Get(len(pktData))
+		copy(*data, pktData)
+		if !pipeline.dispatch(capturedPacket{intf: intfName, linkType: linkType, ci: pktCi, data: data}) {
 			log.Println("Gather queue is full. Discarding ")
+			pools.packets.Put(data)
 		}
 	}
 }
@@ -208,7 +230,12 @@ func createBpfString(c *config.Config, resolver network.Resolver, portList []int
 		portString = append(portString, portVal)
 	}
 
-	if c.Output.Server == nil {
+	/* don't capture the traffic sent to any of the servers and mirror targets */
+	outputFilters, err := createOutputFilters(c, resolver)
+	if err != nil {
+		return "", err
+	}
+	if len(outputFilters) == 0 {
 		if len(portList) == 0 {
 			return "", nil
 		}
@@ -223,24 +250,7 @@ func createBpfString(c *config.Config, resolver network.Resolver, portList []int
 			return "", nil
 		}
 	} else {
-		var hostIPs []string
-		if net.ParseIP(c.Output.Server.Address) == nil {
-			ips, err := resolveHost(resolver, c.Output.Server.Address)
-			if err != nil {
-				return "", fmt.Errorf("unable to resolve host %s: %w", c.Output.Server.Address, err)
-			}
-			hostIPs = append(hostIPs, ips...)
-		} else {
-			hostIPs = append(hostIPs, c.Output.Server.Address)
-		}
-
-		defaultBpfString := ""
-		for i, ip := range hostIPs {
-			defaultBpfString += fmt.Sprintf("not ( dst host %s and port %d )", ip, *c.Output.Server.Port)
-			if i != len(hostIPs)-1 {
-				defaultBpfString += " and "
-			}
-		}
+		defaultBpfString := strings.Join(outputFilters, " and ")
 
 		if len(portList) == 0 {
 			return defaultBpfString, nil
@@ -257,6 +267,35 @@ func createBpfString(c *config.Config, resolver network.Resolver, portList []int
 	}
 }
 
+// createOutputFilters returns the filters leaving out the packets sent to the
+// outputs.
+func createOutputFilters(c *config.Config, resolver network.Resolver) ([]string, error) {
+	var filters []string
+	for _, server := range c.Output.Servers() {
+		addrs, err := resolveServers(resolver, server)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve the receivers %s: %w", server, err)
+		}
+		for _, addr := range addrs {
+			// the local system, whose loopback interfaces aren't captured
+			if addr.IP == nil {
+				continue
+			}
+			filters = append(filters, fmt.Sprintf("not ( dst host %s and port %d )", addr.IP, addr.Port))
+		}
+	}
+	for _, mirror := range c.Output.Mirrors() {
+		ips, err := resolveAddress(resolver, mirror.Address)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve the mirror target %s: %w", mirror.Address, err)
+		}
+		for _, ip := range ips {
+			filters = append(filters, mirrorFilter(mirror, ip))
+		}
+	}
+	return filters, nil
+}
+
 func setupInterfacesAndPortMappings(c *config.Config) error {
 	/* if it is a deny mode, and no ports have been selected, run
 	 * capture on all interfaces */
@@ -2,6 +2,7 @@ package streamer
 
 import (
 	"errors"
+	"net"
 	"testing"
 
 	"github.com/foxcpp/go-mockdns"
@@ -16,6 +17,14 @@ func TestCreateBpfString(t *testing.T) {
 			"packetstreamer.io.": {
 				A: []string{"172.68.142.37"},
 			},
+			"_packetstreamer._tcp.receivers.packetstreamer.io.": {
+				SRV: []net.SRV{
+					{Target: "receiver.packetstreamer.io.", Port: 9002, Priority: 10},
+				},
+			},
+			"receiver.packetstreamer.io.": {
+				A: []string{"172.68.142.38", "172.68.142.39"},
+			},
 		},
 	}
 
@@ -30,9 +39,7 @@ func TestCreateBpfString(t *testing.T) {
 			testName:      "no server, no ports",
 			expectedError: nil,
 			config: &config.Config{
-				Output: config.OutputConfig{
-					Server: nil,
-				},
+				Output:   config.OutputConfig{},
 				PcapMode: config.Allow,
 			},
 			portList: nil,
@@ -42,9 +49,7 @@ func TestCreateBpfString(t *testing.T) {
 			testName:      "no server, pcap allow",
 			expectedError: nil,
 			config: &config.Config{
-				Output: config.OutputConfig{
-					Server: nil,
-				},
+				Output:   config.OutputConfig{},
 				PcapMode: config.Allow,
 			},
 			portList: []int{8000, 8001, 8002},
@@ -54,9 +59,7 @@ func TestCreateBpfString(t *testing.T) {
 			testName:      "no server, pcap deny",
 			expectedError: nil,
 			config: &config.Config{
-				Output: config.OutputConfig{
-					Server: nil,
-				},
+				Output:   config.OutputConfig{},
 				PcapMode: config.Deny,
 			},
 			portList: []int{8000, 8001, 8002},
@@ -66,9 +69,7 @@ func TestCreateBpfString(t *testing.T) {
 			testName:      "no server, pcap all",
 			expectedError: nil,
 			config: &config.Config{
-				Output: config.OutputConfig{
-					Server: nil,
-				},
+				Output:   config.OutputConfig{},
 				PcapMode: config.All,
 			},
 			portList: []int{8000, 8001, 8002},
@@ -79,10 +80,12 @@ func TestCreateBpfString(t *testing.T) {
 			expectedError: nil,
 			config: &config.Config{
 				Output: config.OutputConfig{
-					Server: &config.ServerOutputConfig{
-						Address: "192.168.0.30",
-						Port:    utils.IntPtr(9000),
-					},
+					Sinks: []config.SinkConfig{{
+						Server: &config.ServerOutputConfig{
+							Address: "192.168.0.30",
+							Port:    utils.IntPtr(9000),
+						},
+					}},
 				},
 				PcapMode: config.Allow,
 			},
@@ -94,10 +97,12 @@ func TestCreateBpfString(t *testing.T) {
 			expectedError: nil,
 			config: &config.Config{
 				Output: config.OutputConfig{
-					Server: &config.ServerOutputConfig{
-						Address: "192.168.0.30",
-						Port:    utils.IntPtr(9000),
-					},
+					Sinks: []config.SinkConfig{{
+						Server: &config.ServerOutputConfig{
+							Address: "192.168.0.30",
+							Port:    utils.IntPtr(9000),
+						},
+					}},
 				},
 				PcapMode: config.Allow,
 			},
@@ -109,10 +114,12 @@ func TestCreateBpfString(t *testing.T) {
 			expectedError: nil,
 			config: &config.Config{
 				Output: config.OutputConfig{
-					Server: &config.ServerOutputConfig{
-						Address: "192.168.0.30",
-						Port:    utils.IntPtr(9000),
-					},
+					Sinks: []config.SinkConfig{{
+						Server: &config.ServerOutputConfig{
+							Address: "192.168.0.30",
+							Port:    utils.IntPtr(9000),
+						},
+					}},
 				},
 				PcapMode: config.Deny,
 			},
@@ -124,10 +131,12 @@ func TestCreateBpfString(t *testing.T) {
 			expectedError: nil,
 			config: &config.Config{
 				Output: config.OutputConfig{
-					Server: &config.ServerOutputConfig{
-						Address: "192.168.0.30",
-						Port:    utils.IntPtr(9000),
-					},
+					Sinks: []config.SinkConfig{{
+						Server: &config.ServerOutputConfig{
+							Address: "192.168.0.30",
+							Port:    utils.IntPtr(9000),
+						},
+					}},
 				},
 				PcapMode: config.All,
 			},
@@ -139,10 +148,12 @@ func TestCreateBpfString(t *testing.T) {
 			expectedError: nil,
 			config: &config.Config{
 				Output: config.OutputConfig{
-					Server: &config.ServerOutputConfig{
-						Address: "packetstreamer.io",
-						Port:    utils.IntPtr(9000),
-					},
+					Sinks: []config.SinkConfig{{
+						Server: &config.ServerOutputConfig{
+							Address: "packetstreamer.io",
+							Port:    utils.IntPtr(9000),
+						},
+					}},
 				},
 				PcapMode: config.Allow,
 			},
@@ -154,10 +165,12 @@ func TestCreateBpfString(t *testing.T) {
 			expectedError: nil,
 			config: &config.Config{
 				Output: config.OutputConfig{
-					Server: &config.ServerOutputConfig{
-						Address: "packetstreamer.io",
-						Port:    utils.IntPtr(9000),
-					},
+					Sinks: []config.SinkConfig{{
+						Server: &config.ServerOutputConfig{
+							Address: "packetstreamer.io",
+							Port:    utils.IntPtr(9000),
+						},
+					}},
 				},
 				PcapMode: config.Allow,
 			},
@@ -169,10 +182,12 @@ func TestCreateBpfString(t *testing.T) {
 			expectedError: nil,
 			config: &config.Config{
 				Output: config.OutputConfig{
-					Server: &config.ServerOutputConfig{
-						Address: "packetstreamer.io",
-						Port:    utils.IntPtr(9000),
-					},
+					Sinks: []config.SinkConfig{{
+						Server: &config.ServerOutputConfig{
+							Address: "packetstreamer.io",
+							Port:    utils.IntPtr(9000),
+						},
+					}},
 				},
 				PcapMode: config.Deny,
 			},
@@ -184,16 +199,86 @@ func TestCreateBpfString(t *testing.T) {
 			expectedError: nil,
 			config: &config.Config{
 				Output: config.OutputConfig{
-					Server: &config.ServerOutputConfig{
-						Address: "packetstreamer.io",
-						Port:    utils.IntPtr(9000),
-					},
+					Sinks: []config.SinkConfig{{
+						Server: &config.ServerOutputConfig{
+							Address: "packetstreamer.io",
+							Port:    utils.IntPtr(9000),
+						},
+					}},
 				},
 				PcapMode: config.All,
 			},
 			portList: []int{8000, 8001, 8002},
 			expected: "not ( dst host 172.68.142.37 and port 9000 )",
 		},
+		{
+			testName:      "two servers, pcap allow",
+			expectedError: nil,
+			config: &config.Config{
+				Output: config.OutputConfig{
+					Sinks: []config.SinkConfig{
+						{
+							Server: &config.ServerOutputConfig{
+								Address: "192.168.0.30",
+								Port:    utils.IntPtr(9000),
+							},
+						},
+						{
+							File: &config.FileOutputConfig{
+								Path: "/tmp/dump_file",
+							},
+						},
+						{
+							Server: &config.ServerOutputConfig{
+								Address: "packetstreamer.io",
+								Port:    utils.IntPtr(9001),
+							},
+						},
+					},
+				},
+				PcapMode: config.Allow,
+			},
+			portList: []int{8000},
+			expected: "not ( dst host 192.168.0.30 and port 9000 ) and not ( dst host 172.68.142.37 and port 9001 ) and port 8000",
+		},
+		{
+			testName:      "receivers and SRV records, pcap allow",
+			expectedError: nil,
+			config: &config.Config{
+				Output: config.OutputConfig{
+					Sinks: []config.SinkConfig{{
+						Server: &config.ServerOutputConfig{
+							Receivers: []config.ServerAddressConfig{
+								{Address: "192.168.0.30", Port: utils.IntPtr(9000)},
+								{Address: "192.168.0.31", Port: utils.IntPtr(9001)},
+							},
+							SRV: "_packetstreamer._tcp.receivers.packetstreamer.io",
+						},
+					}},
+				},
+				PcapMode: config.Allow,
+			},
+			portList: []int{8000},
+			expected: "not ( dst host 192.168.0.30 and port 9000 ) and not ( dst host 192.168.0.31 and port 9001 ) and " +
+				"not ( dst host 172.68.142.38 and port 9002 ) and not ( dst host 172.68.142.39 and port 9002 ) and port 8000",
+		},
+		{
+			testName:      "mirror targets, no ports",
+			expectedError: nil,
+			config: &config.Config{
+				Output: config.OutputConfig{
+					Sinks: []config.SinkConfig{
+						{Mirror: &config.MirrorOutputConfig{Address: "packetstreamer.io"}},
+						{Mirror: &config.MirrorOutputConfig{Address: "192.168.0.40", Encapsulation: config.ERSPANEncapsulation}},
+						{Mirror: &config.MirrorOutputConfig{Address: "fd00::40", Encapsulation: config.GREEncapsulation}},
+					},
+				},
+				PcapMode: config.All,
+			},
+			portList: nil,
+			expected: "not ( dst host 172.68.142.37 and udp port 4789 ) and not ( dst host 192.168.0.40 and ip proto 47 ) and " +
+				"not ( dst host fd00::40 and ip6 proto 47 )",
+		},
 	} {
 		t.Run(tt.testName, func(t *testing.T) {
 			bpfString, err := createBpfString(tt.config, &resolver, tt.portList)
@@ -0,0 +1,232 @@
+package streamer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/klauspost/compress/s2"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+)
+
+const (
+	vxlanPort = 4789
+	tzspPort  = 37008
+
+	// greProtocol is the IP protocol number of GRE, sent over raw sockets.
+	greProtocol = 47
+
+	vxlanFlagVNI   = 0x08
+	greFlagKey     = 0x2000
+	greFlagSeq     = 0x1000
+	erspanVersion2 = 1
+
+	tzspVersion      = 1
+	tzspTypeReceived = 0
+	tzspEncapEther   = 1
+	tzspTagEnd       = 1
+)
+
+// mirror sends every packet of the batches to a traffic mirroring target, in
+// a datagram of its own. Packets are sent as the Ethernet frames they were
+// captured as, the same way they are written to pcap outputs.
+type mirror struct {
+	config  *config.MirrorOutputConfig
+	conn    net.Conn
+	packets *rateLimiter
+	bytes   *rateLimiter
+	// seq is the GRE sequence number of ERSPAN.
+	seq     uint32
+	decoded []byte
+	buf     []byte
+
+	// pending and sent let a batch be resumed after reopening the target,
+	// so that its packets aren't sent twice.
+	pending *batch.Batch
+	sent    int
+
+	limited uint64
+}
+
+func newMirror(mirrorConfig *config.MirrorOutputConfig) *mirror {
+	return &mirror{
+		config:  mirrorConfig,
+		packets: newRateLimiter(mirrorConfig.PacketsPerSecond),
+		bytes:   newRateLimiter(mirrorConfig.BytesPerSecond),
+	}
+}
+
+// mirrorPort returns the UDP port of the encapsulation, or 0 when the packets
+// aren't sent in UDP.
+func mirrorPort(encapsulation config.Encapsulation, port *int) int {
+	switch encapsulation {
+	case config.GREEncapsulation, config.ERSPANEncapsulation:
+		return 0
+	}
+	if port != nil {
+		return *port
+	}
+	if encapsulation == config.TZSPEncapsulation {
+		return tzspPort
+	}
+	return vxlanPort
+}
+
+// mirrorFilter returns the BPF filter leaving out the packets sent to the
+// target.
+func mirrorFilter(mirrorConfig *config.MirrorOutputConfig, ip net.IP) string {
+	if port := mirrorPort(mirrorConfig.Encapsulation, mirrorConfig.Port); port != 0 {
+		return fmt.Sprintf("not ( dst host %s and udp port %d )", ip, port)
+	}
+	if ip.To4() != nil {
+		return fmt.Sprintf("not ( dst host %s and ip proto %d )", ip, greProtocol)
+	}
+	return fmt.Sprintf("not ( dst host %s and ip6 proto %d )", ip, greProtocol)
+}
+
+// open connects to the target. GRE needs a raw socket, so the CAP_NET_RAW
+// capability.
+func (m *mirror) open() error {
+	var err error
+	if port := mirrorPort(m.config.Encapsulation, m.config.Port); port != 0 {
+		m.conn, err = net.Dial("udp", net.JoinHostPort(m.config.Address, strconv.Itoa(port)))
+	} else {
+		m.conn, err = net.Dial(fmt.Sprintf("ip:%d", greProtocol), m.config.Address)
+	}
+	return err
+}
+
+func (m *mirror) isOpen() bool {
+	return m.conn != nil
+}
+
+func (m *mirror) close() {
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+}
+
+// write sends the packets of the batch which are within the rate limits.
+// Batches which can't be decoded are discarded, as sending them again
+// wouldn't help.
+func (m *mirror) write(b *batch.Batch) error {
+	records := b.Data
+	if b.Codec == batch.CodecS2 {
+		var err error
+		m.decoded, err = s2.Decode(m.decoded[:cap(m.decoded)], b.Data)
+		if err != nil {
+			log.Printf("Discarding a batch for mirror %s: %v\n", m.config.Address, err)
+			return nil
+		}
+		records = m.decoded
+	}
+	if b != m.pending {
+		m.pending, m.sent = b, 0
+	}
+	records = records[m.sent:]
+
+	for len(records) > 0 {
+		_, data, rest, err := batch.NextRecord(records)
+		if err != nil {
+			log.Printf("Discarding the rest of a batch for mirror %s: %v\n", m.config.Address, err)
+			break
+		}
+		if err := m.send(data); err != nil {
+			return err
+		}
+		m.sent += len(records) - len(rest)
+		records = rest
+	}
+	m.pending = nil
+	return nil
+}
+
+func (m *mirror) send(data []byte) error {
+	m.buf = m.encapsulate(m.buf[:0], data)
+	now := time.Now()
+	if !m.packets.allow(now, 1) || !m.bytes.allow(now, len(m.buf)) {
+		atomic.AddUint64(&m.limited, 1)
+		return nil
+	}
+	_, err := m.conn.Write(m.buf)
+	// a target which isn't listening yet only discards the packets
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	return err
+}
+
+// encapsulate appends the headers of the encapsulation and the frame to buf.
+func (m *mirror) encapsulate(buf []byte, frame []byte) []byte {
+	switch m.config.Encapsulation {
+	case config.GREEncapsulation:
+		if m.config.VNI == 0 {
+			buf = binary.BigEndian.AppendUint16(buf, 0)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(layers.EthernetTypeTransparentEthernetBridging))
+			break
+		}
+		buf = binary.BigEndian.AppendUint16(buf, greFlagKey)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(layers.EthernetTypeTransparentEthernetBridging))
+		buf = binary.BigEndian.AppendUint32(buf, m.config.VNI)
+	case config.ERSPANEncapsulation:
+		buf = binary.BigEndian.AppendUint16(buf, greFlagSeq)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(layers.EthernetTypeERSPAN))
+		buf = binary.BigEndian.AppendUint32(buf, m.seq)
+		m.seq++
+		buf = binary.BigEndian.AppendUint16(buf, erspanVersion2<<12)
+		buf = binary.BigEndian.AppendUint16(buf, m.config.SessionID&0x3ff)
+		buf = binary.BigEndian.AppendUint32(buf, 0)
+	case config.TZSPEncapsulation:
+		buf = append(buf, tzspVersion, tzspTypeReceived)
+		buf = binary.BigEndian.AppendUint16(buf, tzspEncapEther)
+		buf = append(buf, tzspTagEnd)
+	default:
+		buf = append(buf, vxlanFlagVNI, 0, 0, 0)
+		buf = binary.BigEndian.AppendUint32(buf, m.config.VNI<<8)
+	}
+	return append(buf, frame...)
+}
+
+// rateLimiter is a token bucket holding up to a second worth of tokens. A nil
+// limiter doesn't limit anything.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate)}
+}
+
+// allow takes n tokens, if there are enough of them.
+func (l *rateLimiter) allow(now time.Time, n int) bool {
+	if l == nil {
+		return true
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
@@ -0,0 +1,170 @@
+package streamer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/testutils"
+)
+
+func TestMirrorEncapsulate(t *testing.T) {
+	frame := testutils.SyntheticPacket(t, 1, false, 7, 64)
+
+	for _, tt := range []struct {
+		testName string
+		config   *config.MirrorOutputConfig
+		first    gopacket.LayerType
+		check    func(t *testing.T, packet gopacket.Packet)
+	}{
+		{
+			testName: "vxlan",
+			config:   &config.MirrorOutputConfig{Encapsulation: config.VXLANEncapsulation, VNI: 42},
+			first:    layers.LayerTypeVXLAN,
+			check: func(t *testing.T, packet gopacket.Packet) {
+				vxlan := packet.Layer(layers.LayerTypeVXLAN).(*layers.VXLAN)
+				if !vxlan.ValidIDFlag || vxlan.VNI != 42 {
+					t.Errorf("unexpected VXLAN header %+v", vxlan)
+				}
+			},
+		},
+		{
+			testName: "gre",
+			config:   &config.MirrorOutputConfig{Encapsulation: config.GREEncapsulation, VNI: 42},
+			first:    layers.LayerTypeGRE,
+			check: func(t *testing.T, packet gopacket.Packet) {
+				gre := packet.Layer(layers.LayerTypeGRE).(*layers.GRE)
+				if !gre.KeyPresent || gre.Key != 42 || gre.Protocol != layers.EthernetTypeTransparentEthernetBridging {
+					t.Errorf("unexpected GRE header %+v", gre)
+				}
+			},
+		},
+		{
+			testName: "gre without key",
+			config:   &config.MirrorOutputConfig{Encapsulation: config.GREEncapsulation},
+			first:    layers.LayerTypeGRE,
+			check: func(t *testing.T, packet gopacket.Packet) {
+				if gre := packet.Layer(layers.LayerTypeGRE).(*layers.GRE); gre.KeyPresent {
+					t.Errorf("unexpected GRE header %+v", gre)
+				}
+			},
+		},
+		{
+			testName: "erspan",
+			config:   &config.MirrorOutputConfig{Encapsulation: config.ERSPANEncapsulation, SessionID: 7},
+			first:    layers.LayerTypeGRE,
+			check: func(t *testing.T, packet gopacket.Packet) {
+				gre := packet.Layer(layers.LayerTypeGRE).(*layers.GRE)
+				if !gre.SeqPresent || gre.Protocol != layers.EthernetTypeERSPAN {
+					t.Errorf("unexpected GRE header %+v", gre)
+				}
+				erspan := packet.Layer(layers.LayerTypeERSPANII).(*layers.ERSPANII)
+				if erspan.SessionID != 7 {
+					t.Errorf("unexpected ERSPAN header %+v", erspan)
+				}
+			},
+		},
+	} {
+		t.Run(tt.testName, func(t *testing.T) {
+			m := newMirror(tt.config)
+			packet := gopacket.NewPacket(m.encapsulate(nil, frame), tt.first, gopacket.Default)
+			if errLayer := packet.ErrorLayer(); errLayer != nil {
+				t.Fatalf("unexpected error: %v", errLayer.Error())
+			}
+			tt.check(t, packet)
+			ethernet := packet.Layer(layers.LayerTypeEthernet)
+			if ethernet == nil || !bytes.Equal(append(ethernet.LayerContents(), ethernet.LayerPayload()...), frame) {
+				t.Error("expected the original frame")
+			}
+		})
+	}
+
+	t.Run("tzsp", func(t *testing.T) {
+		m := newMirror(&config.MirrorOutputConfig{Encapsulation: config.TZSPEncapsulation})
+		expected := append([]byte{tzspVersion, tzspTypeReceived, 0, tzspEncapEther, tzspTagEnd}, frame...)
+		if got := m.encapsulate(nil, frame); !bytes.Equal(got, expected) {
+			t.Errorf("expected %x, got %x", expected, got)
+		}
+	})
+
+	t.Run("erspan sequence", func(t *testing.T) {
+		m := newMirror(&config.MirrorOutputConfig{Encapsulation: config.ERSPANEncapsulation})
+		m.encapsulate(nil, frame)
+		if seq := binary.BigEndian.Uint32(m.encapsulate(nil, frame)[4:8]); seq != 1 {
+			t.Errorf("expected sequence number 1, got %d", seq)
+		}
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(2)
+	if !l.allow(now, 1) || !l.allow(now, 1) || l.allow(now, 1) {
+		t.Error("expected a burst of 2 tokens")
+	}
+	if !l.allow(now.Add(500*time.Millisecond), 1) || l.allow(now.Add(500*time.Millisecond), 1) {
+		t.Error("expected a token after half a second")
+	}
+	if newRateLimiter(0) != nil {
+		t.Error("expected no limiter")
+	}
+}
+
+func TestMirrorOutput(t *testing.T) {
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer target.Close()
+	port := target.LocalAddr().(*net.UDPAddr).Port
+
+	cfg := testConfig()
+	cfg.Output.Sinks = []config.SinkConfig{{
+		Mirror: &config.MirrorOutputConfig{
+			Address:          "127.0.0.1",
+			Port:             &port,
+			VNI:              42,
+			PacketsPerSecond: 3,
+		},
+	}}
+	outputs, err := NewOutputs(context.Background(), cfg, "tcp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// packets of sensors and receivers
+	b := compressedBatch(t, 0, 1)
+	outputs.Write(b)
+	b.Release()
+	b = recordsBatch(t, 2, 3)
+	outputs.Write(b)
+	b.Release()
+	outputs.Close()
+
+	var seqs []uint32
+	buf := make([]byte, 2048)
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(seqs) < 3 {
+		n, _, err := target.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		packet := gopacket.NewPacket(buf[:n], layers.LayerTypeVXLAN, gopacket.Default)
+		vxlan, ok := packet.Layer(layers.LayerTypeVXLAN).(*layers.VXLAN)
+		if !ok || vxlan.VNI != 42 {
+			t.Fatalf("unexpected datagram %x", buf[:n])
+		}
+		seqs = append(seqs, binary.BigEndian.Uint32(buf[n-64:n]))
+	}
+	expectSequences(t, []uint32{0, 1, 2}, seqs)
+
+	if stats := outputs.Stats()[0]; stats.Written != 2 || stats.Limited != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,265 @@
+package streamer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+)
+
+const (
+	// mirrorReadBufferLen fits any datagram.
+	mirrorReadBufferLen = 65535
+
+	greFlagChecksum     = 0x8000
+	erspanType3Protocol = 0x22eb
+	erspan2HeaderLen    = 8
+	erspan3HeaderLen    = 12
+	// erspan3PlatformLen is the length of the optional platform specific
+	// subheader of ERSPAN type III, present when its O flag is set.
+	erspan3PlatformLen = 8
+
+	tzspTagPadding = 0
+)
+
+var (
+	errInvalidMirrorPacket = errors.New("invalid mirrored packet")
+	errUnsupportedPayload  = errors.New("unsupported encapsulated payload")
+)
+
+// listenMirror starts receiving mirrored traffic. GRE needs a raw socket, so
+// the CAP_NET_RAW capability.
+func listenMirror(input config.MirrorInputConfig, address string) (net.PacketConn, error) {
+	if input.Address != "" {
+		address = input.Address
+	}
+	if port := mirrorPort(input.Encapsulation, input.Port); port != 0 {
+		return net.ListenPacket("udp", net.JoinHostPort(address, strconv.Itoa(port)))
+	}
+	network := "ip4"
+	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+		network = "ip6"
+	}
+	return net.ListenPacket(fmt.Sprintf("%s:%d", network, greProtocol), address)
+}
+
+// serveMirror decapsulates the mirrored packets and gathers them in batches,
+// the same way sensors do. Every mirror session, told apart by the source of
+// the packets and their VNI, GRE key or ERSPAN session ID, is a virtual sensor
+// of its own.
+func serveMirror(conn net.PacketConn, input config.MirrorInputConfig, config *config.Config, pools *batchPools, output chan *batch.Batch, sizeChannel chan int) {
+	defer conn.Close()
+
+	gatherer := &mirrorGatherer{
+		config:      config,
+		pools:       pools,
+		output:      output,
+		sizeChannel: sizeChannel,
+		batches:     make(map[string]*batch.Batch),
+	}
+	buf := make([]byte, mirrorReadBufferLen)
+	flushTime := time.Now().Add(config.MaxGatherWait)
+	for {
+		conn.SetReadDeadline(flushTime)
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if time.Now().After(flushTime) {
+			gatherer.flushAll()
+			flushTime = time.Now().Add(config.MaxGatherWait)
+		}
+		if err != nil {
+			continue
+		}
+
+		frame, session, err := decapsulate(input.Encapsulation, buf[:n])
+		if err != nil {
+			log.Printf("Discarding %s packet from %s: %v\n", input.Encapsulation, addr, err)
+			continue
+		}
+		gatherer.add(session+"@"+addrIP(addr), frame)
+	}
+}
+
+func addrIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP.String()
+	case *net.IPAddr:
+		return addr.IP.String()
+	default:
+		return addr.String()
+	}
+}
+
+// mirrorGatherer gathers the packets of every virtual sensor in a batch of
+// its own.
+type mirrorGatherer struct {
+	config      *config.Config
+	pools       *batchPools
+	output      chan *batch.Batch
+	sizeChannel chan int
+	batches     map[string]*batch.Batch
+}
+
+func (g *mirrorGatherer) add(sensorID string, frame []byte) {
+	ci := gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(frame),
+		Length:        len(frame),
+	}
+	if ci.CaptureLength > g.config.InputPacketLen {
+		ci.CaptureLength = g.config.InputPacketLen
+	}
+
+	b, ok := g.batches[sensorID]
+	if ok && len(b.Data)+batch.RecordHeaderLen+ci.CaptureLength > g.config.MaxGatherLen {
+		g.flush(sensorID, b)
+		ok = false
+	}
+	if !ok {
+		b = g.pools.raw.Get()
+		b.SensorID = sensorID
+		b.LinkType = layers.LinkTypeEthernet
+		b.Codec = batch.CodecNone
+		g.batches[sensorID] = b
+	}
+	b.AppendPacket(ci, frame[:ci.CaptureLength])
+}
+
+func (g *mirrorGatherer) flush(sensorID string, b *batch.Batch) {
+	delete(g.batches, sensorID)
+	select {
+	case g.sizeChannel <- len(b.Data):
+	default:
+		log.Println("Size queue is full. Discarding")
+	}
+	select {
+	case g.output <- b:
+	default:
+		log.Println("Mirror output queue is full. Discarding")
+		b.Release()
+	}
+}
+
+func (g *mirrorGatherer) flushAll() {
+	for sensorID, b := range g.batches {
+		g.flush(sensorID, b)
+	}
+}
+
+// decapsulate returns the Ethernet frame carried by a mirrored packet, along
+// with the name of its mirror session.
+func decapsulate(encapsulation config.Encapsulation, data []byte) ([]byte, string, error) {
+	switch encapsulation {
+	case config.VXLANEncapsulation:
+		return decapsulateVXLAN(data)
+	case config.TZSPEncapsulation:
+		return decapsulateTZSP(data)
+	default:
+		return decapsulateGRE(data)
+	}
+}
+
+func decapsulateVXLAN(data []byte) ([]byte, string, error) {
+	if len(data) < 8 || data[0]&vxlanFlagVNI == 0 {
+		return nil, "", errInvalidMirrorPacket
+	}
+	vni := binary.BigEndian.Uint32(data[4:8]) >> 8
+	return data[8:], fmt.Sprintf("vxlan-%d", vni), nil
+}
+
+func decapsulateTZSP(data []byte) ([]byte, string, error) {
+	if len(data) < 4 || data[0] != tzspVersion {
+		return nil, "", errInvalidMirrorPacket
+	}
+	if binary.BigEndian.Uint16(data[2:4]) != tzspEncapEther {
+		return nil, "", errUnsupportedPayload
+	}
+	data = data[4:]
+	for {
+		if len(data) == 0 {
+			return nil, "", errInvalidMirrorPacket
+		}
+		switch data[0] {
+		case tzspTagEnd:
+			return data[1:], "tzsp", nil
+		case tzspTagPadding:
+			data = data[1:]
+		default:
+			if len(data) < 2 || len(data) < 2+int(data[1]) {
+				return nil, "", errInvalidMirrorPacket
+			}
+			data = data[2+int(data[1]):]
+		}
+	}
+}
+
+// decapsulateGRE takes Ethernet over GRE and ERSPAN types I, II and III.
+func decapsulateGRE(data []byte) ([]byte, string, error) {
+	if len(data) < 4 {
+		return nil, "", errInvalidMirrorPacket
+	}
+	flags := binary.BigEndian.Uint16(data[0:2])
+	protocol := binary.BigEndian.Uint16(data[2:4])
+	headerLen := 4
+	keyOffset := -1
+	if flags&greFlagChecksum != 0 {
+		headerLen += 4
+	}
+	if flags&greFlagKey != 0 {
+		keyOffset = headerLen
+		headerLen += 4
+	}
+	seq := flags&greFlagSeq != 0
+	if seq {
+		headerLen += 4
+	}
+	if len(data) < headerLen {
+		return nil, "", errInvalidMirrorPacket
+	}
+	header, data := data[:headerLen], data[headerLen:]
+
+	switch protocol {
+	case uint16(layers.EthernetTypeTransparentEthernetBridging):
+		if keyOffset < 0 {
+			return data, "gre", nil
+		}
+		return data, fmt.Sprintf("gre-%d", binary.BigEndian.Uint32(header[keyOffset:])), nil
+	case uint16(layers.EthernetTypeERSPAN):
+		// type I has no sequence number, nor header
+		if !seq {
+			return data, "erspan", nil
+		}
+		if len(data) < erspan2HeaderLen {
+			return nil, "", errInvalidMirrorPacket
+		}
+		session := binary.BigEndian.Uint16(data[2:4]) & 0x3ff
+		return data[erspan2HeaderLen:], fmt.Sprintf("erspan-%d", session), nil
+	case erspanType3Protocol:
+		if len(data) < erspan3HeaderLen {
+			return nil, "", errInvalidMirrorPacket
+		}
+		session := binary.BigEndian.Uint16(data[2:4]) & 0x3ff
+		headerLen := erspan3HeaderLen
+		if data[erspan3HeaderLen-1]&0x1 != 0 {
+			headerLen += erspan3PlatformLen
+		}
+		if len(data) < headerLen {
+			return nil, "", errInvalidMirrorPacket
+		}
+		return data[headerLen:], fmt.Sprintf("erspan-%d", session), nil
+	default:
+		return nil, "", errUnsupportedPayload
+	}
+}
@@ -0,0 +1,171 @@
+package streamer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/testutils"
+)
+
+func TestDecapsulate(t *testing.T) {
+	frame := testutils.SyntheticPacket(t, 1, false, 7, 64)
+	encapsulate := func(mirrorConfig *config.MirrorOutputConfig) []byte {
+		return newMirror(mirrorConfig).encapsulate(nil, frame)
+	}
+
+	for _, tt := range []struct {
+		testName      string
+		encapsulation config.Encapsulation
+		data          []byte
+		session       string
+	}{
+		{
+			testName:      "vxlan",
+			encapsulation: config.VXLANEncapsulation,
+			data:          encapsulate(&config.MirrorOutputConfig{Encapsulation: config.VXLANEncapsulation, VNI: 42}),
+			session:       "vxlan-42",
+		},
+		{
+			testName:      "gre",
+			encapsulation: config.GREEncapsulation,
+			data:          encapsulate(&config.MirrorOutputConfig{Encapsulation: config.GREEncapsulation}),
+			session:       "gre",
+		},
+		{
+			testName:      "gre with key",
+			encapsulation: config.GREEncapsulation,
+			data:          encapsulate(&config.MirrorOutputConfig{Encapsulation: config.GREEncapsulation, VNI: 42}),
+			session:       "gre-42",
+		},
+		{
+			testName:      "gre with checksum",
+			encapsulation: config.GREEncapsulation,
+			data:          append([]byte{0x80, 0x00, 0x65, 0x58, 0x12, 0x34, 0x00, 0x00}, frame...),
+			session:       "gre",
+		},
+		{
+			testName:      "erspan type I",
+			encapsulation: config.ERSPANEncapsulation,
+			data:          append([]byte{0x00, 0x00, 0x88, 0xbe}, frame...),
+			session:       "erspan",
+		},
+		{
+			testName:      "erspan type II",
+			encapsulation: config.ERSPANEncapsulation,
+			data:          encapsulate(&config.MirrorOutputConfig{Encapsulation: config.ERSPANEncapsulation, SessionID: 7}),
+			session:       "erspan-7",
+		},
+		{
+			testName:      "erspan type III with platform subheader",
+			encapsulation: config.GREEncapsulation,
+			data: append([]byte{
+				0x10, 0x00, 0x22, 0xeb, 0x00, 0x00, 0x00, 0x01,
+				0x20, 0x00, 0x00, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+				0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+			}, frame...),
+			session: "erspan-7",
+		},
+		{
+			testName:      "tzsp",
+			encapsulation: config.TZSPEncapsulation,
+			data:          encapsulate(&config.MirrorOutputConfig{Encapsulation: config.TZSPEncapsulation}),
+			session:       "tzsp",
+		},
+		{
+			testName:      "tzsp with tags",
+			encapsulation: config.TZSPEncapsulation,
+			data:          append([]byte{0x01, 0x00, 0x00, 0x01, 0x00, 0x0a, 0x01, 0xd8, 0x01}, frame...),
+			session:       "tzsp",
+		},
+	} {
+		t.Run(tt.testName, func(t *testing.T) {
+			got, session, err := decapsulate(tt.encapsulation, tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if session != tt.session || !bytes.Equal(got, frame) {
+				t.Errorf("expected session %s and the original frame, got session %s and %x", tt.session, session, got)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		testName      string
+		encapsulation config.Encapsulation
+		data          []byte
+	}{
+		{"truncated vxlan", config.VXLANEncapsulation, []byte{0x08, 0x00, 0x00}},
+		{"vxlan without VNI", config.VXLANEncapsulation, make([]byte, 8)},
+		{"tzsp without end tag", config.TZSPEncapsulation, []byte{0x01, 0x00, 0x00, 0x01, 0x00}},
+		{"tzsp of 802.11 frames", config.TZSPEncapsulation, []byte{0x01, 0x00, 0x00, 0x12, 0x01}},
+		{"truncated gre", config.GREEncapsulation, []byte{0x20, 0x00, 0x65, 0x58, 0x00}},
+		{"ip over gre", config.GREEncapsulation, []byte{0x00, 0x00, 0x08, 0x00}},
+		{"truncated erspan", config.ERSPANEncapsulation, []byte{0x10, 0x00, 0x88, 0xbe, 0x00, 0x00, 0x00, 0x01, 0x10}},
+	} {
+		t.Run(tt.testName, func(t *testing.T) {
+			if _, _, err := decapsulate(tt.encapsulation, tt.data); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestServeMirror(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxGatherWait = 10 * time.Millisecond
+	input := config.MirrorInputConfig{Encapsulation: config.VXLANEncapsulation, Port: freeUDPPort(t)}
+	conn, err := listenMirror(input, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	output := make(chan *batch.Batch, 10)
+	go serveMirror(conn, input, cfg, newBatchPools(cfg), output, make(chan int, 10))
+
+	// two mirror sessions
+	sensorConfig := testConfig()
+	for _, vni := range []uint32{42, 43} {
+		sensorConfig.Output.Sinks = append(sensorConfig.Output.Sinks, config.SinkConfig{
+			Mirror: &config.MirrorOutputConfig{Address: "127.0.0.1", Port: input.Port, VNI: vni},
+		})
+	}
+	outputs, err := NewOutputs(context.Background(), sensorConfig, "tcp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b := compressedBatch(t, 0, 1, 2)
+	outputs.Write(b)
+	b.Release()
+	outputs.Close()
+
+	received := make(map[string][]uint32)
+	for len(received["vxlan-42@127.0.0.1"])+len(received["vxlan-43@127.0.0.1"]) < 6 {
+		select {
+		case b := <-output:
+			if b.LinkType != layers.LinkTypeEthernet || b.Codec != batch.CodecNone || b.PacketCount == 0 {
+				t.Errorf("unexpected batch metadata %+v", b.Metadata)
+			}
+			for records := b.Data; len(records) > 0; {
+				_, data, rest, err := batch.NextRecord(records)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				received[b.SensorID] = append(received[b.SensorID], binary.BigEndian.Uint32(data[len(data)-64:]))
+				records = rest
+			}
+			b.Release()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for packets, got %v", received)
+		}
+	}
+	for _, sensorID := range []string{"vxlan-42@127.0.0.1", "vxlan-43@127.0.0.1"} {
+		expectSequences(t, []uint32{0, 1, 2}, received[sensorID])
+	}
+}
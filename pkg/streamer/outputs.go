@@ -0,0 +1,412 @@
+package streamer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/s2"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+)
+
+const (
+	// sinkQueueLen is the number of batches which can wait for a core
+	// output.
+	sinkQueueLen = maxNumPkts
+
+	maxReconnectBackoff = time.Minute
+)
+
+var (
+	minReconnectBackoff = time.Second
+
+	// errLinkTypeMismatch is returned for the batches which can't be written
+	// to the standard output, after packets of another link type.
+	errLinkTypeMismatch = errors.New("link type mismatch")
+)
+
+// SinkStats are the counters of a single core output.
+type SinkStats struct {
+	Name       string
+	Written    uint64
+	Dropped    uint64
+	Reconnects uint64
+	Queued     int
+	// Limited is the number of packets a mirror output discarded to stay
+	// within its rate limits.
+	Limited uint64
+}
+
+// Outputs are the core outputs of a sensor or a receiver. Every output (sink)
+// has its own queue and worker, so an output which is slow or down doesn't
+// hold back the other ones. Outputs which fail are reopened with backoff.
+type Outputs struct {
+	sinks    []*sink
+	lossless bool
+	wg       sync.WaitGroup
+}
+
+// sink is a single core output. Server outputs get PacketStreamer frames of
+// compressed batches, preceded by the ID of the sensor which captured them,
+// mirror outputs get the encapsulated packets, the other outputs get pcap
+// records. A file output of a sensor records the
+// stream of frames instead, which can be replayed later.
+type sink struct {
+	config     *config.Config
+	sinkConfig config.SinkConfig
+	name       string
+	proto      string
+	queue      chan *batch.Batch
+
+	// servers are the receivers of a server output, mirror is the target of
+	// a mirror output, w is used by the other outputs.
+	servers *serverPool
+	mirror  *mirror
+	w       io.WriteCloser
+	// pcapHeader is set when the pcap header has to be written before the
+	// next pcap records, linkType is the link type of the header written.
+	pcapHeader bool
+	linkType   layers.LinkType
+	// path is the file written to. A new file is started with a numbered
+	// path whenever the link type of the packets changes.
+	path  string
+	files int
+	// frames is the metadata of the frames written to w.
+	frames  frameState
+	opened  bool
+	encoded []byte
+
+	written    uint64
+	dropped    uint64
+	reconnects uint64
+}
+
+// NewOutputs opens all the configured core outputs. Server outputs which
+// can't be reached yet are retried in the background, any other failure is
+// returned.
+func NewOutputs(ctx context.Context, config *config.Config, proto string) (*Outputs, error) {
+	o := &Outputs{
+		lossless: config.Capture.File != nil,
+	}
+	for _, sinkConfig := range config.Output.Sinks {
+		s := &sink{
+			config:     config,
+			sinkConfig: sinkConfig,
+			name:       sinkConfig.String(),
+			proto:      proto,
+			queue:      make(chan *batch.Batch, sinkQueueLen),
+		}
+		if sinkConfig.Server != nil {
+			s.servers = newServerPool(config, sinkConfig.Server, proto, s.name, net.DefaultResolver)
+			go s.servers.maintain(ctx)
+		}
+		if sinkConfig.Mirror != nil {
+			s.mirror = newMirror(sinkConfig.Mirror)
+		}
+		if err := s.open(); err != nil {
+			if sinkConfig.Server == nil {
+				o.Close()
+				return nil, fmt.Errorf("could not open output %s: %w", s.name, err)
+			}
+			log.Printf("Could not connect to output %s, retrying in the background: %v\n", s.name, err)
+		}
+		o.sinks = append(o.sinks, s)
+
+		o.wg.Add(1)
+		go func() {
+			s.run(ctx)
+			o.wg.Done()
+		}()
+	}
+	return o, nil
+}
+
+// Write queues the batch for every output. The caller keeps its reference to
+// the batch. Outputs whose queue is full miss the batch, unless reading
+// packets from files, in which case Write waits for them.
+func (o *Outputs) Write(b *batch.Batch) {
+	for _, s := range o.sinks {
+		if o.lossless {
+			s.queue <- b.Retain()
+			continue
+		}
+		select {
+		case s.queue <- b.Retain():
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			b.Release()
+		}
+	}
+}
+
+// Close waits until the queued batches are written and closes the outputs.
+func (o *Outputs) Close() {
+	for _, s := range o.sinks {
+		close(s.queue)
+	}
+	o.wg.Wait()
+}
+
+func (o *Outputs) Stats() []SinkStats {
+	stats := make([]SinkStats, 0, len(o.sinks))
+	for _, s := range o.sinks {
+		sinkStats := SinkStats{
+			Name:       s.name,
+			Written:    atomic.LoadUint64(&s.written),
+			Dropped:    atomic.LoadUint64(&s.dropped),
+			Reconnects: atomic.LoadUint64(&s.reconnects),
+			Queued:     len(s.queue),
+		}
+		if s.mirror != nil {
+			sinkStats.Limited = atomic.LoadUint64(&s.mirror.limited)
+		}
+		stats = append(stats, sinkStats)
+	}
+	return stats
+}
+
+func (s *sink) run(ctx context.Context) {
+	backoff := minReconnectBackoff
+	for b := range s.queue {
+		for {
+			if !s.isOpen() {
+				if err := s.open(); err != nil {
+					log.Printf("Could not reopen output %s, retrying in %v: %v\n", s.name, backoff, err)
+					if !sleepContext(ctx, backoff) {
+						atomic.AddUint64(&s.dropped, 1)
+						break
+					}
+					if backoff *= 2; backoff > maxReconnectBackoff {
+						backoff = maxReconnectBackoff
+					}
+					continue
+				}
+				atomic.AddUint64(&s.reconnects, 1)
+				log.Printf("Reopened output %s\n", s.name)
+			}
+
+			err := s.write(b)
+			if err == nil {
+				atomic.AddUint64(&s.written, 1)
+				backoff = minReconnectBackoff
+				break
+			}
+			if errors.Is(err, errLinkTypeMismatch) {
+				log.Printf("Dropping a batch of output %s: %v\n", s.name, err)
+				atomic.AddUint64(&s.dropped, 1)
+				break
+			}
+			log.Printf("Error while writing to output %s: %v\n", s.name, err)
+			s.close()
+		}
+		b.Release()
+	}
+	s.close()
+	if s.servers != nil {
+		s.servers.close()
+	}
+}
+
+func (s *sink) isOpen() bool {
+	if s.servers != nil {
+		return s.servers.connected()
+	}
+	if s.mirror != nil {
+		return s.mirror.isOpen()
+	}
+	return s.w != nil
+}
+
+func (s *sink) open() error {
+	s.frames = frameState{}
+	switch {
+	case s.sinkConfig.File != nil:
+		return s.openFile()
+	case s.sinkConfig.Server != nil:
+		return s.servers.connect()
+	case s.sinkConfig.Mirror != nil:
+		return s.mirror.open()
+	default:
+		stream, err := initPcapStream(s.sinkConfig, s.config.InputPacketLen)
+		if err != nil {
+			return err
+		}
+		s.w = stream
+		return nil
+	}
+}
+
+// openFile opens the output file. The file is truncated when opened for the
+// first time and appended to when reopened.
+func (s *sink) openFile() error {
+	if s.path == "" {
+		s.path = s.sinkConfig.File.Path
+	}
+	path := s.path
+	if path == "stdout" {
+		s.w = nopCloser{os.Stdout}
+		s.pcapHeader = !s.opened
+		s.frames.resumed = s.opened
+		s.opened = true
+		return nil
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !s.opened {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.w = file
+	s.pcapHeader = info.Size() == 0
+	s.frames.resumed = info.Size() > 0
+	s.opened = true
+	if !s.pcapHeader {
+		s.linkType = fileLinkType(path)
+	}
+	return nil
+}
+
+// fileLinkType returns the link type of the pcap header of the file at path.
+// Files which can't be read are taken as Ethernet, the link type all the
+// files used to be written with.
+func fileLinkType(path string) layers.LinkType {
+	file, err := os.Open(path)
+	if err != nil {
+		return layers.LinkTypeEthernet
+	}
+	defer file.Close()
+	reader, err := pcapgo.NewReader(file)
+	if err != nil {
+		return layers.LinkTypeEthernet
+	}
+	return reader.LinkType()
+}
+
+// nextFile starts a new output file for packets of another link type, after
+// the configured path with a number, e.g. dump.1.pcap after dump.pcap.
+func (s *sink) nextFile(linkType layers.LinkType) error {
+	if s.path == "stdout" {
+		return fmt.Errorf("%w: %v packets after %v ones", errLinkTypeMismatch, linkType, s.linkType)
+	}
+	s.close()
+	s.files++
+	path := s.sinkConfig.File.Path
+	ext := filepath.Ext(path)
+	s.path = fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), s.files, ext)
+	s.opened = false
+	log.Printf("Writing the %v packets of output %s to %s\n", linkType, s.name, s.path)
+	return s.openFile()
+}
+
+func (s *sink) write(b *batch.Batch) error {
+	if s.mirror != nil {
+		return s.mirror.write(b)
+	}
+	if s.sinkConfig.Server == nil && b.Codec == batch.CodecNone {
+		linkType := b.PcapLinkType()
+		if stream, ok := s.w.(*pcapStream); ok {
+			stream.setLinkType(linkType)
+			return writeFull(s.w, b.Data)
+		}
+		if !s.pcapHeader && linkType != s.linkType {
+			if err := s.nextFile(linkType); err != nil {
+				return err
+			}
+		}
+		if s.pcapHeader {
+			header := pcapFileHeader(s.config.InputPacketLen, linkType)
+			if err := writeFull(s.w, header); err != nil {
+				return err
+			}
+			s.pcapHeader = false
+			s.linkType = linkType
+		}
+		return writeFull(s.w, b.Data)
+	}
+
+	// forward the original compressed data when there is one
+	compressed := b
+	if compressed.Codec == batch.CodecNone && compressed.Source != nil {
+		compressed = compressed.Source
+	}
+	payload := compressed.Data
+	if compressed.Codec == batch.CodecNone {
+		s.encoded = s2.Encode(s.encoded[:cap(s.encoded)], compressed.Data)
+		payload = s.encoded
+	}
+
+	if s.servers != nil {
+		return s.servers.write(b.SensorID, b.PcapLinkType(), payload)
+	}
+	return s.frames.write(s.w, b.SensorID, b.PcapLinkType(), payload)
+}
+
+// writeFrame writes the payload as a single PacketStreamer frame.
+func writeFrame(w io.Writer, magic, payload []byte) error {
+	var header [8]byte
+	copy(header[:], magic)
+	binary.LittleEndian.PutUint32(header[len(magic):], uint32(len(payload)))
+	buffers := net.Buffers{header[:], payload}
+	_, err := buffers.WriteTo(w)
+	return err
+}
+
+func (s *sink) close() {
+	if s.mirror != nil {
+		s.mirror.close()
+	}
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// deadlineConn fails writes to a server which stopped reading, so that the
+// connection gets reopened.
+type deadlineConn struct {
+	net.Conn
+}
+
+func (c deadlineConn) Write(p []byte) (int, error) {
+	c.SetWriteDeadline(time.Now().Add(connTimeout * time.Second))
+	return c.Conn.Write(p)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
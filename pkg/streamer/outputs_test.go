@@ -0,0 +1,390 @@
+package streamer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/s2"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/replay"
+)
+
+func init() {
+	minReconnectBackoff = time.Millisecond
+}
+
+// recordsBatch returns a batch of pcap records, like the ones written by
+// receivers.
+func recordsBatch(t *testing.T, seqs ...uint32) *batch.Batch {
+	t.Helper()
+
+	b := batch.NewPool(64 * 1024).Get()
+	b.Data = append(b.Data, pcapRecords(t, seqs...)...)
+	b.LinkType = layers.LinkTypeEthernet
+	return b
+}
+
+// compressedBatch returns a batch of compressed pcap records, like the ones
+// written by sensors.
+func compressedBatch(t *testing.T, seqs ...uint32) *batch.Batch {
+	t.Helper()
+
+	b := batch.NewPool(64 * 1024).Get()
+	b.Data = s2.Encode(b.Data[:cap(b.Data)], pcapRecords(t, seqs...))
+	b.LinkType = layers.LinkTypeEthernet
+	b.Codec = batch.CodecS2
+	return b
+}
+
+func portOf(t *testing.T, listener net.Listener) *int {
+	t.Helper()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	return &port
+}
+
+// readFrames reads PacketStreamer frames from the connection and returns the
+// sequence numbers of the packets in them.
+func readFrames(conn net.Conn, frames int) ([]uint32, error) {
+	var seqs []uint32
+	header := make([]byte, 8)
+	for i := 0; i < frames; i++ {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return seqs, err
+		}
+		if !bytes.Equal(header[:4], hdrData[:]) {
+			return seqs, replay.ErrInvalidFrame
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return seqs, err
+		}
+		records, err := s2.Decode(nil, payload)
+		if err != nil {
+			return seqs, err
+		}
+		for len(records) > 0 {
+			capLen := int(binary.LittleEndian.Uint32(records[8:12]))
+			payload := records[batch.RecordHeaderLen+capLen-64 : batch.RecordHeaderLen+capLen]
+			seqs = append(seqs, binary.BigEndian.Uint32(payload[0:4]))
+			records = records[batch.RecordHeaderLen+capLen:]
+		}
+	}
+	return seqs, nil
+}
+
+func readPcapSequences(t *testing.T, r io.Reader) []uint32 {
+	t.Helper()
+
+	reader, err := pcapgo.NewReader(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var seqs []uint32
+	for {
+		data, _, err := reader.ReadPacketData()
+		if err == io.EOF {
+			return seqs
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		seqs = append(seqs, binary.BigEndian.Uint32(data[len(data)-64:]))
+	}
+}
+
+func expectSequences(t *testing.T, expected, got []uint32) {
+	t.Helper()
+
+	if len(expected) != len(got) {
+		t.Fatalf("expected packets %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if expected[i] != got[i] {
+			t.Fatalf("expected packets %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestOutputsFileAndServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+
+	type result struct {
+		seqs []uint32
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		seqs, err := readFrames(conn, 2)
+		results <- result{seqs: seqs, err: err}
+	}()
+
+	path := filepath.Join(t.TempDir(), "dump.pcap")
+	cfg := testConfig()
+	cfg.Output.Sinks = []config.SinkConfig{
+		{File: &config.FileOutputConfig{Path: path}},
+		{Server: &config.ServerOutputConfig{Address: "127.0.0.1", Port: portOf(t, listener)}},
+	}
+	outputs, err := NewOutputs(context.Background(), cfg, "tcp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, b := range []*batch.Batch{recordsBatch(t, 0, 1), recordsBatch(t, 2)} {
+		outputs.Write(b)
+		b.Release()
+	}
+	outputs.Close()
+
+	// the server gets the records compressed
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("unexpected error: %v", res.err)
+	}
+	expectSequences(t, []uint32{0, 1, 2}, res.seqs)
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer file.Close()
+	expectSequences(t, []uint32{0, 1, 2}, readPcapSequences(t, file))
+
+	for _, stats := range outputs.Stats() {
+		if stats.Written != 2 || stats.Dropped != 0 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+	}
+}
+
+func TestOutputsFileLinkType(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig()
+	cfg.Output.Sinks = []config.SinkConfig{
+		{File: &config.FileOutputConfig{Path: filepath.Join(dir, "dump.pcap")}},
+	}
+	outputs, err := NewOutputs(context.Background(), cfg, "tcp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sll := recordsBatch(t, 2)
+	sll.LinkType = layers.LinkTypeLinuxSLL
+	unknown := recordsBatch(t, 4)
+	unknown.LinkType = layers.LinkTypeNull
+	for _, b := range []*batch.Batch{recordsBatch(t, 0, 1), sll, recordsBatch(t, 3), unknown} {
+		outputs.Write(b)
+		b.Release()
+	}
+	outputs.Close()
+
+	// every change of link type starts a new file
+	for _, tt := range []struct {
+		name     string
+		linkType layers.LinkType
+		seqs     []uint32
+	}{
+		{name: "dump.pcap", linkType: layers.LinkTypeEthernet, seqs: []uint32{0, 1}},
+		{name: "dump.1.pcap", linkType: layers.LinkTypeLinuxSLL, seqs: []uint32{2}},
+		{name: "dump.2.pcap", linkType: layers.LinkTypeEthernet, seqs: []uint32{3, 4}},
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, tt.name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		reader, err := pcapgo.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if reader.LinkType() != tt.linkType {
+			t.Errorf("expected link type %v in %s, got %v", tt.linkType, tt.name, reader.LinkType())
+		}
+		expectSequences(t, tt.seqs, readPcapSequences(t, bytes.NewReader(data)))
+	}
+}
+
+func TestOutputsStreamFileLinkType(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.stream")
+	cfg := testConfig()
+	cfg.Output.Sinks = []config.SinkConfig{
+		{File: &config.FileOutputConfig{Path: path}},
+	}
+	outputs, err := NewOutputs(context.Background(), cfg, "tcp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sll := compressedBatch(t, 1)
+	sll.LinkType = layers.LinkTypeLinuxSLL
+	for _, b := range []*batch.Batch{compressedBatch(t, 0), sll, compressedBatch(t, 2)} {
+		outputs.Write(b)
+		b.Release()
+	}
+	outputs.Close()
+
+	// the compressed batches are written as frames, announcing their link
+	// types
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer file.Close()
+	reader, err := replay.NewReader(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, expected := range []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL, layers.LinkTypeEthernet} {
+		_, _, linkType, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if linkType != expected {
+			t.Errorf("expected link type %v of packet %d, got %v", expected, i, linkType)
+		}
+	}
+}
+
+func TestOutputsServerReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+
+	// every connection gets closed after a single frame
+	received := make(chan []uint32, 3)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			seqs, _ := readFrames(conn, 1)
+			conn.Close()
+			received <- seqs
+		}
+	}()
+
+	cfg := testConfig()
+	cfg.Output.Sinks = []config.SinkConfig{
+		{Server: &config.ServerOutputConfig{Address: "127.0.0.1", Port: portOf(t, listener)}},
+	}
+	outputs, err := NewOutputs(context.Background(), cfg, "tcp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer outputs.Close()
+
+	var seqs []uint32
+	for seq := uint32(0); seq < 3; seq++ {
+		b := compressedBatch(t, seq)
+		outputs.Write(b)
+		b.Release()
+
+		// wait for the frame, so the next write hits the closed connection
+		select {
+		case frame := <-received:
+			seqs = append(seqs, frame...)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for packet %d", seq)
+		}
+	}
+	expectSequences(t, []uint32{0, 1, 2}, seqs)
+	if stats := outputs.Stats()[0]; stats.Reconnects == 0 {
+		t.Errorf("expected the output to reconnect, got %+v", stats)
+	}
+}
+
+func TestOutputsIndependent(t *testing.T) {
+	// nothing listens on the port anymore
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	port := portOf(t, listener)
+	listener.Close()
+
+	path := filepath.Join(t.TempDir(), "sensor.stream")
+	cfg := testConfig()
+	cfg.Output.Sinks = []config.SinkConfig{
+		{Server: &config.ServerOutputConfig{Address: "127.0.0.1", Port: port}},
+		{File: &config.FileOutputConfig{Path: path}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	outputs, err := NewOutputs(ctx, cfg, "tcp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the file output doesn't wait for the server, whose queue fills up
+	for seq := uint32(0); seq < 2*sinkQueueLen; seq++ {
+		b := compressedBatch(t, seq)
+		outputs.Write(b)
+		b.Release()
+
+		if (seq+1)%sinkQueueLen == 0 {
+			deadline := time.Now().Add(5 * time.Second)
+			for outputs.Stats()[1].Written < uint64(seq+1) && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	cancel()
+	outputs.Close()
+
+	stats := outputs.Stats()
+	if stats[0].Written != 0 || stats[0].Dropped == 0 {
+		t.Errorf("expected the server output to drop batches, got %+v", stats[0])
+	}
+	if stats[1].Written != 2*sinkQueueLen {
+		t.Errorf("expected the file output to write all the batches, got %+v", stats[1])
+	}
+
+	// a sensor records the stream of frames, which can be replayed
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer file.Close()
+	reader, err := replay.NewReader(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for seq := uint32(0); seq < 2*sinkQueueLen; seq++ {
+		data, _, _, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := binary.BigEndian.Uint32(data[len(data)-64:]); got != seq {
+			t.Fatalf("expected packet %d, got %d", seq, got)
+		}
+	}
+}
+
+func TestNewOutputsInvalid(t *testing.T) {
+	cfg := testConfig()
+	cfg.Output.Sinks = []config.SinkConfig{
+		{File: &config.FileOutputConfig{Path: filepath.Join(t.TempDir(), "missing", "dump.pcap")}},
+	}
+	if _, err := NewOutputs(context.Background(), cfg, "tcp"); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,264 @@
+package streamer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/deepfence/PacketStreamer/pkg/config"
+)
+
+const (
+	// pcapReaderQueueLen is the number of batches which can wait for a slow
+	// reader of a pcap stream before they get discarded.
+	pcapReaderQueueLen = maxNumPkts
+
+	// pipeRetryInterval is how long to wait before trying to open a named
+	// pipe again after a failure.
+	pipeRetryInterval = 5 * time.Second
+)
+
+// errLinkTypeChanged detaches the readers of a stream whose link type changed.
+var errLinkTypeChanged = errors.New("link type changed")
+
+// pcapStream serves a live pcap stream to any number of readers. Every reader
+// gets its own pcap header first, followed by the records written after it
+// attached. Readers which can't keep up lose batches instead of slowing the
+// receiver down.
+type pcapStream struct {
+	snapLen  int
+	listener net.Listener
+
+	mu       sync.Mutex
+	linkType layers.LinkType
+	header   []byte
+	readers  map[*pcapReader]struct{}
+}
+
+type pcapReader struct {
+	name      string
+	w         io.WriteCloser
+	queue     chan []byte
+	discarded uint64
+	// detached is closed when the stream detaches the reader.
+	detached chan struct{}
+	done     chan struct{}
+}
+
+func newPcapStream(snapLen int) *pcapStream {
+	return &pcapStream{
+		snapLen:  snapLen,
+		linkType: layers.LinkTypeEthernet,
+		header:   pcapFileHeader(snapLen, layers.LinkTypeEthernet),
+		readers:  make(map[*pcapReader]struct{}),
+	}
+}
+
+func pcapFileHeader(snapLen int, linkType layers.LinkType) []byte {
+	var header bytes.Buffer
+	pcapgo.NewWriter(&header).WriteFileHeader(uint32(snapLen), linkType)
+	return header.Bytes()
+}
+
+// setLinkType changes the link type of the records written next. The
+// attached readers got the header of the previous link type, so they are
+// detached, and get the new header when they attach again.
+func (s *pcapStream) setLinkType(linkType layers.LinkType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if linkType == s.linkType {
+		return
+	}
+	s.linkType = linkType
+	s.header = pcapFileHeader(s.snapLen, linkType)
+	for reader := range s.readers {
+		delete(s.readers, reader)
+		close(reader.detached)
+	}
+}
+
+// Write queues the pcap records for all the attached readers. It never fails,
+// the stream is just discarded when nobody reads it.
+func (s *pcapStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.readers) == 0 {
+		return len(p), nil
+	}
+	// shared by the readers, which only read it
+	data := append([]byte(nil), p...)
+	for reader := range s.readers {
+		select {
+		case reader.queue <- data:
+		default:
+			reader.discarded++
+		}
+	}
+	return len(p), nil
+}
+
+// Close stops accepting readers and detaches the attached ones.
+func (s *pcapStream) Close() error {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for reader := range s.readers {
+		reader.w.Close()
+	}
+	return nil
+}
+
+// attach starts streaming to w. The returned channel is closed once writing
+// to w fails, i.e. when the reader went away.
+func (s *pcapStream) attach(name string, w io.WriteCloser) <-chan struct{} {
+	reader := &pcapReader{
+		name:     name,
+		w:        w,
+		queue:    make(chan []byte, pcapReaderQueueLen),
+		detached: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.readers[reader] = struct{}{}
+	header := s.header
+	s.mu.Unlock()
+	log.Printf("Pcap reader attached to %s\n", name)
+
+	go func() {
+		err := writeFull(w, header)
+		for err == nil {
+			select {
+			case data := <-reader.queue:
+				err = writeFull(w, data)
+			case <-reader.detached:
+				err = errLinkTypeChanged
+			}
+		}
+
+		s.mu.Lock()
+		delete(s.readers, reader)
+		discarded := reader.discarded
+		s.mu.Unlock()
+		w.Close()
+		log.Printf("Pcap reader detached from %s (%v), %d batches discarded\n", name, err, discarded)
+		close(reader.done)
+	}()
+	return reader.done
+}
+
+// serve attaches every connection accepted by the listener as a reader.
+func (s *pcapStream) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Unable to accept pcap readers on %s: %v\n", listener.Addr(), err)
+			return
+		}
+		name := listener.Addr().String()
+		// unnamed UNIX domain sockets show up as "@"
+		if remoteAddr := conn.RemoteAddr().String(); remoteAddr != "" && remoteAddr != "@" {
+			name = fmt.Sprintf("%s from %s", name, remoteAddr)
+		}
+		s.attach(name, conn)
+	}
+}
+
+// servePipe writes the stream to the named pipe at path, waiting for a new
+// reader whenever the previous one goes away. The pipe is created again if it
+// was removed in the meantime.
+func (s *pcapStream) servePipe(path string) {
+	for {
+		pipe, err := openPipe(path)
+		if err != nil {
+			log.Printf("Unable to open pipe %s: %v\n", path, err)
+			time.Sleep(pipeRetryInterval)
+			continue
+		}
+		<-s.attach(path, pipe)
+	}
+}
+
+// openPipe creates the named pipe if needed and opens it for writing, which
+// blocks until a reader opens it.
+func openPipe(path string) (*os.File, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := syscall.Mkfifo(path, 0644); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if info.Mode()&os.ModeNamedPipe == 0 {
+		return nil, fmt.Errorf("%s exists and is not a named pipe", path)
+	}
+	return os.OpenFile(path, os.O_WRONLY, 0)
+}
+
+// listenUnix listens on the UNIX domain socket at path, removing the socket
+// left behind by a previous run.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// initPcapStream starts serving the pcap stream on the pipe, UNIX domain
+// socket or TCP listener of the sink.
+func initPcapStream(sinkConfig config.SinkConfig, snapLen int) (*pcapStream, error) {
+	stream := newPcapStream(snapLen)
+	switch {
+	case sinkConfig.Pipe != nil:
+		go stream.servePipe(sinkConfig.Pipe.Path)
+	case sinkConfig.UnixSocket != nil:
+		listener, err := listenUnix(sinkConfig.UnixSocket.Path)
+		if err != nil {
+			return nil, err
+		}
+		stream.listener = listener
+		go stream.serve(listener)
+	case sinkConfig.TCPListener != nil:
+		addr := sinkConfig.TCPListener.Address
+		if sinkConfig.TCPListener.Port != nil {
+			addr = fmt.Sprintf("%s:%d", sinkConfig.TCPListener.Address, *sinkConfig.TCPListener.Port)
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		stream.listener = listener
+		go stream.serve(listener)
+	default:
+		return nil, fmt.Errorf("unsupported pcap stream output %s", sinkConfig)
+	}
+	return stream, nil
+}
+
+func writeFull(w io.Writer, data []byte) error {
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
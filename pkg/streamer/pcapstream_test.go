@@ -0,0 +1,221 @@
+package streamer
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/testutils"
+)
+
+// pcapRecords returns the pcap records of packets carrying the given sequence
+// numbers.
+func pcapRecords(t *testing.T, seqs ...uint32) []byte {
+	t.Helper()
+
+	b := &batch.Batch{}
+	ts := time.Unix(1650000000, 0)
+	for _, seq := range seqs {
+		data := testutils.SyntheticPacket(t, 0, false, seq, 64)
+		b.AppendPacket(gopacket.CaptureInfo{
+			Timestamp:     ts.Add(time.Duration(seq) * time.Millisecond),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}, data)
+	}
+	return b.Data
+}
+
+func waitForReaders(t *testing.T, stream *pcapStream, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		stream.mu.Lock()
+		attached := len(stream.readers)
+		stream.mu.Unlock()
+		if attached == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d readers", n)
+}
+
+// expectPcapStream checks that the reader starts with a pcap header and then
+// gets the packets with the given sequence numbers.
+func expectPcapStream(t *testing.T, reader *pcapgo.Reader, seqs ...uint32) {
+	t.Helper()
+
+	if reader.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("expected link type %v, got %v", layers.LinkTypeEthernet, reader.LinkType())
+	}
+	for _, seq := range seqs {
+		data, _, err := reader.ReadPacketData()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		payload := data[len(data)-64:]
+		if got := binary.BigEndian.Uint32(payload[0:4]); got != seq {
+			t.Errorf("expected packet %d, got %d", seq, got)
+		}
+	}
+}
+
+func TestPcapStreamUnixSocket(t *testing.T) {
+	cfg := testConfig()
+	socketPath := filepath.Join(t.TempDir(), "pcap.sock")
+	stream := newPcapStream(cfg.InputPacketLen)
+	listener, err := listenUnix(socketPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+	go stream.serve(listener)
+
+	// nobody reads the stream yet
+	if _, err := stream.Write(pcapRecords(t, 0)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	first, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer first.Close()
+	waitForReaders(t, stream, 1)
+	stream.Write(pcapRecords(t, 1, 2))
+
+	second, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer second.Close()
+	waitForReaders(t, stream, 2)
+	stream.Write(pcapRecords(t, 3))
+
+	for _, tt := range []struct {
+		conn net.Conn
+		seqs []uint32
+	}{
+		{conn: first, seqs: []uint32{1, 2, 3}},
+		// joins mid-stream with its own header
+		{conn: second, seqs: []uint32{3}},
+	} {
+		tt.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader, err := pcapgo.NewReader(tt.conn)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expectPcapStream(t, reader, tt.seqs...)
+	}
+
+	// a reader going away doesn't affect the others
+	first.Close()
+	for i := 0; i < 10; i++ {
+		stream.Write(pcapRecords(t, 4))
+	}
+	waitForReaders(t, stream, 1)
+}
+
+func TestPcapStreamPipe(t *testing.T) {
+	cfg := testConfig()
+	pipePath := filepath.Join(t.TempDir(), "pcap.pipe")
+	stream := newPcapStream(cfg.InputPacketLen)
+	go stream.servePipe(pipePath)
+
+	for i, seq := range []uint32{10, 20} {
+		var pipe *os.File
+		var err error
+		// the pipe shows up once the stream starts serving it
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			pipe, err = os.Open(pipePath)
+			if err == nil || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		waitForReaders(t, stream, 1)
+		stream.Write(pcapRecords(t, seq, seq+1))
+
+		// every reader of the pipe gets a fresh header
+		reader, err := pcapgo.NewReader(pipe)
+		if err != nil {
+			t.Fatalf("reader %d: unexpected error: %v", i, err)
+		}
+		expectPcapStream(t, reader, seq, seq+1)
+		pipe.Close()
+
+		// the writer notices the reader is gone on the next write
+		for j := 0; j < 10; j++ {
+			stream.Write(pcapRecords(t, 0))
+		}
+		waitForReaders(t, stream, 0)
+	}
+}
+
+func TestPcapStreamLinkType(t *testing.T) {
+	cfg := testConfig()
+	socketPath := filepath.Join(t.TempDir(), "pcap.sock")
+	stream := newPcapStream(cfg.InputPacketLen)
+	listener, err := listenUnix(socketPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+	go stream.serve(listener)
+
+	first, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer first.Close()
+	waitForReaders(t, stream, 1)
+
+	// the reader of the Ethernet stream is detached
+	stream.setLinkType(layers.LinkTypeLinuxSLL)
+	stream.Write(pcapRecords(t, 0))
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader, err := pcapgo.NewReader(first)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := reader.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected the stream to end, got %v", err)
+	}
+	waitForReaders(t, stream, 0)
+
+	// and the next one gets the new link type
+	second, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer second.Close()
+	waitForReaders(t, stream, 1)
+	stream.Write(pcapRecords(t, 1))
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader, err = pcapgo.NewReader(second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reader.LinkType() != layers.LinkTypeLinuxSLL {
+		t.Errorf("expected link type %v, got %v", layers.LinkTypeLinuxSLL, reader.LinkType())
+	}
+	if _, _, err := reader.ReadPacketData(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
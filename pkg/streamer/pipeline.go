@@ -0,0 +1,128 @@
+package streamer
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/flow"
+	"github.com/deepfence/PacketStreamer/pkg/plugins"
+)
+
+const (
+	// gatherQueueLen is the number of captured packets which can wait for
+	// gathering, split evenly between the workers.
+	gatherQueueLen = maxNumPkts * 500
+)
+
+// pipeline spreads captured packets across a set of workers, each of which
+// gathers the packets into batches and compresses them. Packets of the same
+// flow (or interface, depending on the config) are always handled by the same
+// worker, so their order is preserved. A lossless pipeline waits for the
+// output instead of discarding batches when it can't keep up, which is what
+// we want when reading packets from files.
+type pipeline struct {
+	shardBy  config.ShardBy
+	shards   []chan capturedPacket
+	lossless bool
+	wg       sync.WaitGroup
+
+	// intfShards maps the interface names to their shards when sharding by
+	// interface. Interfaces are assigned to the shards in a round-robin
+	// fashion, in order of appearance.
+	intfShards    sync.Map
+	nextIntfShard uint32
+}
+
+// startPipeline starts the configured number of gather and compression
+// workers. The compressed batches are written to output.
+func startPipeline(config *config.Config, pools *batchPools, output chan *batch.Batch,
+	pluginManager *plugins.Manager) *pipeline {
+
+	workers := config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	queueLen := gatherQueueLen / workers
+	if queueLen < maxNumPkts {
+		queueLen = maxNumPkts
+	}
+
+	p := &pipeline{
+		shardBy:  config.ShardBy,
+		shards:   make([]chan capturedPacket, workers),
+		lossless: config.Capture.File != nil,
+	}
+	for i := range p.shards {
+		pktGatherChannel := make(chan capturedPacket, queueLen)
+		pktCompressChannel := make(chan *batch.Batch, maxNumPkts)
+		p.shards[i] = pktGatherChannel
+
+		p.wg.Add(2)
+		go func() {
+			gatherPkts(config, pools, pktGatherChannel, pktCompressChannel, pluginManager, p.lossless)
+			close(pktCompressChannel)
+			p.wg.Done()
+		}()
+		go func() {
+			compressPkts(config, pools, pktCompressChannel, output, p.lossless)
+			p.wg.Done()
+		}()
+	}
+	return p
+}
+
+// dispatch queues the packet on its shard. It returns false when the queue is
+// full, in which case the caller keeps the ownership of the packet data.
+func (p *pipeline) dispatch(pkt capturedPacket) bool {
+	select {
+	case p.shards[p.shardFor(pkt)] <- pkt:
+		return true
+	default:
+		return false
+	}
+}
+
+// send queues the packet on its shard, waiting until there's room for it. It
+// returns false when the context is done before that, in which case the caller
+// keeps the ownership of the packet data.
+func (p *pipeline) send(ctx context.Context, pkt capturedPacket) bool {
+	select {
+	case p.shards[p.shardFor(pkt)] <- pkt:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// close stops accepting packets and waits until the workers have flushed all
+// the queued packets to the output.
+func (p *pipeline) close() {
+	for _, shard := range p.shards {
+		close(shard)
+	}
+	p.wg.Wait()
+}
+
+func (p *pipeline) shardFor(pkt capturedPacket) int {
+	if len(p.shards) == 1 {
+		return 0
+	}
+	if p.shardBy == config.ShardByFlow {
+		if key, ok := flow.Parse(pkt.linkType, *pkt.data); ok {
+			return int(key.Hash() % uint32(len(p.shards)))
+		}
+	}
+	return p.intfShard(pkt.intf)
+}
+
+func (p *pipeline) intfShard(intf string) int {
+	if shard, ok := p.intfShards.Load(intf); ok {
+		return shard.(int)
+	}
+	next := int(atomic.AddUint32(&p.nextIntfShard, 1)-1) % len(p.shards)
+	shard, _ := p.intfShards.LoadOrStore(intf, next)
+	return shard.(int)
+}
@@ -0,0 +1,163 @@
+package streamer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/klauspost/compress/s2"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/testutils"
+)
+
+func TestIntfShard(t *testing.T) {
+	cfg := testConfig()
+	cfg.Workers = 2
+	cfg.ShardBy = config.ShardByInterface
+	pipeline := startPipeline(cfg, newBatchPools(cfg), make(chan *batch.Batch, 1), nil)
+	defer pipeline.close()
+
+	eth0, eth1 := pipeline.intfShard("eth0"), pipeline.intfShard("eth1")
+	if eth0 == eth1 {
+		t.Errorf("expected the interfaces to be assigned to different shards, got %d", eth0)
+	}
+	if shard := pipeline.intfShard("eth0"); shard != eth0 {
+		t.Errorf("expected eth0 to stay in shard %d, got %d", eth0, shard)
+	}
+}
+
+func TestPipelineFlowOrder(t *testing.T) {
+	// keep the number of batches below the capacity of the compression
+	// queues, so that no batch gets discarded
+	const (
+		flows          = 16
+		packetsPerFlow = 50
+		payloadLen     = 64
+	)
+
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Workers = workers
+			cfg.MaxGatherLen = 2 * 1024
+			cfg.MaxEncodedLen = s2.MaxEncodedLen(cfg.MaxGatherLen)
+			pools := newBatchPools(cfg)
+			output := make(chan *batch.Batch, flows*packetsPerFlow)
+			pipeline := startPipeline(cfg, pools, output, nil)
+
+			for seq := 0; seq < packetsPerFlow; seq++ {
+				for flow := 0; flow < flows; flow++ {
+					// alternate the directions, both should end up in the same shard
+					packet := testutils.SyntheticPacket(t, flow, seq%2 == 1, uint32(seq), payloadLen)
+					data := pools.packets.Get(len(packet))
+					copy(*data, packet)
+					pkt := capturedPacket{
+						intf:     "eth0",
+						linkType: layers.LinkTypeEthernet,
+						ci: gopacket.CaptureInfo{
+							Timestamp:     time.Now(),
+							CaptureLength: len(packet),
+							Length:        len(packet),
+						},
+						data: data,
+					}
+					pipeline.shards[pipeline.shardFor(pkt)] <- pkt
+				}
+			}
+			pipeline.close()
+			close(output)
+
+			received := make(map[uint32][]uint32)
+			for b := range output {
+				records, err := s2.Decode(nil, b.Data)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				b.Release()
+				for len(records) > 0 {
+					capLen := int(binary.LittleEndian.Uint32(records[8:12]))
+					payload := records[batch.RecordHeaderLen+capLen-payloadLen : batch.RecordHeaderLen+capLen]
+					flow := binary.BigEndian.Uint32(payload[4:8])
+					received[flow] = append(received[flow], binary.BigEndian.Uint32(payload[0:4]))
+					records = records[batch.RecordHeaderLen+capLen:]
+				}
+			}
+
+			if len(received) != flows {
+				t.Fatalf("expected %d flows, got %d", flows, len(received))
+			}
+			for flow, seqs := range received {
+				if len(seqs) != packetsPerFlow {
+					t.Errorf("expected %d packets in flow %d, got %d", packetsPerFlow, flow, len(seqs))
+				}
+				for i, seq := range seqs {
+					if seq != uint32(i) {
+						t.Errorf("expected packet %d of flow %d, got %d", i, flow, seq)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPipeline measures the throughput of the gather and compression
+// workers with synthetic packets of many flows.
+func BenchmarkPipeline(b *testing.B) {
+	const flows = 1024
+
+	for _, payloadLen := range []int{64, 1400} {
+		packets := make([][]byte, flows)
+		for flow := range packets {
+			packets[flow] = testutils.SyntheticPacket(b, flow, false, 0, payloadLen)
+		}
+
+		for _, workers := range []int{1, 2, 4, 8} {
+			b.Run(fmt.Sprintf("payload=%d/workers=%d", payloadLen, workers), func(b *testing.B) {
+				benchmarkPipeline(b, workers, packets)
+			})
+		}
+	}
+}
+
+func benchmarkPipeline(b *testing.B, workers int, packets [][]byte) {
+	cfg := testConfig()
+	cfg.Workers = workers
+	cfg.ShardBy = config.ShardByFlow
+	pools := newBatchPools(cfg)
+	output := make(chan *batch.Batch, maxNumPkts)
+	pipeline := startPipeline(cfg, pools, output, nil)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		for batch := range output {
+			batch.Release()
+		}
+		wg.Done()
+	}()
+
+	ci := gopacket.CaptureInfo{Timestamp: time.Now()}
+	b.SetBytes(int64(len(packets[0])))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		packet := packets[i%len(packets)]
+		data := pools.packets.Get(len(packet))
+		copy(*data, packet)
+		ci.CaptureLength, ci.Length = len(packet), len(packet)
+		pkt := capturedPacket{intf: "eth0", linkType: layers.LinkTypeEthernet, ci: ci, data: data}
+		pipeline.shards[pipeline.shardFor(pkt)] <- pkt
+	}
+	pipeline.close()
+	b.StopTimer()
+
+	close(output)
+	wg.Wait()
+}
@@ -0,0 +1,336 @@
+package streamer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/quic-go/quic-go"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+)
+
+// PacketStreamer over QUIC carries the same frames as over TCP. The sensor
+// authenticates on the first stream (the control stream) when authentication
+// is enabled, and opens a data stream for every sensor it sends batches of,
+// starting with the ID of the sensor. Datagrams hold whole frames, each of
+// them preceded by the ID of its sensor.
+const (
+	// quicProtocol is the ALPN protocol negotiated by sensors and receivers.
+	quicProtocol = "packetstreamer"
+
+	// quicControlStreamID is the ID of the first stream opened by a sensor.
+	quicControlStreamID = 0
+
+	// quicMaxStreams is the number of sensors whose batches a connection can
+	// carry at the same time, relays forward many of them.
+	quicMaxStreams = 1024
+
+	quicKeepAlivePeriod = 15 * time.Second
+
+	quicErrNone       quic.ApplicationErrorCode = 0
+	quicErrAuthFailed quic.ApplicationErrorCode = 1
+)
+
+var (
+	errInvalidDatagram = errors.New("invalid datagram")
+)
+
+func quicInput(input *config.InputConfig) bool {
+	return input.Transport == config.QUICTransport
+}
+
+func quicConfig(datagrams bool) *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:     connTimeout * time.Second,
+		KeepAlivePeriod:    quicKeepAlivePeriod,
+		MaxIncomingStreams: quicMaxStreams,
+		EnableDatagrams:    datagrams,
+	}
+}
+
+// listenQUIC starts accepting sensors over QUIC. TLS 1.3 is mandatory, so the
+// receiver always needs a certificate.
+func listenQUIC(config *config.Config, addr string) (*quic.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(config.TLS.CertFile, config.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		NextProtos:   []string{quicProtocol},
+	}
+	return quic.ListenAddr(addr, tlsConfig, quicConfig(true))
+}
+
+func serveQUIC(listener *quic.Listener, config *config.Config, pools *batchPools, newPktChannel func() chan *batch.Batch, sizeChannel chan int) {
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			log.Println("Unable to accept connections on socket " + err.Error())
+			return
+		}
+		log.Println("Accepted connection on socket: ", "quic", conn.RemoteAddr())
+		go handleQUICConn(conn, config, pools, newPktChannel, sizeChannel)
+	}
+}
+
+// handleQUICConn reads the batches of all the data streams and datagrams of
+// the connection, once the sensor is authenticated.
+func handleQUICConn(conn quic.Connection, config *config.Config, pools *batchPools, newPktChannel func() chan *batch.Batch, sizeChannel chan int) {
+	authenticated := make(chan struct{})
+	if !config.Auth.Enable {
+		close(authenticated)
+	}
+	if conn.ConnectionState().SupportsDatagrams {
+		go readDatagrams(conn, config, pools, authenticated, newPktChannel(), sizeChannel)
+	}
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		streamConn := &quicStreamConn{Stream: stream, conn: conn}
+
+		if config.Auth.Enable && stream.StreamID() == quicControlStreamID {
+			go func() {
+				if !handleServerAuth(streamConn) {
+					conn.CloseWithError(quicErrAuthFailed, "authentication failed")
+					return
+				}
+				close(authenticated)
+				// nothing else is sent on the control stream yet
+				io.Copy(io.Discard, stream)
+			}()
+			continue
+		}
+
+		go func() {
+			select {
+			case <-authenticated:
+			case <-conn.Context().Done():
+				return
+			}
+			readPkts(streamConn, config, pools, newPktChannel(), sizeChannel)
+		}()
+	}
+}
+
+func readDatagrams(conn quic.Connection, config *config.Config, pools *batchPools, authenticated <-chan struct{}, pktUncompressChannel chan *batch.Batch, sizeChannel chan int) {
+	defer close(pktUncompressChannel)
+
+	select {
+	case <-authenticated:
+	case <-conn.Context().Done():
+		return
+	}
+	for {
+		datagram, err := conn.ReceiveDatagram(conn.Context())
+		if err != nil {
+			return
+		}
+		if err := readDatagram(datagram, conn.RemoteAddr().String(), config, pools, pktUncompressChannel, sizeChannel); err != nil {
+			log.Printf("Discarding datagram from %s: %v\n", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// readDatagram queues the batches of the frames in the datagram. Sensors which
+// don't send their ID are told apart by their address, the packets are
+// Ethernet ones unless the datagram has a link type frame.
+func readDatagram(datagram []byte, sensorID string, config *config.Config, pools *batchPools, pktUncompressChannel chan *batch.Batch, sizeChannel chan int) error {
+	hdrDataLen := len(hdrData)
+	linkType := layers.LinkTypeEthernet
+	for len(datagram) > 0 {
+		if len(datagram) < config.MaxHeaderLen {
+			return errInvalidDatagram
+		}
+		magic := datagram[:hdrDataLen]
+		payloadLen := binary.LittleEndian.Uint32(datagram[hdrDataLen:config.MaxHeaderLen])
+		datagram = datagram[config.MaxHeaderLen:]
+		if int(payloadLen) > len(datagram) {
+			return errInvalidDatagram
+		}
+		payload := datagram[:payloadLen]
+		datagram = datagram[payloadLen:]
+
+		switch {
+		case bytes.Equal(magic, sensorHdrData[:]):
+			if payloadLen == 0 || payloadLen > maxSensorIDLen {
+				return fmt.Errorf("invalid sensor ID length %d", payloadLen)
+			}
+			sensorID = string(payload)
+		case bytes.Equal(magic, linkTypeHdrData[:]):
+			var err error
+			if linkType, err = parseLinkType(payload); err != nil {
+				return err
+			}
+		case bytes.Equal(magic, hdrData[:]):
+			if int(payloadLen) > config.MaxEncodedLen-config.MaxHeaderLen {
+				return fmt.Errorf("invalid buffer length %d", payloadLen)
+			}
+			compressedData := pools.compressed.Get()
+			compressedData.Data = append(compressedData.Data[:0], payload...)
+			compressedData.SensorID = sensorID
+			compressedData.LinkType = linkType
+			compressedData.Codec = batch.CodecS2
+			select {
+			case pktUncompressChannel <- compressedData:
+			default:
+				log.Println("Uncompress queue is full. Discarding")
+				compressedData.Release()
+			}
+			select {
+			case sizeChannel <- config.MaxHeaderLen + int(payloadLen):
+			default:
+				log.Println("Size queue is full. Discarding")
+			}
+		default:
+			return errInvalidDatagram
+		}
+	}
+	return nil
+}
+
+// quicStreamConn lets the data streams be read like TCP connections.
+type quicStreamConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicStreamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *quicStreamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// quicReceiverConn is a connection to a receiver over QUIC.
+type quicReceiverConn struct {
+	conn      quic.Connection
+	control   quic.Stream
+	datagrams bool
+	// streams are the data streams of every sensor.
+	streams  map[string]*quicDataStream
+	datagram []byte
+}
+
+// quicDataStream is the data stream of a sensor.
+type quicDataStream struct {
+	quic.Stream
+	frames frameState
+}
+
+func dialQUIC(config *config.Config, server *config.ServerOutputConfig, addr string) (*quicReceiverConn, error) {
+	tlsConfig := &tls.Config{
+		// receivers aren't verified, like over TCP
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+		NextProtos:         []string{quicProtocol},
+	}
+	if config.TLS.Enable {
+		cert, err := tls.LoadX509KeyPair(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), connTimeout*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, tlsConfig, quicConfig(server.Datagrams))
+	if err != nil {
+		return nil, err
+	}
+	c := &quicReceiverConn{
+		conn: conn,
+		// the state only tells whether the receiver supports datagrams
+		datagrams: server.Datagrams && conn.ConnectionState().SupportsDatagrams,
+		streams:   make(map[string]*quicDataStream),
+	}
+	if config.Auth.Enable {
+		c.control, err = conn.OpenStreamSync(ctx)
+		if err != nil {
+			conn.CloseWithError(quicErrNone, "")
+			return nil, err
+		}
+		if err := handleClientAuth(c.control, config.Auth.Key); err != nil {
+			conn.CloseWithError(quicErrAuthFailed, "authentication failed")
+			return nil, err
+		}
+	}
+	log.Println("Connection established, QUIC: ", conn.RemoteAddr())
+	return c, nil
+}
+
+// write sends the batch in a datagram when enabled and the batch fits in
+// one, on the data stream of the sensor otherwise.
+func (c *quicReceiverConn) write(sensorID string, linkType layers.LinkType, payload []byte) error {
+	if c.datagrams {
+		// every datagram is read on its own
+		c.datagram = c.datagram[:0]
+		if sensorID != "" {
+			c.datagram = appendFrame(c.datagram, sensorHdrData[:], []byte(sensorID))
+		}
+		if linkType != layers.LinkTypeEthernet {
+			c.datagram = appendFrame(c.datagram, linkTypeHdrData[:], linkTypePayload(linkType))
+		}
+		c.datagram = appendFrame(c.datagram, hdrData[:], payload)
+		err := c.conn.SendDatagram(c.datagram)
+		var tooLarge *quic.DatagramTooLargeError
+		if !errors.As(err, &tooLarge) {
+			return err
+		}
+	}
+
+	stream, ok := c.streams[sensorID]
+	if !ok {
+		ctx, cancel := context.WithTimeout(c.conn.Context(), connTimeout*time.Second)
+		defer cancel()
+		quicStream, err := c.conn.OpenStreamSync(ctx)
+		if err != nil {
+			return err
+		}
+		stream = &quicDataStream{Stream: quicStream}
+		c.streams[sensorID] = stream
+	}
+	stream.SetWriteDeadline(time.Now().Add(connTimeout * time.Second))
+	return stream.frames.write(stream, sensorID, linkType, payload)
+}
+
+func (c *quicReceiverConn) check() error {
+	select {
+	case <-c.conn.Context().Done():
+		return context.Cause(c.conn.Context())
+	default:
+		return nil
+	}
+}
+
+func (c *quicReceiverConn) Close() error {
+	return c.conn.CloseWithError(quicErrNone, "")
+}
+
+func appendFrame(buf []byte, magic, payload []byte) []byte {
+	var header [8]byte
+	copy(header[:], magic)
+	binary.LittleEndian.PutUint32(header[len(magic):], uint32(len(payload)))
+	return append(append(buf, header[:]...), payload...)
+}
@@ -0,0 +1,187 @@
+package streamer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key.
+func writeTestCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "receiver"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func freeUDPPort(t *testing.T) *int {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	return &port
+}
+
+// testQUIC streams batches of two sensors from a sensor to a receiver over
+// QUIC on the loopback interface.
+func testQUIC(t *testing.T, datagrams bool) {
+	certFile, keyFile := writeTestCertificate(t)
+	path := filepath.Join(t.TempDir(), "dump.pcap")
+
+	receiverConfig := testConfig()
+	receiverConfig.Input = &config.InputConfig{Address: "127.0.0.1", Port: freeUDPPort(t), Transport: config.QUICTransport}
+	receiverConfig.TLS = config.TLSConfig{CertFile: certFile, KeyFile: keyFile}
+	receiverConfig.Output.Sinks = []config.SinkConfig{{File: &config.FileOutputConfig{Path: path}}}
+	if err := config.ValidateReceiverConfig(receiverConfig); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	receiverOutputs, err := NewOutputs(ctx, receiverConfig, "tcp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	StartReceiver(ctx, receiverConfig, receiverOutputs, "tcp")
+
+	sensorConfig := testConfig()
+	sensorConfig.Output.Sinks = []config.SinkConfig{{
+		Server: &config.ServerOutputConfig{
+			Address:   "127.0.0.1",
+			Port:      receiverConfig.Input.Port,
+			Transport: config.QUICTransport,
+			Datagrams: datagrams,
+		},
+	}}
+	sensorOutputs, err := NewOutputs(ctx, sensorConfig, "tcp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer sensorOutputs.Close()
+
+	for seq := uint32(0); seq < 4; seq++ {
+		b := compressedBatch(t, seq)
+		b.SensorID = "sensor-a"
+		if seq%2 == 1 {
+			b.SensorID = "sensor-b"
+		}
+		sensorOutputs.Write(b)
+		b.Release()
+
+		// wait for every batch, so the order is known
+		deadline := time.Now().Add(5 * time.Second)
+		for receiverOutputs.Stats()[0].Written < uint64(seq+1) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for packet %d", seq)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer file.Close()
+	expectSequences(t, []uint32{0, 1, 2, 3}, readPcapSequences(t, file))
+
+	_, conn := sensorOutputs.sinks[0].servers.pick()
+	streams := len(conn.(*quicReceiverConn).streams)
+	if datagrams && streams != 0 {
+		t.Errorf("expected the batches to be sent in datagrams, got %d streams", streams)
+	}
+	if !datagrams && streams != 2 {
+		t.Errorf("expected a stream for every sensor, got %d streams", streams)
+	}
+}
+
+func TestQUIC(t *testing.T) {
+	t.Run("streams", func(t *testing.T) {
+		testQUIC(t, false)
+	})
+	t.Run("datagrams", func(t *testing.T) {
+		testQUIC(t, true)
+	})
+}
+
+func TestReadDatagram(t *testing.T) {
+	cfg := testConfig()
+	pools := newBatchPools(cfg)
+	out := make(chan *batch.Batch, 10)
+	sizes := make(chan int, 10)
+
+	payload := compressedBatch(t, 0).Data
+	datagram := appendFrame(nil, hdrData[:], payload)
+	datagram = appendFrame(datagram, sensorHdrData[:], []byte("sensor-a"))
+	datagram = appendFrame(datagram, linkTypeHdrData[:], linkTypePayload(layers.LinkTypeLinuxSLL))
+	datagram = appendFrame(datagram, hdrData[:], payload)
+	if err := readDatagram(datagram, "10.0.0.1:1234", cfg, pools, out, sizes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, expected := range []batch.Metadata{
+		{SensorID: "10.0.0.1:1234", LinkType: layers.LinkTypeEthernet},
+		{SensorID: "sensor-a", LinkType: layers.LinkTypeLinuxSLL},
+	} {
+		b := <-out
+		if b.SensorID != expected.SensorID || b.LinkType != expected.LinkType || b.Codec != batch.CodecS2 || string(b.Data) != string(payload) {
+			t.Errorf("unexpected batch of sensor %s with link type %v", b.SensorID, b.LinkType)
+		}
+		b.Release()
+	}
+
+	for _, invalid := range [][]byte{
+		datagram[:len(datagram)-1],
+		appendFrame(nil, []byte{1, 2, 3, 4}, payload),
+		appendFrame(nil, sensorHdrData[:], nil),
+		appendFrame(nil, linkTypeHdrData[:], []byte{1}),
+	} {
+		if err := readDatagram(invalid, "10.0.0.1:1234", cfg, pools, out, sizes); err == nil {
+			t.Error("expected an error")
+		}
+	}
+}
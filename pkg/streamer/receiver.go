@@ -12,9 +12,11 @@ import (
 	"os"
 	"time"
 
-	"github.com/deepfence/PacketStreamer/pkg/plugins"
+	"github.com/google/gopacket/layers"
 
+	"github.com/deepfence/PacketStreamer/pkg/batch"
 	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/plugins"
 )
 
 const (
@@ -57,14 +59,20 @@ func readDataFromSocket(hostConn net.Conn, dataBuff []byte, bytesToRead int) err
 	}
 }
 
-func readPkts(clientConn net.Conn, config *config.Config, pktUncompressChannel chan string, sizeChannel chan int) {
+func readPkts(clientConn net.Conn, config *config.Config, pools *batchPools, pktUncompressChannel chan *batch.Batch, sizeChannel chan int) {
 
-	var dataBuff = make([]byte, config.MaxPayloadLen)
 	hdrDataLen := len(hdrData)
 	var totalHdrLen = config.MaxHeaderLen
+	var hdrBuff = make([]byte, totalHdrLen)
+	var sensorIDBuff [maxSensorIDLen]byte
+	var linkTypeBuff [linkTypeLen]byte
+	// sensors which don't send their ID are told apart by their address, and
+	// the ones which don't send the link type capture Ethernet packets
+	sensorID := clientConn.RemoteAddr().String()
+	linkType := layers.LinkTypeEthernet
 
 	for {
-		err := readDataFromSocket(clientConn, dataBuff[0:totalHdrLen], totalHdrLen)
+		err := readDataFromSocket(clientConn, hdrBuff, totalHdrLen)
 		if err != nil {
 			if !os.IsTimeout(err) {
 				log.Printf("Unable to read data from connection. %v\n", err)
@@ -73,31 +81,75 @@ func readPkts(clientConn net.Conn, config *config.Config, pktUncompressChannel c
 			close(pktUncompressChannel)
 			return
 		}
-		compareRes := bytes.Compare(dataBuff[0:hdrDataLen], hdrData[:])
+		compressedDataLen := binary.LittleEndian.Uint32(hdrBuff[hdrDataLen:])
+		if bytes.Equal(hdrBuff[0:hdrDataLen], sensorHdrData[:]) {
+			if compressedDataLen == 0 || compressedDataLen > maxSensorIDLen {
+				log.Printf("Invalid sensor ID length %d obtained from client", compressedDataLen)
+				clientConn.Close()
+				close(pktUncompressChannel)
+				return
+			}
+			err = readDataFromSocket(clientConn, sensorIDBuff[:compressedDataLen], int(compressedDataLen))
+			if err != nil {
+				log.Printf("Unable to read data from connection. %s\n", err)
+				clientConn.Close()
+				close(pktUncompressChannel)
+				return
+			}
+			sensorID = string(sensorIDBuff[:compressedDataLen])
+			log.Printf("Receiving packets of sensor %s from %s\n", sensorID, clientConn.RemoteAddr())
+			continue
+		}
+		if bytes.Equal(hdrBuff[0:hdrDataLen], linkTypeHdrData[:]) {
+			if compressedDataLen != linkTypeLen {
+				log.Printf("Invalid link type length %d obtained from client", compressedDataLen)
+				clientConn.Close()
+				close(pktUncompressChannel)
+				return
+			}
+			err = readDataFromSocket(clientConn, linkTypeBuff[:], linkTypeLen)
+			if err == nil {
+				linkType, err = parseLinkType(linkTypeBuff[:])
+			}
+			if err != nil {
+				log.Printf("Unable to read the link type from connection. %s\n", err)
+				clientConn.Close()
+				close(pktUncompressChannel)
+				return
+			}
+			continue
+		}
+		compareRes := bytes.Compare(hdrBuff[0:hdrDataLen], hdrData[:])
 		if compareRes != 0 {
 			log.Printf("Illegal data received from client")
 			clientConn.Close()
 			close(pktUncompressChannel)
 			return
 		}
-		compressedDataLen := binary.LittleEndian.Uint32(dataBuff[hdrDataLen:])
 		if int(compressedDataLen) > (config.MaxEncodedLen - totalHdrLen) {
 			log.Printf("Invalid buffer length %d obtained from client", compressedDataLen)
 			clientConn.Close()
 			close(pktUncompressChannel)
 			return
 		}
-		err = readDataFromSocket(clientConn, dataBuff[totalHdrLen:(totalHdrLen+int(compressedDataLen))], int(compressedDataLen))
+		compressedData := pools.compressed.Get()
+		compressedData.Data = compressedData.Data[:compressedDataLen]
+		err = readDataFromSocket(clientConn, compressedData.Data, int(compressedDataLen))
 		if err != nil {
 			log.Printf("Unable to read data from connection. %s\n", err)
+			compressedData.Release()
 			clientConn.Close()
 			close(pktUncompressChannel)
 			return
 		}
+		compressedData.SensorID = sensorID
+		compressedData.LinkType = linkType
+		compressedData.Codec = batch.CodecS2
 		select {
-		case pktUncompressChannel <- string(dataBuff[totalHdrLen:(int(compressedDataLen) + totalHdrLen)]):
+		case pktUncompressChannel <- compressedData:
 		default:
 			log.Println("Uncompress queue is full. Discarding")
+			compressedData.Release()
 		}
 		select {
 		case sizeChannel <- (totalHdrLen + int(compressedDataLen)):
@@ -107,7 +159,7 @@ func readPkts(clientConn net.Conn, config *config.Config, pktUncompressChannel c
 	}
 }
 
-func receiverOutput(ctx context.Context, config *config.Config, consolePktOutputChannel chan string, pluginChan chan<- string) {
+func receiverOutput(ctx context.Context, consolePktOutputChannel chan *batch.Batch, outputs *Outputs, pluginManager *plugins.Manager) {
 loop:
 	for {
 		select {
@@ -117,21 +169,17 @@ loop:
 				break loop
 			}
 
-			if pluginChan != nil {
-				pluginChan <- tmpData
-			}
-
-			if err := writeOutput(config, []byte(tmpData)); err != nil {
-				log.Printf("Error while writing to output: %v\n", err)
-				break loop
-			}
+			pluginManager.Write(tmpData)
+			outputs.Write(tmpData)
+			tmpData.Release()
 		case <-ctx.Done():
 			break loop
 		}
 	}
+	outputs.Close()
 }
 
-func processHost(config *config.Config, consolePktOutputChannel chan string, proto string) {
+func processHost(config *config.Config, pools *batchPools, consolePktOutputChannel chan *batch.Batch, proto string) {
 
 	var err error
 	var listener net.Listener
@@ -140,6 +188,47 @@ func processHost(config *config.Config, consolePktOutputChannel chan string, pro
 		addr = fmt.Sprintf("%s:%d", config.Input.Address, *config.Input.Port)
 	}
 
+	sizeChannel := make(chan int, maxNumPkts)
+	go calculateDataSize(sizeChannel)
+
+	// Server outputs forward the compressed batches as they are, so the
+	// batches only need to be decompressed for the other outputs and plugins.
+	servers := len(config.Output.Servers())
+	decode := len(config.Output.Plugins) > 0 || len(config.Output.Sinks) > servers
+	newPktChannel := func() chan *batch.Batch {
+		pktUncompressChannel := make(chan *batch.Batch, maxNumPkts)
+		if decode {
+			go decompressPkts(config, pools, pktUncompressChannel, consolePktOutputChannel, servers > 0)
+		} else {
+			go forwardPkts(pktUncompressChannel, consolePktOutputChannel)
+		}
+		return pktUncompressChannel
+	}
+
+	for _, mirrorInput := range config.Input.Mirrors {
+		conn, err := listenMirror(mirrorInput, config.Input.Address)
+		if err != nil {
+			log.Printf("Unable to listen for %s mirrored traffic: %v\n", mirrorInput.Encapsulation, err)
+			continue
+		}
+		log.Printf("Listening for %s mirrored traffic on %s\n", mirrorInput.Encapsulation, conn.LocalAddr())
+		go serveMirror(conn, mirrorInput, config, pools, consolePktOutputChannel, sizeChannel)
+	}
+	// only listening for mirrored traffic
+	if config.Input.Port == nil {
+		return
+	}
+
+	if quicInput(config.Input) {
+		quicListener, err := listenQUIC(config, addr)
+		if err != nil {
+			log.Println("Unable to start QUIC listener socket "+err.Error(), addr)
+			return
+		}
+		serveQUIC(quicListener, config, pools, newPktChannel, sizeChannel)
+		return
+	}
+
 	if config.TLS.Enable {
 		config, err := getTlsConfig(config.TLS.CertFile, config.TLS.KeyFile, "")
 		if err != nil {
@@ -159,9 +248,6 @@ func processHost(config *config.Config, consolePktOutputChannel chan string, pro
 		}
 	}
 
-	sizeChannel := make(chan int, maxNumPkts)
-	go calculateDataSize(sizeChannel)
-
 	for {
 		hostConn, cerr := listener.Accept()
 		if cerr != nil {
@@ -173,42 +259,54 @@ func processHost(config *config.Config, consolePktOutputChannel chan string, pro
 		if config.Auth.Enable {
 			go func() {
 				if handleServerAuth(hostConn) {
-					pktUncompressChannel := make(chan string, maxNumPkts)
-					go decompressPkts(config, pktUncompressChannel, consolePktOutputChannel)
-					go readPkts(hostConn, config, pktUncompressChannel, sizeChannel)
+					go readPkts(hostConn, config, pools, newPktChannel(), sizeChannel)
 				}
 			}()
 			continue
 		}
-		pktUncompressChannel := make(chan string, maxNumPkts)
-		go decompressPkts(config, pktUncompressChannel, consolePktOutputChannel)
-		go readPkts(hostConn, config, pktUncompressChannel, sizeChannel)
+		go readPkts(hostConn, config, pools, newPktChannel(), sizeChannel)
 	}
 }
 
-func StartReceiver(ctx context.Context, config *config.Config, proto string) {
+// StartReceiver starts receiving packets and writing them to the outputs. The
+// returned channel is closed once ctx is cancelled and the outputs and plugins
+// were flushed and closed.
+func StartReceiver(ctx context.Context, config *config.Config, outputs *Outputs, proto string) <-chan struct{} {
 	ticker := time.NewTicker(1 * time.Minute)
-	consolePktOutputChannel := make(chan string, maxNumPkts*10)
+	consolePktOutputChannel := make(chan *batch.Batch, maxNumPkts*10)
+	pools := newBatchPools(config)
 
-	pluginChan, err := plugins.Start(ctx, config)
+	// the plugins are stopped by closing them, so that they still write the
+	// queued batches once ctx is cancelled
+	pluginManager, err := plugins.Start(context.WithoutCancel(ctx), config)
 	if err != nil {
 		// log but carry on, we still might want to see the receiver output despite the broken plugins
 		log.Println(err)
 	}
-	go receiverOutput(ctx, config, consolePktOutputChannel, pluginChan)
-	go processHost(config, consolePktOutputChannel, proto)
+	outputsClosed := make(chan struct{})
+	go func() {
+		receiverOutput(ctx, consolePktOutputChannel, outputs, pluginManager)
+		close(outputsClosed)
+	}()
+	go processHost(config, pools, consolePktOutputChannel, proto)
 
+	done := make(chan struct{})
 	go func() {
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
 				printDataSize()
-			case <-ctx.Done():
-				if pluginChan != nil {
-					close(pluginChan)
-				}
+				printOutputStats(outputs)
+				printPluginStats(pluginManager)
+			case <-outputsClosed:
+				// nothing is written to the plugins once the outputs are
+				// closed
+				pluginManager.Close()
+				close(done)
 				return
 			}
 		}
 	}()
+	return done
 }
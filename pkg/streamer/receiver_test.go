@@ -0,0 +1,357 @@
+package streamer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/s2"
+
+	"github.com/deepfence/PacketStreamer/pkg/batch"
+	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/plugins"
+)
+
+type relayedFrame struct {
+	sensorID string
+	linkType layers.LinkType
+	payload  []byte
+}
+
+// readRelayedFrames reads the data frames from the connection, along with the
+// sensor and link type each of them was announced with.
+func readRelayedFrames(conn net.Conn, frames int) ([]relayedFrame, error) {
+	var received []relayedFrame
+	var sensorID string
+	linkType := layers.LinkTypeEthernet
+	header := make([]byte, 8)
+	for len(received) < frames {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return received, err
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return received, err
+		}
+		if bytes.Equal(header[:4], sensorHdrData[:]) {
+			sensorID = string(payload)
+			continue
+		}
+		if bytes.Equal(header[:4], linkTypeHdrData[:]) {
+			linkType = layers.LinkType(binary.LittleEndian.Uint32(payload))
+			continue
+		}
+		received = append(received, relayedFrame{sensorID: sensorID, linkType: linkType, payload: payload})
+	}
+	return received, nil
+}
+
+func writeTestFrame(t *testing.T, conn net.Conn, magic []byte, payload []byte) {
+	t.Helper()
+
+	header := make([]byte, 8)
+	copy(header, magic)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(payload)))
+	if _, err := conn.Write(append(header, payload...)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func freePort(t *testing.T) *int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+	return portOf(t, listener)
+}
+
+func dialReceiver(t *testing.T, port int) net.Conn {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testRelay relays the frames of two sensors to an upstream receiver, and
+// optionally keeps a local copy of the packets.
+func testRelay(t *testing.T, localCopy string) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer upstream.Close()
+
+	type result struct {
+		frames []relayedFrame
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		frames, err := readRelayedFrames(conn, 3)
+		results <- result{frames: frames, err: err}
+	}()
+
+	cfg := testConfig()
+	cfg.Input = &config.InputConfig{Address: "127.0.0.1", Port: freePort(t)}
+	cfg.Output.Sinks = []config.SinkConfig{
+		{Server: &config.ServerOutputConfig{Address: "127.0.0.1", Port: portOf(t, upstream)}},
+	}
+	if localCopy != "" {
+		cfg.Output.Sinks = append(cfg.Output.Sinks, config.SinkConfig{File: &config.FileOutputConfig{Path: localCopy}})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outputs, err := NewOutputs(ctx, cfg, "tcp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	StartReceiver(ctx, cfg, outputs, "tcp")
+
+	// the payloads are forwarded as they are, without compressing them again
+	first := s2.EncodeBetter(nil, pcapRecords(t, 0, 1))
+	second := s2.EncodeBetter(nil, pcapRecords(t, 2))
+	third := s2.EncodeBetter(nil, pcapRecords(t, 3))
+
+	sensorA := dialReceiver(t, *cfg.Input.Port)
+	defer sensorA.Close()
+	writeTestFrame(t, sensorA, sensorHdrData[:], []byte("sensor-a"))
+	writeTestFrame(t, sensorA, hdrData[:], first)
+	writeTestFrame(t, sensorA, hdrData[:], second)
+
+	// wait for the frames of the first sensor, so the order is known
+	deadline := time.Now().Add(5 * time.Second)
+	for outputs.Stats()[0].Written < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// sensors which don't send their ID are told apart by their address
+	legacySensor := dialReceiver(t, *cfg.Input.Port)
+	defer legacySensor.Close()
+	writeTestFrame(t, legacySensor, hdrData[:], third)
+
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("unexpected error: %v", res.err)
+	}
+	expected := []relayedFrame{
+		{sensorID: "sensor-a", payload: first},
+		{sensorID: "sensor-a", payload: second},
+		{sensorID: legacySensor.LocalAddr().String(), payload: third},
+	}
+	for i, frame := range res.frames {
+		if frame.sensorID != expected[i].sensorID {
+			t.Errorf("expected frame %d from sensor %s, got %s", i, expected[i].sensorID, frame.sensorID)
+		}
+		if !bytes.Equal(frame.payload, expected[i].payload) {
+			t.Errorf("frame %d was not forwarded as it is", i)
+		}
+	}
+
+	if localCopy != "" {
+		deadline := time.Now().Add(5 * time.Second)
+		for outputs.Stats()[1].Written < 3 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		file, err := os.Open(localCopy)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer file.Close()
+		expectSequences(t, []uint32{0, 1, 2, 3}, readPcapSequences(t, file))
+	}
+}
+
+func TestReceiverRelay(t *testing.T) {
+	t.Run("relay only", func(t *testing.T) {
+		testRelay(t, "")
+	})
+	t.Run("with a local copy", func(t *testing.T) {
+		testRelay(t, filepath.Join(t.TempDir(), "dump.pcap"))
+	})
+}
+
+func TestReceiverLinkType(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer upstream.Close()
+
+	type result struct {
+		frames []relayedFrame
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		frames, err := readRelayedFrames(conn, 1)
+		results <- result{frames: frames, err: err}
+	}()
+
+	localCopy := filepath.Join(t.TempDir(), "dump.pcap")
+	cfg := testConfig()
+	cfg.Input = &config.InputConfig{Address: "127.0.0.1", Port: freePort(t)}
+	cfg.Output.Sinks = []config.SinkConfig{
+		{Server: &config.ServerOutputConfig{Address: "127.0.0.1", Port: portOf(t, upstream)}},
+		{File: &config.FileOutputConfig{Path: localCopy}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outputs, err := NewOutputs(ctx, cfg, "tcp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	StartReceiver(ctx, cfg, outputs, "tcp")
+
+	sensor := dialReceiver(t, *cfg.Input.Port)
+	defer sensor.Close()
+	writeTestFrame(t, sensor, linkTypeHdrData[:], linkTypePayload(layers.LinkTypeLinuxSLL))
+	writeTestFrame(t, sensor, hdrData[:], s2.EncodeBetter(nil, pcapRecords(t, 0)))
+
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("unexpected error: %v", res.err)
+	}
+	if res.frames[0].linkType != layers.LinkTypeLinuxSLL {
+		t.Errorf("expected the frame to be relayed with link type %v, got %v", layers.LinkTypeLinuxSLL, res.frames[0].linkType)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for outputs.Stats()[1].Written < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	file, err := os.Open(localCopy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer file.Close()
+	reader, err := pcapgo.NewReader(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reader.LinkType() != layers.LinkTypeLinuxSLL {
+		t.Errorf("expected link type %v, got %v", layers.LinkTypeLinuxSLL, reader.LinkType())
+	}
+}
+
+// shutdownPlugin records the batches written to it, the errors of the
+// contexts they were written with and whether it was closed.
+type shutdownPlugin struct {
+	mu      sync.Mutex
+	written int
+	errs    []error
+	closed  bool
+}
+
+func (p *shutdownPlugin) Init(ctx context.Context, global *config.Config, pluginConfig config.PluginConfig) error {
+	return nil
+}
+
+func (p *shutdownPlugin) Write(ctx context.Context, b *batch.Batch) error {
+	// take long enough for the receiver to be stopped meanwhile
+	time.Sleep(50 * time.Millisecond)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.written++
+	if err := ctx.Err(); err != nil {
+		p.errs = append(p.errs, err)
+	}
+	return nil
+}
+
+func (p *shutdownPlugin) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (p *shutdownPlugin) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+func (p *shutdownPlugin) Stats() plugins.Stats {
+	return plugins.Stats{}
+}
+
+var shutdownTests int
+
+func TestReceiverShutdown(t *testing.T) {
+	// every run registers its own plugin type
+	shutdownTests++
+	pluginType := "shutdown-test-" + strconv.Itoa(shutdownTests)
+	plugin := &shutdownPlugin{}
+	plugins.Register(pluginType, func() plugins.Plugin { return plugin })
+
+	path := filepath.Join(t.TempDir(), "dump.pcap")
+	cfg := testConfig()
+	cfg.Input = &config.InputConfig{Address: "127.0.0.1", Port: freePort(t)}
+	cfg.Output.Sinks = []config.SinkConfig{{File: &config.FileOutputConfig{Path: path}}}
+	cfg.Output.Plugins = config.PluginsConfig{
+		{Type: pluginType, Name: pluginType, QueueSize: 10, Overflow: config.Block},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outputs, err := NewOutputs(ctx, cfg, "tcp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	done := StartReceiver(ctx, cfg, outputs, "tcp")
+
+	sensor := dialReceiver(t, *cfg.Input.Port)
+	defer sensor.Close()
+	writeTestFrame(t, sensor, hdrData[:], s2.EncodeBetter(nil, pcapRecords(t, 0)))
+	deadline := time.Now().Add(5 * time.Second)
+	for outputs.Stats()[0].Written < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the batch queued for the plugin is still written once stopped
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the receiver wasn't stopped")
+	}
+	plugin.mu.Lock()
+	defer plugin.mu.Unlock()
+	if plugin.written != 1 || len(plugin.errs) != 0 || !plugin.closed {
+		t.Errorf("expected the batch to be written and the plugin closed, got %d batches, errors %v, closed %v",
+			plugin.written, plugin.errs, plugin.closed)
+	}
+}
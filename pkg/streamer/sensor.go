@@ -2,86 +2,109 @@ package streamer
 
 import (
 	"context"
-	"encoding/binary"
 	"log"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 
+	"github.com/deepfence/PacketStreamer/pkg/batch"
 	"github.com/deepfence/PacketStreamer/pkg/config"
 	"github.com/deepfence/PacketStreamer/pkg/plugins"
 )
 
-func StartSensor(ctx context.Context, config *config.Config) {
+// StartSensor starts capturing packets and sending them to the outputs. The
+// returned channel is closed once the outputs and plugins were flushed and
+// closed, which happens when ctx is cancelled, or once all the packets were
+// sent when reading a finite set of files.
+func StartSensor(ctx context.Context, config *config.Config, outputs *Outputs) <-chan struct{} {
 	ticker := time.NewTicker(1 * time.Minute)
+	agentOutputChan := make(chan *batch.Batch, maxNumPkts)
+	// the plugins are stopped by closing them, so that they still write the
+	// queued batches once ctx is cancelled
+	pluginManager, err := plugins.Start(context.WithoutCancel(ctx), config)
+	if err != nil {
+		// log but carry on, we still might want to see the receiver output despite the broken plugins
+		log.Println(err)
+	}
+	outputsClosed := make(chan struct{})
+	go sensorOutput(ctx, agentOutputChan, outputs, outputsClosed)
+
+	done := make(chan struct{})
 	go func() {
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
 				printPacketCount()
+				printOutputStats(outputs)
+				printPluginStats(pluginManager)
+			case <-outputsClosed:
+				// the capture is over once the outputs are closed
+				pluginManager.Close()
+				close(done)
+				return
 			}
 		}
 	}()
-	agentOutputChan := make(chan string, maxNumPkts)
-	pluginChan, err := plugins.Start(ctx, config)
-	if err != nil {
-		// log but carry on, we still might want to see the receiver output despite the broken plugins
-		log.Println(err)
+
+	if config.Capture.File != nil {
+		go processFileCapture(ctx, config, agentOutputChan, pluginManager)
+	} else {
+		go processIntfCapture(ctx, config, agentOutputChan, pluginManager)
 	}
-	go sensorOutput(ctx, config, agentOutputChan)
-	go processIntfCapture(ctx, config, agentOutputChan, pluginChan)
+	return done
 }
 
-func sensorOutput(ctx context.Context, config *config.Config, agentPktOutputChan chan string) {
-	outputErr := 0
-	payloadMarkerBuff := [...]byte{0x0, 0x0, 0x0, 0x0}
-	dataToSend := make([]byte, config.MaxPayloadLen)
-	copy(dataToSend[0:], hdrData[:])
-
+// sensorOutput hands the compressed batches over to the outputs. Once the
+// capture is over or ctx is cancelled, it waits until the outputs have written
+// all of them, and closes closed.
+func sensorOutput(ctx context.Context, agentPktOutputChan chan *batch.Batch, outputs *Outputs, closed chan struct{}) {
 loop:
 	for {
-		if outputErr == maxWriteAttempts {
-			log.Printf("Error while writing %d packets to output. Giving up \n", maxWriteAttempts)
-			break
-		}
 		select {
 		case tmpData, chanExitVal := <-agentPktOutputChan:
 			if !chanExitVal {
-				log.Println("Error while reading from output channel")
-				break loop
-			}
-
-			outputData := []byte(tmpData)
-			outputDataLen := len(outputData)
-			startIdx := len(hdrData)
-			binary.LittleEndian.PutUint32(payloadMarkerBuff[:], uint32(outputDataLen))
-			copy(dataToSend[startIdx:], payloadMarkerBuff[:])
-			startIdx += len(payloadMarkerBuff)
-			copy(dataToSend[startIdx:], outputData[:])
-			startIdx += outputDataLen
-			if err := writeOutput(config, dataToSend[0:startIdx]); err != nil {
-				log.Printf("Error while writing to output: %s\n", err)
+				log.Println("All packets sent to output")
 				break loop
 			}
+			outputs.Write(tmpData)
+			tmpData.Release()
 		case <-ctx.Done():
 			break loop
 		}
 	}
+	outputs.Close()
+	close(closed)
+
+	// don't let the capture get stuck on a full output channel
+	for tmpData := range agentPktOutputChan {
+		tmpData.Release()
+	}
+}
+
+// capturedPacket is a single packet read from an interface, waiting to be
+// gathered into a batch.
+type capturedPacket struct {
+	intf     string
+	linkType layers.LinkType
+	ci       gopacket.CaptureInfo
+	data     *[]byte
 }
 
-func gatherPkts(config *config.Config, pktGatherChannel, compressChan chan string,
-	pluginChan chan<- string) {
+func gatherPkts(config *config.Config, pools *batchPools, pktGatherChannel chan capturedPacket,
+	compressChan chan *batch.Batch, pluginManager *plugins.Manager, lossless bool) {
 
-	var totalLen = 0
-	var currLen = 0
-	var packetData = make([]byte, config.MaxGatherLen)
-	var tmpPacketData []byte
+	var packetData = pools.raw.Get()
 
 	timeout := time.After(config.MaxGatherWait)
 	send_packets := false
+	stop := false
+	var tmpPacket capturedPacket
 	enqueue_next := false
 	for {
 		select {
@@ -90,78 +113,99 @@ func gatherPkts(config *config.Config, pktGatherChannel, compressChan chan strin
 		case tmpChanData, chanExitVal := <-pktGatherChannel:
 			if !chanExitVal {
 				log.Println("Error while reading from gather channel")
+				send_packets = true
+				stop = true
 				break
 			}
-			pktsRead += 1
-			tmpPacketData = []byte(tmpChanData)
-			currLen = len(tmpPacketData)
+			atomic.AddUint64(&pktsRead, 1)
+			tmpPacket = tmpChanData
 			enqueue_next = true
 
-			if (totalLen + currLen) > config.MaxGatherLen {
+			if (len(packetData.Data) + batch.RecordHeaderLen + len(*tmpPacket.data)) > config.MaxGatherLen {
+				send_packets = true
+			}
+			// a batch holds packets of a single link type
+			if packetData.PacketCount > 0 && packetData.LinkType != tmpPacket.linkType {
 				send_packets = true
 			}
 		}
 
 		if send_packets {
-			if totalLen > 0 {
+			if packetData.PacketCount > 0 {
 				// NOTE(vadorovsky): Currently we output an uncompressed packet to
-				// two channels:
+				// two consumers:
 				// * `compressChan` - to output the compressed packets to an another
 				//    PacketStreamer server
-				// * `pluginChan` - to output the raw packets to plugins
+				// * `pluginManager` - to output the raw packets to plugins
 				// TODO(vadorovsky): We eventually want to compress plugin outputs
 				// as well. But there is no CLI tool for uncompressing S2. Probably
 				// the best thing to do would be providing a CLI in PacketStreamer
 				// to read S2-compressed pcap files.
-				select {
-				case compressChan <- string(packetData[:totalLen]):
-				default:
-					log.Println("Gather compression queue is full. Discarding")
+				pluginManager.Write(packetData)
+				if lossless {
+					compressChan <- packetData
+				} else {
+					select {
+					case compressChan <- packetData:
+					default:
+						log.Println("Gather compression queue is full. Discarding")
+						packetData.Release()
+					}
 				}
-				select {
-				case pluginChan <- string(packetData[:totalLen]):
-				default:
-					log.Println("Gather output queue is full. Discarding")
-				}
-				totalLen = 0
+				packetData = pools.raw.Get()
 			}
 
 			send_packets = false
 			timeout = time.After(config.MaxGatherWait)
 		}
 
+		if stop {
+			packetData.Release()
+			return
+		}
+
 		if enqueue_next {
 			enqueue_next = false
-			copy(packetData[totalLen:], tmpPacketData[:currLen])
-			totalLen += currLen
+			if packetData.PacketCount == 0 {
+				packetData.SensorID = config.SensorID
+				packetData.Interface = tmpPacket.intf
+				packetData.LinkType = tmpPacket.linkType
+				packetData.Filter = intfFilter(tmpPacket.intf)
+			} else if packetData.Interface != tmpPacket.intf {
+				// the batch contains packets from multiple interfaces
+				packetData.Interface = ""
+				packetData.Filter = ""
+			}
+			packetData.AppendPacket(tmpPacket.ci, *tmpPacket.data)
+			pools.packets.Put(tmpPacket.data)
 		}
 	}
 }
 
 func processIntfCapture(ctx context.Context, config *config.Config,
-	agentPktOutputChannel chan string, pluginChan chan<- string) {
+	agentPktOutputChannel chan *batch.Batch, pluginManager *plugins.Manager) {
 
-	pktGatherChannel := make(chan string, maxNumPkts*500)
-	pktCompressChannel := make(chan string, maxNumPkts)
+	pools := newBatchPools(config)
+	pipeline := startPipeline(config, pools, agentPktOutputChannel, pluginManager)
 
 	var wg sync.WaitGroup
-	go gatherPkts(config, pktGatherChannel, pktCompressChannel, pluginChan)
-	go compressPkts(config, pktCompressChannel, agentPktOutputChannel)
 
 	if len(config.CapturePorts) == 0 && len(config.CaptureInterfacesPorts) == 0 {
 		captureHandles, err := initAllInterfaces(config)
 		if err != nil {
 			log.Fatalf("Unable to init interfaces:%v\n", err)
 		}
-		for _, intf := range captureHandles {
-			wg.Add(1)
-			go func(intf *pcap.Handle) {
-				readPacketOnIntf(config, intf, pktGatherChannel)
-				wg.Done()
-			}(intf)
+		for intfName, intfHandles := range captureHandles {
+			for _, intf := range intfHandles {
+				wg.Add(1)
+				go func(intfName string, intf captureHandle) {
+					readPacketOnIntf(config, pools, intfName, intf, pipeline)
+					wg.Done()
+				}(intfName, intf)
+			}
 		}
 	} else {
-		capturing := make(map[string]*pcap.Handle)
+		capturing := make(map[string][]captureHandle)
 		toUpdate := grabInterface(ctx, config)
 		for {
 			var intfPorts intfPorts
@@ -171,16 +215,18 @@ func processIntfCapture(ctx context.Context, config *config.Config,
 				break
 			}
 			if capturing[intfPorts.name] == nil {
-				handle, err := initInterface(config, intfPorts.name, intfPorts.ports)
+				handles, err := initInterface(config, intfPorts.name, intfPorts.ports)
 				if err != nil {
 					log.Fatalf("Unable to init interface %v: %v\n", intfPorts.name, err)
 				}
-				capturing[intfPorts.name] = handle
-				wg.Add(1)
-				go func(intf *pcap.Handle) {
-					readPacketOnIntf(config, intf, pktGatherChannel)
-					wg.Done()
-				}(handle)
+				capturing[intfPorts.name] = handles
+				for _, handle := range handles {
+					wg.Add(1)
+					go func(intfName string, intf captureHandle) {
+						readPacketOnIntf(config, pools, intfName, intf, pipeline)
+						wg.Done()
+					}(intfPorts.name, handle)
+				}
 				log.Printf("New interface setup: %v\n", intfPorts.name)
 			} else {
 				bpfString, err := createBpfString(config, net.DefaultResolver, intfPorts.ports)
@@ -190,13 +236,17 @@ func processIntfCapture(ctx context.Context, config *config.Config,
 				filter := strings.Replace(bpfString, bpfParamInputDelimiter, bpfParamOutputDelimiter, -1)
 				if filter != "" {
 					log.Printf("Existing interface %v updated with: %v\n", intfPorts.name, filter)
-					capturing[intfPorts.name].SetBPFFilter(filter)
+					for _, handle := range capturing[intfPorts.name] {
+						if err := handle.SetBPFFilter(filter); err != nil {
+							log.Printf("Could not update the filter of interface %v: %v\n", intfPorts.name, err)
+						}
+					}
+					setIntfFilter(intfPorts.name, filter)
 				}
 			}
 		}
 
 	}
 	wg.Wait()
-	close(pktGatherChannel)
-	close(pktCompressChannel)
+	pipeline.close()
 }
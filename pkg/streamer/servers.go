@@ -0,0 +1,568 @@
+package streamer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/network"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultResolveInterval     = 30 * time.Second
+
+	// probeTimeout is how long a health check waits for a connection to a
+	// receiver to report that it was closed.
+	probeTimeout = 10 * time.Millisecond
+)
+
+var (
+	errNoReceivers        = errors.New("no receivers found")
+	errNoHealthyReceivers = errors.New("no healthy receivers")
+)
+
+// serverPool is the set of receivers of a server output. In the failover
+// mode, batches go to the first receiver which is up, in the order of the
+// configuration, and traffic moves back to a preferred receiver as soon as it
+// is up again. In the load-balanced mode, batches are spread across all the
+// receivers which are up.
+type serverPool struct {
+	config   *config.Config
+	server   *config.ServerOutputConfig
+	proto    string
+	name     string
+	resolver network.Resolver
+
+	healthCheckInterval time.Duration
+	resolveInterval     time.Duration
+
+	mu        sync.Mutex
+	receivers []*serverReceiver
+	resolved  bool
+	next      int
+
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+type serverReceiver struct {
+	addr string
+	conn receiverConn
+}
+
+// receiverConn is a connection to a receiver. Only the writer of the pool
+// writes to it, a new connection is created every time a receiver is dialed.
+type receiverConn interface {
+	// write sends the frame of the payload, preceded by the ID of the sensor
+	// and the link type of the packets when the receiver doesn't know them
+	// yet.
+	write(sensorID string, linkType layers.LinkType, payload []byte) error
+	// check tells whether the receiver is still there.
+	check() error
+	Close() error
+}
+
+// tcpReceiverConn is a connection to a receiver over TCP.
+type tcpReceiverConn struct {
+	net.Conn
+	frames frameState
+}
+
+func (c *tcpReceiverConn) write(sensorID string, linkType layers.LinkType, payload []byte) error {
+	return c.frames.write(c, sensorID, linkType, payload)
+}
+
+// check reads from the connection to tell whether the receiver closed it.
+// Receivers never write to sensors after the authentication, so anything but
+// a timeout means the connection is gone.
+func (c *tcpReceiverConn) check() error {
+	c.SetReadDeadline(time.Now().Add(probeTimeout))
+	var buf [1]byte
+	if _, err := c.Read(buf[:]); err != nil && !os.IsTimeout(err) {
+		return err
+	}
+	return nil
+}
+
+func newServerPool(config *config.Config, server *config.ServerOutputConfig, proto string, name string, resolver network.Resolver) *serverPool {
+	p := &serverPool{
+		config:              config,
+		server:              server,
+		proto:               proto,
+		name:                name,
+		resolver:            resolver,
+		healthCheckInterval: server.HealthCheckInterval,
+		resolveInterval:     server.ResolveInterval,
+		done:                make(chan struct{}),
+	}
+	if p.healthCheckInterval <= 0 {
+		p.healthCheckInterval = defaultHealthCheckInterval
+	}
+	if p.resolveInterval <= 0 {
+		p.resolveInterval = defaultResolveInterval
+	}
+	return p
+}
+
+// connect makes sure the pool can take batches, dialing the receivers which
+// are down. In the failover mode it stops at the first receiver which is up.
+func (p *serverPool) connect() error {
+	p.mu.Lock()
+	resolved := p.resolved
+	p.mu.Unlock()
+	if !resolved {
+		if err := p.resolve(); err != nil {
+			return err
+		}
+	}
+
+	var lastErr error = errNoReceivers
+	for _, r := range p.snapshot() {
+		if p.connectedTo(r) {
+			if p.server.Mode == config.FailoverMode {
+				return nil
+			}
+			continue
+		}
+		if err := p.dial(r); err != nil {
+			lastErr = err
+			continue
+		}
+		if p.server.Mode == config.FailoverMode {
+			return nil
+		}
+	}
+	if p.connected() {
+		return nil
+	}
+	return lastErr
+}
+
+// write sends the frame of the payload, preceded by the ID of the sensor and
+// the link type of the packets when the receiver doesn't know them yet, to one
+// of the receivers. A receiver which fails is disconnected and the next one is
+// tried.
+func (p *serverPool) write(sensorID string, linkType layers.LinkType, payload []byte) error {
+	for {
+		r, conn := p.pick()
+		if conn == nil {
+			return errNoHealthyReceivers
+		}
+
+		err := conn.write(sensorID, linkType, payload)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Error while writing to receiver %s of output %s: %v\n", r.addr, p.name, err)
+		p.disconnect(r, conn)
+	}
+}
+
+// pick returns the receiver to write the next batch to.
+func (p *serverPool) pick() (*serverReceiver, receiverConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.server.Mode == config.FailoverMode {
+		for _, r := range p.receivers {
+			if r.conn != nil {
+				return r, r.conn
+			}
+		}
+		return nil, nil
+	}
+
+	for i := range p.receivers {
+		r := p.receivers[(p.next+i)%len(p.receivers)]
+		if r.conn != nil {
+			p.next = (p.next + i + 1) % len(p.receivers)
+			return r, r.conn
+		}
+	}
+	return nil, nil
+}
+
+// connected tells whether any of the receivers is up.
+func (p *serverPool) connected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, r := range p.receivers {
+		if r.conn != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *serverPool) connectedTo(r *serverReceiver) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return r.conn != nil
+}
+
+func (p *serverPool) snapshot() []*serverReceiver {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*serverReceiver(nil), p.receivers...)
+}
+
+func (p *serverPool) dial(r *serverReceiver) error {
+	var conn receiverConn
+	if p.server.Transport == config.QUICTransport {
+		quicConn, err := dialQUIC(p.config, p.server, r.addr)
+		if err != nil {
+			return err
+		}
+		conn = quicConn
+	} else {
+		tcpConn, err := dialServer(p.config, p.proto, r.addr)
+		if err != nil {
+			return err
+		}
+		conn = &tcpReceiverConn{Conn: tcpConn}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// the receiver was dialed by someone else or removed in the meantime
+	if r.conn != nil || !p.has(r) {
+		conn.Close()
+		return nil
+	}
+	r.conn = conn
+	log.Printf("Connected to receiver %s of output %s\n", r.addr, p.name)
+	return nil
+}
+
+func (p *serverPool) has(r *serverReceiver) bool {
+	for _, receiver := range p.receivers {
+		if receiver == r {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *serverPool) disconnect(r *serverReceiver, conn receiverConn) {
+	p.mu.Lock()
+	if r.conn == conn {
+		r.conn = nil
+	}
+	p.mu.Unlock()
+	conn.Close()
+}
+
+// resolve looks up the receivers again, keeping the connections to the ones
+// which are still there.
+func (p *serverPool) resolve() error {
+	addrs, err := resolveServers(p.resolver, p.server)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return errNoReceivers
+	}
+
+	p.mu.Lock()
+	current := make(map[string]*serverReceiver, len(p.receivers))
+	for _, r := range p.receivers {
+		current[r.addr] = r
+	}
+	receivers := make([]*serverReceiver, 0, len(addrs))
+	var added []string
+	for _, addr := range addrs {
+		r, ok := current[addr.String()]
+		if ok {
+			delete(current, addr.String())
+		} else {
+			r = &serverReceiver{addr: addr.String()}
+			added = append(added, r.addr)
+		}
+		receivers = append(receivers, r)
+	}
+	p.receivers = receivers
+	p.resolved = true
+	var removed []receiverConn
+	for _, r := range current {
+		log.Printf("Receiver %s of output %s is gone\n", r.addr, p.name)
+		if r.conn != nil {
+			removed = append(removed, r.conn)
+			r.conn = nil
+		}
+	}
+	p.mu.Unlock()
+
+	for _, conn := range removed {
+		conn.Close()
+	}
+	if len(added) > 0 {
+		log.Printf("Found receivers %s of output %s\n", strings.Join(added, ", "), p.name)
+	}
+	return nil
+}
+
+// checkHealth disconnects the receivers whose connections were closed and
+// dials the receivers which should take batches when they are up: all of them
+// in the load-balanced mode, the ones preferred to the current receiver in the
+// failover mode.
+func (p *serverPool) checkHealth() {
+	for _, r := range p.snapshot() {
+		p.mu.Lock()
+		conn := r.conn
+		p.mu.Unlock()
+		if conn == nil {
+			continue
+		}
+		if err := conn.check(); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// disconnected in the meantime
+				continue
+			}
+			log.Printf("Receiver %s of output %s went away: %v\n", r.addr, p.name, err)
+			p.disconnect(r, conn)
+		}
+	}
+
+	receivers := p.snapshot()
+	for i, r := range receivers {
+		if p.connectedTo(r) {
+			if p.server.Mode == config.FailoverMode {
+				return
+			}
+			continue
+		}
+		if err := p.dial(r); err != nil {
+			continue
+		}
+		if p.server.Mode == config.FailoverMode {
+			// fail back to the preferred receiver
+			for _, standby := range receivers[i+1:] {
+				p.mu.Lock()
+				conn := standby.conn
+				p.mu.Unlock()
+				if conn != nil {
+					p.disconnect(standby, conn)
+				}
+			}
+			return
+		}
+	}
+}
+
+// maintain checks the health of the receivers and looks them up again until
+// the pool is closed. Receivers given as IP addresses are never looked up
+// again.
+func (p *serverPool) maintain(ctx context.Context) {
+	healthChecks := time.NewTicker(p.healthCheckInterval)
+	defer healthChecks.Stop()
+
+	var resolves <-chan time.Time
+	if needsResolving(p.server) {
+		ticker := time.NewTicker(p.resolveInterval)
+		defer ticker.Stop()
+		resolves = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.done:
+			return
+		case <-healthChecks.C:
+			p.checkHealth()
+		case <-resolves:
+			if err := p.resolve(); err != nil {
+				log.Printf("Could not look up the receivers of output %s: %v\n", p.name, err)
+			}
+		}
+	}
+}
+
+// close disconnects all the receivers and stops maintaining the pool.
+func (p *serverPool) close() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
+	for _, r := range p.snapshot() {
+		p.mu.Lock()
+		conn := r.conn
+		p.mu.Unlock()
+		if conn != nil {
+			p.disconnect(r, conn)
+		}
+	}
+}
+
+func dialServer(config *config.Config, proto string, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: connTimeout * time.Second}
+
+	var conn net.Conn
+	if config.TLS.Enable {
+		tlsConfig, err := getTlsConfig(config.TLS.CertFile, config.TLS.KeyFile, "")
+		if err != nil {
+			return nil, err
+		}
+		tlsConn, err := tls.DialWithDialer(dialer, proto, addr, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			tlsConn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	} else {
+		var err error
+		conn, err = dialer.Dial(proto, addr)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Connection established, TLS disabled: ", proto, conn.RemoteAddr())
+	}
+	if config.Auth.Enable {
+		if err := handleClientAuth(conn, config.Auth.Key); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return deadlineConn{conn}, nil
+}
+
+// needsResolving tells whether any of the receivers is given by a name.
+func needsResolving(server *config.ServerOutputConfig) bool {
+	if server.SRV != "" {
+		return true
+	}
+	for _, address := range server.Addresses() {
+		if address.Address != "" && net.ParseIP(address.Address) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// receiverAddresses returns the addresses of the receivers of all the server
+// outputs, in order to tell when they change. Nothing is looked up when all
+// the receivers are given as IP addresses.
+func receiverAddresses(config *config.Config, resolver network.Resolver) (string, error) {
+	var receivers []string
+	for _, server := range config.Output.Servers() {
+		if !needsResolving(server) {
+			continue
+		}
+		addrs, err := resolveServers(resolver, server)
+		if err != nil {
+			return "", err
+		}
+		for _, addr := range addrs {
+			receivers = append(receivers, addr.String())
+		}
+	}
+	return strings.Join(receivers, ","), nil
+}
+
+// resolveServers returns the addresses of all the receivers of the server
+// output. Names are resolved to all their addresses, SRV records are ordered
+// by priority and weight.
+func resolveServers(resolver network.Resolver, server *config.ServerOutputConfig) ([]*net.TCPAddr, error) {
+	var addrs []*net.TCPAddr
+	seen := make(map[string]bool)
+	add := func(host string, port int) error {
+		ips, err := resolveAddress(resolver, host)
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			addr := &net.TCPAddr{IP: ip, Port: port}
+			if !seen[addr.String()] {
+				seen[addr.String()] = true
+				addrs = append(addrs, addr)
+			}
+		}
+		return nil
+	}
+
+	for _, address := range server.Addresses() {
+		if address.Port == nil {
+			return nil, fmt.Errorf("no port configured for receiver %s", address.Address)
+		}
+		if err := add(address.Address, *address.Port); err != nil {
+			return nil, err
+		}
+	}
+
+	if server.SRV != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*dnsResolveTimeout)
+		defer cancel()
+		service, proto, name := splitSRVName(server.SRV)
+		_, records, err := resolver.LookupSRV(ctx, service, proto, name)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve SRV records of %s: %w", server.SRV, err)
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i].Priority != records[j].Priority {
+				return records[i].Priority < records[j].Priority
+			}
+			if records[i].Weight != records[j].Weight {
+				return records[i].Weight > records[j].Weight
+			}
+			return records[i].Target < records[j].Target
+		})
+		for _, record := range records {
+			if err := add(strings.TrimSuffix(record.Target, "."), int(record.Port)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// splitSRVName splits a name like _packetstreamer._tcp.example.com into the
+// service, the protocol and the domain. Other names are looked up as they are.
+func splitSRVName(srv string) (string, string, string) {
+	parts := strings.SplitN(srv, ".", 3)
+	if len(parts) == 3 && strings.HasPrefix(parts[0], "_") && strings.HasPrefix(parts[1], "_") {
+		return parts[0][1:], parts[1][1:], parts[2]
+	}
+	return "", "", srv
+}
+
+// resolveAddress returns the sorted IP addresses of the host. An empty host
+// stands for the local system.
+func resolveAddress(resolver network.Resolver, host string) ([]net.IP, error) {
+	if host == "" {
+		return []net.IP{nil}, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	hosts, err := resolveHost(resolver, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(hosts))
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+	return ips, nil
+}
@@ -0,0 +1,238 @@
+package streamer
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+
+	"github.com/deepfence/PacketStreamer/pkg/config"
+	"github.com/deepfence/PacketStreamer/pkg/utils"
+)
+
+// testReceiver accepts connections and reports the sequence numbers of the
+// packets it gets on them.
+type testReceiver struct {
+	listener net.Listener
+	seqs     chan uint32
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTestReceiver(t *testing.T, addr string) *testReceiver {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := &testReceiver{listener: listener, seqs: make(chan uint32, 100)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.conns = append(r.conns, conn)
+			r.mu.Unlock()
+			go func() {
+				defer conn.Close()
+				for {
+					seqs, err := readFrames(conn, 1)
+					if err != nil {
+						return
+					}
+					for _, seq := range seqs {
+						r.seqs <- seq
+					}
+				}
+			}()
+		}
+	}()
+	return r
+}
+
+func (r *testReceiver) port(t *testing.T) *int {
+	return portOf(t, r.listener)
+}
+
+// stop closes the listener and all the connections, like a receiver going
+// down.
+func (r *testReceiver) stop() {
+	r.listener.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+}
+
+// writeUntil writes batches to the outputs until the receiver gets one of
+// them.
+func writeUntil(t *testing.T, outputs *Outputs, receiver *testReceiver, seq *uint32) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b := compressedBatch(t, *seq)
+		outputs.Write(b)
+		b.Release()
+		*seq++
+
+		select {
+		case <-receiver.seqs:
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	t.Fatalf("timed out waiting for receiver %s", receiver.listener.Addr())
+}
+
+func TestServerOutputFailover(t *testing.T) {
+	primary := newTestReceiver(t, "127.0.0.1:0")
+	defer primary.stop()
+	secondary := newTestReceiver(t, "127.0.0.1:0")
+	defer secondary.stop()
+
+	cfg := testConfig()
+	cfg.Output.Sinks = []config.SinkConfig{{
+		Server: &config.ServerOutputConfig{
+			Receivers: []config.ServerAddressConfig{
+				{Address: "127.0.0.1", Port: primary.port(t)},
+				{Address: "127.0.0.1", Port: secondary.port(t)},
+			},
+			HealthCheckInterval: 10 * time.Millisecond,
+		},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outputs, err := NewOutputs(ctx, cfg, "tcp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer outputs.Close()
+
+	var seq uint32
+	writeUntil(t, outputs, primary, &seq)
+	if len(secondary.seqs) != 0 {
+		t.Fatal("expected the secondary receiver to get no packets")
+	}
+
+	// the secondary receiver takes over while the primary one is down
+	addr := primary.listener.Addr().String()
+	primary.stop()
+	writeUntil(t, outputs, secondary, &seq)
+
+	// and the primary one gets the packets again once it is back
+	primary = newTestReceiver(t, addr)
+	writeUntil(t, outputs, primary, &seq)
+}
+
+func TestServerOutputLoadBalance(t *testing.T) {
+	receivers := []*testReceiver{
+		newTestReceiver(t, "127.0.0.1:0"),
+		newTestReceiver(t, "127.0.0.1:0"),
+	}
+	server := &config.ServerOutputConfig{Mode: config.LoadBalanceMode}
+	for _, receiver := range receivers {
+		defer receiver.stop()
+		server.Receivers = append(server.Receivers, config.ServerAddressConfig{Address: "127.0.0.1", Port: receiver.port(t)})
+	}
+
+	cfg := testConfig()
+	cfg.Output.Sinks = []config.SinkConfig{{Server: server}}
+	outputs, err := NewOutputs(context.Background(), cfg, "tcp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for seq := uint32(0); seq < 4; seq++ {
+		b := compressedBatch(t, seq)
+		outputs.Write(b)
+		b.Release()
+	}
+	outputs.Close()
+
+	for i, receiver := range receivers {
+		var seqs []uint32
+		for len(seqs) < 2 {
+			select {
+			case seq := <-receiver.seqs:
+				seqs = append(seqs, seq)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for receiver %d, got packets %v", i, seqs)
+			}
+		}
+		expectSequences(t, []uint32{uint32(i), uint32(i + 2)}, seqs)
+	}
+}
+
+func TestResolveServers(t *testing.T) {
+	resolver := mockdns.Resolver{
+		Zones: map[string]mockdns.Zone{
+			"receiver.packetstreamer.io.": {
+				A: []string{"10.0.0.12", "10.0.0.11"},
+			},
+			"_packetstreamer._tcp.receivers.packetstreamer.io.": {
+				SRV: []net.SRV{
+					{Target: "backup.packetstreamer.io.", Port: 8082, Priority: 20, Weight: 10},
+					{Target: "receiver.packetstreamer.io.", Port: 8081, Priority: 10, Weight: 10},
+				},
+			},
+			"backup.packetstreamer.io.": {
+				A: []string{"10.0.0.21"},
+			},
+		},
+	}
+
+	for _, tt := range []struct {
+		testName string
+		server   *config.ServerOutputConfig
+		expected string
+	}{
+		{
+			testName: "address",
+			server:   &config.ServerOutputConfig{Address: "10.0.0.1", Port: utils.IntPtr(8081)},
+			expected: "10.0.0.1:8081",
+		},
+		{
+			testName: "name with several addresses",
+			server: &config.ServerOutputConfig{
+				Address: "10.0.0.1",
+				Port:    utils.IntPtr(8081),
+				Receivers: []config.ServerAddressConfig{
+					{Address: "receiver.packetstreamer.io", Port: utils.IntPtr(8081)},
+				},
+			},
+			expected: "10.0.0.1:8081,10.0.0.11:8081,10.0.0.12:8081",
+		},
+		{
+			testName: "SRV records",
+			server:   &config.ServerOutputConfig{SRV: "_packetstreamer._tcp.receivers.packetstreamer.io"},
+			expected: "10.0.0.11:8081,10.0.0.12:8081,10.0.0.21:8082",
+		},
+	} {
+		t.Run(tt.testName, func(t *testing.T) {
+			addrs, err := resolveServers(&resolver, tt.server)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, addr := range addrs {
+				got = append(got, addr.String())
+			}
+			if strings.Join(got, ",") != tt.expected {
+				t.Errorf("expected %s, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	if _, err := resolveServers(&resolver, &config.ServerOutputConfig{SRV: "_missing._tcp.packetstreamer.io"}); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,50 @@
+package testutils
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// SyntheticPacket serializes an Ethernet/IPv4/TCP packet of the given flow,
+// with the sequence number and the flow at the start of the payload.
+func SyntheticPacket(t testing.TB, flow int, reverse bool, seq uint32, payloadLen int) []byte {
+	srcIP := net.IPv4(10, 0, byte(flow>>8), byte(flow))
+	dstIP := net.IPv4(192, 168, 0, 1)
+	srcPort, dstPort := layers.TCPPort(1024+flow), layers.TCPPort(443)
+	if reverse {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+	}
+
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+	}
+	tcp := &layers.TCP{SrcPort: srcPort, DstPort: dstPort, Seq: seq, ACK: true}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	payload := make([]byte, payloadLen)
+	binary.BigEndian.PutUint32(payload[0:4], seq)
+	binary.BigEndian.PutUint32(payload[4:8], uint32(flow))
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x0, 0x1, 0x2, 0x3, 0x4, 0x5},
+			DstMAC:       net.HardwareAddr{0x0, 0x6, 0x7, 0x8, 0x9, 0xa},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		ip, tcp, gopacket.Payload(payload))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return buf.Bytes()
+}